@@ -3,6 +3,7 @@ package av
 import (
 	"fmt"
 	"io"
+	"time"
 )
 
 // Tag definitions
@@ -151,6 +152,11 @@ type GetWriter interface {
 	Writer(Info) WriteCloser
 }
 
+// PacketWriter writes packet
+type PacketWriter interface {
+	Write(*Packet) error
+}
+
 // Handler handle reader and writer
 type Handler interface {
 	HandleReader(ReadCloser)
@@ -171,6 +177,45 @@ type Closer interface {
 	Close(error)
 }
 
+// Queuer can return the number of packets waiting to be sent
+type Queuer interface {
+	// QueueLen returns the number of queued packets
+	QueueLen() int
+}
+
+// Discontinuer is implemented by writers which mark discontinuities, such
+// as a change of publisher, in their output
+type Discontinuer interface {
+	// Discontinuity marks a discontinuity before the next packet
+	Discontinuity()
+}
+
+// Viewer is implemented by the writers of single viewers, such as RTMP and
+// HTTP-FLV players, unlike recorders and the HLS segmenter
+type Viewer interface {
+	// IsViewer returns if the writer counts as a viewer, until it is closed
+	IsViewer() bool
+}
+
+// Stats are the statistics of a publisher, a player or an output of a
+// stream
+type Stats struct {
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr"`
+	Connected  time.Time `json:"connect_time"`
+	Bytes      uint64    `json:"bytes"`
+	Kbps       int       `json:"kbps"`
+	Queue      int       `json:"queue"`
+	Dropped    uint64    `json:"dropped"`
+}
+
+// Stater is implemented by the readers and writers which report their
+// statistics
+type Stater interface {
+	// Stats returns the statistics
+	Stats() Stats
+}
+
 // CalcTimer calculate base timestamp
 type CalcTimer interface {
 	CalcBaseTimestamp()
@@ -0,0 +1,51 @@
+package av
+
+import (
+	"sync"
+	"time"
+)
+
+// meterWindow is the period bitrates are measured over
+const meterWindow = time.Second
+
+// Meter counts bytes and measures their bitrate, the zero value is ready
+// to use
+type Meter struct {
+	lock   sync.Mutex
+	start  time.Time
+	window uint64
+	total  uint64
+	kbps   int // of the last window
+}
+
+func (m *Meter) roll(now time.Time) {
+	if d := now.Sub(m.start); d >= meterWindow {
+		m.kbps = int(m.window * 8 / uint64(d/time.Millisecond))
+		m.window = 0
+		m.start = now
+	}
+}
+
+// Add counts n bytes
+func (m *Meter) Add(n int) {
+	m.lock.Lock()
+	m.roll(time.Now())
+	m.window += uint64(n)
+	m.total += uint64(n)
+	m.lock.Unlock()
+}
+
+// Kbps returns the bitrate in kbps
+func (m *Meter) Kbps() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.roll(time.Now())
+	return m.kbps
+}
+
+// Bytes returns the bytes counted
+func (m *Meter) Bytes() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.total
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/gwuhaolin/livego"
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var VERSION = "master"
+
+func init() {
+	log.SetFormatter(&log.TextFormatter{
+		FullTimestamp: true,
+		CallerPrettyfier: func(f *runtime.Frame) (string, string) {
+			filename := path.Base(f.File)
+			return fmt.Sprintf("%s()", f.Function), fmt.Sprintf(" %s:%d", filename, f.Line)
+		},
+	})
+}
+
+func main() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("livego panic: ", r)
+			time.Sleep(1 * time.Second)
+		}
+	}()
+
+	log.Infof(`
+     _     _            ____       
+    | |   (_)_   _____ / ___| ___  
+    | |   | \ \ / / _ \ |  _ / _ \ 
+    | |___| |\ V /  __/ |_| | (_) |
+    |_____|_| \_/ \___|\____|\___/ 
+        version: %s
+	`, VERSION)
+
+	cfg, err := configure.Init()
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+	server, err := livego.NewServer(livego.Options{
+		Config: *cfg,
+		Loader: configure.Load,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+loop:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				cfg, err := configure.Load()
+				if err == nil {
+					err = server.Reload(*cfg)
+				}
+				if err != nil {
+					log.Error("reload configuration error: ", err)
+				} else {
+					log.Infof("Configuration reloaded from %s", cfg.ConfigFile)
+				}
+				continue
+			}
+			log.Infof("Received %v, shutting down", sig)
+			break loop
+		case err := <-server.Err():
+			log.Error(err)
+			break loop
+		}
+	}
+
+	timeout := time.Duration(server.Config().ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		log.Warning("shutdown: ", err)
+	}
+	log.Info("livego stopped")
+}
@@ -0,0 +1,296 @@
+package configure
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons of denied clients
+const (
+	DenyMaxConns      = "max_conns"
+	DenyMaxConnsPerIP = "max_conns_per_ip"
+	DenyPublish       = "publish_acl"
+	DenyPlay          = "play_acl"
+	DenyBanned        = "banned"
+)
+
+// Kinds of bans
+const (
+	// BanIP refuses a client address
+	BanIP = "ip"
+	// BanKey refuses the publishers of a stream key, app/name
+	BanKey = "key"
+)
+
+// ACL lists the networks allowed and denied, in CIDR notation or as single
+// addresses. Denied networks take precedence, every address is allowed if
+// Allow is empty.
+type ACL struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+
+	// the networks of Allow and Deny, parsed by validate
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseNet parses a network in CIDR notation or a single address
+func parseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// ParseNets parses networks in CIDR notation or single addresses
+func ParseNets(nets []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, s := range nets {
+		n, err := parseNet(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func matchNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// nets returns the parsed networks, those of an acl which was not
+// validated are parsed now and invalid ones are skipped
+func (a ACL) nets() (allow, deny []*net.IPNet) {
+	if len(a.allow) == len(a.Allow) && len(a.deny) == len(a.Deny) {
+		return a.allow, a.deny
+	}
+	for _, s := range a.Allow {
+		if n, err := parseNet(s); err == nil {
+			allow = append(allow, n)
+		}
+	}
+	for _, s := range a.Deny {
+		if n, err := parseNet(s); err == nil {
+			deny = append(deny, n)
+		}
+	}
+	return allow, deny
+}
+
+// Allows returns if the acl allows ip
+func (a ACL) Allows(ip string) bool {
+	if len(a.Allow) == 0 && len(a.Deny) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	allow, deny := a.nets()
+	if matchNets(deny, addr) {
+		return false
+	}
+	return len(a.Allow) == 0 || matchNets(allow, addr)
+}
+
+// validate parses the networks of the acl once for Allows
+func (a *ACL) validate() error {
+	allow, err := ParseNets(a.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := ParseNets(a.Deny)
+	if err != nil {
+		return err
+	}
+	a.allow, a.deny = allow, deny
+	return nil
+}
+
+// Ban is a client address or a stream key refused until a time
+type Ban struct {
+	Kind   string    `json:"kind"`
+	Target string    `json:"target"`
+	Until  time.Time `json:"until"`
+}
+
+// banKey identifies the ban of a target of a kind
+type banKey struct {
+	kind   string
+	target string
+}
+
+// AccessStats are the open connections, the denied clients by reason and
+// the bans
+type AccessStats struct {
+	Conns  int               `json:"conns"`
+	IPs    int               `json:"ips"`
+	Denied map[string]uint64 `json:"denied"`
+	Bans   []Ban             `json:"bans"`
+}
+
+// Access enforces the connection limits and the ACLs of the applications
+// of a Store
+type Access struct {
+	conf   *Store
+	lock   sync.Mutex
+	conns  map[string]int
+	total  int
+	denied map[string]uint64
+	bans   map[banKey]time.Time
+}
+
+func newAccess(conf *Store) *Access {
+	return &Access{
+		conf:   conf,
+		conns:  make(map[string]int),
+		denied: make(map[string]uint64),
+		bans:   make(map[banKey]time.Time),
+	}
+}
+
+// Open takes a connection of the client at ip, it is refused once
+// max_conns or max_conns_per_ip is reached. Every open connection is
+// released by Close.
+func (a *Access) Open(ip string) error {
+	cfg := a.conf.Current()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.banned(banKey{BanIP, ip}) {
+		a.denied[DenyBanned]++
+		return fmt.Errorf("%s is banned", ip)
+	}
+	if cfg.MaxConns > 0 && a.total >= cfg.MaxConns {
+		a.denied[DenyMaxConns]++
+		return fmt.Errorf("too many connections")
+	}
+	if cfg.MaxConnsPerIP > 0 && a.conns[ip] >= cfg.MaxConnsPerIP {
+		a.denied[DenyMaxConnsPerIP]++
+		return fmt.Errorf("too many connections from %s", ip)
+	}
+	a.total++
+	a.conns[ip]++
+	return nil
+}
+
+// Close releases a connection of the client at ip
+func (a *Access) Close(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.total--
+	if a.conns[ip]--; a.conns[ip] <= 0 {
+		delete(a.conns, ip)
+	}
+}
+
+// CheckPublish checks the publish ACL of app for the client at ip
+func (a *Access) CheckPublish(app, ip string) error {
+	conf, _ := a.conf.GetApplication(app)
+	return a.check(conf.PublishACL, DenyPublish, ip)
+}
+
+// CheckPlay checks the play ACL of app for the client at ip
+func (a *Access) CheckPlay(app, ip string) error {
+	conf, _ := a.conf.GetApplication(app)
+	return a.check(conf.PlayACL, DenyPlay, ip)
+}
+
+func (a *Access) check(acl ACL, reason, ip string) error {
+	if err := a.CheckBan(BanIP, ip); err != nil {
+		return err
+	}
+	if acl.Allows(ip) {
+		return nil
+	}
+	a.lock.Lock()
+	a.denied[reason]++
+	a.lock.Unlock()
+	return fmt.Errorf("%s denied by %s", ip, reason)
+}
+
+// Ban refuses the client at the address target with BanIP, or the
+// publishers of the stream key target with BanKey, for d
+func (a *Access) Ban(kind, target string, d time.Duration) Ban {
+	ban := Ban{Kind: kind, Target: target, Until: time.Now().Add(d)}
+	a.lock.Lock()
+	a.bans[banKey{kind, target}] = ban.Until
+	a.lock.Unlock()
+	return ban
+}
+
+// Unban lifts the ban of target of kind, it returns false if target is not
+// banned
+func (a *Access) Unban(kind, target string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := banKey{kind, target}
+	ok := a.banned(key)
+	delete(a.bans, key)
+	return ok
+}
+
+// CheckBan returns an error if target, a client address with BanIP or a
+// stream key with BanKey, is banned
+func (a *Access) CheckBan(kind, target string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.banned(banKey{kind, target}) {
+		return nil
+	}
+	a.denied[DenyBanned]++
+	return fmt.Errorf("%s is banned", target)
+}
+
+// banned returns if key is banned, expired bans are removed
+func (a *Access) banned(key banKey) bool {
+	until, ok := a.bans[key]
+	if ok && !time.Now().Before(until) {
+		delete(a.bans, key)
+		return false
+	}
+	return ok
+}
+
+// Stats returns the connection counters
+func (a *Access) Stats() AccessStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	stats := AccessStats{
+		Conns:  a.total,
+		IPs:    len(a.conns),
+		Denied: make(map[string]uint64, len(a.denied)),
+	}
+	for reason, n := range a.denied {
+		stats.Denied[reason] = n
+	}
+	for key := range a.bans {
+		if a.banned(key) {
+			stats.Bans = append(stats.Bans, Ban{Kind: key.kind, Target: key.target, Until: a.bans[key]})
+		}
+	}
+	sort.Slice(stats.Bans, func(i, j int) bool {
+		if stats.Bans[i].Kind != stats.Bans[j].Kind {
+			return stats.Bans[i].Kind < stats.Bans[j].Kind
+		}
+		return stats.Bans[i].Target < stats.Bans[j].Target
+	})
+	return stats
+}
@@ -0,0 +1,84 @@
+package configure
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	at := assert.New(t)
+
+	at.True(ACL{}.Allows("192.0.2.1"))
+	acl := ACL{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+		Deny:  []string{"192.0.2.7"},
+	}
+	at.Nil(acl.validate())
+	at.Equal(2, len(acl.allow))
+	at.Equal(1, len(acl.deny))
+	at.True(acl.Allows("192.0.2.1"))
+	at.True(acl.Allows("2001:db8::1"))
+	at.False(acl.Allows("192.0.2.7"))
+	at.False(acl.Allows("198.51.100.1"))
+	at.False(acl.Allows("invalid"))
+
+	//acls which were not validated are parsed when used
+	at.False(ACL{Allow: []string{"192.0.2.0/24"}}.Allows("198.51.100.1"))
+	at.False(ACL{Deny: []string{"198.51.100.1"}}.Allows("198.51.100.1"))
+
+	at.NotNil((&ACL{Allow: []string{"192.0.2.0/33"}}).validate())
+	at.NotNil((&ACL{Deny: []string{"invalid"}}).validate())
+}
+
+func TestValidateParsesACL(t *testing.T) {
+	at := assert.New(t)
+	cfg := defaultConf
+	cfg.Server = []Application{{
+		Appname:    "live",
+		Live:       true,
+		PublishACL: ACL{Allow: []string{"10.0.0.0/8"}},
+	}}
+	at.Nil(cfg.Validate())
+	at.Equal(1, len(cfg.Server[0].PublishACL.allow))
+	at.True(cfg.Server[0].PublishACL.Allows("10.1.2.3"))
+	at.False(cfg.Server[0].PublishACL.Allows("192.0.2.1"))
+}
+
+func TestBans(t *testing.T) {
+	at := assert.New(t)
+	cfg := defaultConf
+	s, err := NewStore(&cfg, nil)
+	if !at.Nil(err) {
+		return
+	}
+	a := s.Access()
+
+	//bans of addresses and stream keys are apart
+	a.Ban(BanIP, "live/room", time.Minute)
+	a.Ban(BanKey, "live/room", time.Minute)
+	a.Ban(BanIP, "192.0.2.7", -time.Second)
+	at.NotNil(a.CheckBan(BanIP, "live/room"))
+	at.NotNil(a.CheckBan(BanKey, "live/room"))
+	at.Nil(a.CheckBan(BanKey, "192.0.2.7"))
+	bans := a.Stats().Bans
+	if at.Len(bans, 2) {
+		at.Equal(BanIP, bans[0].Kind)
+		at.Equal(BanKey, bans[1].Kind)
+		at.Equal("live/room", bans[1].Target)
+	}
+
+	//lifting one keeps the other
+	at.True(a.Unban(BanKey, "live/room"))
+	at.False(a.Unban(BanKey, "live/room"))
+	at.Nil(a.CheckBan(BanKey, "live/room"))
+	at.NotNil(a.CheckBan(BanIP, "live/room"))
+	at.NotNil(a.Open("live/room"))
+	at.Equal(uint64(4), a.Stats().Denied[DenyBanned])
+
+	//expired bans are lifted
+	at.Nil(a.Open("192.0.2.7"))
+	a.Close("192.0.2.7")
+	at.False(a.Unban(BanIP, "192.0.2.7"))
+}
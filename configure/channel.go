@@ -9,14 +9,25 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// KeyStore stores the keys publishers use for room channels
+type KeyStore interface {
+	SetKey(channel string) (key string, err error)
+	GetKey(channel string) (newKey string, err error)
+	GetChannel(key string) (channel string, err error)
+	DeleteChannel(channel string) bool
+	DeleteKey(key string) bool
+}
+
 // RoomKeysType is a storage for room channel name and key
 type RoomKeysType struct {
 	localCache *cache.Cache
 }
 
-// RoomKeys storages room channel and key
-var RoomKeys = &RoomKeysType{
-	localCache: cache.New(cache.NoExpiration, 0),
+// NewRoomKeys returns an in-memory KeyStore
+func NewRoomKeys() *RoomKeysType {
+	return &RoomKeysType{
+		localCache: cache.New(cache.NoExpiration, 0),
+	}
 }
 
 // SetKey set a random key for channel
@@ -0,0 +1,93 @@
+package configure
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of the events published on the event bus
+const (
+	EventPublishStart = "publish_start"
+	EventPublishStop  = "publish_stop"
+	EventPlayerJoin   = "player_join"
+	EventPlayerLeave  = "player_leave"
+	EventRelayState   = "relay_state"
+	EventDVRFinalized = "dvr_finalized"
+	EventHLSSegment   = "hls_segment"
+	EventCodecChange  = "codec_change"
+	EventError        = "error"
+)
+
+// Event is something which happened on the server. Its id increases by one
+// with every event published, so a subscriber which missed events sees a gap.
+type Event struct {
+	ID   uint64                 `json:"id"`
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Key  string                 `json:"key,omitempty"` // the stream key, empty for relays
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Events is the event bus of a Store. The streams, the HLS server and the
+// relays publish to it and every subscriber gets the events on its own
+// channel, a subscriber which does not keep up misses events.
+type Events struct {
+	lock sync.Mutex
+	id   uint64
+	subs map[chan Event]struct{}
+}
+
+func newEvents() *Events {
+	return &Events{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish sends an event of type typ about the stream key to the
+// subscribers, it never blocks. Publishing to a nil Events does nothing.
+func (e *Events) Publish(typ, key string, data map[string]interface{}) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.id++
+	ev := Event{
+		ID:   e.id,
+		Type: typ,
+		Time: time.Now(),
+		Key:  key,
+		Data: data,
+	}
+	for c := range e.subs {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel buffering up to size events published from
+// now on, and the function which stops the subscription
+func (e *Events) Subscribe(size int) (<-chan Event, func()) {
+	c := make(chan Event, size)
+	e.lock.Lock()
+	e.subs[c] = struct{}{}
+	e.lock.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			e.lock.Lock()
+			delete(e.subs, c)
+			e.lock.Unlock()
+		})
+	}
+}
+
+// Subscribers returns the number of subscriptions
+func (e *Events) Subscribers() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.subs)
+}
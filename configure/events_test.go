@@ -0,0 +1,56 @@
+package configure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	at := assert.New(t)
+	e := newEvents()
+
+	//events published without subscribers are lost
+	e.Publish(EventPublishStart, "live/room", nil)
+	c1, cancel1 := e.Subscribe(4)
+	c2, cancel2 := e.Subscribe(1)
+	at.Equal(2, e.Subscribers())
+
+	e.Publish(EventPlayerJoin, "live/room", map[string]interface{}{"id": "1"})
+	e.Publish(EventPlayerLeave, "live/room", map[string]interface{}{"id": "1"})
+	ev := <-c1
+	at.Equal(uint64(2), ev.ID)
+	at.Equal(EventPlayerJoin, ev.Type)
+	at.Equal("live/room", ev.Key)
+	at.Equal("1", ev.Data["id"])
+	at.False(ev.Time.IsZero())
+	at.Equal(uint64(3), (<-c1).ID)
+
+	//a subscriber which does not keep up misses events
+	at.Equal(uint64(2), (<-c2).ID)
+	select {
+	case ev := <-c2:
+		t.Errorf("unexpected event %d", ev.ID)
+	default:
+	}
+	e.Publish(EventRelayState, "", nil)
+	at.Equal(uint64(4), (<-c2).ID)
+	at.Equal(uint64(4), (<-c1).ID)
+
+	cancel1()
+	cancel1()
+	at.Equal(1, e.Subscribers())
+	e.Publish(EventError, "", nil)
+	select {
+	case ev := <-c1:
+		t.Errorf("event %d after cancel", ev.ID)
+	default:
+	}
+	at.Equal(uint64(5), (<-c2).ID)
+	cancel2()
+	at.Equal(0, e.Subscribers())
+
+	//publishing to a nil bus does nothing
+	var none *Events
+	none.Publish(EventError, "", nil)
+}
@@ -3,9 +3,11 @@ package configure
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"strings"
 
-	"github.com/kr/pretty"
+	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -26,12 +28,61 @@ import (
 
 // Application is application, the basic unit of push and pull
 type Application struct {
-	Appname    string   `mapstructure:"appname"`
-	Live       bool     `mapstructure:"live"`
-	Hls        bool     `mapstructure:"hls"`
-	StaticPush []string `mapstructure:"static_push"`
+	Appname           string   `mapstructure:"appname"`
+	Live              bool     `mapstructure:"live"`
+	Hls               bool     `mapstructure:"hls"`
+	StaticPush        []string `mapstructure:"static_push"`
+	PlayBeforePublish string   `mapstructure:"play_before_publish"`
+	// DuplicatePublisher is the policy for a publisher of a stream which
+	// is already published
+	DuplicatePublisher string `mapstructure:"duplicate_publisher"`
+	// PublishACL and PlayACL restrict the addresses of publishers and
+	// players
+	PublishACL ACL `mapstructure:"publish_acl"`
+	PlayACL    ACL `mapstructure:"play_acl"`
+	// MaxBitrate is the ingest bitrate limit of the publishers in kbps,
+	// StreamBitrates overrides it for some streams
+	MaxBitrate     int             `mapstructure:"max_bitrate"`
+	BitrateAction  string          `mapstructure:"bitrate_action"`
+	StreamBitrates []StreamBitrate `mapstructure:"stream_bitrates"`
+	// MaxViewers limits the players of every stream, MaxAppViewers those
+	// of all streams of the application
+	MaxViewers    int `mapstructure:"max_viewers"`
+	MaxAppViewers int `mapstructure:"max_app_viewers"`
 }
 
+// StreamBitrate is the ingest bitrate limit of the stream named Name
+type StreamBitrate struct {
+	Name       string `mapstructure:"name"`
+	MaxBitrate int    `mapstructure:"max_bitrate"`
+}
+
+// Behaviors for players of streams which are not published yet
+const (
+	PlayWait   = "wait" // the player waits for the publisher, the default
+	PlayReject = "reject"
+)
+
+// Policies for duplicate publishers
+const (
+	PublishReplace = "replace" // the new publisher replaces the old one, the default
+	PublishReject  = "reject"
+	PublishStandby = "standby" // the new publisher is promoted when the old one stops
+)
+
+// Actions on publishers over their bitrate limit
+const (
+	BitrateWarn       = "warn" // the publisher is logged, the default
+	BitrateDrop       = "drop" // video is dropped until the next key frame under the limit
+	BitrateDisconnect = "disconnect"
+)
+
+// Actions once the egress bitrate is over max_egress
+const (
+	EgressDrop   = "drop" // players skip video until the next key frame, the default
+	EgressRefuse = "refuse"
+)
+
 // Applications is a collection of Application
 type Applications []Application
 
@@ -41,36 +92,68 @@ type JWT struct {
 	Algorithm string `mapstructure:"algorithm"`
 }
 
+// ProxyProtocol lists the trusted sources of PROXY protocol headers of
+// every listener, the headers are not read if it is empty
+type ProxyProtocol struct {
+	RTMP    []string `mapstructure:"rtmp"`
+	HTTPFLV []string `mapstructure:"httpflv"`
+	HLS     []string `mapstructure:"hls"`
+	RTMPT   []string `mapstructure:"rtmpt"`
+	API     []string `mapstructure:"api"`
+}
+
 // ServerCfg is the configuration of server
 type ServerCfg struct {
-	Level           string       `mapstructure:"level"`
-	ConfigFile      string       `mapstructure:"config_file"`
-	FLVDir          string       `mapstructure:"flv_dir"`
-	RTMPAddr        string       `mapstructure:"rtmp_addr"`
-	HTTPFLVAddr     string       `mapstructure:"httpflv_addr"`
-	HLSAddr         string       `mapstructure:"hls_addr"`
-	HLSKeepAfterEnd bool         `mapstructure:"hls_keep_after_end"`
-	APIAddr         string       `mapstructure:"api_addr"`
-	RedisAddr       string       `mapstructure:"redis_addr"`
-	RedisPwd        string       `mapstructure:"redis_pwd"`
-	ReadTimeout     int          `mapstructure:"read_timeout"`
-	WriteTimeout    int          `mapstructure:"write_timeout"`
-	GopNum          int          `mapstructure:"gop_num"`
-	JWT             JWT          `mapstructure:"jwt"`
-	Server          Applications `mapstructure:"server"`
+	Level             string        `mapstructure:"level"`
+	ConfigFile        string        `mapstructure:"config_file"`
+	FLVDir            string        `mapstructure:"flv_dir"`
+	RTMPAddr          string        `mapstructure:"rtmp_addr"`
+	HTTPFLVAddr       string        `mapstructure:"httpflv_addr"`
+	RTMPTAddr         string        `mapstructure:"rtmpt_addr"`
+	HLSAddr           string        `mapstructure:"hls_addr"`
+	HLSKeepAfterEnd   bool          `mapstructure:"hls_keep_after_end"`
+	HLSSessionTimeout int           `mapstructure:"hls_session_timeout"`
+	APIAddr           string        `mapstructure:"api_addr"`
+	RedisAddr         string        `mapstructure:"redis_addr"`
+	RedisPwd          string        `mapstructure:"redis_pwd"`
+	ReadTimeout       int           `mapstructure:"read_timeout"`
+	WriteTimeout      int           `mapstructure:"write_timeout"`
+	RTMPAggregate     bool          `mapstructure:"rtmp_aggregate"`
+	HandshakeStrict   bool          `mapstructure:"handshake_strict"`
+	GopNum            int           `mapstructure:"gop_num"`
+	ShutdownTimeout   int           `mapstructure:"shutdown_timeout"`
+	PingInterval      int           `mapstructure:"ping_interval"`
+	IdleTimeout       int           `mapstructure:"idle_timeout"`
+	PublishTimeout    int           `mapstructure:"publish_timeout"`
+	MaxConns          int           `mapstructure:"max_conns"`
+	MaxConnsPerIP     int           `mapstructure:"max_conns_per_ip"`
+	MaxEgress         int           `mapstructure:"max_egress"`
+	EgressAction      string        `mapstructure:"egress_action"`
+	ProxyProtocol     ProxyProtocol `mapstructure:"proxy_protocol"`
+	JWT               JWT           `mapstructure:"jwt"`
+	Token             Token         `mapstructure:"token"`
+	Server            Applications  `mapstructure:"server"`
 }
 
 // defaultConfig is the default configuration
 var defaultConf = ServerCfg{
-	ConfigFile:      "livego.yaml",
-	RTMPAddr:        ":1935",
-	HTTPFLVAddr:     ":7001",
-	HLSAddr:         ":7002",
-	HLSKeepAfterEnd: false,
-	APIAddr:         ":8090",
-	WriteTimeout:    10,
-	ReadTimeout:     10,
-	GopNum:          1,
+	Level:             "info",
+	ConfigFile:        "livego.yaml",
+	FLVDir:            "tmp",
+	RTMPAddr:          ":1935",
+	HTTPFLVAddr:       ":7001",
+	HLSAddr:           ":7002",
+	HLSKeepAfterEnd:   false,
+	HLSSessionTimeout: 30,
+	APIAddr:           ":8090",
+	WriteTimeout:      10,
+	ReadTimeout:       10,
+	GopNum:            1,
+	ShutdownTimeout:   10,
+	PingInterval:      10,
+	IdleTimeout:       30,
+	PublishTimeout:    10,
+	EgressAction:      EgressDrop,
 	Server: Applications{{
 		Appname:    "live",
 		Live:       true,
@@ -79,88 +162,205 @@ var defaultConf = ServerCfg{
 	}},
 }
 
-// Config is the configuration of this livego
-var Config = viper.New()
-
-func initLog() {
-	if l, err := log.ParseLevel(Config.GetString("level")); err == nil {
-		log.SetLevel(l)
-		log.SetReportCaller(l == log.DebugLevel)
-	}
+// DefaultConfig returns the default configuration
+func DefaultConfig() ServerCfg {
+	c := defaultConf
+	c.Server = append(Applications(nil), defaultConf.Server...)
+	return c
 }
 
-func init() {
+// load reads defaults, flags, the configuration file and environment into v.
+// The error of reading the configuration file is returned, v still holds
+// the other sources in that case.
+func load(v *viper.Viper) error {
 	// Default config
 	b, _ := json.Marshal(defaultConf)
-	defaultConfig := bytes.NewReader(b)
-	viper.SetConfigType("json")
-	viper.ReadConfig(defaultConfig)
-	Config.MergeConfigMap(viper.AllSettings())
+	defaults := viper.New()
+	defaults.SetConfigType("json")
+	defaults.ReadConfig(bytes.NewReader(b))
+	v.MergeConfigMap(defaults.AllSettings())
 
 	// Flags
+	v.BindPFlags(pflag.CommandLine)
+
+	// File
+	v.SetConfigFile(v.GetString("config_file"))
+	v.AddConfigPath(".")
+	err := v.ReadInConfig()
+	if err == nil {
+		v.MergeInConfig()
+	}
+
+	// Environment
+	replacer := strings.NewReplacer(".", "_")
+	v.SetEnvKeyReplacer(replacer)
+	v.AllowEmptyEnv(true)
+	v.AutomaticEnv()
+
+	return err
+}
+
+// Init defines and parses the command line flags of livego, then reads the
+// configuration from defaults, flags, the configuration file and environment.
+// It is meant for the livego command, programs embedding livego build a
+// ServerCfg themselves.
+func Init() (*ServerCfg, error) {
 	pflag.String("rtmp_addr", ":1935", "RTMP server listen address")
 	pflag.String("httpflv_addr", ":7001", "HTTP-FLV server listen address")
+	pflag.String("rtmpt_addr", "", "RTMPT (RTMP over HTTP) server listen address, disabled if empty")
 	pflag.String("hls_addr", ":7002", "HLS server listen address")
 	pflag.String("api_addr", ":8090", "HTTP manage interface server listen address")
 	pflag.String("config_file", "livego.yaml", "configure filename")
 	pflag.String("level", "info", "Log level")
 	pflag.Bool("hls_keep_after_end", false, "Maintains the HLS after the stream ends")
+	pflag.Int("hls_session_timeout", 30, "seconds after its last request an HLS viewer session expires")
 	pflag.String("flv_dir", "tmp", "output flv file at flvDir/APP/KEY_TIME.flv")
 	pflag.Int("read_timeout", 10, "read time out")
 	pflag.Int("write_timeout", 10, "write time out")
+	pflag.Bool("rtmp_aggregate", false, "send aggregate messages to RTMP players")
+	pflag.Bool("handshake_strict", false, "reject RTMP handshakes without valid digest instead of falling back to the simple handshake")
 	pflag.Int("gop_num", 1, "gop num")
+	pflag.Int("shutdown_timeout", 10, "grace period in seconds for draining streams on shutdown")
+	pflag.Int("ping_interval", 10, "interval in seconds of RTMP ping requests, 0 disables them")
+	pflag.Int("idle_timeout", 30, "seconds without any message before closing an RTMP connection, 0 disables it")
+	pflag.Int("publish_timeout", 10, "seconds before closing an RTMP publisher which sends no media, 0 disables it")
+	pflag.Int("max_conns", 0, "maximum number of RTMP, HTTP-FLV and HLS connections, 0 for no limit")
+	pflag.Int("max_conns_per_ip", 0, "maximum number of connections of one client address, 0 for no limit")
+	pflag.Int("max_egress", 0, "maximum bitrate in kbps sent to the players, 0 for no limit")
+	pflag.String("egress_action", "drop", "action over max_egress: drop video frames or refuse new players")
 	pflag.Parse()
-	Config.BindPFlags(pflag.CommandLine)
 
-	// File
-	Config.SetConfigFile(Config.GetString("config_file"))
-	Config.AddConfigPath(".")
-	err := Config.ReadInConfig()
-	if err != nil {
+	v := viper.New()
+	if err := load(v); err != nil {
 		log.Warning(err)
 		log.Info("Using default config")
-	} else {
-		Config.MergeInConfig()
 	}
 
-	// Environment
-	replacer := strings.NewReplacer(".", "_")
-	Config.SetEnvKeyReplacer(replacer)
-	Config.AllowEmptyEnv(true)
-	Config.AutomaticEnv()
-
-	// Log
-	initLog()
+	c := &ServerCfg{}
+	if err := v.Unmarshal(c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	// Print final config
-	c := ServerCfg{}
-	Config.Unmarshal(&c)
-	log.Debugf("Current configurations: \n%# v", pretty.Formatter(c))
+// Load reads the configuration file again, the flags parsed by Init still apply
+func Load() (*ServerCfg, error) {
+	v := viper.New()
+	if err := load(v); err != nil {
+		return nil, err
+	}
+	c := &ServerCfg{}
+	if err := v.Unmarshal(c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-// CheckAppName check the appname is still live
-func CheckAppName(appname string) bool {
-	apps := Applications{}
-	Config.UnmarshalKey("server", &apps)
-	for _, app := range apps {
-		if app.Appname == appname {
-			return app.Live
+// Validate checks if the configuration can be applied
+func (c *ServerCfg) Validate() error {
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 {
+		return fmt.Errorf("read_timeout and write_timeout must be positive")
+	}
+	if c.GopNum <= 0 {
+		return fmt.Errorf("gop_num must be positive")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative")
+	}
+	if c.PingInterval < 0 || c.IdleTimeout < 0 || c.PublishTimeout < 0 {
+		return fmt.Errorf("ping_interval, idle_timeout and publish_timeout must not be negative")
+	}
+	if c.MaxConns < 0 || c.MaxConnsPerIP < 0 {
+		return fmt.Errorf("max_conns and max_conns_per_ip must not be negative")
+	}
+	if c.MaxEgress < 0 {
+		return fmt.Errorf("max_egress must not be negative")
+	}
+	switch c.EgressAction {
+	case "", EgressDrop, EgressRefuse:
+	default:
+		return fmt.Errorf("invalid egress_action %s", c.EgressAction)
+	}
+	for _, nets := range [][]string{c.ProxyProtocol.RTMP, c.ProxyProtocol.HTTPFLV,
+		c.ProxyProtocol.HLS, c.ProxyProtocol.RTMPT, c.ProxyProtocol.API} {
+		if _, err := ParseNets(nets); err != nil {
+			return fmt.Errorf("proxy_protocol: %v", err)
 		}
 	}
-	return false
-}
+	if c.Level != "" {
+		if _, err := log.ParseLevel(c.Level); err != nil {
+			return err
+		}
+	}
+	if c.JWT.Algorithm != "" && jwt.GetSigningMethod(c.JWT.Algorithm) == nil {
+		return fmt.Errorf("unsupported jwt algorithm %s", c.JWT.Algorithm)
+	}
+	if c.HLSSessionTimeout < 0 {
+		return fmt.Errorf("hls_session_timeout must not be negative")
+	}
+	if (c.Token.Publish || c.Token.Play) && c.Token.Secret == "" {
+		return fmt.Errorf("token.secret is required for publish or play tokens")
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Server {
+		app := &c.Server[i]
+		if app.Appname == "" {
+			return fmt.Errorf("application without appname")
+		}
+		if names[app.Appname] {
+			return fmt.Errorf("application %s is configured twice", app.Appname)
+		}
+		names[app.Appname] = true
 
-// GetStaticPushURLList get static push url list from config
-func GetStaticPushURLList(appname string) ([]string, bool) {
-	apps := Applications{}
-	Config.UnmarshalKey("server", &apps)
-	for _, app := range apps {
-		if (app.Appname == appname) && app.Live {
-			if len(app.StaticPush) > 0 {
-				return app.StaticPush, true
+		switch app.DuplicatePublisher {
+		case "", PublishReplace, PublishReject, PublishStandby:
+		default:
+			return fmt.Errorf("application %s: invalid duplicate_publisher %s", app.Appname, app.DuplicatePublisher)
+		}
+		switch app.PlayBeforePublish {
+		case "", PlayWait, PlayReject:
+		default:
+			return fmt.Errorf("application %s: invalid play_before_publish %s", app.Appname, app.PlayBeforePublish)
+		}
+		switch app.BitrateAction {
+		case "", BitrateWarn, BitrateDrop, BitrateDisconnect:
+		default:
+			return fmt.Errorf("application %s: invalid bitrate_action %s", app.Appname, app.BitrateAction)
+		}
+		if app.MaxBitrate < 0 {
+			return fmt.Errorf("application %s: max_bitrate must not be negative", app.Appname)
+		}
+		if app.MaxViewers < 0 || app.MaxAppViewers < 0 {
+			return fmt.Errorf("application %s: max_viewers and max_app_viewers must not be negative", app.Appname)
+		}
+		for _, limit := range app.StreamBitrates {
+			if limit.Name == "" || limit.MaxBitrate < 0 {
+				return fmt.Errorf("application %s: invalid stream_bitrates", app.Appname)
+			}
+		}
+		if err := app.PublishACL.validate(); err != nil {
+			return fmt.Errorf("application %s: publish_acl: %v", app.Appname, err)
+		}
+		if err := app.PlayACL.validate(); err != nil {
+			return fmt.Errorf("application %s: play_acl: %v", app.Appname, err)
+		}
+
+		for _, pushURL := range app.StaticPush {
+			u, err := url.Parse(pushURL)
+			if err != nil {
+				return fmt.Errorf("application %s: %v", app.Appname, err)
+			}
+			if u.Scheme != "rtmp" || u.Host == "" {
+				return fmt.Errorf("application %s: invalid static_push url %s", app.Appname, pushURL)
 			}
-			return nil, false
 		}
 	}
-	return nil, false
+	return nil
 }
@@ -0,0 +1,188 @@
+package configure
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kr/pretty"
+	log "github.com/sirupsen/logrus"
+)
+
+// Store holds the configuration of one livego instance and the logger it
+// applies the log level to. The configuration is replaced as a whole on
+// reload, so the value returned by Current must not be modified.
+type Store struct {
+	value     atomic.Value
+	logger    *log.Logger
+	lock      sync.Mutex
+	listeners []func(*ServerCfg)
+	loader    func() (*ServerCfg, error)
+	access    *Access
+	events    *Events
+}
+
+// NewStore returns a Store holding c, logger defaults to the standard logger
+func NewStore(c *ServerCfg, logger *log.Logger) (*Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+
+	s := &Store{logger: logger}
+	s.access = newAccess(s)
+	s.events = newEvents()
+	s.value.Store(c)
+	s.setLevel(c.Level)
+	logger.Debugf("Current configurations: \n%# v", pretty.Formatter(*c))
+	return s, nil
+}
+
+func (s *Store) setLevel(level string) {
+	if l, err := log.ParseLevel(level); err == nil {
+		s.logger.SetLevel(l)
+		s.logger.SetReportCaller(l == log.DebugLevel)
+	}
+}
+
+// Logger returns the logger of this instance
+func (s *Store) Logger() *log.Logger {
+	return s.logger
+}
+
+// Access returns the connection limits and ACLs of this instance
+func (s *Store) Access() *Access {
+	return s.access
+}
+
+// Events returns the event bus of this instance
+func (s *Store) Events() *Events {
+	return s.events
+}
+
+// Current returns the active configuration
+func (s *Store) Current() *ServerCfg {
+	return s.value.Load().(*ServerCfg)
+}
+
+// SetLoader sets the function Reload reads the new configuration with
+func (s *Store) SetLoader(fn func() (*ServerCfg, error)) {
+	s.lock.Lock()
+	s.loader = fn
+	s.lock.Unlock()
+}
+
+// OnReload registers a function called with the new configuration after
+// every successful update
+func (s *Store) OnReload(fn func(*ServerCfg)) {
+	s.lock.Lock()
+	s.listeners = append(s.listeners, fn)
+	s.lock.Unlock()
+}
+
+// Update applies c if it is valid.
+// Applications, static pushes, JWT, timeouts, connection limits, gop_num,
+// flv_dir, hls_keep_after_end and level take effect for new sessions,
+// listen addresses and proxy_protocol only after restart.
+func (s *Store) Update(c *ServerCfg) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.Current()
+	if old.RTMPAddr != c.RTMPAddr || old.HTTPFLVAddr != c.HTTPFLVAddr ||
+		old.HLSAddr != c.HLSAddr || old.APIAddr != c.APIAddr ||
+		old.RTMPTAddr != c.RTMPTAddr {
+		s.logger.Warning("listen addresses changed, restart livego to apply them")
+	}
+	if !reflect.DeepEqual(old.ProxyProtocol, c.ProxyProtocol) {
+		s.logger.Warning("proxy_protocol changed, restart livego to apply it")
+	}
+
+	s.value.Store(c)
+	s.setLevel(c.Level)
+	s.logger.Debugf("Current configurations: \n%# v", pretty.Formatter(*c))
+
+	for _, fn := range s.listeners {
+		fn(c)
+	}
+	return nil
+}
+
+// Reload reads the configuration with the loader and applies it
+func (s *Store) Reload() (*ServerCfg, error) {
+	s.lock.Lock()
+	loader := s.loader
+	s.lock.Unlock()
+	if loader == nil {
+		return nil, fmt.Errorf("reload is not supported")
+	}
+
+	c, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Update(c); err != nil {
+		return nil, err
+	}
+	s.logger.Infof("Configuration reloaded from %s", c.ConfigFile)
+	return c, nil
+}
+
+// CheckAppName check the appname is still live
+func (s *Store) CheckAppName(appname string) bool {
+	for _, app := range s.Current().Server {
+		if app.Appname == appname {
+			return app.Live
+		}
+	}
+	return false
+}
+
+// GetApplication returns the configuration of a live application
+func (s *Store) GetApplication(appname string) (Application, bool) {
+	for _, app := range s.Current().Server {
+		if app.Appname == appname && app.Live {
+			return app, true
+		}
+	}
+	return Application{}, false
+}
+
+// GetMaxBitrate returns the ingest bitrate limit in kbps of the stream
+// app/name and the action over it, 0 for no limit
+func (s *Store) GetMaxBitrate(app, name string) (int, string) {
+	conf, ok := s.GetApplication(app)
+	if !ok {
+		return 0, ""
+	}
+	action := conf.BitrateAction
+	if action == "" {
+		action = BitrateWarn
+	}
+	for _, limit := range conf.StreamBitrates {
+		if limit.Name == name {
+			return limit.MaxBitrate, action
+		}
+	}
+	return conf.MaxBitrate, action
+}
+
+// GetStaticPushURLList get static push url list from config
+func (s *Store) GetStaticPushURLList(appname string) ([]string, bool) {
+	for _, app := range s.Current().Server {
+		if (app.Appname == appname) && app.Live {
+			if len(app.StaticPush) > 0 {
+				return app.StaticPush, true
+			}
+			return nil, false
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,31 @@
+package configure
+
+import (
+	"bytes"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateRestartWarning(t *testing.T) {
+	at := assert.New(t)
+	out := bytes.NewBuffer(nil)
+	logger := log.New()
+	logger.SetOutput(out)
+
+	cfg := defaultConf
+	s, err := NewStore(&cfg, logger)
+	at.Nil(err)
+
+	c := *s.Current()
+	c.Level = "warn"
+	at.Nil(s.Update(&c))
+	at.NotContains(out.String(), "restart livego")
+
+	//the RTMPT listener is only started with livego
+	c2 := c
+	c2.RTMPTAddr = "127.0.0.1:7936"
+	at.Nil(s.Update(&c2))
+	at.Contains(out.String(), "listen addresses changed")
+}
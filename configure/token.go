@@ -0,0 +1,66 @@
+package configure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Token actions
+const (
+	TokenPublish = "publish"
+	TokenPlay    = "play"
+)
+
+// Token configures the signed URL tokens of publishers and players
+type Token struct {
+	Secret  string `mapstructure:"secret"`
+	Publish bool   `mapstructure:"publish"` // publishers need a token instead of a key
+	Play    bool   `mapstructure:"play"`    // players need a token
+}
+
+// SignToken returns the token allowing action on the stream app/name until
+// expire, a unix time. The token is only valid from ip if it is not empty.
+func SignToken(secret, action, app, name string, expire int64, ip string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s\n%s/%s\n%d\n%s", action, app, name, expire, ip)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// TokenQuery returns the query parameters carrying a token
+func TokenQuery(token string, expire int64) url.Values {
+	return url.Values{
+		"token":  {token},
+		"expire": {strconv.FormatInt(expire, 10)},
+	}
+}
+
+// Check checks the token of query for action on the stream app/name by a
+// client at ip. Nothing is checked if action needs no token.
+func (t Token) Check(action, app, name string, query url.Values, ip string) error {
+	if (action == TokenPublish && !t.Publish) || (action == TokenPlay && !t.Play) {
+		return nil
+	}
+	token := query.Get("token")
+	if token == "" {
+		return fmt.Errorf("%s token required", action)
+	}
+	expire, err := strconv.ParseInt(query.Get("expire"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid token expire %q", query.Get("expire"))
+	}
+	if time.Now().Unix() > expire {
+		return fmt.Errorf("token expired")
+	}
+	// tokens bound to the ip of the client or to none
+	for _, bound := range []string{ip, ""} {
+		if hmac.Equal([]byte(token), []byte(SignToken(t.Secret, action, app, name, expire, bound))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid token")
+}
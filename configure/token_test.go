@@ -0,0 +1,50 @@
+package configure
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCheck(t *testing.T) {
+	at := assert.New(t)
+	token := Token{Secret: "secret", Publish: true}
+	expire := time.Now().Add(time.Minute).Unix()
+	query := func(action, name string, expire int64, ip string) url.Values {
+		return TokenQuery(SignToken("secret", action, "live", name, expire, ip), expire)
+	}
+
+	at.Nil(token.Check(TokenPublish, "live", "room", query(TokenPublish, "room", expire, ""), "192.0.2.1"))
+	at.Nil(token.Check(TokenPublish, "live", "room", query(TokenPublish, "room", expire, "192.0.2.1"), "192.0.2.1"))
+	//players need no token unless configured
+	at.Nil(token.Check(TokenPlay, "live", "room", nil, "192.0.2.1"))
+
+	for _, q := range []url.Values{
+		nil,
+		{"token": {"abc"}},
+		{"token": {"abc"}, "expire": {"never"}},
+		query(TokenPublish, "room", time.Now().Add(-time.Minute).Unix(), ""),
+		query(TokenPlay, "room", expire, ""),
+		query(TokenPublish, "other", expire, ""),
+		query(TokenPublish, "room", expire, "192.0.2.2"),
+		TokenQuery(SignToken("other", TokenPublish, "live", "room", expire, ""), expire),
+	} {
+		at.NotNil(token.Check(TokenPublish, "live", "room", q, "192.0.2.1"), q)
+	}
+
+	//the expiry is signed
+	q := query(TokenPublish, "room", expire, "")
+	q.Set("expire", "9999999999")
+	at.NotNil(token.Check(TokenPublish, "live", "room", q, "192.0.2.1"))
+}
+
+func TestValidateToken(t *testing.T) {
+	at := assert.New(t)
+	cfg := DefaultConfig()
+	cfg.Token = Token{Play: true}
+	at.NotNil(cfg.Validate())
+	cfg.Token.Secret = "secret"
+	at.Nil(cfg.Validate())
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
@@ -53,17 +54,22 @@ const (
 type Writer struct {
 	av.RWBaser
 
-	uid    string
-	app    string
-	title  string
-	url    string
-	buf    []byte
-	closed chan struct{}
-	ctx    *os.File
+	uid       string
+	app       string
+	title     string
+	url       string
+	buf       []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	ctx       *os.File
+	dvr       *Dvr
+	connected time.Time
+	meter     av.Meter
+	log       *log.Logger
 }
 
-// NewWriter returns a writer
-func NewWriter(app, title, url string, ctx *os.File) *Writer {
+// NewWriter returns a writer logging to logger
+func NewWriter(app, title, url string, ctx *os.File, logger *log.Logger) *Writer {
 	ret := &Writer{
 		RWBaser: av.NewRWBase(time.Second * 10),
 
@@ -74,6 +80,9 @@ func NewWriter(app, title, url string, ctx *os.File) *Writer {
 		ctx:    ctx,
 		closed: make(chan struct{}),
 		buf:    make([]byte, headerLen),
+
+		connected: time.Now(),
+		log:       logger,
 	}
 
 	ret.ctx.Write(flvHeader)
@@ -126,10 +135,23 @@ func (writer *Writer) Write(p *av.Packet) error {
 	if _, err := writer.ctx.Write(h[:4]); err != nil {
 		return err
 	}
+	writer.meter.Add(preDataLen + 4)
 
 	return nil
 }
 
+// Stats returns the statistics of the recorder, the remote address is
+// the file
+func (writer *Writer) Stats() av.Stats {
+	return av.Stats{
+		Protocol:   "flv",
+		RemoteAddr: writer.ctx.Name(),
+		Connected:  writer.connected,
+		Bytes:      writer.meter.Bytes(),
+		Kbps:       writer.meter.Kbps(),
+	}
+}
+
 // Wait waits for closing
 func (writer *Writer) Wait() {
 	select {
@@ -138,10 +160,23 @@ func (writer *Writer) Wait() {
 	}
 }
 
-// Close close the writer
+// Close flushes the file to disk and closes the writer
 func (writer *Writer) Close(error) {
-	writer.ctx.Close()
-	close(writer.closed)
+	writer.closeOnce.Do(func() {
+		if err := writer.ctx.Sync(); err != nil {
+			writer.log.Warning("sync flv file error: ", err)
+		}
+		writer.ctx.Close()
+		close(writer.closed)
+		if writer.dvr != nil {
+			writer.dvr.writers.Delete(writer.uid)
+			writer.dvr.conf.Events().Publish(configure.EventDVRFinalized, writer.app+"/"+writer.title, map[string]interface{}{
+				"file":        writer.ctx.Name(),
+				"bytes":       writer.meter.Bytes(),
+				"duration_ms": int64(time.Since(writer.connected) / time.Millisecond),
+			})
+		}
+	})
 }
 
 // Info return the info
@@ -153,33 +188,56 @@ func (writer *Writer) Info() (ret av.Info) {
 }
 
 // Dvr is a dvr
-type Dvr struct{}
+type Dvr struct {
+	conf    *configure.Store
+	log     *log.Logger
+	writers sync.Map
+}
+
+// NewDvr returns a Dvr recording to the flv_dir of conf
+func NewDvr(conf *configure.Store) *Dvr {
+	return &Dvr{
+		conf: conf,
+		log:  conf.Logger(),
+	}
+}
 
 // Writer get writer from Dvr
 func (f *Dvr) Writer(info av.Info) av.WriteCloser {
 	paths := strings.SplitN(info.Key, "/", 2)
 	if len(paths) != 2 {
-		log.Warning("invalid info")
+		f.log.Warning("invalid info")
 		return nil
 	}
 
-	flvDir := configure.Config.GetString("flv_dir")
+	flvDir := f.conf.Current().FLVDir
 
 	err := os.MkdirAll(path.Join(flvDir, paths[0]), 0755)
 	if err != nil {
-		log.Error("mkdir error: ", err)
+		f.log.Error("mkdir error: ", err)
 		return nil
 	}
 
 	fileName := fmt.Sprintf("%s_%d.%s", path.Join(flvDir, info.Key), time.Now().Unix(), "flv")
-	log.Debug("flv dvr save stream to: ", fileName)
+	f.log.Debug("flv dvr save stream to: ", fileName)
 	w, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
-		log.Error("open file error: ", err)
+		f.log.Error("open file error: ", err)
 		return nil
 	}
 
-	writer := NewWriter(paths[0], paths[1], info.URL, w)
-	log.Debug("new flv dvr: ", writer.Info())
+	writer := NewWriter(paths[0], paths[1], info.URL, w, f.log)
+	writer.dvr = f
+	f.writers.Store(writer.uid, writer)
+	f.log.Debug("new flv dvr: ", writer.Info())
 	return writer
 }
+
+// Close finalizes all files still being recorded
+func (f *Dvr) Close() error {
+	f.writers.Range(func(key, value interface{}) bool {
+		value.(*Writer).Close(fmt.Errorf("dvr closed"))
+		return true
+	})
+	return nil
+}
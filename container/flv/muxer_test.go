@@ -0,0 +1,88 @@
+package flv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/utils/pio"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDvr(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "livego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := configure.DefaultConfig()
+	cfg.FLVDir = dir
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	conf, err := configure.NewStore(&cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := conf.Events().Subscribe(16)
+	defer cancel()
+
+	dvr := NewDvr(conf)
+	w := dvr.Writer(av.Info{Key: "live/room", URL: "rtmp://localhost/live/room"})
+	if !at.NotNil(w) {
+		return
+	}
+	meta := []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a', 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09}
+	packets := []*av.Packet{
+		{IsMetadata: true, Data: meta},
+		{IsVideo: true, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x01}},
+		{IsAudio: true, TimeStamp: 20, Data: []byte{0xaf, 0x01, 0x21}},
+		{IsVideo: true, TimeStamp: 0x1000028, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x02}},
+	}
+	for _, p := range packets {
+		at.Nil(w.Write(p))
+	}
+	at.Nil(dvr.Close())
+	at.NotNil(w.Write(packets[1]))
+
+	//the file is complete once the recorder is closed
+	ev := <-events
+	at.Equal(configure.EventDVRFinalized, ev.Type)
+	at.Equal("live/room", ev.Key)
+	files, _ := filepath.Glob(filepath.Join(dir, "live", "room_*.flv"))
+	if !at.Len(files, 1) {
+		return
+	}
+	at.Equal(files[0], ev.Data["file"])
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(ev.Data["bytes"], uint64(len(data)-len(flvHeader)-4))
+	at.Equal(flvHeader, data[:len(flvHeader)])
+	at.Equal(uint32(0), pio.U32BE(data[len(flvHeader):]))
+	data = data[len(flvHeader)+4:]
+	for _, p := range packets {
+		if !at.True(len(data) >= headerLen) {
+			return
+		}
+		typeID := av.TagAudio
+		if p.IsVideo {
+			typeID = av.TagVideo
+		} else if p.IsMetadata {
+			typeID = av.TagScriptDataAMF0
+		}
+		size := int(pio.U24BE(data[1:]))
+		at.Equal(byte(typeID), data[0])
+		at.Equal(p.TimeStamp, pio.U24BE(data[4:])|uint32(data[7])<<24)
+		at.Equal(p.Data, data[headerLen:headerLen+size])
+		at.Equal(uint32(headerLen+size), pio.U32BE(data[headerLen+size:]))
+		data = data[headerLen+size+4:]
+	}
+	at.Len(data, 0)
+}
@@ -0,0 +1,341 @@
+// Package livego is a live streaming server which can be embedded in other
+// Go programs. Every Server has its own configuration, key store and
+// streams, so several of them can run in one process.
+package livego
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/api"
+	"github.com/gwuhaolin/livego/protocol/hls"
+	"github.com/gwuhaolin/livego/protocol/httpflv"
+	"github.com/gwuhaolin/livego/protocol/proxyproto"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/protocol/rtmpt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures a Server
+type Options struct {
+	// Config holds the listen addresses, applications and settings,
+	// an empty HTTP-FLV, HLS, RTMPT or API address disables that server
+	Config configure.ServerCfg
+	// KeyStore holds the keys of the publishers, in memory if nil
+	KeyStore configure.KeyStore
+	// Hooks are called before publishers and players start
+	Hooks rtmp.Hooks
+	// Logger receives the logs of the servers and gets the configured level,
+	// the standard logger is used if nil
+	Logger *logrus.Logger
+	// Loader reads the configuration applied by /control/reload,
+	// reloading through the API is not supported if nil
+	Loader func() (*configure.ServerCfg, error)
+}
+
+// Server is one livego instance with its RTMP, HTTP-FLV, HLS, RTMPT and API
+// servers
+type Server struct {
+	hooks rtmp.Hooks
+	conf  *configure.Store
+	keys  configure.KeyStore
+	errc  chan error
+
+	lock        sync.Mutex
+	started     bool
+	streams     *rtmp.Streams
+	rtmpServer  *rtmp.Server
+	flvServer   *httpflv.Server
+	hlsServer   *hls.Server
+	rtmptServer *rtmpt.Server
+	apiServer   *api.Server
+	rtmpAddr    net.Addr
+	flvAddr     net.Addr
+	hlsAddr     net.Addr
+	rtmptAddr   net.Addr
+	apiAddr     net.Addr
+}
+
+// NewServer returns a Server configured by opts
+func NewServer(opts Options) (*Server, error) {
+	cfg := opts.Config
+	conf, err := configure.NewStore(&cfg, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Loader != nil {
+		conf.SetLoader(opts.Loader)
+	}
+
+	keys := opts.KeyStore
+	if keys == nil {
+		keys = configure.NewRoomKeys()
+	}
+
+	s := &Server{
+		hooks: opts.Hooks,
+		conf:  conf,
+		keys:  keys,
+		errc:  make(chan error, 5),
+	}
+	conf.OnReload(func(*configure.ServerCfg) {
+		if streams := s.Streams(); streams != nil {
+			streams.ReloadStaticPush()
+		}
+	})
+	return s, nil
+}
+
+// listen listens on addr, no listener is returned for an empty addr.
+// The PROXY protocol headers of the connections from trusted are read.
+func listen(addr string, trusted []string) (net.Listener, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	nets, err := configure.ParseNets(trusted)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil || len(nets) == 0 {
+		return l, err
+	}
+	return proxyproto.NewListener(l, nets), nil
+}
+
+func closeListeners(listeners ...net.Listener) {
+	for _, l := range listeners {
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+// Start listens on the configured addresses and starts serving.
+// Nothing is started if any address can not be listened on.
+func (s *Server) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return fmt.Errorf("server already started")
+	}
+
+	cfg := s.conf.Current()
+	log := s.conf.Logger()
+
+	if cfg.RTMPAddr == "" {
+		return fmt.Errorf("rtmp_addr is empty")
+	}
+	rtmpListen, err := listen(cfg.RTMPAddr, cfg.ProxyProtocol.RTMP)
+	if err != nil {
+		return err
+	}
+	flvListen, err := listen(cfg.HTTPFLVAddr, cfg.ProxyProtocol.HTTPFLV)
+	if err != nil {
+		closeListeners(rtmpListen)
+		return err
+	}
+	hlsListen, err := listen(cfg.HLSAddr, cfg.ProxyProtocol.HLS)
+	if err != nil {
+		closeListeners(rtmpListen, flvListen)
+		return err
+	}
+	rtmptListen, err := listen(cfg.RTMPTAddr, cfg.ProxyProtocol.RTMPT)
+	if err != nil {
+		closeListeners(rtmpListen, flvListen, hlsListen)
+		return err
+	}
+	apiListen, err := listen(cfg.APIAddr, cfg.ProxyProtocol.API)
+	if err != nil {
+		closeListeners(rtmpListen, flvListen, hlsListen, rtmptListen)
+		return err
+	}
+
+	s.streams = rtmp.NewStreams(s.conf)
+	s.flvServer, s.hlsServer, s.rtmptServer, s.apiServer = nil, nil, nil, nil
+	s.flvAddr, s.hlsAddr, s.rtmptAddr, s.apiAddr = nil, nil, nil, nil
+
+	var getter av.GetWriter
+	if hlsListen != nil {
+		s.hlsServer = hls.NewServer(s.conf)
+		s.hlsAddr = hlsListen.Addr()
+		getter = s.hlsServer
+		log.Info("HLS server enable....")
+		s.serve("HLS", hlsListen, s.hlsServer.Serve)
+	} else {
+		log.Info("HLS server disable....")
+	}
+
+	if flvListen != nil {
+		s.flvServer = httpflv.NewServer(s.streams, s.conf, s.hooks)
+		s.flvAddr = flvListen.Addr()
+		s.serve("HTTP-FLV", flvListen, s.flvServer.Serve)
+	}
+
+	if s.hlsServer != nil {
+		s.streams.AddViewerCounter(s.hlsServer.Viewers)
+		s.hlsServer.SetViewerCheck(s.streams.AdmitViewer)
+	}
+
+	s.rtmpServer = rtmp.NewServer(s.streams, getter, s.conf, s.keys, s.hooks)
+	s.rtmpAddr = rtmpListen.Addr()
+	s.serve("RTMP", rtmpListen, s.rtmpServer.Serve)
+
+	if rtmptListen != nil {
+		s.rtmptServer = rtmpt.NewServer(s.conf, s.rtmpServer.ServeConn)
+		s.rtmptAddr = rtmptListen.Addr()
+		s.serve("RTMPT", rtmptListen, s.rtmptServer.Serve)
+	}
+
+	if apiListen != nil {
+		// relays connect to the local RTMP server on its port
+		_, port, _ := net.SplitHostPort(s.rtmpAddr.String())
+		s.apiServer = api.NewServer(s.streams, s.rtmpServer, s.hlsServer, ":"+port, s.conf, s.keys)
+		s.apiAddr = apiListen.Addr()
+		s.serve("HTTP-API", apiListen, s.apiServer.Serve)
+	}
+
+	s.started = true
+	return nil
+}
+
+// serve runs fn with l in a new goroutine, its error is sent to Err
+func (s *Server) serve(name string, l net.Listener, fn func(net.Listener) error) {
+	log := s.conf.Logger()
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("%s server panic: %v", name, r)
+			}
+		}()
+		log.Infof("%s listen On %s", name, l.Addr())
+		if err := fn(l); err != nil {
+			select {
+			case s.errc <- fmt.Errorf("%s server: %v", name, err):
+			default:
+				log.Errorf("%s server: %v", name, err)
+			}
+		}
+	}()
+}
+
+// Stop stops the servers in order: relays and api first, then RTMP
+// publishers are ended and players drained, finally the RTMPT sessions are
+// closed and the HTTP-FLV and HLS servers finish their requests and
+// playlists. ctx limits the time given for draining.
+func (s *Server) Stop(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.started {
+		return nil
+	}
+	s.started = false
+
+	var err error
+	keep := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.apiServer != nil {
+		keep(s.apiServer.Shutdown(ctx))
+	}
+	keep(s.rtmpServer.Shutdown(ctx))
+	if s.rtmptServer != nil {
+		keep(s.rtmptServer.Shutdown(ctx))
+	}
+	if s.flvServer != nil {
+		keep(s.flvServer.Shutdown(ctx))
+	}
+	if s.hlsServer != nil {
+		keep(s.hlsServer.Shutdown(ctx))
+	}
+	return err
+}
+
+// Err returns a channel receiving the errors of servers which stopped
+// serving unexpectedly
+func (s *Server) Err() <-chan error {
+	return s.errc
+}
+
+// Reload applies cfg if it is valid, see configure.Store.Update
+func (s *Server) Reload(cfg configure.ServerCfg) error {
+	return s.conf.Update(&cfg)
+}
+
+// Config returns the active configuration, which must not be modified
+func (s *Server) Config() *configure.ServerCfg {
+	return s.conf.Current()
+}
+
+// Events returns the event bus of the server, see configure.Events
+func (s *Server) Events() *configure.Events {
+	return s.conf.Events()
+}
+
+// Keys returns the key store of the publishers
+func (s *Server) Keys() configure.KeyStore {
+	return s.keys
+}
+
+// Streams returns the streams of a started server
+func (s *Server) Streams() *rtmp.Streams {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams
+}
+
+// HLSServer returns the HLS server of a started server, nil if it is
+// disabled
+func (s *Server) HLSServer() *hls.Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.hlsServer
+}
+
+// RTMPAddr returns the address the RTMP server listens on
+func (s *Server) RTMPAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rtmpAddr
+}
+
+// HTTPFLVAddr returns the address the HTTP-FLV server listens on,
+// nil if it is disabled
+func (s *Server) HTTPFLVAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flvAddr
+}
+
+// HLSAddr returns the address the HLS server listens on,
+// nil if it is disabled
+func (s *Server) HLSAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.hlsAddr
+}
+
+// RTMPTAddr returns the address the RTMPT server listens on,
+// nil if it is disabled
+func (s *Server) RTMPTAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rtmptAddr
+}
+
+// APIAddr returns the address the API server listens on,
+// nil if it is disabled
+func (s *Server) APIAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.apiAddr
+}
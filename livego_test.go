@@ -0,0 +1,367 @@
+package livego
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer starts a server on local ports with the HTTP servers
+// disabled, then changed by configs
+func newTestServer(t *testing.T, opts Options, configs ...func(*configure.ServerCfg)) *Server {
+	dir, err := ioutil.TempDir("", "livego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Config = configure.DefaultConfig()
+	opts.Config.FLVDir = dir
+	opts.Config.RTMPAddr = "127.0.0.1:0"
+	opts.Config.HTTPFLVAddr = ""
+	opts.Config.HLSAddr = ""
+	opts.Config.APIAddr = ""
+	for _, config := range configs {
+		config(&opts.Config)
+	}
+
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func stopTestServer(s *Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Stop(ctx)
+	os.RemoveAll(s.Config().FLVDir)
+}
+
+func publish(s *Server, key string) (*core.ConnClient, error) {
+	c := core.NewConnClient()
+	url := fmt.Sprintf("rtmp://%s/live/%s", s.RTMPAddr(), key)
+	return c, c.Start(url, av.PUBLISH)
+}
+
+// waitEvent returns the next event of type typ about the stream key
+func waitEvent(t *testing.T, events <-chan configure.Event, typ, key string) configure.Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == typ && ev.Key == key {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no event %s of %s", typ, key)
+		}
+	}
+}
+
+func TestIndependentServers(t *testing.T) {
+	at := assert.New(t)
+
+	s1 := newTestServer(t, Options{})
+	defer stopTestServer(s1)
+	s2 := newTestServer(t, Options{})
+	defer stopTestServer(s2)
+	at.NotEqual(s1.RTMPAddr().String(), s2.RTMPAddr().String())
+
+	key, err := s1.Keys().GetKey("room")
+	at.Nil(err)
+	_, err = s2.Keys().GetChannel(key)
+	at.NotNil(err)
+
+	events1, cancel1 := s1.Events().Subscribe(16)
+	defer cancel1()
+	events2, cancel2 := s2.Events().Subscribe(16)
+	defer cancel2()
+
+	c, err := publish(s1, key)
+	at.Nil(err)
+	defer c.Close(nil)
+	waitEvent(t, events1, configure.EventPublishStart, "live/room")
+	at.False(s2.Streams().GetStreams().Has("live/room"))
+
+	c, err = publish(s2, key)
+	if err == nil {
+		defer c.Close(nil)
+	}
+	waitEvent(t, events2, configure.EventError, "live/"+key)
+	at.False(s2.Streams().HasPublisher("live/room"))
+}
+
+func TestHooksRejectPublisher(t *testing.T) {
+	at := assert.New(t)
+
+	published := make(chan av.Info, 1)
+	s := newTestServer(t, Options{
+		Hooks: rtmp.Hooks{
+			OnPublish: func(info av.Info) error {
+				published <- info
+				return fmt.Errorf("rejected")
+			},
+		},
+	})
+	defer stopTestServer(s)
+
+	events, cancel := s.Events().Subscribe(16)
+	defer cancel()
+
+	key, _ := s.Keys().GetKey("room")
+	c, err := publish(s, key)
+	if err == nil {
+		defer c.Close(nil)
+	}
+
+	ev := waitEvent(t, events, configure.EventError, "live/room")
+	at.Equal("rejected", ev.Data["error"])
+	info := <-published
+	at.Equal("live/room", info.Key)
+	at.False(s.Streams().HasPublisher("live/room"))
+}
+
+func TestReload(t *testing.T) {
+	at := assert.New(t)
+
+	s := newTestServer(t, Options{})
+	defer stopTestServer(s)
+
+	cfg := *s.Config()
+	cfg.GopNum = 0
+	at.NotNil(s.Reload(cfg))
+	at.Equal(1, s.Config().GopNum)
+
+	cfg.GopNum = 2
+	at.Nil(s.Reload(cfg))
+	at.Equal(2, s.Config().GopNum)
+}
+
+func play(s *Server, key string) (*core.ConnClient, error) {
+	c := core.NewConnClient()
+	url := fmt.Sprintf("rtmp://%s/live/%s", s.RTMPAddr(), key)
+	return c, c.Start(url, av.PLAY)
+}
+
+// dialProxy connects to the RTMP server and sends the PROXY protocol header
+func dialProxy(s *Server, header []byte) (net.Conn, error) {
+	conn, err := net.Dial("tcp", s.RTMPAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	at := assert.New(t)
+
+	s := newTestServer(t, Options{}, func(cfg *configure.ServerCfg) {
+		cfg.ProxyProtocol.RTMP = []string{"127.0.0.0/8"}
+		cfg.Server[0].PublishACL.Allow = []string{"203.0.113.0/24"}
+	})
+	defer stopTestServer(s)
+	access := s.conf.Access()
+	events, cancel := s.Events().Subscribe(16)
+	defer cancel()
+
+	key, _ := s.Keys().GetKey("room")
+	url := fmt.Sprintf("rtmp://%s/live/%s", s.RTMPAddr(), key)
+
+	conn, err := dialProxy(s, []byte("PROXY TCP4 203.0.113.5 127.0.0.1 5000 1935\r\n"))
+	at.Nil(err)
+	c := core.NewConnClient()
+	at.Nil(c.StartConn(conn, url, av.PUBLISH))
+	defer c.Close(nil)
+	waitEvent(t, events, configure.EventPublishStart, "live/room")
+
+	// version 2 from 198.51.100.1:5000 to 127.0.0.1:1935
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 198, 51, 100, 1, 127, 0, 0, 1, 0x13, 0x88, 0x07, 0x8f)
+	conn, err = dialProxy(s, v2)
+	at.Nil(err)
+	key, _ = s.Keys().GetKey("other")
+	c = core.NewConnClient()
+	if err := c.StartConn(conn, fmt.Sprintf("rtmp://%s/live/%s", s.RTMPAddr(), key), av.PUBLISH); err == nil {
+		c.Close(nil)
+	}
+	ev := waitEvent(t, events, configure.EventError, "live/"+key)
+	at.Equal("198.51.100.1:5000", ev.Data["remote_addr"])
+	at.False(s.Streams().HasPublisher("live/other"))
+	at.Equal(uint64(1), access.Stats().Denied[configure.DenyPublish])
+
+	// trusted sources must send a header
+	conn, err = net.Dial("tcp", s.RTMPAddr().String())
+	at.Nil(err)
+	c = core.NewConnClient()
+	at.NotNil(c.StartConn(conn, url, av.PUBLISH))
+	conn.Close()
+}
+
+// sendH264 publishes an H.264 sequence header and frames of 40ms, with a
+// key frame every 25 frames
+func sendH264(c *core.ConnClient, done chan struct{}) {
+	seq := []byte{0x17, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0x00, 0x04, 0x67, 0x42, 0xc0, 0x1e,
+		0x01, 0x00, 0x04, 0x68, 0xce, 0x3c, 0x80}
+	c.Write(core.ChunkStream{CSID: 6, TypeID: av.TagVideo, StreamID: c.StreamID(), Length: uint32(len(seq)), Data: seq})
+	key := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x65, 0x88}
+	inter := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x41, 0x9a}
+	for i := uint32(0); ; i++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(2 * time.Millisecond):
+		}
+		data := inter
+		if i%25 == 0 {
+			data = key
+		}
+		c.Write(core.ChunkStream{CSID: 6, TypeID: av.TagVideo, StreamID: c.StreamID(), Timestamp: 40 * i, Length: uint32(len(data)), Data: data})
+		c.Flush()
+	}
+}
+
+// getAPI decodes the data of the API response to uri, it returns the
+// status of the response
+func getAPI(s *Server, uri string, data interface{}) (int, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", s.APIAddr(), uri))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(&struct {
+		Data interface{} `json:"data"`
+	}{data})
+}
+
+func TestEvents(t *testing.T) {
+	at := assert.New(t)
+
+	s := newTestServer(t, Options{}, func(cfg *configure.ServerCfg) {
+		cfg.APIAddr = "127.0.0.1:0"
+	})
+	defer stopTestServer(s)
+
+	types := "publish_start,publish_stop,player_join,player_leave,codec_change,error"
+	resp, err := http.Get(fmt.Sprintf("http://%s/stat/events?app=live&type=%s", s.APIAddr(), types))
+	if !at.Nil(err) {
+		return
+	}
+	defer resp.Body.Close()
+	at.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	events := make(chan configure.Event, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				var ev configure.Event
+				json.Unmarshal([]byte(data), &ev)
+				events <- ev
+			}
+		}
+	}()
+	// the subscription is made before the response starts
+	at.Equal(1, s.Events().Subscribers())
+	next := func() configure.Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(3 * time.Second):
+			return configure.Event{}
+		}
+	}
+
+	key, _ := s.Keys().GetKey("room")
+	c, err := publish(s, key)
+	if !at.Nil(err) {
+		return
+	}
+	ev := next()
+	at.Equal(configure.EventPublishStart, ev.Type)
+	at.Equal("live/room", ev.Key)
+	at.Equal("rtmp", ev.Data["protocol"])
+
+	done := make(chan struct{})
+	go sendH264(c, done)
+	ev = next()
+	at.Equal(configure.EventCodecChange, ev.Type)
+	at.Equal("H264", ev.Data["video_codec"])
+
+	p, err := play(s, "room")
+	if !at.Nil(err) {
+		close(done)
+		c.Close(nil)
+		return
+	}
+	defer p.Close(nil)
+	join := next()
+	at.Equal(configure.EventPlayerJoin, join.Type)
+	//the deprecated livestat serves the v1 stats
+	for _, uri := range []string{"/stat/v1/streams", "/stat/livestat"} {
+		var stats struct {
+			Version int                `json:"version"`
+			Streams []rtmp.StreamStats `json:"streams"`
+		}
+		status, _ := getAPI(s, uri, &stats)
+		at.Equal(http.StatusOK, status)
+		at.Equal(1, stats.Version)
+		if at.Len(stats.Streams, 1, uri) && at.Len(stats.Streams[0].Players, 1, uri) {
+			at.Equal("live/room", stats.Streams[0].Key)
+			at.Equal(join.Data["id"], stats.Streams[0].Players[0].ID)
+		}
+	}
+	var data interface{}
+	status, _ := getAPI(s, fmt.Sprintf("/control/kick?id=%v&ban=60", join.Data["id"]), &data)
+	at.Equal(http.StatusOK, status)
+	ev = next()
+	at.Equal(configure.EventPlayerLeave, ev.Type)
+	at.Equal(join.Data["id"], ev.Data["id"])
+	at.Equal("kicked", ev.Data["reason"])
+	var access configure.AccessStats
+	getAPI(s, "/stat/access", &access)
+	if at.Len(access.Bans, 1) {
+		at.Equal(configure.BanIP, access.Bans[0].Kind)
+		at.Equal("127.0.0.1", access.Bans[0].Target)
+	}
+	status, _ = getAPI(s, "/control/unban?kind=key&target=127.0.0.1", &data)
+	at.Equal(http.StatusNotFound, status)
+	status, _ = getAPI(s, "/control/unban?kind=ip&target=127.0.0.1", &data)
+	at.Equal(http.StatusOK, status)
+
+	c2, err := publish(s, "wrong")
+	if err == nil {
+		c2.Close(nil)
+	}
+	ev = next()
+	at.Equal(configure.EventError, ev.Type)
+	at.Equal("live/wrong", ev.Key)
+
+	close(done)
+	c.Close(nil)
+	ev = next()
+	at.Equal(configure.EventPublishStop, ev.Type)
+	at.Equal("live/room", ev.Key)
+	at.True(ev.ID > join.ID)
+}
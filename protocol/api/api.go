@@ -1,18 +1,25 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/hls"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
 	"github.com/gwuhaolin/livego/protocol/rtmp/rtmprelay"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
+	cmap "github.com/orcaman/concurrent-map"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -52,34 +59,50 @@ func (r *Response) SendJSON() (int, error) {
 
 // Server serve the http api
 type Server struct {
-	handler  av.Handler
-	session  map[string]*rtmprelay.RtmpRelay
-	rtmpAddr string
+	handler    av.Handler
+	session    cmap.ConcurrentMap
+	rtmpServer *rtmp.Server
+	hlsServer  *hls.Server
+	rtmpAddr   string
+	conf       *configure.Store
+	keys       configure.KeyStore
+	log        *log.Logger
+	httpServer *http.Server
+	done       chan struct{}
+	closeOnce  sync.Once
 }
 
-// NewServer return a new Server
-func NewServer(h av.Handler, rtmpAddr string) *Server {
+// NewServer return a new Server, rtmpServer listens on rtmpAddr and
+// hlsServer is nil if HLS is disabled
+func NewServer(h av.Handler, rtmpServer *rtmp.Server, hlsServer *hls.Server, rtmpAddr string, conf *configure.Store, keys configure.KeyStore) *Server {
 	return &Server{
-		handler:  h,
-		session:  make(map[string]*rtmprelay.RtmpRelay),
-		rtmpAddr: rtmpAddr,
+		handler:    h,
+		session:    cmap.New(),
+		rtmpServer: rtmpServer,
+		hlsServer:  hlsServer,
+		rtmpAddr:   rtmpAddr,
+		conf:       conf,
+		keys:       keys,
+		log:        conf.Logger(),
+		httpServer: &http.Server{},
+		done:       make(chan struct{}),
 	}
 }
 
 // JWTMiddleware is a jwt middleware
 // If jwt.secret is specified in config, this middleware will be activated.
-func JWTMiddleware(next http.Handler) http.Handler {
-	isJWT := len(configure.Config.GetString("jwt.secret")) > 0
-	if !isJWT {
-		return next
-	}
-
-	log.Info("Using JWT middleware")
-
+// The settings are read on every request, so they can be changed by reload.
+func JWTMiddleware(conf *configure.Store, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwtCfg := conf.Current().JWT
+		if len(jwtCfg.Secret) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		var algorithm jwt.SigningMethod
-		if len(configure.Config.GetString("jwt.algorithm")) > 0 {
-			algorithm = jwt.GetSigningMethod(configure.Config.GetString("jwt.algorithm"))
+		if len(jwtCfg.Algorithm) > 0 {
+			algorithm = jwt.GetSigningMethod(jwtCfg.Algorithm)
 		}
 
 		if algorithm == nil {
@@ -89,7 +112,7 @@ func JWTMiddleware(next http.Handler) http.Handler {
 		jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
 			Extractor: jwtmiddleware.FromFirst(jwtmiddleware.FromAuthHeader, jwtmiddleware.FromParameter("jwt")),
 			ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-				return []byte(configure.Config.GetString("jwt.secret")), nil
+				return []byte(jwtCfg.Secret), nil
 			},
 			SigningMethod: algorithm,
 			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err string) {
@@ -118,28 +141,60 @@ func (s *Server) Serve(l net.Listener) error {
 	mux.HandleFunc("/control/get", s.handleGet)
 	mux.HandleFunc("/control/reset", s.handleReset)
 	mux.HandleFunc("/control/delete", s.handleDelete)
-	mux.HandleFunc("/stat/livestat", s.getLiveStatics)
-	http.Serve(l, JWTMiddleware(mux))
+	mux.HandleFunc("/control/reload", s.handleReload)
+	mux.HandleFunc("/control/token", s.handleToken)
+	mux.HandleFunc("/control/viewers", s.handleViewers)
+	mux.HandleFunc("/control/kick", s.handleKick)
+	mux.HandleFunc("/control/unban", s.handleUnban)
+	// deprecated alias of /stat/v1/streams
+	mux.HandleFunc("/stat/livestat", s.getStreamStats)
+	mux.HandleFunc("/stat/v1/streams", s.getStreamStats)
+	mux.HandleFunc("/stat/staticpush", s.getStaticPushes)
+	mux.HandleFunc("/stat/relay", s.getRelays)
+	mux.HandleFunc("/stat/handshake", s.getHandshakes)
+	mux.HandleFunc("/stat/access", s.getAccess)
+	mux.HandleFunc("/stat/egress", s.getEgress)
+	mux.HandleFunc("/stat/hls", s.getHLS)
+	mux.HandleFunc("/stat/events", s.getEvents)
+	if len(s.conf.Current().JWT.Secret) > 0 {
+		s.log.Info("Using JWT middleware")
+	}
+	s.httpServer.Handler = JWTMiddleware(s.conf, mux)
+	if err := s.httpServer.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
 	return nil
 }
 
-type stream struct {
-	Key             string `json:"key"`
-	URL             string `json:"url"`
-	StreamID        uint32 `json:"stream_id"`
-	VideoTotalBytes uint64 `json:"video_total_bytes"`
-	VideoSpeed      uint64 `json:"video_speed"`
-	AudioTotalBytes uint64 `json:"audio_total_bytes"`
-	AudioSpeed      uint64 `json:"audio_speed"`
+// Shutdown stops serving api requests, ends the event streams and stops
+// all relays
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	err := s.httpServer.Shutdown(ctx)
+	for item := range s.session.IterBuffered() {
+		s.log.Debugf("rtmprelay stop %s on shutdown", item.Key)
+		item.Val.(*rtmprelay.RtmpRelay).Stop()
+		s.session.Remove(item.Key)
+	}
+	return err
 }
 
-type streams struct {
-	Publishers []stream `json:"publishers"`
-	Players    []stream `json:"players"`
+// statsVersion is the version of the stats of /stat/v1/streams
+const statsVersion = 1
+
+type streamStats struct {
+	Version int                `json:"version"`
+	Streams []rtmp.StreamStats `json:"streams"`
 }
 
-// getLiveStatics get the static of this live
-func (s *Server) getLiveStatics(w http.ResponseWriter, req *http.Request) {
+// getStreamStats returns the streams with the statistics of their
+// publisher, their RTMP, HTTP-FLV and HLS players and their outputs,
+// filtered by app and name
+// url schema like this:
+//  http://127.0.0.1:8090/stat/v1/streams?app=live&name=ROOM_NAME
+func (s *Server) getStreamStats(w http.ResponseWriter, req *http.Request) {
 	res := &Response{
 		w:      w,
 		Data:   nil,
@@ -148,61 +203,249 @@ func (s *Server) getLiveStatics(w http.ResponseWriter, req *http.Request) {
 
 	defer res.SendJSON()
 
-	rtmpStream := s.handler.(*rtmp.Streams)
-	if rtmpStream == nil {
+	rtmpStream, ok := s.handler.(*rtmp.Streams)
+	if !ok {
 		res.Status = 500
 		res.Data = "Get rtmp stream information error"
 		return
 	}
 
-	msgs := new(streams)
-	for item := range rtmpStream.GetStreams().IterBuffered() {
-		if s, ok := item.Val.(*rtmp.Stream); ok {
-			if s.Reader() != nil {
-				switch s.Reader().(type) {
-				case *rtmp.VirReader:
-					v := s.Reader().(*rtmp.VirReader)
-					msg := stream{
-						Key:             item.Key,
-						URL:             v.Info().URL,
-						StreamID:        v.ReadBWInfo.StreamID,
-						VideoTotalBytes: v.ReadBWInfo.VideoDatainBytes,
-						VideoSpeed:      v.ReadBWInfo.VideoSpeedInBytesperMS,
-						AudioTotalBytes: v.ReadBWInfo.AudioDatainBytes,
-						AudioSpeed:      v.ReadBWInfo.AudioSpeedInBytesperMS,
-					}
-					msgs.Publishers = append(msgs.Publishers, msg)
-				}
+	query := req.URL.Query()
+	stats := rtmpStream.Stats(query.Get("app"), query.Get("name"))
+	if s.hlsServer != nil {
+		sessions := make(map[string][]hls.Session)
+		for _, session := range s.hlsServer.Stats().Sessions {
+			sessions[session.Key] = append(sessions[session.Key], session)
+		}
+		for i := range stats {
+			var video, audio string
+			if v, ok := rtmpStream.GetStreams().Get(stats[i].Key); ok {
+				video, audio = v.(*rtmp.Stream).Codecs()
+			}
+			for _, session := range sessions[stats[i].Key] {
+				stats[i].Players = append(stats[i].Players, rtmp.ConnStats{
+					ID:    session.ID,
+					URL:   "/" + session.Key + ".m3u8",
+					Stats: session.Stats(),
+					Video: video,
+					Audio: audio,
+				})
 			}
 		}
 	}
+	res.Data = streamStats{Version: statsVersion, Streams: stats}
+}
+
+// getStaticPushes lists the static pushes with their state and retry count
+// url schema like this:
+//  http://127.0.0.1:8090/stat/staticpush
+func (s *Server) getStaticPushes(w http.ResponseWriter, req *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
 
-	for item := range rtmpStream.GetStreams().IterBuffered() {
-		ws := item.Val.(*rtmp.Stream).Ws()
-		for s := range ws.IterBuffered() {
-			if pw, ok := s.Val.(*rtmp.PackWriterCloser); ok {
-				if pw.Writer() != nil {
-					switch pw.Writer().(type) {
-					case *rtmp.VirWriter:
-						v := pw.Writer().(*rtmp.VirWriter)
-						msg := stream{
-							Key:             item.Key,
-							URL:             v.Info().URL,
-							StreamID:        v.WriteBWInfo.StreamID,
-							VideoTotalBytes: v.WriteBWInfo.VideoDatainBytes,
-							VideoSpeed:      v.WriteBWInfo.VideoSpeedInBytesperMS,
-							AudioTotalBytes: v.WriteBWInfo.AudioDatainBytes,
-							AudioSpeed:      v.WriteBWInfo.AudioSpeedInBytesperMS,
-						}
-						msgs.Players = append(msgs.Players, msg)
-					}
-				}
+	defer res.SendJSON()
+
+	rtmpStream, ok := s.handler.(*rtmp.Streams)
+	if !ok {
+		res.Status = 500
+		res.Data = "Get rtmp stream information error"
+		return
+	}
+
+	res.Data = rtmpStream.StaticPushes().List()
+}
+
+// relay is the state of a relay started by /control/pull or /control/push
+type relay struct {
+	Key string `json:"key"`
+	rtmprelay.RtmpRelayStatus
+}
+
+// getRelays lists the relays with their state, bytes relayed and uptime
+// url schema like this:
+//  http://127.0.0.1:8090/stat/relay
+func (s *Server) getRelays(w http.ResponseWriter, req *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+
+	defer res.SendJSON()
+
+	relays := make([]relay, 0, s.session.Count())
+	for item := range s.session.IterBuffered() {
+		relays = append(relays, relay{
+			Key:             item.Key,
+			RtmpRelayStatus: item.Val.(*rtmprelay.RtmpRelay).Status(),
+		})
+	}
+	res.Data = relays
+}
+
+// getHandshakes returns the RTMP handshake counters by kind and the
+// failed handshakes by reason
+// url schema like this:
+//  http://127.0.0.1:8090/stat/handshake
+func (s *Server) getHandshakes(w http.ResponseWriter, req *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+
+	defer res.SendJSON()
+
+	res.Data = s.rtmpServer.Handshakes()
+}
+
+// getEgress returns the bitrate sent to the players and the video packets
+// and players dropped because of max_egress
+// url schema like this:
+//  http://127.0.0.1:8090/stat/egress
+func (s *Server) getEgress(w http.ResponseWriter, req *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+
+	defer res.SendJSON()
+
+	rtmpStream, ok := s.handler.(*rtmp.Streams)
+	if !ok {
+		res.Status = 500
+		res.Data = "Get rtmp stream information error"
+		return
+	}
+
+	res.Data = rtmpStream.Egress()
+}
+
+// getHLS returns the HLS sessions with their bytes, playlists and segments
+// served, and the totals of all sessions
+// url schema like this:
+//  http://127.0.0.1:8090/stat/hls
+func (s *Server) getHLS(w http.ResponseWriter, req *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+
+	defer res.SendJSON()
+
+	if s.hlsServer == nil {
+		res.Status = 404
+		res.Data = "HLS is disabled"
+		return
+	}
+
+	res.Data = s.hlsServer.Stats()
+}
+
+const (
+	// eventBuffer is the number of events buffered for a slow subscriber
+	// before it misses events
+	eventBuffer = 256
+	// eventKeepalive is the interval of the comments keeping an idle
+	// event stream open through proxies
+	eventKeepalive = 15 * time.Second
+)
+
+// matchEvent returns if ev is about the stream app/name and of one of types,
+// empty filters match every event
+func matchEvent(ev configure.Event, app, name string, types map[string]bool) bool {
+	if len(types) > 0 && !types[ev.Type] {
+		return false
+	}
+	if app == "" && name == "" {
+		return true
+	}
+	paths := strings.SplitN(ev.Key, "/", 2)
+	if len(paths) != 2 {
+		return false
+	}
+	return (app == "" || paths[0] == app) && (name == "" || paths[1] == name)
+}
+
+// getEvents streams the events of the server as server-sent events, each
+// one is named by its type and carries the event as json. The events can
+// be filtered by app, name and a comma separated list of types.
+// url schema like this:
+//  http://127.0.0.1:8090/stat/events?app=live&type=publish_start,publish_stop
+func (s *Server) getEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		res := &Response{
+			w:      w,
+			Data:   "streaming is not supported",
+			Status: 500,
+		}
+		res.SendJSON()
+		return
+	}
+
+	req.ParseForm()
+	app, name := req.Form.Get("app"), req.Form.Get("name")
+	types := make(map[string]bool)
+	for _, t := range strings.Split(req.Form.Get("type"), ",") {
+		if t != "" {
+			types[t] = true
+		}
+	}
+
+	events, cancel := s.conf.Events().Subscribe(eventBuffer)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepalive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-events:
+			if !matchEvent(ev, app, name, types) {
+				continue
 			}
+			data, _ := json.Marshal(ev)
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
 		}
+		if err != nil {
+			s.log.Debug("event stream closed: ", err)
+			return
+		}
+		flusher.Flush()
 	}
+}
 
-	resp, _ := json.Marshal(msgs)
-	res.Data = resp
+// getAccess returns the open connections and the clients denied by the
+// connection limits and ACLs, by reason
+// url schema like this:
+//  http://127.0.0.1:8090/stat/access
+func (s *Server) getAccess(w http.ResponseWriter, req *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+
+	defer res.SendJSON()
+
+	res.Data = s.conf.Access().Stats()
 }
 
 // handlePull pull a rtmp stream to a application
@@ -231,7 +474,7 @@ func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
 	name := req.Form.Get("name")
 	url := req.Form.Get("url")
 
-	log.Debugf("control pull: oper=%v, app=%v, name=%v, url=%v", oper, app, name, url)
+	s.log.Debugf("control pull: oper=%v, app=%v, name=%v, url=%v", oper, app, name, url)
 	if (len(app) <= 0) || (len(name) <= 0) || (len(url) <= 0) {
 		res.Status = 400
 		res.Data = "control push parameter error, please check them."
@@ -243,7 +486,7 @@ func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
 
 	keyString := "pull:" + app + "/" + name
 	if oper == "stop" {
-		pullRtmprelay, found := s.session[keyString]
+		item, found := s.session.Get(keyString)
 
 		if !found {
 			retString = fmt.Sprintf("session key[%s] not exist, please check it again.", keyString)
@@ -251,27 +494,36 @@ func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
 			res.Data = retString
 			return
 		}
-		log.Debugf("rtmprelay stop push %s from %s", remoteurl, localurl)
-		pullRtmprelay.Stop()
+		s.log.Debugf("rtmprelay stop push %s from %s", remoteurl, localurl)
+		item.(*rtmprelay.RtmpRelay).Stop()
 
-		delete(s.session, keyString)
+		s.session.Remove(keyString)
 		retString = fmt.Sprintf("<h1>push url stop %s ok</h1></br>", url)
 		res.Status = 400
 		res.Data = retString
-		log.Debugf("pull stop return %s", retString)
+		s.log.Debugf("pull stop return %s", retString)
 	} else {
+		if s.session.Has(keyString) {
+			res.Status = 400
+			res.Data = fmt.Sprintf("session key[%s] already exists, stop it first.", keyString)
+			return
+		}
 		pullRtmprelay := rtmprelay.NewRtmpRelay(&localurl, &remoteurl)
-		log.Debugf("rtmprelay start push %s from %s", remoteurl, localurl)
+		pullRtmprelay.SetEvents(s.conf.Events())
+		pullRtmprelay.SetLogger(s.log)
+		s.log.Debugf("rtmprelay start push %s from %s", remoteurl, localurl)
 		err = pullRtmprelay.Start()
 		if err != nil {
 			retString = fmt.Sprintf("push error=%v", err)
+		} else if !s.session.SetIfAbsent(keyString, pullRtmprelay) {
+			pullRtmprelay.Stop()
+			retString = fmt.Sprintf("session key[%s] already exists, stop it first.", keyString)
 		} else {
-			s.session[keyString] = pullRtmprelay
 			retString = fmt.Sprintf("<h1>push url start %s ok</h1></br>", url)
 		}
 		res.Status = 400
 		res.Data = retString
-		log.Debugf("pull start return %s", retString)
+		s.log.Debugf("pull start return %s", retString)
 	}
 }
 
@@ -300,7 +552,7 @@ func (s *Server) handlePush(w http.ResponseWriter, req *http.Request) {
 	name := req.Form.Get("name")
 	url := req.Form.Get("url")
 
-	log.Debugf("control push: oper=%v, app=%v, name=%v, url=%v", oper, app, name, url)
+	s.log.Debugf("control push: oper=%v, app=%v, name=%v, url=%v", oper, app, name, url)
 	if (len(app) <= 0) || (len(name) <= 0) || (len(url) <= 0) {
 		res.Data = "control push parameter error, please check them."
 		return
@@ -311,32 +563,40 @@ func (s *Server) handlePush(w http.ResponseWriter, req *http.Request) {
 
 	keyString := "push:" + app + "/" + name
 	if oper == "stop" {
-		pushRtmprelay, found := s.session[keyString]
+		item, found := s.session.Get(keyString)
 		if !found {
 			retString = fmt.Sprintf("<h1>session key[%s] not exist, please check it again.</h1>", keyString)
 			res.Data = retString
 			return
 		}
-		log.Debugf("rtmprelay stop push %s from %s", remoteurl, localurl)
-		pushRtmprelay.Stop()
+		s.log.Debugf("rtmprelay stop push %s from %s", remoteurl, localurl)
+		item.(*rtmprelay.RtmpRelay).Stop()
 
-		delete(s.session, keyString)
+		s.session.Remove(keyString)
 		retString = fmt.Sprintf("<h1>push url stop %s ok</h1></br>", url)
 		res.Data = retString
-		log.Debugf("push stop return %s", retString)
+		s.log.Debugf("push stop return %s", retString)
 	} else {
+		if s.session.Has(keyString) {
+			res.Data = fmt.Sprintf("session key[%s] already exists, stop it first.", keyString)
+			return
+		}
 		pushRtmprelay := rtmprelay.NewRtmpRelay(&localurl, &remoteurl)
-		log.Debugf("rtmprelay start push %s from %s", remoteurl, localurl)
+		pushRtmprelay.SetEvents(s.conf.Events())
+		pushRtmprelay.SetLogger(s.log)
+		s.log.Debugf("rtmprelay start push %s from %s", remoteurl, localurl)
 		err = pushRtmprelay.Start()
 		if err != nil {
 			retString = fmt.Sprintf("push error=%v", err)
+		} else if !s.session.SetIfAbsent(keyString, pushRtmprelay) {
+			pushRtmprelay.Stop()
+			retString = fmt.Sprintf("session key[%s] already exists, stop it first.", keyString)
 		} else {
 			retString = fmt.Sprintf("<h1>push url start %s ok</h1></br>", url)
-			s.session[keyString] = pushRtmprelay
 		}
 
 		res.Data = retString
-		log.Debugf("push start return %s", retString)
+		s.log.Debugf("push start return %s", retString)
 	}
 }
 
@@ -364,7 +624,7 @@ func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg, err := configure.RoomKeys.SetKey(room)
+	msg, err := s.keys.SetKey(room)
 
 	if err != nil {
 		msg = err.Error()
@@ -399,7 +659,7 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg, err := configure.RoomKeys.GetKey(room)
+	msg, err := s.keys.GetKey(room)
 	if err != nil {
 		msg = err.Error()
 		res.Status = 400
@@ -432,10 +692,253 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if configure.RoomKeys.DeleteChannel(room) {
+	if s.keys.DeleteChannel(room) {
 		res.Data = "Ok"
 		return
 	}
 	res.Status = 404
 	res.Data = "room not found"
 }
+
+// handleReload reloads the configuration file
+// the url schema like:
+//  http://127.0.0.1:8090/control/reload
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJSON()
+
+	if _, err := s.conf.Reload(); err != nil {
+		s.log.Warning("reload configuration error: ", err)
+		res.Status = 400
+		res.Data = err.Error()
+		return
+	}
+	res.Data = "Ok"
+}
+
+// handleViewers returns the viewers and the viewer limit of a stream, or
+// of an application without name. max sets the limit until the server
+// stops, 0 for no limit and -1 to restore the configured limit.
+// the url schema like:
+//  http://127.0.0.1:8090/control/viewers?app=live&name=ROOM_NAME&max=100
+func (s *Server) handleViewers(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJSON()
+
+	const usage = "url: /control/viewers?app=<APP>[&name=<ROOM_NAME>][&max=<VIEWERS>]"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	app := r.Form.Get("app")
+	if app == "" {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	key := app
+	if name := r.Form.Get("name"); name != "" {
+		key = app + "/" + name
+	}
+
+	rtmpStream, ok := s.handler.(*rtmp.Streams)
+	if !ok {
+		res.Status = 500
+		res.Data = "Get rtmp stream information error"
+		return
+	}
+	if v := r.Form.Get("max"); v != "" {
+		max, err := strconv.Atoi(v)
+		if err != nil {
+			res.Status = 400
+			res.Data = usage
+			return
+		}
+		rtmpStream.SetViewerLimit(key, max)
+		s.log.Infof("viewer limit of %s set to %d", key, max)
+	}
+	res.Data = rtmpStream.ViewerLimit(key)
+}
+
+// kicked is a client disconnected by /control/kick and its ban
+type kicked struct {
+	Addr string         `json:"addr"`
+	Ban  *configure.Ban `json:"ban"`
+}
+
+// handleKick disconnects the publisher of a stream, or a RTMP or HTTP-FLV
+// player or HLS session by its id. ban refuses the stream key of the
+// publisher, or the address of the player, for ban seconds.
+// the url schema like:
+//  http://127.0.0.1:8090/control/kick?app=live&name=ROOM_NAME&ban=600
+//  http://127.0.0.1:8090/control/kick?id=PLAYER_ID&ban=600
+func (s *Server) handleKick(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJSON()
+
+	const usage = "url: /control/kick?app=<APP>&name=<ROOM_NAME>|id=<PLAYER_ID>[&ban=<SECONDS>]"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	app, name, id := r.Form.Get("app"), r.Form.Get("name"), r.Form.Get("id")
+	if (id == "") == (app == "" || name == "") {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	var ban int
+	if v := r.Form.Get("ban"); v != "" {
+		var err error
+		if ban, err = strconv.Atoi(v); err != nil || ban < 0 {
+			res.Status = 400
+			res.Data = usage
+			return
+		}
+	}
+
+	rtmpStream, ok := s.handler.(*rtmp.Streams)
+	if !ok {
+		res.Status = 500
+		res.Data = "Get rtmp stream information error"
+		return
+	}
+	var addr, target string
+	var err error
+	kind := configure.BanIP
+	if id == "" {
+		target, kind = app+"/"+name, configure.BanKey
+		addr, err = rtmpStream.KickPublisher(target)
+	} else {
+		addr, err = rtmpStream.KickPlayer(id)
+		if err != nil && s.hlsServer != nil {
+			if hlsAddr, hlsErr := s.hlsServer.Kick(id); hlsErr == nil {
+				addr, err = hlsAddr, nil
+			}
+		}
+		target = addr
+		if host, _, splitErr := net.SplitHostPort(addr); splitErr == nil {
+			target = host
+		}
+	}
+	if err != nil {
+		res.Status = 404
+		res.Data = err.Error()
+		return
+	}
+
+	ret := kicked{Addr: addr}
+	if ban > 0 && target != "" {
+		d := time.Duration(ban) * time.Second
+		b := s.conf.Access().Ban(kind, target, d)
+		ret.Ban = &b
+		s.log.Infof("%s banned for %v", target, d)
+	}
+	res.Data = ret
+}
+
+// handleUnban lifts the ban of a client address, kind ip, or of a stream
+// key, kind key, the bans are listed by /stat/access
+// the url schema like:
+//  http://127.0.0.1:8090/control/unban?kind=key&target=live/ROOM_NAME
+func (s *Server) handleUnban(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJSON()
+
+	const usage = "url: /control/unban?kind=ip&target=<ADDRESS>|kind=key&target=<APP>/<ROOM_NAME>"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	kind, target := r.Form.Get("kind"), r.Form.Get("target")
+	if target == "" || (kind != configure.BanIP && kind != configure.BanKey) {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	if !s.conf.Access().Unban(kind, target) {
+		res.Status = 404
+		res.Data = fmt.Sprintf("%s is not banned", target)
+		return
+	}
+	s.log.Infof("%s unbanned", target)
+	res.Data = "ok"
+}
+
+// token is a signed token with the query carrying it
+type token struct {
+	Token  string `json:"token"`
+	Expire int64  `json:"expire"`
+	Query  string `json:"query"`
+}
+
+// handleToken signs a token allowing to publish or play a stream for ttl
+// seconds, from ip only if it is given
+// the url schema like:
+//  http://127.0.0.1:8090/control/token?app=live&name=ROOM_NAME&action=play&ttl=3600&ip=IP
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJSON()
+
+	const usage = "url: /control/token?app=<APP>&name=<ROOM_NAME>&action=<publish|play>[&ttl=<SECONDS>][&ip=<IP>]"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+
+	app := r.Form.Get("app")
+	name := r.Form.Get("name")
+	action := r.Form.Get("action")
+	if app == "" || name == "" || (action != configure.TokenPublish && action != configure.TokenPlay) {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	ttl := int64(3600)
+	if v := r.Form.Get("ttl"); v != "" {
+		var err error
+		if ttl, err = strconv.ParseInt(v, 10, 64); err != nil || ttl <= 0 {
+			res.Status = 400
+			res.Data = usage
+			return
+		}
+	}
+
+	secret := s.conf.Current().Token.Secret
+	if secret == "" {
+		res.Status = 400
+		res.Data = "token.secret is not configured"
+		return
+	}
+	expire := time.Now().Unix() + ttl
+	t := configure.SignToken(secret, action, app, name, expire, r.Form.Get("ip"))
+	res.Data = token{
+		Token:  t,
+		Expire: expire,
+		Query:  configure.TokenQuery(t, expire).Encode(),
+	}
+}
@@ -18,11 +18,15 @@ var (
 
 // TSCacheItem is the ts cache item
 type TSCacheItem struct {
-	id   string
-	num  int
-	lock sync.RWMutex
-	ll   *list.List
-	lm   map[string]TSItem
+	id    string
+	num   int
+	ended bool
+	lock  sync.RWMutex
+	ll    *list.List
+	lm    map[string]TSItem
+
+	// discontinuitySeq counts the discontinuities removed from the playlist
+	discontinuitySeq int
 }
 
 // NewTSCacheItem returns a TSCacheItem
@@ -40,9 +44,15 @@ func (tsCacheItem *TSCacheItem) ID() string {
 	return tsCacheItem.id
 }
 
-// GenM3U8PlayList generates m3u8 playlist
-// TODO: found data race, fix it
-func (tsCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
+// GenM3U8PlayList generates m3u8 playlist, query is added to the segment
+// urls if it is not empty
+func (tsCacheItem *TSCacheItem) GenM3U8PlayList(query string) ([]byte, error) {
+	if query != "" {
+		query = "?" + query
+	}
+	tsCacheItem.lock.RLock()
+	defer tsCacheItem.lock.RUnlock()
+
 	var seq int
 	var getSeq bool
 	var maxDuration int
@@ -58,23 +68,45 @@ func (tsCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
 				getSeq = true
 				seq = v.SeqNum
 			}
-			fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
+			if v.Discontinuity {
+				m3u8body.WriteString("#EXT-X-DISCONTINUITY\n")
+			}
+			fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s%s\n", float64(v.Duration)/float64(1000), v.Name, query)
 		}
 	}
 	w := bytes.NewBuffer(nil)
 	fmt.Fprintf(w,
 		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
 		maxDuration/1000+1, seq)
+	if tsCacheItem.discontinuitySeq > 0 {
+		fmt.Fprintf(w, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", tsCacheItem.discontinuitySeq)
+	}
 	w.Write(m3u8body.Bytes())
+	if tsCacheItem.ended {
+		w.WriteString("#EXT-X-ENDLIST\n")
+	}
 	return w.Bytes(), nil
 }
 
+// End marks the playlist as complete, no more segments will be added
+func (tsCacheItem *TSCacheItem) End() {
+	tsCacheItem.lock.Lock()
+	tsCacheItem.ended = true
+	tsCacheItem.lock.Unlock()
+}
+
 // SetItem set item with key
 func (tsCacheItem *TSCacheItem) SetItem(key string, item TSItem) {
+	tsCacheItem.lock.Lock()
+	defer tsCacheItem.lock.Unlock()
+
 	if tsCacheItem.ll.Len() == tsCacheItem.num {
 		e := tsCacheItem.ll.Front()
 		tsCacheItem.ll.Remove(e)
 		k := e.Value.(string)
+		if tsCacheItem.lm[k].Discontinuity {
+			tsCacheItem.discontinuitySeq++
+		}
 		delete(tsCacheItem.lm, k)
 	}
 	tsCacheItem.lm[key] = item
@@ -83,6 +115,9 @@ func (tsCacheItem *TSCacheItem) SetItem(key string, item TSItem) {
 
 // GetItem get item by key
 func (tsCacheItem *TSCacheItem) GetItem(key string) (TSItem, error) {
+	tsCacheItem.lock.RLock()
+	defer tsCacheItem.lock.RUnlock()
+
 	item, ok := tsCacheItem.lm[key]
 	if !ok {
 		return item, ErrNoKey
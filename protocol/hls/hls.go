@@ -1,12 +1,14 @@
 package hls
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/configure"
@@ -41,14 +43,28 @@ var crossdomainxml = []byte(
 
 // Server is a HLS server
 type Server struct {
-	listener net.Listener
-	conns    cmap.ConcurrentMap
+	listener   net.Listener
+	httpServer *http.Server
+	conns      cmap.ConcurrentMap
+	conf       *configure.Store
+	log        *log.Logger
+	done       chan struct{}
+	closeOnce  sync.Once
+	viewers    *viewers
+
+	lock         sync.Mutex
+	checkViewers func(key string) (func(), error)
 }
 
 // NewServer returns a Server
-func NewServer() *Server {
+func NewServer(conf *configure.Store) *Server {
 	ret := &Server{
-		conns: cmap.New(),
+		conns:      cmap.New(),
+		conf:       conf,
+		log:        conf.Logger(),
+		httpServer: &http.Server{},
+		done:       make(chan struct{}),
+		viewers:    newViewers(conf),
 	}
 	go ret.checkStop()
 	return ret
@@ -59,17 +75,32 @@ func (server *Server) Serve(listener net.Listener) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", server.handle)
 	server.listener = listener
-	http.Serve(listener, mux)
+	server.httpServer.Handler = mux
+	if err := server.httpServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
 	return nil
 }
 
+// Shutdown finalizes the playlists of all sources and stops serving,
+// waiting until ctx is done for in-flight requests
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.closeOnce.Do(func() {
+		close(server.done)
+	})
+	for item := range server.conns.IterBuffered() {
+		item.Val.(*Source).Close(fmt.Errorf("server is shutting down"))
+	}
+	return server.httpServer.Shutdown(ctx)
+}
+
 // Writer get writer
 func (server *Server) Writer(info av.Info) av.WriteCloser {
 	var s *Source
 	ok := server.conns.Has(info.Key)
 	if !ok {
-		log.Debug("new hls source")
-		s = NewSource(info)
+		server.log.Debug("new hls source")
+		s = NewSource(info, server.conf)
 		server.conns.Set(info.Key, s)
 	} else {
 		v, _ := server.conns.Get(info.Key)
@@ -88,11 +119,16 @@ func (server *Server) getConn(key string) *Source {
 
 func (server *Server) checkStop() {
 	for {
-		<-time.After(5 * time.Second)
+		select {
+		case <-server.done:
+			return
+		case <-time.After(5 * time.Second):
+		}
+		server.viewers.expireNow()
 		for item := range server.conns.IterBuffered() {
 			v := item.Val.(*Source)
-			if !v.Alive() && !configure.Config.GetBool("hls_keep_after_end") {
-				log.Debug("check stop and remove: ", v.Info())
+			if !v.Alive() && !server.conf.Current().HLSKeepAfterEnd {
+				server.log.Debug("check stop and remove: ", v.Info())
 				server.conns.Remove(item.Key)
 			}
 		}
@@ -105,9 +141,21 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		w.Write(crossdomainxml)
 		return
 	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	access := server.conf.Access()
+	if err := access.Open(ip); err != nil {
+		server.log.Infof("refuse request of %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer access.Close(ip)
+
 	switch path.Ext(r.URL.Path) {
 	case ".m3u8":
 		key, _ := server.parseM3u8(r.URL.Path)
+		if !server.checkPlay(w, r, key) {
+			return
+		}
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
@@ -118,9 +166,14 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
-		body, err := tsCache.GenM3U8PlayList()
+		id, ok := server.join(w, r, key)
+		if !ok {
+			return
+		}
+		// the segments are requested with the token of the playlist
+		body, err := tsCache.GenM3U8PlayList(r.URL.RawQuery)
 		if err != nil {
-			log.Debug("GenM3U8PlayList error: ", err)
+			server.log.Debug("GenM3U8PlayList error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -129,26 +182,60 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Content-Type", "application/x-mpegURL")
 		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
-		w.Write(body)
+		n, _ := w.Write(body)
+		server.viewers.served(key, id, n, false)
 	case ".ts":
 		key, _ := server.parseTs(r.URL.Path)
+		if !server.checkPlay(w, r, key) {
+			return
+		}
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
 		tsCache := conn.GetCacheInc()
+		if tsCache == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		id, ok := server.join(w, r, key)
+		if !ok {
+			return
+		}
 		item, err := tsCache.GetItem(r.URL.Path)
 		if err != nil {
-			log.Debug("GetItem error: ", err)
+			server.log.Debug("GetItem error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "video/mp2ts")
 		w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
-		w.Write(item.Data)
+		n, _ := w.Write(item.Data)
+		server.viewers.served(key, id, n, true)
+	}
+}
+
+// checkPlay checks the play ACL and token of a request for the stream key,
+// forbidden requests are answered
+func (server *Server) checkPlay(w http.ResponseWriter, r *http.Request, key string) bool {
+	app, name := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		app, name = key[:i], key[i+1:]
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if err := server.conf.Access().CheckPlay(app, ip); err != nil {
+		server.log.Info("play: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	if err := server.conf.Current().Token.Check(configure.TokenPlay, app, name, r.URL.Query(), ip); err != nil {
+		server.log.Debugf("play token of %s: %v", ip, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
 	}
+	return true
 }
 
 func (server *Server) parseM3u8(pathstr string) (key string, err error) {
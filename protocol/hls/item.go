@@ -6,6 +6,8 @@ type TSItem struct {
 	SeqNum   int
 	Duration int
 	Data     []byte
+	// Discontinuity marks a change of publisher before the item
+	Discontinuity bool
 }
 
 // NewTSItem return a TSItem
@@ -3,6 +3,8 @@ package hls
 import (
 	"bytes"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gwuhaolin/livego/configure"
@@ -39,17 +41,35 @@ type Source struct {
 	cache       *audioCache
 	tsCache     *TSCacheItem
 	tsparser    *parser.CodecParser
+	closeLock   sync.Mutex // guards closed, packetQueue is sent to and closed under it
 	closed      bool
+	conf        *configure.Store
+	log         *log.Logger
+	closeOnce   sync.Once
 	packetQueue chan *av.Packet
+	connected   time.Time
+	meter       av.Meter // of the segments
+	dropped     uint64   // packets dropped from the queue
+
+	// discontinuity is set by a discontinuity marker until the next
+	// segment starts, segDiscontinuity marks the current segment
+	discontinuity    bool
+	segDiscontinuity bool
 }
 
+// discontinuityMarker is queued to mark a discontinuity in order with the
+// packets
+var discontinuityMarker = &av.Packet{}
+
 // NewSource returns a Source
-func NewSource(info av.Info) *Source {
+func NewSource(info av.Info, conf *configure.Store) *Source {
 	info.Inter = true
 	s := &Source{
 		RWBaser: av.NewRWBase(time.Second * 10),
 
 		info:        info,
+		conf:        conf,
+		log:         conf.Logger(),
 		align:       &align{},
 		stat:        newStatus(),
 		cache:       newAudioCache(),
@@ -59,12 +79,15 @@ func NewSource(info av.Info) *Source {
 		tsparser:    parser.NewCodecParser(),
 		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
+		connected:   time.Now(),
 	}
 	go func() {
 		err := s.SendPacket()
 		if err != nil {
-			log.Warning("send packet error: ", err)
+			s.log.Warning("send packet error: ", err)
+			s.closeLock.Lock()
 			s.closed = true
+			s.closeLock.Unlock()
 		}
 	}()
 	return s
@@ -77,13 +100,21 @@ func (source *Source) GetCacheInc() *TSCacheItem {
 
 // DropPacket drops packet due to queue max
 func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Warningf("[%v] packet queue max!!!", info)
+	source.log.Warningf("[%v] packet queue max!!!", info)
+	var dropped uint64
 	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
+		// the queue may be drained by the sender meanwhile
+		var tmpPkt *av.Packet
+		var ok bool
+		select {
+		case tmpPkt, ok = <-pktQue:
+		default:
+		}
 		// try to don't drop audio
 		if ok && tmpPkt.IsAudio {
 			if len(pktQue) > maxQueueNum-2 {
 				<-pktQue
+				dropped += 2
 			} else {
 				pktQue <- tmpPkt
 			}
@@ -94,23 +125,38 @@ func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
 			// dont't drop sps config and dont't drop key frame
 			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
 				pktQue <- tmpPkt
+			} else {
+				dropped++
 			}
 			if len(pktQue) > maxQueueNum-10 {
 				<-pktQue
+				dropped++
 			}
 		}
 
+		if ok && tmpPkt.IsMetadata {
+			dropped++
+		}
 	}
-	log.Debug("packet queue len: ", len(pktQue))
+	atomic.AddUint64(&source.dropped, dropped)
+	source.log.Debug("packet queue len: ", len(pktQue))
 }
 
 // Write writes packet
 func (source *Source) Write(p *av.Packet) (err error) {
 	err = nil
+	source.closeLock.Lock()
+	defer source.closeLock.Unlock()
 	if source.closed {
 		err = fmt.Errorf("hls source closed")
 		return
 	}
+	// the packets of the GOP cache are sent to every writer, the copy is
+	// demuxed in place
+	if p != discontinuityMarker {
+		pkt := *p
+		p = &pkt
+	}
 	source.SetPreTime()
 	defer func() {
 		if e := recover(); e != nil {
@@ -127,40 +173,55 @@ func (source *Source) Write(p *av.Packet) (err error) {
 	return
 }
 
+// Discontinuity starts a new segment marked as discontinuous at the next
+// key frame
+func (source *Source) Discontinuity() {
+	source.Write(discontinuityMarker)
+}
+
+// QueueLen returns the number of packets waiting to be muxed
+func (source *Source) QueueLen() int {
+	return len(source.packetQueue)
+}
+
 // SendPacket sends packet
 func (source *Source) SendPacket() error {
 	defer func() {
-		log.Debugf("[%v] hls sender stop", source.info)
+		source.log.Debugf("[%v] hls sender stop", source.info)
 		if r := recover(); r != nil {
-			log.Warning("hls SendPacket panic: ", r)
+			source.log.Warning("hls SendPacket panic: ", r)
 		}
 	}()
 
-	log.Debugf("[%v] hls sender start", source.info)
+	source.log.Debugf("[%v] hls sender start", source.info)
 	for {
-		if source.closed {
-			return fmt.Errorf("closed")
-		}
-
 		p, ok := <-source.packetQueue
 		if ok {
+			if p == discontinuityMarker {
+				source.discontinuity = true
+				continue
+			}
 			if p.IsMetadata {
 				continue
 			}
 
 			err := source.demuxer.Demux(p)
 			if err == flv.ErrAvcEndSEQ {
-				log.Warning(err)
+				source.log.Warning(err)
 				continue
 			} else {
 				if err != nil {
-					log.Warning(err)
+					source.log.Warning(err)
+					source.conf.Events().Publish(configure.EventError, source.info.Key, map[string]interface{}{
+						"protocol": "hls",
+						"error":    err.Error(),
+					})
 					return err
 				}
 			}
 			compositionTime, isSeq, err := source.parse(p)
 			if err != nil {
-				log.Warning(err)
+				source.log.Warning(err)
 			}
 			if err != nil || isSeq {
 				continue
@@ -171,50 +232,97 @@ func (source *Source) SendPacket() error {
 				source.tsMux(p)
 			}
 		} else {
+			source.finish()
 			return fmt.Errorf("closed")
 		}
 	}
 }
 
+// Stats returns the statistics of the segmenter, the bytes are those of
+// the segments
+func (source *Source) Stats() av.Stats {
+	return av.Stats{
+		Protocol:  "hls",
+		Connected: source.connected,
+		Bytes:     source.meter.Bytes(),
+		Kbps:      source.meter.Kbps(),
+		Queue:     len(source.packetQueue),
+		Dropped:   atomic.LoadUint64(&source.dropped),
+	}
+}
+
 // Info returns info
 func (source *Source) Info() (ret av.Info) {
 	return source.info
 }
 
 func (source *Source) cleanup() {
-	close(source.packetQueue)
 	source.bwriter = nil
 	source.btswriter = nil
 	source.cache = nil
 	source.tsCache = nil
 }
 
-// Close closes the source
-func (source *Source) Close(err error) {
-	log.Debug("hls source closed: ", source.info)
-	if !source.closed && !configure.Config.GetBool("hls_keep_after_end") {
+// finish flushes the pending segment and ends the playlist,
+// it is called once the packet queue is closed and drained
+func (source *Source) finish() {
+	if source.btswriter != nil && source.stat.durationMs() > 0 {
+		source.flushSegment()
+	}
+	source.tsCache.End()
+	if !source.conf.Current().HLSKeepAfterEnd {
 		source.cleanup()
 	}
-	source.closed = true
+}
+
+// Close closes the source, queued packets are still muxed before the
+// playlist is ended
+func (source *Source) Close(err error) {
+	source.closeOnce.Do(func() {
+		source.log.Debug("hls source closed: ", source.info)
+		source.closeLock.Lock()
+		source.closed = true
+		close(source.packetQueue)
+		source.closeLock.Unlock()
+	})
+}
+
+func (source *Source) flushSegment() {
+	source.flushAudio()
+
+	source.seq++
+	filename := fmt.Sprintf("/%s/%d-%d.ts", source.info.Key, time.Now().Unix(), source.seq)
+	item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
+	item.Discontinuity = source.segDiscontinuity
+	source.segDiscontinuity = false
+	source.tsCache.SetItem(filename, item)
+	source.meter.Add(len(item.Data))
+	source.conf.Events().Publish(configure.EventHLSSegment, source.info.Key, map[string]interface{}{
+		"name":          filename,
+		"seq":           item.SeqNum,
+		"duration_ms":   item.Duration,
+		"bytes":         len(item.Data),
+		"discontinuity": item.Discontinuity,
+	})
+
+	source.btswriter.Reset()
+	source.stat.resetAndNew()
 }
 
 func (source *Source) cut() {
 	newf := true
 	if source.btswriter == nil {
 		source.btswriter = bytes.NewBuffer(nil)
-	} else if source.btswriter != nil && source.stat.durationMs() >= duration {
-		source.flushAudio()
-
-		source.seq++
-		filename := fmt.Sprintf("/%s/%d.ts", source.info.Key, time.Now().Unix())
-		item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
-		source.tsCache.SetItem(filename, item)
-
-		source.btswriter.Reset()
-		source.stat.resetAndNew()
+	} else if source.btswriter != nil && (source.stat.durationMs() >= duration ||
+		source.discontinuity && source.stat.durationMs() > 0) {
+		source.flushSegment()
 	} else {
 		newf = false
 	}
+	if newf || source.discontinuity {
+		source.segDiscontinuity = source.discontinuity
+		source.discontinuity = false
+	}
 	if newf {
 		source.btswriter.Write(source.muxer.PAT())
 		source.btswriter.Write(source.muxer.PMT(av.SoundAAC, true))
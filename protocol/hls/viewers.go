@@ -0,0 +1,301 @@
+package hls
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/utils/uid"
+)
+
+// sessionCookie is the cookie identifying the session of a viewer which
+// does not send the session query parameter
+const sessionCookie = "livego_session"
+
+// Session is an HLS viewer of a stream, identified by its session and its
+// address
+type Session struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Session   string    `json:"session"`
+	Addr      string    `json:"addr"`
+	Start     time.Time `json:"start"`
+	Last      time.Time `json:"last"`
+	Bytes     uint64    `json:"bytes"`
+	Playlists uint64    `json:"playlists"`
+	Segments  uint64    `json:"segments"`
+}
+
+// Stats returns the statistics of the session, its bitrate is the average
+// since it started
+func (s Session) Stats() av.Stats {
+	stats := av.Stats{
+		Protocol:   "hls",
+		RemoteAddr: s.Addr,
+		Connected:  s.Start,
+		Bytes:      s.Bytes,
+	}
+	if ms := uint64(s.Last.Sub(s.Start) / time.Millisecond); ms > 0 {
+		stats.Kbps = int(s.Bytes * 8 / ms)
+	}
+	return stats
+}
+
+// Stats are the open HLS sessions and the totals of all sessions, expired
+// ones included
+type Stats struct {
+	Viewers   int       `json:"viewers"`
+	Expired   uint64    `json:"expired"`
+	Bytes     uint64    `json:"bytes"`
+	Playlists uint64    `json:"playlists"`
+	Segments  uint64    `json:"segments"`
+	Sessions  []Session `json:"sessions"`
+}
+
+// viewers tracks the HLS sessions of every stream, a session expires
+// hls_session_timeout seconds after its last request
+type viewers struct {
+	conf     *configure.Store
+	lock     sync.Mutex
+	sessions map[string]map[string]*Session // by stream key and id
+	expired  uint64
+	bytes    uint64
+	lists    uint64
+	segments uint64
+}
+
+func newViewers(conf *configure.Store) *viewers {
+	return &viewers{
+		conf:     conf,
+		sessions: make(map[string]map[string]*Session),
+	}
+}
+
+// viewerID returns the id of the session of r, its session query parameter
+// or cookie and its address
+func viewerID(r *http.Request) (id, session, addr string) {
+	session = r.URL.Query().Get("session")
+	if session == "" {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			session = c.Value
+		}
+	}
+	addr, _, _ = net.SplitHostPort(r.RemoteAddr)
+	return addr + " " + session, session, addr
+}
+
+func (v *viewers) timeout() time.Duration {
+	if t := v.conf.Current().HLSSessionTimeout; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// event publishes an event about the session s
+func (v *viewers) event(typ string, s *Session, reason string) {
+	data := map[string]interface{}{
+		"id":          s.ID,
+		"protocol":    "hls",
+		"remote_addr": s.Addr,
+		"session":     s.Session,
+	}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	v.conf.Events().Publish(typ, s.Key, data)
+}
+
+// expire removes the sessions idle for longer than the timeout
+func (v *viewers) expire(now time.Time) {
+	timeout := v.timeout()
+	for key, ids := range v.sessions {
+		for id, s := range ids {
+			if now.Sub(s.Last) >= timeout {
+				delete(ids, id)
+				v.expired++
+				v.event(configure.EventPlayerLeave, s, "session timeout")
+			}
+		}
+		if len(ids) == 0 {
+			delete(v.sessions, key)
+		}
+	}
+}
+
+// touch returns if the session id of key is open
+func (v *viewers) touch(key, id string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.expire(time.Now())
+	_, ok := v.sessions[key][id]
+	return ok
+}
+
+// add opens the session id of key unless it is open
+func (v *viewers) add(key, id, session, addr string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.sessions[key][id]; ok {
+		return
+	}
+	if v.sessions[key] == nil {
+		v.sessions[key] = make(map[string]*Session)
+	}
+	now := time.Now()
+	s := &Session{
+		ID:      uid.NewID(),
+		Key:     key,
+		Session: session,
+		Addr:    addr,
+		Start:   now,
+		Last:    now,
+	}
+	v.sessions[key][id] = s
+	v.event(configure.EventPlayerJoin, s, "")
+}
+
+// served counts n bytes of a playlist or a segment sent to the session id
+// of key
+func (v *viewers) served(key, id string, n int, segment bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.bytes += uint64(n)
+	if segment {
+		v.segments++
+	} else {
+		v.lists++
+	}
+	s, ok := v.sessions[key][id]
+	if !ok {
+		return
+	}
+	s.Last = time.Now()
+	s.Bytes += uint64(n)
+	if segment {
+		s.Segments++
+	} else {
+		s.Playlists++
+	}
+}
+
+// counts returns the open sessions by stream key
+func (v *viewers) counts() map[string]int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.expire(time.Now())
+	counts := make(map[string]int, len(v.sessions))
+	for key, ids := range v.sessions {
+		counts[key] = len(ids)
+	}
+	return counts
+}
+
+// expireNow removes the sessions which timed out, so their leaving is
+// published without waiting for another request
+func (v *viewers) expireNow() {
+	v.lock.Lock()
+	v.expire(time.Now())
+	v.lock.Unlock()
+}
+
+func (v *viewers) stats() Stats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.expire(time.Now())
+	stats := Stats{
+		Expired:   v.expired,
+		Bytes:     v.bytes,
+		Playlists: v.lists,
+		Segments:  v.segments,
+		Sessions:  []Session{},
+	}
+	for _, ids := range v.sessions {
+		for _, s := range ids {
+			stats.Sessions = append(stats.Sessions, *s)
+		}
+	}
+	stats.Viewers = len(stats.Sessions)
+	sort.Slice(stats.Sessions, func(i, j int) bool {
+		return stats.Sessions[i].Start.Before(stats.Sessions[j].Start)
+	})
+	return stats
+}
+
+// kick ends the session id, it returns the session
+func (v *viewers) kick(id string) (Session, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for key, ids := range v.sessions {
+		for k, s := range ids {
+			if s.ID == id {
+				delete(ids, k)
+				if len(ids) == 0 {
+					delete(v.sessions, key)
+				}
+				v.event(configure.EventPlayerLeave, s, "kicked")
+				return *s, true
+			}
+		}
+	}
+	return Session{}, false
+}
+
+// Viewers returns the HLS viewers by stream key
+func (server *Server) Viewers() map[string]int {
+	return server.viewers.counts()
+}
+
+// Stats returns the open HLS sessions and the served bytes, playlists and
+// segments
+func (server *Server) Stats() Stats {
+	return server.viewers.stats()
+}
+
+// Kick ends the HLS session id, it returns the address of the viewer. The
+// viewer starts a new session with its next request unless it is banned.
+func (server *Server) Kick(id string) (string, error) {
+	s, ok := server.viewers.kick(id)
+	if !ok {
+		return "", fmt.Errorf("hls session %s not found", id)
+	}
+	server.log.Infof("hls session %q of %s on %s kicked", s.Session, s.Addr, s.Key)
+	return s.Addr, nil
+}
+
+// SetViewerCheck sets the function returning an error if a new viewer of
+// the stream key is refused. An admitted viewer is counted by the check
+// until the returned function is called, once its session is open.
+func (server *Server) SetViewerCheck(fn func(key string) (func(), error)) {
+	server.lock.Lock()
+	server.checkViewers = fn
+	server.lock.Unlock()
+}
+
+// join opens the session of r if it is new, new viewers beyond the viewer
+// limits are answered with 429. It returns the id of the session.
+func (server *Server) join(w http.ResponseWriter, r *http.Request, key string) (string, bool) {
+	id, session, addr := viewerID(r)
+	if server.viewers.touch(key, id) {
+		return id, true
+	}
+	server.lock.Lock()
+	check := server.checkViewers
+	server.lock.Unlock()
+	if check != nil {
+		admitted, err := check(key)
+		if err != nil {
+			server.log.Info("play: ", err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return "", false
+		}
+		defer admitted()
+	}
+	server.viewers.add(key, id, session, addr)
+	server.log.Debugf("new hls session %q of %s on %s", session, addr, key)
+	return id, true
+}
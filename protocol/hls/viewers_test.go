@@ -0,0 +1,230 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer returns a Server of the default configuration changed by
+// config
+func newTestServer(t *testing.T, config func(*configure.ServerCfg)) *Server {
+	cfg := configure.DefaultConfig()
+	if config != nil {
+		config(&cfg)
+	}
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	conf, err := configure.NewStore(&cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(conf)
+}
+
+// join joins the session of a viewer at addr
+func join(server *Server, key, session, addr string) (int, bool) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/"+key+".m3u8?session="+session, nil)
+	r.RemoteAddr = addr
+	_, ok := server.join(w, r, key)
+	return w.Code, ok
+}
+
+func TestJoinViewerCheck(t *testing.T) {
+	at := assert.New(t)
+	server := newTestServer(t, nil)
+	defer server.Shutdown(context.Background())
+
+	//new sessions are admitted by the check once, and counted once open
+	var checked []string
+	admitted := make(map[string]int)
+	limit := 2
+	server.SetViewerCheck(func(key string) (func(), error) {
+		checked = append(checked, key)
+		if server.Viewers()[key] >= limit {
+			return nil, fmt.Errorf("max viewers reached")
+		}
+		return func() {
+			admitted[key]++
+			at.Equal(admitted[key], server.Viewers()[key])
+		}, nil
+	})
+	_, ok := join(server, "live/room", "a", "192.0.2.1:1000")
+	at.True(ok)
+	_, ok = join(server, "live/room", "a", "192.0.2.1:1001")
+	at.True(ok)
+	_, ok = join(server, "live/room", "b", "192.0.2.1:1002")
+	at.True(ok)
+	at.Equal([]string{"live/room", "live/room"}, checked)
+	at.Equal(map[string]int{"live/room": 2}, admitted)
+
+	//viewers beyond the limit are refused
+	status, ok := join(server, "live/room", "c", "192.0.2.1:1003")
+	at.False(ok)
+	at.Equal(http.StatusTooManyRequests, status)
+	at.Equal(map[string]int{"live/room": 2}, server.Viewers())
+	_, ok = join(server, "live/other", "c", "192.0.2.1:1003")
+	at.True(ok)
+	at.Equal(map[string]int{"live/room": 2, "live/other": 1}, admitted)
+}
+
+// nextEvent returns the next event of events
+func nextEvent(t *testing.T, events <-chan configure.Event) configure.Event {
+	select {
+	case ev := <-events:
+		return ev
+	default:
+		t.Fatal("no event")
+		return configure.Event{}
+	}
+}
+
+func TestViewers(t *testing.T) {
+	at := assert.New(t)
+	server := newTestServer(t, nil)
+	defer server.Shutdown(context.Background())
+	events, cancel := server.conf.Events().Subscribe(16)
+	defer cancel()
+	v := server.viewers
+
+	//sessions are opened once
+	at.False(v.touch("live/room", "a"))
+	v.add("live/room", "a", "1", "192.0.2.1")
+	v.add("live/room", "a", "1", "192.0.2.1")
+	v.add("live/room", "b", "2", "192.0.2.2")
+	at.True(v.touch("live/room", "a"))
+	ev := nextEvent(t, events)
+	at.Equal(configure.EventPlayerJoin, ev.Type)
+	at.Equal("live/room", ev.Key)
+	at.Equal("1", ev.Data["session"])
+	at.Equal(configure.EventPlayerJoin, nextEvent(t, events).Type)
+	at.Len(events, 0)
+	at.Equal(map[string]int{"live/room": 2}, v.counts())
+
+	//the served bytes are counted by session and in total
+	v.served("live/room", "a", 100, false)
+	v.served("live/room", "a", 1000, true)
+	v.served("live/room", "c", 10, true)
+	stats := v.stats()
+	at.Equal(2, stats.Viewers)
+	at.Equal(uint64(1110), stats.Bytes)
+	at.Equal(uint64(1), stats.Playlists)
+	at.Equal(uint64(2), stats.Segments)
+	if at.Len(stats.Sessions, 2) {
+		a := stats.Sessions[0]
+		at.Equal("1", a.Session)
+		at.Equal("192.0.2.1", a.Addr)
+		at.Equal(uint64(1100), a.Bytes)
+		at.Equal(uint64(1), a.Playlists)
+		at.Equal(uint64(1), a.Segments)
+		at.Equal("hls", a.Stats().Protocol)
+		at.Equal("2", stats.Sessions[1].Session)
+	}
+
+	//kicked sessions leave
+	s, ok := v.kick(stats.Sessions[1].ID)
+	at.True(ok)
+	at.Equal("2", s.Session)
+	ev = nextEvent(t, events)
+	at.Equal(configure.EventPlayerLeave, ev.Type)
+	at.Equal("kicked", ev.Data["reason"])
+	_, ok = v.kick(stats.Sessions[1].ID)
+	at.False(ok)
+
+	//idle sessions expire
+	v.lock.Lock()
+	v.expire(time.Now().Add(v.timeout()))
+	v.lock.Unlock()
+	ev = nextEvent(t, events)
+	at.Equal(configure.EventPlayerLeave, ev.Type)
+	at.Equal("session timeout", ev.Data["reason"])
+	stats = v.stats()
+	at.Equal(0, stats.Viewers)
+	at.Equal(uint64(1), stats.Expired)
+	at.Equal(map[string]int{}, v.counts())
+}
+
+func TestSessionStats(t *testing.T) {
+	at := assert.New(t)
+	start := time.Now()
+	s := Session{Addr: "192.0.2.1", Start: start, Last: start.Add(time.Second), Bytes: 1000}
+	stats := s.Stats()
+	at.Equal("hls", stats.Protocol)
+	at.Equal(8, stats.Kbps)
+	s.Last = start
+	at.Equal(0, s.Stats().Kbps)
+}
+
+func TestHandleSessions(t *testing.T) {
+	at := assert.New(t)
+	server := newTestServer(t, nil)
+	defer server.Shutdown(context.Background())
+	server.SetViewerCheck(func(key string) (func(), error) {
+		if server.Viewers()[key] >= 2 {
+			return nil, fmt.Errorf("max viewers reached")
+		}
+		return func() {}, nil
+	})
+	source := server.Writer(av.Info{Key: "live/room"}).(*Source)
+	source.GetCacheInc().SetItem("/live/room/1.ts", NewTSItem("/live/room/1.ts", 1000, 1, []byte("segment")))
+
+	get := func(uri string, cookie *http.Cookie) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", uri, nil)
+		r.RemoteAddr = "192.0.2.1:1000"
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		server.handle(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	//the segments are requested with the session of the playlist
+	status, playlist := get("/live/room.m3u8?session=a", nil)
+	at.Equal(http.StatusOK, status)
+	at.True(strings.Contains(playlist, "/live/room/1.ts?session=a"), playlist)
+	status, data := get("/live/room/1.ts?session=a", nil)
+	at.Equal(http.StatusOK, status)
+	at.Equal("segment", data)
+	status, _ = get("/live/room.m3u8", &http.Cookie{Name: sessionCookie, Value: "b"})
+	at.Equal(http.StatusOK, status)
+	status, _ = get("/live/room.m3u8?session=c", nil)
+	at.Equal(http.StatusTooManyRequests, status)
+	status, _ = get("/live/other.m3u8?session=a", nil)
+	at.Equal(http.StatusForbidden, status)
+
+	stats := server.Stats()
+	at.Equal(2, stats.Viewers)
+	if at.Len(stats.Sessions, 2) {
+		a := stats.Sessions[0]
+		at.Equal("a", a.Session)
+		at.Equal("live/room", a.Key)
+		at.Equal("192.0.2.1", a.Addr)
+		at.Equal(uint64(1), a.Playlists)
+		at.Equal(uint64(1), a.Segments)
+		at.Equal(uint64(len(playlist)+len(data)), a.Bytes)
+		at.Equal("b", stats.Sessions[1].Session)
+	}
+
+	//a kicked viewer starts a new session
+	addr, err := server.Kick(stats.Sessions[0].ID)
+	at.Nil(err)
+	at.Equal("192.0.2.1", addr)
+	_, err = server.Kick(stats.Sessions[0].ID)
+	at.NotNil(err)
+	status, _ = get("/live/room.m3u8?session=a", nil)
+	at.Equal(http.StatusOK, status)
+	at.NotEqual(stats.Sessions[0].ID, server.Stats().Sessions[1].ID)
+}
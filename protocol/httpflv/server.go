@@ -1,12 +1,13 @@
 package httpflv
 
 import (
-	"encoding/json"
+	"context"
 	"net"
 	"net/http"
 	"strings"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
 
 	log "github.com/sirupsen/logrus"
@@ -14,23 +15,21 @@ import (
 
 // Server is the http flv server
 type Server struct {
-	handler av.Handler
-}
-
-type stream struct {
-	Key string `json:"key"`
-	ID  string `json:"id"`
-}
-
-type streams struct {
-	Publishers []stream `json:"publishers"`
-	Players    []stream `json:"players"`
+	handler    av.Handler
+	hooks      rtmp.Hooks
+	conf       *configure.Store
+	log        *log.Logger
+	httpServer *http.Server
 }
 
 // NewServer returns a server
-func NewServer(h av.Handler) *Server {
+func NewServer(h av.Handler, conf *configure.Store, hooks rtmp.Hooks) *Server {
 	return &Server{
-		handler: h,
+		handler:    h,
+		hooks:      hooks,
+		conf:       conf,
+		log:        conf.Logger(),
+		httpServer: &http.Server{},
 	}
 }
 
@@ -38,61 +37,36 @@ func NewServer(h av.Handler) *Server {
 func (server *Server) Serve(l net.Listener) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", server.handleConn)
-	mux.HandleFunc("/streams", server.getStream)
-	http.Serve(l, mux)
-	return nil
-}
-
-// getStreams get the information of publishers and players
-func (server *Server) getStreams(w http.ResponseWriter, r *http.Request) *streams {
-	rtmpStream := server.handler.(*rtmp.Streams)
-	if rtmpStream == nil {
-		return nil
-	}
-	msgs := new(streams)
-	for item := range rtmpStream.GetStreams().IterBuffered() {
-		if s, ok := item.Val.(*rtmp.Stream); ok {
-			if s.Reader() != nil {
-				msg := stream{item.Key, s.Reader().Info().UID}
-				msgs.Publishers = append(msgs.Publishers, msg)
-			}
-		}
-	}
-
-	for item := range rtmpStream.GetStreams().IterBuffered() {
-		ws := item.Val.(*rtmp.Stream).Ws()
-		for s := range ws.IterBuffered() {
-			if pw, ok := s.Val.(*rtmp.PackWriterCloser); ok {
-				if pw.Writer() != nil {
-					msg := stream{item.Key, pw.Writer().Info().UID}
-					msgs.Players = append(msgs.Players, msg)
-				}
-			}
-		}
+	server.httpServer.Handler = mux
+	if err := server.httpServer.Serve(l); err != http.ErrServerClosed {
+		return err
 	}
-
-	return msgs
+	return nil
 }
 
-// getStream handles getStream request
-func (server *Server) getStream(w http.ResponseWriter, r *http.Request) {
-	msgs := server.getStreams(w, r)
-	if msgs == nil {
-		return
-	}
-	resp, _ := json.Marshal(msgs)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(resp)
+// Shutdown stops accepting new players and waits until ctx is done for
+// the connected ones to finish
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.httpServer.Shutdown(ctx)
 }
 
 // handleConn handles connections
 func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Error("http flv handleConn panic: ", r)
+			server.log.Error("http flv handleConn panic: ", r)
 		}
 	}()
 
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	access := server.conf.Access()
+	if err := access.Open(ip); err != nil {
+		server.log.Warningf("refuse connection of %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer access.Close(ip)
+
 	url := r.URL.String()
 	u := r.URL.Path
 	if pos := strings.LastIndex(u, "."); pos < 0 || u[pos:] != ".flv" {
@@ -101,35 +75,60 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 	}
 	path := strings.TrimSuffix(strings.TrimLeft(u, "/"), ".flv")
 	paths := strings.SplitN(path, "/", 2)
-	log.Debug("url:", u, "path:", path, "paths:", paths)
+	server.log.Debug("url:", u, "path:", path, "paths:", paths)
 
 	if len(paths) != 2 {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
 
-	// 判断视屏流是否发布,如果没有发布,直接返回404
-	msgs := server.getStreams(w, r)
-	if msgs == nil || len(msgs.Publishers) == 0 {
-		http.Error(w, "invalid path", http.StatusNotFound)
+	if err := access.CheckPlay(paths[0], ip); err != nil {
+		server.log.Warning("play: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-
-	include := false
-	for _, item := range msgs.Publishers {
-		if item.Key == path {
-			include = true
-			break
+	if err := server.conf.Current().Token.Check(configure.TokenPlay, paths[0], paths[1], r.URL.Query(), ip); err != nil {
+		server.log.Warningf("play token of %s: %v", ip, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// the admitted player is counted until it is added to the stream
+	admitted := func() {}
+	if streams, ok := server.handler.(*rtmp.Streams); ok {
+		if err := streams.CheckEgress(); err != nil {
+			server.log.Warning("play: ", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		var err error
+		if admitted, err = streams.AdmitViewer(path); err != nil {
+			server.log.Warning("play: ", err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
 		}
 	}
-	if include == false {
+	defer admitted()
+
+	// 判断视屏流是否发布,如果没有发布,直接返回404
+	if streams, ok := server.handler.(*rtmp.Streams); !ok || !streams.HasPublisher(path) {
 		http.Error(w, "invalid path", http.StatusNotFound)
 		return
 	}
 
+	if err := server.hooks.Play(av.Info{Key: path, URL: url, Inter: true}); err != nil {
+		server.log.Error("OnPlay err: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	writer := NewWriter(paths[0], paths[1], url, w)
+	writer := NewWriter(paths[0], paths[1], url, w, server.log)
+	writer.addr = r.RemoteAddr
 
-	server.handler.HandleWriter(writer)
+	if streams, ok := server.handler.(*rtmp.Streams); ok {
+		streams.HandleViewer(writer, admitted)
+	} else {
+		server.handler.HandleWriter(writer)
+	}
 	writer.Wait()
 }
@@ -0,0 +1,41 @@
+package httpflv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxViewers(t *testing.T) {
+	at := assert.New(t)
+	cfg := configure.DefaultConfig()
+	cfg.Server[0].MaxViewers = 1
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	conf, err := configure.NewStore(&cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := rtmp.NewStreams(conf)
+	server := NewServer(streams, conf, rtmp.Hooks{})
+	get := func() int {
+		w := httptest.NewRecorder()
+		server.handleConn(w, httptest.NewRequest("GET", "/live/room.flv", nil))
+		return w.Code
+	}
+
+	//players are admitted before the stream is looked up
+	at.Equal(http.StatusNotFound, get())
+	admitted, err := streams.AdmitViewer("live/room")
+	at.Nil(err)
+	at.Equal(http.StatusTooManyRequests, get())
+	admitted()
+	at.Equal(http.StatusNotFound, get())
+}
@@ -3,6 +3,8 @@ package httpflv
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
@@ -25,14 +27,20 @@ type Writer struct {
 	uid             string
 	app, title, url string
 	buf             []byte
+	closeLock       sync.Mutex // guards closed, packetQueue is sent to and closed under it
 	closed          bool
 	closedChan      chan struct{}
 	ctx             http.ResponseWriter
 	packetQueue     chan *av.Packet
+	addr            string
+	connected       time.Time
+	meter           av.Meter
+	dropped         uint64 // packets dropped from the queue
+	log             *log.Logger
 }
 
-// NewWriter returns a FLV writer
-func NewWriter(app, title, url string, ctx http.ResponseWriter) *Writer {
+// NewWriter returns a FLV writer logging to logger
+func NewWriter(app, title, url string, ctx http.ResponseWriter, logger *log.Logger) *Writer {
 	ret := &Writer{
 		RWBaser: av.NewRWBase(time.Second * 10),
 
@@ -44,6 +52,8 @@ func NewWriter(app, title, url string, ctx http.ResponseWriter) *Writer {
 		closedChan:  make(chan struct{}),
 		buf:         make([]byte, headerLen),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
+		connected:   time.Now(),
+		log:         logger,
 	}
 
 	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09})
@@ -52,8 +62,10 @@ func NewWriter(app, title, url string, ctx http.ResponseWriter) *Writer {
 	go func() {
 		err := ret.SendPacket()
 		if err != nil {
-			log.Error("SendPacket error: ", err)
+			ret.log.Error("SendPacket error: ", err)
+			ret.closeLock.Lock()
 			ret.closed = true
+			ret.closeLock.Unlock()
 		}
 	}()
 	return ret
@@ -61,35 +73,55 @@ func NewWriter(app, title, url string, ctx http.ResponseWriter) *Writer {
 
 // DropPacket drops packets due to queue max
 func (flvWriter *Writer) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Warningf("[%v] packet queue max!!!", info)
+	flvWriter.log.Warningf("[%v] packet queue max!!!", info)
+	var dropped uint64
 	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
+		// the queue may be drained by the sender meanwhile
+		var tmpPkt *av.Packet
+		var ok bool
+		select {
+		case tmpPkt, ok = <-pktQue:
+		default:
+		}
 		if ok && tmpPkt.IsVideo {
 			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
 			// dont't drop sps config and dont't drop key frame
 			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
-				log.Debug("insert keyframe to queue")
+				flvWriter.log.Debug("insert keyframe to queue")
 				pktQue <- tmpPkt
+			} else {
+				dropped++
 			}
 
 			if len(pktQue) > maxQueueNum-10 {
 				<-pktQue
+				dropped++
 			}
 			// drop other packet
-			<-pktQue
+			select {
+			case <-pktQue:
+				dropped++
+			default:
+			}
 		}
 		// try to don't drop audio
 		if ok && tmpPkt.IsAudio {
-			log.Debug("insert audio to queue")
+			flvWriter.log.Debug("insert audio to queue")
 			pktQue <- tmpPkt
 		}
+		if ok && tmpPkt.IsMetadata {
+			dropped++
+		}
 	}
-	log.Debug("packet queue len: ", len(pktQue))
+	atomic.AddUint64(&flvWriter.dropped, dropped)
+	flvWriter.log.Debug("packet queue len: ", len(pktQue))
 }
 
 // Write writes packet
 func (flvWriter *Writer) Write(p *av.Packet) (err error) {
 	err = nil
+	flvWriter.closeLock.Lock()
+	defer flvWriter.closeLock.Unlock()
 	if flvWriter.closed {
 		err = fmt.Errorf("flvwrite source closed")
 		return
@@ -110,6 +142,31 @@ func (flvWriter *Writer) Write(p *av.Packet) (err error) {
 	return
 }
 
+// IsViewer returns if the player is connected, every writer serves one
+func (flvWriter *Writer) IsViewer() bool {
+	flvWriter.closeLock.Lock()
+	defer flvWriter.closeLock.Unlock()
+	return !flvWriter.closed
+}
+
+// QueueLen returns the number of packets waiting to be sent
+func (flvWriter *Writer) QueueLen() int {
+	return len(flvWriter.packetQueue)
+}
+
+// Stats returns the statistics of the player
+func (flvWriter *Writer) Stats() av.Stats {
+	return av.Stats{
+		Protocol:   "httpflv",
+		RemoteAddr: flvWriter.addr,
+		Connected:  flvWriter.connected,
+		Bytes:      flvWriter.meter.Bytes(),
+		Kbps:       flvWriter.meter.Kbps(),
+		Queue:      len(flvWriter.packetQueue),
+		Dropped:    atomic.LoadUint64(&flvWriter.dropped),
+	}
+}
+
 // SendPacket sends packet
 func (flvWriter *Writer) SendPacket() error {
 	for {
@@ -156,6 +213,7 @@ func (flvWriter *Writer) SendPacket() error {
 			if _, err := flvWriter.ctx.Write(h[:4]); err != nil {
 				return err
 			}
+			flvWriter.meter.Add(preDataLen + 4)
 		} else {
 			return fmt.Errorf("closed")
 		}
@@ -173,7 +231,9 @@ func (flvWriter *Writer) Wait() {
 
 // Close closes the writer
 func (flvWriter *Writer) Close(error) {
-	log.Debug("http flv closed")
+	flvWriter.log.Debug("http flv closed")
+	flvWriter.closeLock.Lock()
+	defer flvWriter.closeLock.Unlock()
 	if !flvWriter.closed {
 		close(flvWriter.packetQueue)
 		close(flvWriter.closedChan)
@@ -0,0 +1,58 @@
+package httpflv
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// responseWriter passes the writes of a Writer to a channel
+type responseWriter struct {
+	writes chan []byte
+}
+
+func (w *responseWriter) Header() http.Header { return http.Header{} }
+func (w *responseWriter) WriteHeader(int)     {}
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.writes <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestWriterStats(t *testing.T) {
+	at := assert.New(t)
+	rw := &responseWriter{writes: make(chan []byte)}
+	created := make(chan *Writer)
+	go func() {
+		created <- NewWriter("live", "room", "/live/room.flv", rw, log.StandardLogger())
+	}()
+	at.Equal([]byte("FLV\x01\x05\x00\x00\x00\x09"), <-rw.writes)
+	<-rw.writes
+	writer := <-created
+	writer.addr = "192.0.2.1:1000"
+
+	//a packet is counted once its tag and size are written, the writes
+	//of the next one wait for the test
+	data := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x01}
+	at.Nil(writer.Write(&av.Packet{IsVideo: true, Data: data}))
+	at.Nil(writer.Write(&av.Packet{IsVideo: true, TimeStamp: 40, Data: data}))
+	at.Equal(byte(av.TagVideo), (<-rw.writes)[0])
+	at.Equal(data, <-rw.writes)
+	<-rw.writes
+	<-rw.writes
+	stats := writer.Stats()
+	at.Equal("httpflv", stats.Protocol)
+	at.Equal("192.0.2.1:1000", stats.RemoteAddr)
+	at.Equal(uint64(headerLen+len(data)+4), stats.Bytes)
+	at.True(writer.IsViewer())
+	at.Equal("live/room", writer.Info().Key)
+	<-rw.writes
+	<-rw.writes
+
+	writer.Close(nil)
+	at.False(writer.IsViewer())
+	at.NotNil(writer.Write(&av.Packet{IsVideo: true, Data: data}))
+}
@@ -0,0 +1,278 @@
+// Package proxyproto reads the PROXY protocol headers, version 1 and 2, sent
+// by load balancers in front of the listeners. The connections get the
+// address of the client as remote address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// headerTimeout is the time given to read the header of a connection
+	headerTimeout = 5 * time.Second
+	// maxV1Length is the longest version 1 header, CRLF included
+	maxV1Length = 107
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Conn is a connection with the addresses of its PROXY protocol header
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	local  net.Addr
+	remote net.Addr
+}
+
+// Read reads the data following the header
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// LocalAddr returns the address the client connected to
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the client
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Listener accepts connections and reads the PROXY protocol header of the
+// ones from trusted sources, which must send one. The headers are read
+// concurrently so slow clients do not hold the others back.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	lock  sync.Mutex
+	err   error
+	fail  chan struct{}
+}
+
+// NewListener returns a Listener reading the headers of the connections
+// accepted by l from the trusted networks
+func NewListener(l net.Listener, trusted []*net.IPNet) *Listener {
+	pl := &Listener{
+		Listener: l,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		fail:     make(chan struct{}),
+	}
+	go pl.accept()
+	return pl
+}
+
+func (l *Listener) accept() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.lock.Lock()
+			l.err = err
+			l.lock.Unlock()
+			close(l.fail)
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+// handshake reads the header of c if it comes from a trusted source and
+// passes it to Accept, c is closed if the header is invalid
+func (l *Listener) handshake(c net.Conn) {
+	var conn net.Conn = c
+	if l.isTrusted(c.RemoteAddr()) {
+		c.SetReadDeadline(time.Now().Add(headerTimeout))
+		pc, err := readHeader(c)
+		if err != nil {
+			c.Close()
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		conn = pc
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection whose header was read
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, fmt.Errorf("use of closed network connection")
+	case <-l.fail:
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close closes the listener
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// readHeader reads the header of c
+func readHeader(c net.Conn) (*Conn, error) {
+	r := bufio.NewReader(c)
+	conn := &Conn{
+		Conn:   c,
+		r:      r,
+		local:  c.LocalAddr(),
+		remote: c.RemoteAddr(),
+	}
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		err = conn.readV1()
+	case '\r':
+		err = conn.readV2()
+	default:
+		err = fmt.Errorf("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1935\r\n"
+func (c *Conn) readV1() error {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1Length {
+			return fmt.Errorf("PROXY protocol header too long")
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("invalid PROXY protocol family %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	src, err := parseAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func parseAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY protocol address %s", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port %s", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads a binary header, the addresses of LOCAL commands and of
+// families other than IPv4 and IPv6 are ignored
+func (c *Conn) readV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:12], v2Signature) {
+		return fmt.Errorf("invalid PROXY protocol signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("invalid PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL, such as health checks of the load balancer
+		return nil
+	case 1: // PROXY
+	default:
+		return fmt.Errorf("invalid PROXY protocol command %d", hdr[12]&0xf)
+	}
+	var size int
+	switch hdr[13] >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return fmt.Errorf("PROXY protocol addresses too short")
+	}
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return nil
+}
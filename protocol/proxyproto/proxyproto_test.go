@@ -0,0 +1,296 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readTestHeader reads the header of a connection sending header then
+// "data", it returns the connection and the data read after the header
+func readTestHeader(header []byte) (*Conn, string, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(append(header, "data"...))
+		client.Close()
+	}()
+	c, err := readHeader(server)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadAll(c)
+	return c, string(data), err
+}
+
+// v2Header returns a version 2 header of command cmd and family fam with
+// the address block body
+func v2Header(cmd, fam byte, body []byte) []byte {
+	b := bytes.NewBuffer(nil)
+	b.Write(v2Signature)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(fam)
+	binary.Write(b, binary.BigEndian, uint16(len(body)))
+	b.Write(body)
+	return b.Bytes()
+}
+
+// v2Addrs returns the address block of src and dst
+func v2Addrs(src, dst *net.TCPAddr, size int) []byte {
+	b := bytes.NewBuffer(nil)
+	b.Write(src.IP[len(src.IP)-size:])
+	b.Write(dst.IP[len(dst.IP)-size:])
+	binary.Write(b, binary.BigEndian, uint16(src.Port))
+	binary.Write(b, binary.BigEndian, uint16(dst.Port))
+	return b.Bytes()
+}
+
+func TestReadV1(t *testing.T) {
+	at := assert.New(t)
+
+	c, data, err := readTestHeader([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 1935\r\n"))
+	at.Nil(err)
+	at.Equal("192.0.2.1:56324", c.RemoteAddr().String())
+	at.Equal("192.0.2.2:1935", c.LocalAddr().String())
+	at.Equal("data", data)
+
+	c, data, err = readTestHeader([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1935\r\n"))
+	at.Nil(err)
+	at.Equal("[2001:db8::1]:56324", c.RemoteAddr().String())
+	at.Equal("[2001:db8::2]:1935", c.LocalAddr().String())
+	at.Equal("data", data)
+
+	//the addresses of the connection are kept for UNKNOWN
+	c, data, err = readTestHeader([]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"))
+	at.Nil(err)
+	at.Equal("pipe", c.RemoteAddr().Network())
+	at.Equal("data", data)
+
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 65536\r\n",
+		"PROXY TCP4 invalid 192.0.2.2 56324 1935\r\n",
+		"PROXY UDP4 192.0.2.1 192.0.2.2 56324 1935\r\n",
+		"PROXI TCP4 192.0.2.1 192.0.2.2 56324 1935\r\n",
+		"GET / HTTP/1.1\r\n",
+	} {
+		_, _, err = readTestHeader([]byte(header))
+		at.NotNil(err, header)
+	}
+}
+
+func TestReadV1TooLong(t *testing.T) {
+	at := assert.New(t)
+
+	header := "PROXY TCP6 " + strings.Repeat("f", maxV1Length) + "\r\n"
+	_, _, err := readTestHeader([]byte(header))
+	at.NotNil(err)
+
+	//the longest header is read
+	header = "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"
+	at.Equal(maxV1Length-3, len(header))
+	_, _, err = readTestHeader([]byte(header))
+	at.Nil(err)
+}
+
+func TestReadV2(t *testing.T) {
+	at := assert.New(t)
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1935}
+
+	c, data, err := readTestHeader(v2Header(1, 0x11, v2Addrs(src, dst, net.IPv4len)))
+	at.Nil(err)
+	at.Equal("192.0.2.1:56324", c.RemoteAddr().String())
+	at.Equal("192.0.2.2:1935", c.LocalAddr().String())
+	at.Equal("data", data)
+
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1935}
+	c, data, err = readTestHeader(v2Header(1, 0x21, v2Addrs(src6, dst6, net.IPv6len)))
+	at.Nil(err)
+	at.Equal("[2001:db8::1]:56324", c.RemoteAddr().String())
+	at.Equal("data", data)
+
+	//TLVs following the addresses are skipped
+	body := append(v2Addrs(src, dst, net.IPv4len), 0x04, 0, 1, 0)
+	c, data, err = readTestHeader(v2Header(1, 0x11, body))
+	at.Nil(err)
+	at.Equal("192.0.2.1:56324", c.RemoteAddr().String())
+	at.Equal("data", data)
+}
+
+func TestReadV2Local(t *testing.T) {
+	at := assert.New(t)
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1935}
+
+	//the addresses of LOCAL commands are ignored
+	c, data, err := readTestHeader(v2Header(0, 0x11, v2Addrs(src, dst, net.IPv4len)))
+	at.Nil(err)
+	at.Equal("pipe", c.RemoteAddr().Network())
+	at.Equal("data", data)
+
+	c, data, err = readTestHeader(v2Header(0, 0, nil))
+	at.Nil(err)
+	at.Equal("pipe", c.RemoteAddr().Network())
+	at.Equal("data", data)
+
+	//other commands and versions are refused
+	_, _, err = readTestHeader(v2Header(2, 0x11, v2Addrs(src, dst, net.IPv4len)))
+	at.NotNil(err)
+	header := v2Header(1, 0x11, v2Addrs(src, dst, net.IPv4len))
+	header[12] = 0x11
+	_, _, err = readTestHeader(header)
+	at.NotNil(err)
+	header = v2Header(1, 0x11, v2Addrs(src, dst, net.IPv4len))
+	header[3] = 'X'
+	_, _, err = readTestHeader(header)
+	at.NotNil(err)
+}
+
+func TestReadV2Families(t *testing.T) {
+	at := assert.New(t)
+
+	//the addresses of AF_UNIX and unspecified families are ignored
+	c, data, err := readTestHeader(v2Header(1, 0x31, make([]byte, 216)))
+	at.Nil(err)
+	at.Equal("pipe", c.RemoteAddr().Network())
+	at.Equal("data", data)
+
+	c, data, err = readTestHeader(v2Header(1, 0x00, nil))
+	at.Nil(err)
+	at.Equal("pipe", c.RemoteAddr().Network())
+	at.Equal("data", data)
+
+	c, data, err = readTestHeader(v2Header(1, 0x41, make([]byte, 12)))
+	at.Nil(err)
+	at.Equal("pipe", c.RemoteAddr().Network())
+	at.Equal("data", data)
+}
+
+func TestReadV2Truncated(t *testing.T) {
+	at := assert.New(t)
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1935}
+
+	//address blocks shorter than the addresses of the family
+	_, _, err := readTestHeader(v2Header(1, 0x11, make([]byte, 8)))
+	at.NotNil(err)
+	_, _, err = readTestHeader(v2Header(1, 0x21, v2Addrs(src, dst, net.IPv6len)[:35]))
+	at.NotNil(err)
+
+	//headers ending before their length
+	header := v2Header(1, 0x21, v2Addrs(src, dst, net.IPv6len))
+	client, server := net.Pipe()
+	go func() {
+		client.Write(header[:30])
+		client.Close()
+	}()
+	_, err = readHeader(server)
+	at.NotNil(err)
+	server.Close()
+
+	client, server = net.Pipe()
+	go func() {
+		client.Write(header[:10])
+		client.Close()
+	}()
+	_, err = readHeader(server)
+	at.NotNil(err)
+	server.Close()
+}
+
+// acceptTest accepts a connection sending data to a Listener trusting
+// trusted, it returns the connection and what it sent after its header
+func acceptTest(t *testing.T, trusted string, data string) (net.Conn, string) {
+	_, n, err := net.ParseCIDR(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l, []*net.IPNet{n})
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte(data))
+	client.(*net.TCPConn).CloseWrite()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, string(b)
+}
+
+func TestListener(t *testing.T) {
+	at := assert.New(t)
+	header := "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1935\r\n"
+
+	//the headers of trusted sources are read
+	c, data := acceptTest(t, "127.0.0.0/8", header+"data")
+	at.Equal("192.0.2.1:56324", c.RemoteAddr().String())
+	at.Equal("192.0.2.2:1935", c.LocalAddr().String())
+	at.Equal("data", data)
+
+	//the connections of other sources are passed as they are
+	c, data = acceptTest(t, "10.0.0.0/8", header+"data")
+	at.True(strings.HasPrefix(c.RemoteAddr().String(), "127.0.0.1:"))
+	at.Equal(header+"data", data)
+}
+
+func TestListenerInvalidHeader(t *testing.T) {
+	at := assert.New(t)
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l, []*net.IPNet{n})
+	defer pl.Close()
+
+	//trusted sources without a header are closed
+	bad, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("GET / HTTP/1.1\r\n"))
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bad.Read(make([]byte, 1))
+	at.NotNil(err)
+
+	good, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	good.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 1935\r\n"))
+	c, err := pl.Accept()
+	at.Nil(err)
+	at.Equal("192.0.2.1:56324", c.RemoteAddr().String())
+	c.Close()
+
+	//Accept fails once the listener is closed
+	pl.Close()
+	_, err = pl.Accept()
+	at.NotNil(err)
+}
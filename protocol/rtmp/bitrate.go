@@ -0,0 +1,144 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+)
+
+// EgressStats are the bitrate sent to the players, the video packets they
+// skipped and the players refused because of max_egress
+type EgressStats struct {
+	Kbps    int    `json:"kbps"`
+	Max     int    `json:"max_kbps"`
+	Dropped uint64 `json:"dropped"`
+	Refused uint64 `json:"refused"`
+}
+
+// egress measures the bitrate sent to the players of all streams
+type egress struct {
+	av.Meter
+	dropped uint64
+	refused uint64
+}
+
+// over returns if the egress is over max_egress with the action drop
+func (e *egress) over(cfg *configure.ServerCfg) bool {
+	return cfg.MaxEgress > 0 && cfg.EgressAction != configure.EgressRefuse && e.Kbps() >= cfg.MaxEgress
+}
+
+// skip returns if p is not sent to the writer of v. Once the egress is
+// over max_egress, the video frames other than key frames are dropped and
+// the writer resumes at a key frame.
+func (e *egress) skip(v *PackWriterCloser, p *av.Packet, over bool) bool {
+	if !v.player || !p.IsVideo {
+		return false
+	}
+	if vh, ok := p.Header.(av.VideoPacketHeader); ok && (vh.IsKeyFrame() || vh.IsSeq()) {
+		v.waitKey = false
+		return false
+	}
+	if over || v.waitKey {
+		v.waitKey = true
+		atomic.AddUint64(&e.dropped, 1)
+		atomic.AddUint64(&v.dropped, 1)
+		return true
+	}
+	return false
+}
+
+// CheckEgress returns an error if new players are refused because the
+// egress is over max_egress
+func (rs *Streams) CheckEgress() error {
+	cfg := rs.conf.Current()
+	if cfg.MaxEgress == 0 || cfg.EgressAction != configure.EgressRefuse {
+		return nil
+	}
+	if kbps := rs.egress.Kbps(); kbps >= cfg.MaxEgress {
+		atomic.AddUint64(&rs.egress.refused, 1)
+		return fmt.Errorf("egress of %d kbps over max_egress %d kbps", kbps, cfg.MaxEgress)
+	}
+	return nil
+}
+
+// Egress returns the egress bitrate and counters
+func (rs *Streams) Egress() EgressStats {
+	return EgressStats{
+		Kbps:    rs.egress.Kbps(),
+		Max:     rs.conf.Current().MaxEgress,
+		Dropped: atomic.LoadUint64(&rs.egress.dropped),
+		Refused: atomic.LoadUint64(&rs.egress.refused),
+	}
+}
+
+// statusSender is implemented by connections which send status events
+type statusSender interface {
+	SendStatus(level, code, description string) error
+}
+
+// LimitBitrate sets the function returning the ingest bitrate limit in
+// kbps of the publisher and the action over it
+func (v *VirReader) LimitBitrate(limit func() (int, string)) {
+	v.limit = limit
+}
+
+// checkBitrate applies the bitrate limit once the statistics are updated
+func (v *VirReader) checkBitrate() error {
+	if v.limit == nil {
+		return nil
+	}
+	bw := v.ReadBW()
+	if bw.LastTimestamp == v.checked {
+		return nil
+	}
+	v.checked = bw.LastTimestamp
+	max, action := v.limit()
+	kbps := int(bw.VideoSpeedInBytesperMS + bw.AudioSpeedInBytesperMS)
+	over := max > 0 && kbps > max
+
+	if over != v.dropping && action == configure.BitrateDrop {
+		if over {
+			v.log.Warningf("publisher %v: %d kbps over max_bitrate %d kbps, dropping video", v.Info(), kbps, max)
+		} else {
+			v.log.Infof("publisher %v: %d kbps, video resumes", v.Info(), kbps)
+		}
+	}
+	v.dropping = over && action == configure.BitrateDrop
+	if !over {
+		return nil
+	}
+
+	switch action {
+	case configure.BitrateDisconnect:
+		err := fmt.Errorf("%d kbps over max_bitrate %d kbps", kbps, max)
+		if s, ok := v.conn.(statusSender); ok {
+			s.SendStatus("error", core.StatusPublishRejected, err.Error())
+		}
+		v.log.Warningf("publisher %v: %v, disconnecting", v.Info(), err)
+		return err
+	case configure.BitrateWarn:
+		v.log.Warningf("publisher %v: %d kbps over max_bitrate %d kbps", v.Info(), kbps, max)
+	}
+	return nil
+}
+
+// drop returns if p is dropped because the publisher is over its bitrate
+// limit, video resumes at a key frame
+func (v *VirReader) drop(p *av.Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	if vh, ok := p.Header.(av.VideoPacketHeader); ok && (vh.IsKeyFrame() || vh.IsSeq()) {
+		v.waitKey = false
+		return false
+	}
+	if v.dropping || v.waitKey {
+		v.waitKey = true
+		atomic.AddUint64(&v.dropped, 1)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// videoPacket returns a demuxed H.264 key frame or inter frame
+func videoPacket(key bool) *av.Packet {
+	data := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x02}
+	if key {
+		data = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x01}
+	}
+	p := &av.Packet{IsVideo: true, Data: data}
+	flv.NewDemuxer().DemuxH(p)
+	return p
+}
+
+func TestEgressSkip(t *testing.T) {
+	at := assert.New(t)
+	e := &egress{}
+	v := &PackWriterCloser{player: true}
+
+	//over max_egress, players skip video until a key frame
+	at.False(e.skip(v, videoPacket(false), false))
+	at.True(e.skip(v, videoPacket(false), true))
+	at.False(e.skip(v, &av.Packet{IsAudio: true}, true))
+	at.True(e.skip(v, videoPacket(false), false))
+	at.False(e.skip(v, videoPacket(true), true))
+	at.False(e.skip(v, videoPacket(false), false))
+	at.Equal(uint64(2), e.dropped)
+	at.Equal(uint64(2), v.dropped)
+
+	//recorders are not limited
+	at.False(e.skip(&PackWriterCloser{}, videoPacket(false), true))
+
+	cfg := configure.DefaultConfig()
+	at.False(e.over(&cfg))
+	cfg.MaxEgress = 1
+	cfg.EgressAction = configure.EgressRefuse
+	at.False(e.over(&cfg))
+}
+
+func TestVirReaderDrop(t *testing.T) {
+	at := assert.New(t)
+	v := &VirReader{}
+
+	at.False(v.drop(videoPacket(false)))
+	v.dropping = true
+	at.True(v.drop(videoPacket(false)))
+	at.False(v.drop(&av.Packet{IsAudio: true}))
+	at.False(v.drop(videoPacket(true)))
+	v.dropping = false
+	at.False(v.drop(videoPacket(false)))
+
+	//video resumes at a key frame
+	v.dropping = true
+	at.True(v.drop(videoPacket(false)))
+	v.dropping = false
+	at.True(v.drop(videoPacket(false)))
+	at.False(v.drop(videoPacket(true)))
+	at.Equal(uint64(3), v.dropped)
+}
+
+func TestBitrateLimits(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, func(cfg *configure.ServerCfg) {
+		cfg.MaxEgress = 1
+		cfg.EgressAction = configure.EgressRefuse
+		cfg.Server[0].BitrateAction = configure.BitrateDisconnect
+		cfg.Server[0].StreamBitrates = []configure.StreamBitrate{{Name: "room", MaxBitrate: 1}}
+	}, Hooks{})
+	defer s.close()
+
+	c, err := s.publish("room")
+	at.Nil(err)
+	defer c.Close(nil)
+	done := make(chan struct{})
+	defer close(done)
+	go sendVideo(c, 0, done)
+
+	//the egress is measured over a second
+	p, err := s.play("room")
+	at.Nil(err)
+	defer p.Close(nil)
+	_, err = readVideo(p, 150)
+	at.Nil(err)
+	at.True(s.streams.Egress().Kbps > 1)
+
+	p2, err := s.play("room")
+	if at.NotNil(err) {
+		at.Contains(err.Error(), core.StatusPlayFailed)
+	} else {
+		p2.Close(nil)
+	}
+	at.Equal(uint64(1), s.streams.Egress().Refused)
+
+	//the publisher is disconnected once its bitrate is measured
+	s.waitEvent(t, configure.EventPublishStop, "live/room")
+	at.False(s.streams.HasPublisher("live/room"))
+}
@@ -2,7 +2,6 @@ package cache
 
 import (
 	"github.com/gwuhaolin/livego/av"
-	"github.com/gwuhaolin/livego/configure"
 )
 
 // Cache is a cache of rtmp
@@ -14,9 +13,9 @@ type Cache struct {
 }
 
 // NewCache returns a Cache
-func NewCache() *Cache {
+func NewCache(gopNum int) *Cache {
 	return &Cache{
-		gop:      NewGopCache(configure.Config.GetInt("gop_num")),
+		gop:      NewGopCache(gopNum),
 		videoSeq: NewSpecialCache(),
 		audioSeq: NewSpecialCache(),
 		metadata: NewSpecialCache(),
@@ -52,23 +51,35 @@ func (cache *Cache) Write(p av.Packet) {
 	cache.gop.Write(&p)
 }
 
-// Send send the packets to WriteCloser
-func (cache *Cache) Send(w av.WriteCloser) error {
-	if err := cache.metadata.Send(w); err != nil {
+// Send send the packets to PacketWriter
+func (cache *Cache) Send(w av.PacketWriter) error {
+	if err := cache.SendHeaders(w); err != nil {
 		return err
 	}
 
-	if err := cache.videoSeq.Send(w); err != nil {
+	if err := cache.gop.Send(w); err != nil {
 		return err
 	}
 
-	if err := cache.audioSeq.Send(w); err != nil {
+	return nil
+}
+
+// SendHeaders sends the metadata and sequence headers to PacketWriter
+func (cache *Cache) SendHeaders(w av.PacketWriter) error {
+	if err := cache.metadata.Send(w); err != nil {
 		return err
 	}
 
-	if err := cache.gop.Send(w); err != nil {
+	if err := cache.videoSeq.Send(w); err != nil {
 		return err
 	}
 
-	return nil
+	return cache.audioSeq.Send(w)
+}
+
+// Rebase sets the timestamp of the metadata and sequence headers
+func (cache *Cache) Rebase(timestamp uint32) {
+	cache.metadata.rebase(timestamp)
+	cache.videoSeq.rebase(timestamp)
+	cache.audioSeq.rebase(timestamp)
 }
@@ -40,8 +40,8 @@ func (array *array) write(packet *av.Packet) error {
 	return nil
 }
 
-// send send all packet in this array to WriteCloser
-func (array *array) send(w av.WriteCloser) error {
+// send send all packet in this array to PacketWriter
+func (array *array) send(w av.PacketWriter) error {
 	var err error
 	for i := 0; i < array.index; i++ {
 		packet := array.packets[i]
@@ -104,7 +104,7 @@ func (gopCache *GopCache) Write(p *av.Packet) {
 	}
 }
 
-func (gopCache *GopCache) sendTo(w av.WriteCloser) error {
+func (gopCache *GopCache) sendTo(w av.PacketWriter) error {
 	var err error
 	pos := (gopCache.nextindex + 1) % gopCache.count
 	for i := 0; i < gopCache.num; i++ {
@@ -121,7 +121,7 @@ func (gopCache *GopCache) sendTo(w av.WriteCloser) error {
 	return nil
 }
 
-// Send sends all packet into WriteCloser
-func (gopCache *GopCache) Send(w av.WriteCloser) error {
+// Send sends all packet into PacketWriter
+func (gopCache *GopCache) Send(w av.PacketWriter) error {
 	return gopCache.sendTo(w)
 }
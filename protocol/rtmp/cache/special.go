@@ -44,10 +44,21 @@ func (specialCache *SpecialCache) Write(p *av.Packet) {
 	specialCache.full = true
 }
 
-// Send send packet to WriteCloser
-func (specialCache *SpecialCache) Send(w av.WriteCloser) error {
+// Send send packet to PacketWriter
+func (specialCache *SpecialCache) Send(w av.PacketWriter) error {
 	if !specialCache.full {
 		return nil
 	}
 	return w.Write(specialCache.p)
 }
+
+// rebase sets the timestamp of the packet, which is copied as it may be
+// queued by writers
+func (specialCache *SpecialCache) rebase(timestamp uint32) {
+	if !specialCache.full {
+		return
+	}
+	p := *specialCache.p
+	p.TimeStamp = timestamp
+	specialCache.p = &p
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+// idAggregate is the type of aggregate messages
+const idAggregate = 22
+
+/*
+   An aggregate message is a sequence of FLV tags:
+   +------+-------------+-----------+--------------+-----------+------+---------------+
+   | Type | Size        | Timestamp | Timestamp ext| Stream ID | Data | Back pointer  |
+   | 1    | 3           | 3         | 1            | 3         | Size | 4 (11 + Size) |
+   +------+-------------+-----------+--------------+-----------+------+---------------+
+*/
+const aggregateHeaderLen = 11
+
+// splitAggregate returns the messages of an aggregate message. Their
+// timestamps are rebased on the timestamp of the aggregate message.
+func splitAggregate(c *ChunkStream) ([]ChunkStream, error) {
+	var msgs []ChunkStream
+	var base uint32
+	b := c.Data
+	for len(b) > 0 {
+		if len(b) < aggregateHeaderLen {
+			return msgs, fmt.Errorf("aggregate header too short, %d bytes left", len(b))
+		}
+		typeID := uint32(b[0])
+		size := pio.U24BE(b[1:4])
+		ts := pio.U24BE(b[4:7]) | uint32(b[7])<<24
+		b = b[aggregateHeaderLen:]
+		if uint32(len(b)) < size {
+			return msgs, fmt.Errorf("aggregate message size=%d, %d bytes left", size, len(b))
+		}
+		if len(msgs) == 0 {
+			base = ts
+		}
+
+		switch typeID {
+		case av.TagAudio, av.TagVideo, av.TagScriptDataAMF0, av.TagScriptDataAMF3:
+			msgs = append(msgs, ChunkStream{
+				Format:    c.Format,
+				CSID:      c.CSID,
+				Timestamp: c.Timestamp + ts - base,
+				Length:    size,
+				TypeID:    typeID,
+				StreamID:  c.StreamID,
+				Data:      b[:size:size],
+			})
+		}
+		b = b[size:]
+
+		// the back pointer is optional at the end
+		if len(b) >= 4 {
+			b = b[4:]
+		} else {
+			b = nil
+		}
+	}
+	return msgs, nil
+}
+
+// NewAggregate returns an aggregate message of msgs, which must not be
+// empty. Its timestamp is the one of the first message.
+func NewAggregate(msgs []ChunkStream) ChunkStream {
+	length := 0
+	for _, msg := range msgs {
+		length += aggregateHeaderLen + len(msg.Data) + 4
+	}
+
+	data := make([]byte, length)
+	n := 0
+	for _, msg := range msgs {
+		size := len(msg.Data)
+		data[n] = byte(msg.TypeID)
+		pio.PutU24BE(data[n+1:], uint32(size))
+		pio.PutU24BE(data[n+4:], msg.Timestamp&0xffffff)
+		data[n+7] = byte(msg.Timestamp >> 24)
+		pio.PutU24BE(data[n+8:], 0)
+		n += aggregateHeaderLen
+		n += copy(data[n:], msg.Data)
+		pio.PutU32BE(data[n:], uint32(aggregateHeaderLen+size))
+		n += 4
+	}
+
+	return ChunkStream{
+		TypeID:    idAggregate,
+		Timestamp: msgs[0].Timestamp,
+		StreamID:  msgs[0].StreamID,
+		Length:    uint32(length),
+		Data:      data,
+	}
+}
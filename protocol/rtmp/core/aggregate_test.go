@@ -0,0 +1,81 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAggregate(t *testing.T) {
+	at := assert.New(t)
+	data := []byte{
+		//audio at 1000
+		0x08, 0x00, 0x00, 0x02, 0x00, 0x03, 0xe8, 0x00, 0x00, 0x00, 0x00, 0xaf, 0x01, 0x00, 0x00, 0x00, 0x0d,
+		//video at 1040
+		0x09, 0x00, 0x00, 0x03, 0x00, 0x04, 0x10, 0x00, 0x00, 0x00, 0x00, 0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x0e,
+		//unknown type is skipped
+		0x04, 0x00, 0x00, 0x01, 0x00, 0x04, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+		//audio at 1000 + 2^24 without back pointer
+		0x08, 0x00, 0x00, 0x01, 0x00, 0x03, 0xe8, 0x01, 0x00, 0x00, 0x00, 0xaf,
+	}
+	c := ChunkStream{
+		CSID:      6,
+		TypeID:    idAggregate,
+		Timestamp: 5000,
+		StreamID:  1,
+		Length:    uint32(len(data)),
+		Data:      data,
+	}
+	msgs, err := splitAggregate(&c)
+	at.Nil(err)
+	at.Equal(3, len(msgs))
+
+	at.Equal(uint32(8), msgs[0].TypeID)
+	at.Equal(uint32(5000), msgs[0].Timestamp)
+	at.Equal(uint32(1), msgs[0].StreamID)
+	at.Equal([]byte{0xaf, 0x01}, msgs[0].Data)
+
+	at.Equal(uint32(9), msgs[1].TypeID)
+	at.Equal(uint32(5040), msgs[1].Timestamp)
+	at.Equal(uint32(3), msgs[1].Length)
+	at.Equal([]byte{0x17, 0x01, 0x00}, msgs[1].Data)
+
+	at.Equal(uint32(5000+1<<24), msgs[2].Timestamp)
+
+	c.Data = data[:20]
+	msgs, err = splitAggregate(&c)
+	at.NotNil(err)
+	at.Equal(1, len(msgs))
+}
+
+func TestConnReadAggregate(t *testing.T) {
+	at := assert.New(t)
+	msgs := []ChunkStream{
+		{TypeID: 9, Timestamp: 0x1000000, StreamID: 1, Data: make([]byte, 150)},
+		{TypeID: 8, Timestamp: 0x1000010, StreamID: 1, Data: []byte{0xaf, 0x01, 0x02}},
+		{TypeID: 9, Timestamp: 0x1000020, StreamID: 1, Data: make([]byte, 10)},
+	}
+	msgs[0].Data[0] = 0x17
+	c := NewAggregate(msgs)
+	at.Equal(uint32(idAggregate), c.TypeID)
+	at.Equal(uint32(0x1000000), c.Timestamp)
+
+	wr := bytes.NewBuffer(nil)
+	conn := newTestConn(wr, wr)
+	at.Nil(conn.Write(&c))
+	conn.Flush()
+
+	conn = newTestConn(wr, ioutil.Discard)
+	for _, msg := range msgs {
+		var r ChunkStream
+		at.Nil(conn.Read(&r))
+		at.Equal(msg.TypeID, r.TypeID)
+		at.Equal(msg.Timestamp, r.Timestamp)
+		at.Equal(msg.Data, r.Data)
+	}
+	var r ChunkStream
+	at.Equal(io.EOF, conn.Read(&r))
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// replayCapture serves the client bytes of a capture and returns the
+// messages read from the published stream, one "type timestamp length"
+// line per message
+func replayCapture(data []byte) ([]string, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		//replies of the server are not checked
+		go io.Copy(ioutil.Discard, client)
+		client.Write(data)
+		client.Close()
+	}()
+
+	conn := NewConn(server, 4*1024)
+	if _, err := conn.ServerHandshake(false); err != nil {
+		return nil, err
+	}
+	connServer := NewConnServer(conn, nil)
+	ns, err := connServer.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ns.IsPublisher() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	go func() {
+		for {
+			if _, err := connServer.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var msgs []string
+	for {
+		var c ChunkStream
+		if err := ns.Read(&c); err != nil {
+			if err == io.EOF || err == io.ErrClosedPipe {
+				return msgs, nil
+			}
+			return msgs, err
+		}
+		msgs = append(msgs, fmt.Sprintf("%d %d %d", c.TypeID, c.Timestamp, c.Length))
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.rtmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no capture in testdata")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			at := assert.New(t)
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//the messages of the capture are listed in its .txt file
+			want, err := ioutil.ReadFile(strings.TrimSuffix(file, ".rtmp") + ".txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs, err := replayCapture(data)
+			at.Nil(err)
+			at.Equal(strings.Split(strings.TrimSpace(string(want)), "\n"), msgs)
+		})
+	}
+}
@@ -18,6 +18,7 @@ type ChunkStream struct {
 	StreamID  uint32
 	timeDelta uint32
 	exted     bool
+	extTS     uint32
 	index     uint32
 	remain    uint32
 	got       bool
@@ -36,6 +37,15 @@ func (chunkStream *ChunkStream) new(pool *pool.Pool) {
 	chunkStream.Data = pool.Get(int(chunkStream.Length))
 }
 
+// abort discards the partly received message, the header is kept for the
+// chunks of the next message
+func (chunkStream *ChunkStream) abort() {
+	chunkStream.got = false
+	chunkStream.index = 0
+	chunkStream.remain = 0
+	chunkStream.Data = nil
+}
+
 func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
 	//Chunk Basic Header
 	h := chunkStream.Format << 6
@@ -51,6 +61,8 @@ func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
 		h |= 1
 		w.WriteUintBE(h, 1)
 		w.WriteUintLE(chunkStream.CSID-64, 2)
+	default:
+		return fmt.Errorf("invalid csid=%d", chunkStream.CSID)
 	}
 	//Chunk Message Header
 	ts := chunkStream.Timestamp
@@ -86,7 +98,8 @@ func (chunkStream *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
 		chunkStream.CSID = 4
 	} else if chunkStream.TypeID == av.TagVideo ||
 		chunkStream.TypeID == av.TagScriptDataAMF0 ||
-		chunkStream.TypeID == av.TagScriptDataAMF3 {
+		chunkStream.TypeID == av.TagScriptDataAMF3 ||
+		chunkStream.TypeID == idAggregate {
 		chunkStream.CSID = 6
 	}
 
@@ -125,15 +138,6 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 	if chunkStream.remain != 0 && chunkStream.tmpFromat != 3 {
 		return fmt.Errorf("invalid remain = %d", chunkStream.remain)
 	}
-	switch chunkStream.CSID {
-	case 0:
-		id, _ := r.ReadUintLE(1)
-		chunkStream.CSID = id + 64
-	case 1:
-		id, _ := r.ReadUintLE(2)
-		chunkStream.CSID = id + 64
-	}
-
 	switch chunkStream.tmpFromat {
 	case 0:
 		chunkStream.Format = chunkStream.tmpFromat
@@ -144,6 +148,7 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		if chunkStream.Timestamp == 0xffffff {
 			chunkStream.Timestamp, _ = r.ReadUintBE(4)
 			chunkStream.exted = true
+			chunkStream.extTS = chunkStream.Timestamp
 		} else {
 			chunkStream.exted = false
 		}
@@ -156,6 +161,7 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		if timeStamp == 0xffffff {
 			timeStamp, _ = r.ReadUintBE(4)
 			chunkStream.exted = true
+			chunkStream.extTS = timeStamp
 		} else {
 			chunkStream.exted = false
 		}
@@ -168,6 +174,7 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		if timeStamp == 0xffffff {
 			timeStamp, _ = r.ReadUintBE(4)
 			chunkStream.exted = true
+			chunkStream.extTS = timeStamp
 		} else {
 			chunkStream.exted = false
 		}
@@ -176,48 +183,48 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		chunkStream.new(pool)
 	case 3:
 		if chunkStream.remain == 0 {
+			// a new message with the header of the previous one, the
+			// extended timestamp is repeated if the previous one had it
+			if chunkStream.exted {
+				chunkStream.extTS, _ = r.ReadUintBE(4)
+			}
 			switch chunkStream.Format {
 			case 0:
 				if chunkStream.exted {
-					timestamp, _ := r.ReadUintBE(4)
-					chunkStream.Timestamp = timestamp
+					chunkStream.Timestamp = chunkStream.extTS
 				}
 			case 1, 2:
-				var timedet uint32
 				if chunkStream.exted {
-					timedet, _ = r.ReadUintBE(4)
-				} else {
-					timedet = chunkStream.timeDelta
+					chunkStream.timeDelta = chunkStream.extTS
 				}
-				chunkStream.Timestamp += timedet
+				chunkStream.Timestamp += chunkStream.timeDelta
 			}
 			chunkStream.new(pool)
-		} else {
-			if chunkStream.exted {
-				b, err := r.Peek(4)
-				if err != nil {
-					return err
-				}
-				tmpts := binary.BigEndian.Uint32(b)
-				if tmpts == chunkStream.Timestamp {
-					r.Discard(4)
-				}
+		} else if chunkStream.exted {
+			// continuation chunks should repeat the extended timestamp
+			// but some encoders leave it out
+			b, err := r.Peek(4)
+			if err != nil {
+				return err
+			}
+			if binary.BigEndian.Uint32(b) == chunkStream.extTS {
+				r.Discard(4)
 			}
 		}
 	default:
 		return fmt.Errorf("invalid format=%d", chunkStream.Format)
 	}
-	size := int(chunkStream.remain)
-	if size > int(chunkSize) {
-		size = int(chunkSize)
+	size := chunkStream.remain
+	if size > chunkSize {
+		size = chunkSize
 	}
 
-	buf := chunkStream.Data[chunkStream.index : chunkStream.index+uint32(size)]
+	buf := chunkStream.Data[chunkStream.index : chunkStream.index+size]
 	if _, err := r.Read(buf); err != nil {
 		return err
 	}
-	chunkStream.index += uint32(size)
-	chunkStream.remain -= uint32(size)
+	chunkStream.index += size
+	chunkStream.remain -= size
 	if chunkStream.remain == 0 {
 		chunkStream.got = true
 	}
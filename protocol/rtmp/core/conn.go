@@ -2,11 +2,15 @@ package core
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/utils/pio"
 	"github.com/gwuhaolin/livego/utils/pool"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -26,15 +30,22 @@ type Conn struct {
 	remoteChunkSize     uint32
 	windowAckSize       uint32
 	remoteWindowAckSize uint32
-	received            uint32
-	ackReceived         uint32
+	ackReceived         uint32 // sequence number of the last ack
 	rw                  *ReadWriter
 	pool                *pool.Pool
 	chunks              map[uint32]ChunkStream
+	pending             []ChunkStream // rest of a split aggregate message
+	// wlock serializes writes, acknowledgements are written by the reading
+	// goroutine and shared object messages by other connections
+	wlock     sync.Mutex
+	created   time.Time
+	heartbeat heartbeat
+	log       *log.Logger
 }
 
 // NewConn returns a rtmp connection
 func NewConn(c net.Conn, bufferSize int) *Conn {
+	now := time.Now()
 	return &Conn{
 		Conn:                c,
 		chunkSize:           128,
@@ -44,19 +55,47 @@ func NewConn(c net.Conn, bufferSize int) *Conn {
 		pool:                pool.NewPool(),
 		rw:                  NewReadWriter(c, bufferSize),
 		chunks:              make(map[uint32]ChunkStream),
+		created:             now,
+		heartbeat:           heartbeat{stats: Heartbeat{LastRead: now}},
+		log:                 log.StandardLogger(),
 	}
 }
 
-// Read reads from connection to ChunckStream
+// SetLogger makes the connection and its streams log to l instead of the
+// standard logger
+func (conn *Conn) SetLogger(l *log.Logger) {
+	conn.log = l
+}
+
+// Read reads from connection to ChunckStream, the messages of an aggregate
+// message are returned one by one
 func (conn *Conn) Read(c *ChunkStream) error {
+	for len(conn.pending) == 0 {
+		if err := conn.readMessage(c); err != nil {
+			return err
+		}
+		if c.TypeID != idAggregate {
+			return nil
+		}
+		msgs, err := splitAggregate(c)
+		if err != nil {
+			conn.log.Warning("split aggregate message: ", err)
+		}
+		conn.pending = msgs
+	}
+
+	*c = conn.pending[0]
+	conn.pending = conn.pending[1:]
+	return nil
+}
+
+// readMessage reads the chunks of a message until it is complete
+func (conn *Conn) readMessage(c *ChunkStream) error {
 	for {
-		h, _ := conn.rw.ReadUintBE(1)
-		// if err != nil {
-		// 	log.Println("read from conn error: ", err)
-		// 	return err
-		// }
-		format := h >> 6
-		csid := h & 0x3f
+		format, csid, err := conn.readBasicHeader()
+		if err != nil {
+			return err
+		}
 		cs, ok := conn.chunks[csid]
 		if !ok {
 			cs = ChunkStream{}
@@ -64,7 +103,7 @@ func (conn *Conn) Read(c *ChunkStream) error {
 		}
 		cs.tmpFromat = format
 		cs.CSID = csid
-		err := cs.readChunk(conn.rw, conn.remoteChunkSize, conn.pool)
+		err = cs.readChunk(conn.rw, conn.remoteChunkSize, conn.pool)
 		if err != nil {
 			return err
 		}
@@ -76,21 +115,58 @@ func (conn *Conn) Read(c *ChunkStream) error {
 	}
 
 	conn.handleControlMsg(c)
+	conn.heartbeat.read(c)
+	if err := conn.handleUserControl(c); err != nil {
+		return err
+	}
 
-	conn.ack(c.Length)
+	return conn.ack()
+}
 
-	return nil
+// readBasicHeader reads the format and chunk stream id of a chunk,
+// ids from 64 are sent in 2 or 3 bytes
+func (conn *Conn) readBasicHeader() (uint32, uint32, error) {
+	h, err := conn.rw.ReadUintBE(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	format := h >> 6
+	csid := h & 0x3f
+	switch csid {
+	case 0:
+		id, err := conn.rw.ReadUintLE(1)
+		if err != nil {
+			return 0, 0, err
+		}
+		csid = id + 64
+	case 1:
+		id, err := conn.rw.ReadUintLE(2)
+		if err != nil {
+			return 0, 0, err
+		}
+		csid = id + 64
+	}
+	return format, csid, nil
 }
 
 func (conn *Conn) Write(c *ChunkStream) error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
 	if c.TypeID == idSetChunkSize {
-		conn.chunkSize = binary.BigEndian.Uint32(c.Data)
+		size, err := chunkSize(c)
+		if err != nil {
+			return err
+		}
+		conn.chunkSize = size
 	}
 	return c.writeChunk(conn.rw, int(conn.chunkSize))
 }
 
 // Flush flushes unwritten bytes
 func (conn *Conn) Flush() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
 	return conn.rw.Flush()
 }
 
@@ -136,25 +212,51 @@ func (conn *Conn) NewSetPeerBandwidth(size uint32) ChunkStream {
 	return ret
 }
 
-func (conn *Conn) handleControlMsg(c *ChunkStream) {
-	if c.TypeID == idSetChunkSize {
-		conn.remoteChunkSize = binary.BigEndian.Uint32(c.Data)
-	} else if c.TypeID == idWindowAckSize {
-		conn.remoteWindowAckSize = binary.BigEndian.Uint32(c.Data)
+// chunkSize returns the size of a set chunk size message, which is
+// from 1 to 0x7FFFFFFF
+func chunkSize(c *ChunkStream) (uint32, error) {
+	if len(c.Data) < 4 {
+		return 0, fmt.Errorf("invalid set chunk size length=%d", len(c.Data))
+	}
+	size := binary.BigEndian.Uint32(c.Data) & 0x7fffffff
+	if size == 0 {
+		return 0, fmt.Errorf("invalid chunk size=0")
 	}
+	return size, nil
 }
 
-func (conn *Conn) ack(size uint32) {
-	conn.received += uint32(size)
-	conn.ackReceived += uint32(size)
-	if conn.received >= 0xf0000000 {
-		conn.received = 0
+func (conn *Conn) handleControlMsg(c *ChunkStream) {
+	switch c.TypeID {
+	case idSetChunkSize:
+		if size, err := chunkSize(c); err == nil {
+			conn.remoteChunkSize = size
+		}
+	case idAbortMessages:
+		if len(c.Data) >= 4 {
+			csid := binary.BigEndian.Uint32(c.Data)
+			if cs, ok := conn.chunks[csid]; ok {
+				cs.abort()
+				conn.chunks[csid] = cs
+			}
+		}
+	case idWindowAckSize:
+		if len(c.Data) >= 4 {
+			conn.remoteWindowAckSize = binary.BigEndian.Uint32(c.Data)
+		}
 	}
-	if conn.ackReceived >= conn.remoteWindowAckSize {
-		cs := conn.NewAck(conn.ackReceived)
-		cs.writeChunk(conn.rw, int(conn.chunkSize))
-		conn.ackReceived = 0
+}
+
+// ack acknowledges the bytes received once the window of the peer is
+// reached, the sequence number is the total number of bytes received
+func (conn *Conn) ack() error {
+	received := conn.rw.Received()
+	if conn.remoteWindowAckSize == 0 || received-conn.ackReceived < conn.remoteWindowAckSize {
+		return nil
 	}
+	conn.ackReceived = received
+
+	cs := conn.NewAck(received)
+	return conn.writeControl(&cs)
 }
 
 func initControlMsg(id, size, value uint32) ChunkStream {
@@ -193,7 +295,7 @@ func (conn *Conn) userControlMsg(eventType, buflen uint32) ChunkStream {
 		Format:   0,
 		CSID:     2,
 		TypeID:   4,
-		StreamID: 1,
+		StreamID: 0,
 		Length:   buflen,
 		Data:     make([]byte, buflen),
 	}
@@ -202,20 +304,16 @@ func (conn *Conn) userControlMsg(eventType, buflen uint32) ChunkStream {
 	return ret
 }
 
-// SetBegin sets begin message
-func (conn *Conn) SetBegin() {
+// SetBegin sets begin message of a stream
+func (conn *Conn) SetBegin(streamID uint32) {
 	ret := conn.userControlMsg(streamBegin, 4)
-	for i := 0; i < 4; i++ {
-		ret.Data[2+i] = byte(1 >> uint32((3-i)*8) & 0xff)
-	}
+	pio.PutU32BE(ret.Data[2:], streamID)
 	conn.Write(&ret)
 }
 
-// SetRecorded sets recorded message
-func (conn *Conn) SetRecorded() {
+// SetRecorded sets recorded message of a stream
+func (conn *Conn) SetRecorded(streamID uint32) {
 	ret := conn.userControlMsg(streamIsRecorded, 4)
-	for i := 0; i < 4; i++ {
-		ret.Data[2+i] = byte(1 >> uint32((3-i)*8) & 0xff)
-	}
+	pio.PutU32BE(ret.Data[2:], streamID)
 	conn.Write(&ret)
 }
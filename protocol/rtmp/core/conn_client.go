@@ -45,6 +45,7 @@ type ConnClient struct {
 	encoder    *amf.Encoder
 	decoder    *amf.Decoder
 	bytesw     *bytes.Buffer
+	log        *log.Logger
 }
 
 // NewConnClient returns a ConnClient
@@ -54,9 +55,16 @@ func NewConnClient() *ConnClient {
 		bytesw:  bytes.NewBuffer(nil),
 		encoder: &amf.Encoder{},
 		decoder: &amf.Decoder{},
+		log:     log.StandardLogger(),
 	}
 }
 
+// SetLogger makes the client and its connection log to l instead of the
+// standard logger
+func (connClient *ConnClient) SetLogger(l *log.Logger) {
+	connClient.log = l
+}
+
 // DecodeBatch decodes from reader in batch
 func (connClient *ConnClient) DecodeBatch(r io.Reader, ver amf.Version) (ret []interface{}, err error) {
 	vs, err := connClient.decoder.DecodeBatch(r, ver)
@@ -75,10 +83,9 @@ func (connClient *ConnClient) readRespMsg() error {
 		}
 		switch rc.TypeID {
 		case 20, 17:
-			r := bytes.NewReader(rc.Data)
-			vs, _ := connClient.decoder.DecodeBatch(r, amf.AMF0)
+			vs, _ := DecodeCommand(&rc)
 
-			log.Debugf("readRespMsg: vs=%v", vs)
+			connClient.log.Debugf("readRespMsg: vs=%v", vs)
 			for k, v := range vs {
 				switch v.(type) {
 				case string:
@@ -123,6 +130,10 @@ func (connClient *ConnClient) readRespMsg() error {
 						if ok && code.(string) != publishStart {
 							return ErrResponse
 						}
+					case cmdPlay:
+						if objmap["level"] == "error" {
+							return fmt.Errorf("play failed: %v", objmap["code"])
+						}
 					}
 				}
 			}
@@ -161,7 +172,7 @@ func (connClient *ConnClient) writeConnectMsg() error {
 	event["tcUrl"] = connClient.tcurl
 	connClient.curcmdName = cmdConnect
 
-	log.Debugf("writeConnectMsg: connClient.transID=%d, event=%v", connClient.transID, event)
+	connClient.log.Debugf("writeConnectMsg: connClient.transID=%d, event=%v", connClient.transID, event)
 	if err := connClient.writeMsg(cmdConnect, connClient.transID, event); err != nil {
 		return err
 	}
@@ -172,7 +183,7 @@ func (connClient *ConnClient) writeCreateStreamMsg() error {
 	connClient.transID++
 	connClient.curcmdName = cmdCreateStream
 
-	log.Debugf("writeCreateStreamMsg: connClient.transID=%d", connClient.transID)
+	connClient.log.Debugf("writeCreateStreamMsg: connClient.transID=%d", connClient.transID)
 	if err := connClient.writeMsg(cmdCreateStream, connClient.transID, nil); err != nil {
 		return err
 	}
@@ -184,7 +195,7 @@ func (connClient *ConnClient) writeCreateStreamMsg() error {
 		}
 
 		if err == ErrResponse {
-			log.Debugf("writeCreateStreamMsg readRespMsg err=%v", err)
+			connClient.log.Debugf("writeCreateStreamMsg readRespMsg err=%v", err)
 			return err
 		}
 	}
@@ -194,7 +205,7 @@ func (connClient *ConnClient) writeCreateStreamMsg() error {
 func (connClient *ConnClient) writePublishMsg() error {
 	connClient.transID++
 	connClient.curcmdName = cmdPublish
-	if err := connClient.writeMsg(cmdPublish, connClient.transID, nil, connClient.title, publishLive); err != nil {
+	if err := connClient.writeMsg(cmdPublish, connClient.transID, nil, connClient.streamName(), publishLive); err != nil {
 		return err
 	}
 	return connClient.readRespMsg()
@@ -203,31 +214,49 @@ func (connClient *ConnClient) writePublishMsg() error {
 func (connClient *ConnClient) writePlayMsg() error {
 	connClient.transID++
 	connClient.curcmdName = cmdPlay
-	log.Debugf("writePlayMsg: connClient.transID=%d, cmdPlay=%v, connClient.title=%v",
+	connClient.log.Debugf("writePlayMsg: connClient.transID=%d, cmdPlay=%v, connClient.title=%v",
 		connClient.transID, cmdPlay, connClient.title)
 
-	if err := connClient.writeMsg(cmdPlay, 0, nil, connClient.title); err != nil {
+	if err := connClient.writeMsg(cmdPlay, 0, nil, connClient.streamName()); err != nil {
 		return err
 	}
 	return connClient.readRespMsg()
 }
 
-// Start starts the connection
-func (connClient *ConnClient) Start(url string, method string) error {
+// streamName returns the name sent by publish and play, with the query of
+// the url like other clients
+func (connClient *ConnClient) streamName() string {
+	if connClient.query == "" {
+		return connClient.title
+	}
+	return connClient.title + "?" + connClient.query
+}
+
+// parseURL sets the app, stream name and tcUrl of url
+func (connClient *ConnClient) parseURL(url string) (*neturl.URL, error) {
 	u, err := neturl.Parse(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	connClient.url = url
 	path := strings.TrimLeft(u.Path, "/")
 	ps := strings.SplitN(path, "/", 2)
 	if len(ps) != 2 {
-		return fmt.Errorf("u path err: %s", path)
+		return nil, fmt.Errorf("u path err: %s", path)
 	}
 	connClient.app = ps[0]
 	connClient.title = ps[1]
 	connClient.query = u.RawQuery
 	connClient.tcurl = "rtmp://" + u.Host + "/" + connClient.app
+	return u, nil
+}
+
+// Start starts the connection
+func (connClient *ConnClient) Start(url string, method string) error {
+	u, err := connClient.parseURL(url)
+	if err != nil {
+		return err
+	}
 	port := ":1935"
 	host := u.Host
 	localIP := ":0"
@@ -240,9 +269,9 @@ func (connClient *ConnClient) Start(url string, method string) error {
 		port = ":" + port
 	}
 	ips, err := net.LookupIP(host)
-	log.Debugf("ips: %v, host: %v", ips, host)
+	connClient.log.Debugf("ips: %v, host: %v", ips, host)
 	if err != nil {
-		log.Warning(err)
+		connClient.log.Warning(err)
 		return err
 	}
 	remoteIP = ips[rand.Intn(len(ips))].String()
@@ -252,41 +281,55 @@ func (connClient *ConnClient) Start(url string, method string) error {
 
 	local, err := net.ResolveTCPAddr("tcp", localIP)
 	if err != nil {
-		log.Warning(err)
+		connClient.log.Warning(err)
 		return err
 	}
-	log.Debug("remoteIP: ", remoteIP)
+	connClient.log.Debug("remoteIP: ", remoteIP)
 	remote, err := net.ResolveTCPAddr("tcp", remoteIP)
 	if err != nil {
-		log.Warning(err)
+		connClient.log.Warning(err)
 		return err
 	}
 	conn, err := net.DialTCP("tcp", local, remote)
 	if err != nil {
-		log.Warning(err)
+		connClient.log.Warning(err)
 		return err
 	}
 
-	log.Debug("connection:", "local:", conn.LocalAddr(), "remote:", conn.RemoteAddr())
+	connClient.log.Debug("connection:", "local:", conn.LocalAddr(), "remote:", conn.RemoteAddr())
+
+	return connClient.start(conn, method)
+}
 
+// StartConn starts the session of url on conn, a connection made by the
+// caller such as a tunnel
+func (connClient *ConnClient) StartConn(conn net.Conn, url string, method string) error {
+	if _, err := connClient.parseURL(url); err != nil {
+		return err
+	}
+	return connClient.start(conn, method)
+}
+
+func (connClient *ConnClient) start(conn net.Conn, method string) error {
 	connClient.conn = NewConn(conn, 4*1024)
+	connClient.conn.SetLogger(connClient.log)
 
-	log.Debug("HandshakeClient....")
+	connClient.log.Debug("HandshakeClient....")
 	if err := connClient.conn.HandshakeClient(); err != nil {
 		return err
 	}
 
-	log.Debug("writeConnectMsg....")
+	connClient.log.Debug("writeConnectMsg....")
 	if err := connClient.writeConnectMsg(); err != nil {
 		return err
 	}
-	log.Debug("writeCreateStreamMsg....")
+	connClient.log.Debug("writeCreateStreamMsg....")
 	if err := connClient.writeCreateStreamMsg(); err != nil {
-		log.Debug("writeCreateStreamMsg error", err)
+		connClient.log.Debug("writeCreateStreamMsg error", err)
 		return err
 	}
 
-	log.Debug("method control:", method, av.PUBLISH, av.PLAY)
+	connClient.log.Debug("method control:", method, av.PUBLISH, av.PLAY)
 	if method == av.PUBLISH {
 		if err := connClient.writePublishMsg(); err != nil {
 			return err
@@ -336,5 +379,7 @@ func (connClient *ConnClient) StreamID() uint32 {
 
 // Close closes thie ConnClient
 func (connClient *ConnClient) Close(err error) {
-	connClient.conn.Close()
+	if connClient.conn != nil {
+		connClient.conn.Close()
+	}
 }
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/protocol/amf"
-
-	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -28,11 +28,36 @@ var (
 	cmdReleaseStream = "releaseStream"
 	cmdCreateStream  = "createStream"
 	cmdPublish       = "publish"
-	cmdFCUnpublish   = "FCUnpublish"
-	cmdDeleteStream  = "deleteStream"
 	cmdPlay          = "play"
 )
 
+// NetStream commands handled after publishing or playing started
+const (
+	CmdPause        = "pause"
+	CmdSeek         = "seek"
+	CmdReceiveAudio = "receiveAudio"
+	CmdReceiveVideo = "receiveVideo"
+	CmdCloseStream  = "closeStream"
+	CmdDeleteStream = "deleteStream"
+	CmdFCUnpublish  = "FCUnpublish"
+)
+
+// Status codes of rejected connections and streams
+const (
+	StatusConnectRejected    = "NetConnection.Connect.Rejected"
+	StatusPublishBadName     = "NetStream.Publish.BadName"
+	StatusPublishRejected    = "NetStream.Publish.Rejected"
+	StatusPlayStreamNotFound = "NetStream.Play.StreamNotFound"
+	StatusPlayFailed         = "NetStream.Play.Failed"
+)
+
+// StreamCommand is a NetStream command of a publisher or player
+type StreamCommand struct {
+	Name string
+	// Flag is the flag of pause, receiveAudio and receiveVideo
+	Flag bool
+}
+
 // ConnectInfo is the connection information
 type ConnectInfo struct {
 	App            string `amf:"app" json:"app"`
@@ -67,48 +92,73 @@ type PublishInfo struct {
 
 // ConnServer is the connection server
 type ConnServer struct {
-	ConnInfo    ConnectInfo
-	PublishInfo PublishInfo
+	ConnInfo ConnectInfo
+	// CheckConnect rejects the connect command if it returns an error
+	CheckConnect func(ConnectInfo) error
 
-	done          bool
-	streamID      int
-	isPublisher   bool
+	lock          sync.Mutex
+	streams       map[uint32]*NetStream
+	lastStreamID  uint32
 	conn          *Conn
-	transactionID int
-	decoder       *amf.Decoder
-	encoder       *amf.Encoder
-	bytesw        *bytes.Buffer
+	transactionID int  // only accessed by the goroutine calling Accept
+	connected     bool // only accessed by the goroutine calling Accept
+	sharedObjects *SharedObjects
 }
 
-// NewConnServer returns a new connection server
-func NewConnServer(conn *Conn) *ConnServer {
+// NewConnServer returns a new connection server, shared object messages
+// are ignored if sharedObjects is nil
+func NewConnServer(conn *Conn, sharedObjects *SharedObjects) *ConnServer {
 	return &ConnServer{
-		conn:     conn,
-		streamID: 1,
-		bytesw:   bytes.NewBuffer(nil),
-		decoder:  &amf.Decoder{},
-		encoder:  &amf.Encoder{},
+		conn:          conn,
+		streams:       make(map[uint32]*NetStream),
+		sharedObjects: sharedObjects,
 	}
 }
 
+// writeMsg sends a command in the object encoding of the client. AMF3
+// commands are AMF0 values with objects switched to AMF3. The streams of
+// the connection send their commands from their own goroutines, so every
+// message is encoded in its own buffer.
 func (connServer *ConnServer) writeMsg(csid, streamID uint32, args ...interface{}) error {
-	connServer.bytesw.Reset()
+	b := bytes.NewBuffer(nil)
+	encoder := &amf.Encoder{}
+	typeID := uint32(20)
+	if connServer.ConnInfo.ObjectEncoding == amf.AMF3 {
+		typeID = 17
+		b.WriteByte(0)
+	}
 	for _, v := range args {
-		if _, err := connServer.encoder.Encode(connServer.bytesw, amf.AMF0, v); err != nil {
+		if obj, ok := v.(amf.Object); ok && typeID == 17 {
+			if err := encoder.EncodeAmf0Amf3Marker(b); err != nil {
+				return err
+			}
+			if _, err := encoder.EncodeAmf3(b, obj); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := encoder.Encode(b, amf.AMF0, v); err != nil {
 			return err
 		}
 	}
-	msg := connServer.bytesw.Bytes()
+	msg := b.Bytes()
 	c := ChunkStream{
 		Format:    0,
 		CSID:      csid,
 		Timestamp: 0,
-		TypeID:    20,
+		TypeID:    typeID,
 		StreamID:  streamID,
 		Length:    uint32(len(msg)),
 		Data:      msg,
 	}
-	connServer.conn.Write(&c)
+	return connServer.writeChunk(&c)
+}
+
+// writeChunk writes and flushes a message
+func (connServer *ConnServer) writeChunk(c *ChunkStream) error {
+	if err := connServer.conn.Write(c); err != nil {
+		return err
+	}
 	return connServer.conn.Flush()
 }
 
@@ -169,6 +219,14 @@ func (connServer *ConnServer) connectResp(cur *ChunkStream) error {
 	return connServer.writeMsg(cur.CSID, cur.StreamID, "_result", connServer.transactionID, resp, event)
 }
 
+func (connServer *ConnServer) connectReject(cur *ChunkStream, description string) error {
+	event := make(amf.Object)
+	event["level"] = "error"
+	event["code"] = StatusConnectRejected
+	event["description"] = description
+	return connServer.writeMsg(cur.CSID, cur.StreamID, "_error", connServer.transactionID, nil, event)
+}
+
 func (connServer *ConnServer) createStream(vs []interface{}) error {
 	for _, v := range vs {
 		switch v.(type) {
@@ -182,17 +240,22 @@ func (connServer *ConnServer) createStream(vs []interface{}) error {
 }
 
 func (connServer *ConnServer) createStreamResp(cur *ChunkStream) error {
-	return connServer.writeMsg(cur.CSID, cur.StreamID, "_result", connServer.transactionID, nil, connServer.streamID)
+	connServer.lock.Lock()
+	connServer.lastStreamID++
+	id := connServer.lastStreamID
+	connServer.streams[id] = newNetStream(connServer, id)
+	connServer.lock.Unlock()
+	return connServer.writeMsg(cur.CSID, cur.StreamID, "_result", connServer.transactionID, nil, id)
 }
 
-func (connServer *ConnServer) publishOrPlay(vs []interface{}) error {
+func (connServer *ConnServer) publishOrPlay(ns *NetStream, vs []interface{}) error {
 	for k, v := range vs {
 		switch v.(type) {
 		case string:
 			if k == 2 {
-				connServer.PublishInfo.Name = v.(string)
+				ns.PublishInfo.Name = v.(string)
 			} else if k == 3 {
-				connServer.PublishInfo.Type = v.(string)
+				ns.PublishInfo.Type = v.(string)
 			}
 		case float64:
 			id := int(v.(float64))
@@ -213,8 +276,8 @@ func (connServer *ConnServer) publishResp(cur *ChunkStream) error {
 }
 
 func (connServer *ConnServer) playResp(cur *ChunkStream) error {
-	connServer.conn.SetRecorded()
-	connServer.conn.SetBegin()
+	connServer.conn.SetRecorded(cur.StreamID)
+	connServer.conn.SetBegin(cur.StreamID)
 
 	event := make(amf.Object)
 	event["level"] = "status"
@@ -244,106 +307,350 @@ func (connServer *ConnServer) playResp(cur *ChunkStream) error {
 	if err := connServer.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event); err != nil {
 		return err
 	}
-	return connServer.conn.Flush()
+	return connServer.Flush()
 }
 
-func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
-	amfType := amf.AMF0
-	if c.TypeID == 17 {
-		c.Data = c.Data[1:]
+// DecodeCommand decodes the values of a command message. AMF3 commands
+// start with a zero byte, followed by AMF0 values which may switch to AMF3,
+// or by AMF3 values for some clients. The reference tables of AMF3 are per
+// message.
+func DecodeCommand(c *ChunkStream) ([]interface{}, error) {
+	data := c.Data
+	ver := amf.Version(amf.AMF0)
+	if c.TypeID == 17 && len(data) > 0 {
+		data = data[1:]
+		// the command name tells the encoding
+		if len(data) > 0 && data[0] == amf.AMF3StringMarker {
+			ver = amf.AMF3
+		}
 	}
-	r := bytes.NewReader(c.Data)
-	vs, err := connServer.decoder.DecodeBatch(r, amf.Version(amfType))
+	vs, err := amf.NewDecoder().DecodeBatch(bytes.NewReader(data), ver)
 	if err != nil && err != io.EOF {
-		return err
+		return nil, err
 	}
-	// log.Debugf("rtmp req: %#v", vs)
-	switch vs[0].(type) {
-	case string:
-		switch vs[0].(string) {
-		case cmdConnect:
-			if err = connServer.connect(vs[1:]); err != nil {
-				return err
-			}
-			if err = connServer.connectResp(c); err != nil {
-				return err
-			}
-		case cmdCreateStream:
-			if err = connServer.createStream(vs[1:]); err != nil {
-				return err
-			}
-			if err = connServer.createStreamResp(c); err != nil {
-				return err
-			}
-		case cmdPublish:
-			if err = connServer.publishOrPlay(vs[1:]); err != nil {
-				return err
-			}
-			if err = connServer.publishResp(c); err != nil {
-				return err
+	if len(vs) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	for i, v := range vs {
+		vs[i] = normalize(v)
+	}
+	return vs, nil
+}
+
+// normalize converts AMF3 integers to float64 like AMF0 numbers
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int32:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case amf.Object:
+		for key, val := range v {
+			v[key] = normalize(val)
+		}
+	}
+	return v
+}
+
+// handleCmdMsg handles a command of the connection, it returns the stream
+// which started publishing or playing
+func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) (*NetStream, error) {
+	vs, err := DecodeCommand(c)
+	if err != nil {
+		return nil, err
+	}
+	// connServer.conn.log.Debugf("rtmp req: %#v", vs)
+	name, _ := vs[0].(string)
+	switch name {
+	case cmdConnect:
+		if err = connServer.connect(vs[1:]); err != nil {
+			return nil, err
+		}
+		if connServer.CheckConnect != nil {
+			if err = connServer.CheckConnect(connServer.ConnInfo); err != nil {
+				connServer.connectReject(c, err.Error())
+				return nil, err
 			}
-			connServer.done = true
-			connServer.isPublisher = true
-			log.Debug("handle publish req done")
-		case cmdPlay:
-			if err = connServer.publishOrPlay(vs[1:]); err != nil {
-				return err
+		}
+		if err = connServer.connectResp(c); err != nil {
+			return nil, err
+		}
+		connServer.connected = true
+	case cmdCreateStream:
+		if err = connServer.createStream(vs[1:]); err != nil {
+			return nil, err
+		}
+		if err = connServer.createStreamResp(c); err != nil {
+			return nil, err
+		}
+	case cmdPublish, cmdPlay:
+		ns := connServer.stream(c.StreamID, true)
+		if ns.started {
+			connServer.conn.log.Warningf("stream id=%d already started, %s ignored", c.StreamID, name)
+			return nil, nil
+		}
+		if err = connServer.publishOrPlay(ns, vs[1:]); err != nil {
+			return nil, err
+		}
+		// replies are sent once the stream is accepted
+		connServer.lock.Lock()
+		ns.csid = c.CSID
+		ns.started = true
+		ns.startTime = time.Now()
+		ns.isPublisher = name == cmdPublish
+		connServer.lock.Unlock()
+		connServer.conn.log.Debugf("handle %s req done, stream id=%d", name, c.StreamID)
+		return ns, nil
+	case cmdFcpublish:
+		connServer.fcPublish(vs)
+	case cmdReleaseStream:
+		connServer.releaseStream(vs)
+	case CmdFCUnpublish:
+		// sent on the connection with the stream name
+		if len(vs) > 3 {
+			streamName, _ := vs[3].(string)
+			if ns := connServer.publisher(streamName); ns != nil {
+				connServer.peerEnded(ns, c)
 			}
-			if err = connServer.playResp(c); err != nil {
-				return err
+		}
+	case CmdDeleteStream:
+		// sent on the connection with the stream id
+		if len(vs) > 3 {
+			id, _ := vs[3].(float64)
+			if ns := connServer.stream(uint32(id), false); ns != nil {
+				connServer.peerEnded(ns, c)
 			}
-			connServer.done = true
-			connServer.isPublisher = false
-			log.Debug("handle play req done")
-		case cmdFcpublish:
-			connServer.fcPublish(vs)
-		case cmdReleaseStream:
-			connServer.releaseStream(vs)
-		case cmdFCUnpublish:
-		case cmdDeleteStream:
-		default:
-			log.Debug("no support command=", vs[0].(string))
 		}
+	default:
+		ns := connServer.stream(c.StreamID, false)
+		if ns == nil || !ns.started {
+			connServer.conn.log.Debug("no support command=", name)
+			return nil, nil
+		}
+		if name == CmdCloseStream {
+			connServer.peerEnded(ns, c)
+		} else {
+			ns.push(*c)
+		}
+	}
+
+	return nil, nil
+}
+
+// stream returns the stream of id, streams used without createStream are
+// added if create is set
+func (connServer *ConnServer) stream(id uint32, create bool) *NetStream {
+	connServer.lock.Lock()
+	defer connServer.lock.Unlock()
+	ns, ok := connServer.streams[id]
+	if !ok && create {
+		ns = newNetStream(connServer, id)
+		connServer.streams[id] = ns
 	}
+	return ns
+}
 
+// publisher returns the stream publishing name
+func (connServer *ConnServer) publisher(name string) *NetStream {
+	connServer.lock.Lock()
+	defer connServer.lock.Unlock()
+	for _, ns := range connServer.streams {
+		if ns.started && ns.isPublisher && ns.PublishInfo.Name == name {
+			return ns
+		}
+	}
 	return nil
 }
 
-// ReadMsg reads message from connection
-func (connServer *ConnServer) ReadMsg() error {
+// WaitingPublishers returns the streams which have been publishing for
+// timeout without sending any media
+func (connServer *ConnServer) WaitingPublishers(timeout time.Duration) []*NetStream {
+	connServer.lock.Lock()
+	defer connServer.lock.Unlock()
+	var streams []*NetStream
+	for _, ns := range connServer.streams {
+		if ns.started && ns.isPublisher && !ns.hasMedia && time.Since(ns.startTime) >= timeout {
+			streams = append(streams, ns)
+		}
+	}
+	return streams
+}
+
+// peerEnded passes the command of the client ending ns to the stream
+func (connServer *ConnServer) peerEnded(ns *NetStream, c *ChunkStream) {
+	connServer.lock.Lock()
+	ns.byPeer = true
+	started := ns.started
+	if !started {
+		delete(connServer.streams, ns.id)
+	}
+	connServer.lock.Unlock()
+	if started {
+		ns.push(*c)
+	}
+}
+
+// removeStream removes a closed stream, it returns if the connection is
+// to be closed with it
+func (connServer *ConnServer) removeStream(ns *NetStream) bool {
+	connServer.lock.Lock()
+	defer connServer.lock.Unlock()
+	if connServer.streams[ns.id] == ns {
+		delete(connServer.streams, ns.id)
+	}
+	if ns.byPeer {
+		return false
+	}
+	for _, other := range connServer.streams {
+		if other.started {
+			return false
+		}
+	}
+	return true
+}
+
+func (connServer *ConnServer) onStatus(cur *ChunkStream, level, code, description string) error {
+	event := make(amf.Object)
+	event["level"] = level
+	event["code"] = code
+	event["description"] = description
+	return connServer.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event)
+}
+
+// HandleCommand handles a command message received after publishing or
+// playing started and sends its replies. Unknown commands are returned
+// with an empty name.
+func (connServer *ConnServer) HandleCommand(c *ChunkStream) (StreamCommand, error) {
+	var cmd StreamCommand
+	vs, err := DecodeCommand(c)
+	if err != nil {
+		return cmd, err
+	}
+	name, _ := vs[0].(string)
+	// name, transaction id, command object, then the arguments
+	for _, v := range vs[1:] {
+		if flag, ok := v.(bool); ok {
+			cmd.Flag = flag
+			break
+		}
+	}
+
+	switch name {
+	case CmdPause:
+		cmd.Name = name
+		if cmd.Flag {
+			return cmd, connServer.onStatus(c, "status", "NetStream.Pause.Notify", "Paused live stream.")
+		}
+		connServer.conn.SetBegin(c.StreamID)
+		return cmd, connServer.onStatus(c, "status", "NetStream.Unpause.Notify", "Unpaused live stream.")
+	case CmdSeek:
+		// live streams continue at the live position
+		cmd.Name = name
+		if err := connServer.onStatus(c, "status", "NetStream.Seek.Notify", "Seeking to live position."); err != nil {
+			return cmd, err
+		}
+		return cmd, connServer.onStatus(c, "status", "NetStream.Play.Start", "Started playing stream.")
+	case CmdReceiveAudio, CmdReceiveVideo:
+		cmd.Name = name
+		if !cmd.Flag {
+			return cmd, nil
+		}
+		if err := connServer.onStatus(c, "status", "NetStream.Seek.Notify", "Seeking to live position."); err != nil {
+			return cmd, err
+		}
+		return cmd, connServer.onStatus(c, "status", "NetStream.Play.Start", "Started playing stream.")
+	case CmdFCUnpublish:
+		cmd.Name = name
+		event := make(amf.Object)
+		event["level"] = "status"
+		event["code"] = "NetStream.Unpublish.Success"
+		event["description"] = "Stop publishing."
+		return cmd, connServer.writeMsg(c.CSID, c.StreamID, "onFCUnpublish", 0, nil, event)
+	case CmdCloseStream, CmdDeleteStream:
+		cmd.Name = name
+		return cmd, nil
+	}
+	connServer.conn.log.Debug("no support command=", name)
+	return cmd, nil
+}
+
+// handleSharedObject handles the events of a shared object message, they
+// are refused before the connection is accepted by connect
+func (connServer *ConnServer) handleSharedObject(c *ChunkStream) error {
+	if connServer.sharedObjects == nil {
+		return nil
+	}
+	if !connServer.connected {
+		return fmt.Errorf("shared object message before connect")
+	}
+	data := c.Data
+	if c.TypeID == idSharedObjectAMF3 && len(data) > 0 {
+		data = data[1:]
+	}
+	msg, err := parseSharedObject(data)
+	if err != nil {
+		return err
+	}
+	return connServer.sharedObjects.handle(connServer, c.TypeID, msg)
+}
+
+// Accept reads the messages of the connection until a stream starts
+// publishing or playing and returns it. The media and commands of the
+// started streams are passed to them while reading, so Accept is called
+// until it returns an error, which also ends all the streams.
+func (connServer *ConnServer) Accept() (ns *NetStream, err error) {
+	defer func() {
+		if err != nil {
+			connServer.endStreams(err)
+			if connServer.sharedObjects != nil {
+				connServer.sharedObjects.release(connServer)
+			}
+		}
+	}()
+
 	var c ChunkStream
 	for {
 		if err := connServer.conn.Read(&c); err != nil {
-			return err
+			return nil, err
 		}
 		switch c.TypeID {
 		case 20, 17:
-			if err := connServer.handleCmdMsg(&c); err != nil {
-				return err
+			ns, err := connServer.handleCmdMsg(&c)
+			if err != nil {
+				return nil, err
+			}
+			if ns != nil {
+				return ns, nil
+			}
+		case idSharedObjectAMF0, idSharedObjectAMF3:
+			if err := connServer.handleSharedObject(&c); err != nil {
+				return nil, err
+			}
+		case av.TagAudio, av.TagVideo, av.TagScriptDataAMF0, av.TagScriptDataAMF3:
+			ns := connServer.stream(c.StreamID, false)
+			if ns != nil && ns.started && ns.isPublisher {
+				if !ns.hasMedia {
+					connServer.lock.Lock()
+					ns.hasMedia = true
+					connServer.lock.Unlock()
+				}
+				ns.push(c)
 			}
-		}
-		if connServer.done {
-			break
 		}
 	}
-	return nil
-}
-
-// IsPublisher returns if this is publisher
-func (connServer *ConnServer) IsPublisher() bool {
-	return connServer.isPublisher
 }
 
-func (connServer *ConnServer) Write(c ChunkStream) error {
-	if c.TypeID == av.TagScriptDataAMF0 ||
-		c.TypeID == av.TagScriptDataAMF3 {
-		var err error
-		if c.Data, err = amf.MetaDataReform(c.Data, amf.DEL); err != nil {
-			return err
-		}
-		c.Length = uint32(len(c.Data))
+// endStreams ends all the streams of the connection with err
+func (connServer *ConnServer) endStreams(err error) {
+	connServer.lock.Lock()
+	streams := make([]*NetStream, 0, len(connServer.streams))
+	for _, ns := range connServer.streams {
+		streams = append(streams, ns)
+	}
+	connServer.lock.Unlock()
+	for _, ns := range streams {
+		ns.end(err)
 	}
-	return connServer.conn.Write(&c)
 }
 
 // Flush does flushing
@@ -351,19 +658,10 @@ func (connServer *ConnServer) Flush() error {
 	return connServer.conn.Flush()
 }
 
-func (connServer *ConnServer) Read(c *ChunkStream) (err error) {
-	return connServer.conn.Read(c)
-}
-
-// GetInfo gets information
-func (connServer *ConnServer) GetInfo() (app string, name string, url string) {
-	app = connServer.ConnInfo.App
-	name = connServer.PublishInfo.Name
-	url = connServer.ConnInfo.TcURL + "/" + connServer.PublishInfo.Name
-	return
-}
-
 // Close closes the server
 func (connServer *ConnServer) Close(err error) {
+	if connServer.sharedObjects != nil {
+		connServer.sharedObjects.release(connServer)
+	}
 	connServer.conn.Close()
 }
@@ -0,0 +1,494 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeCmdAMF3(t *testing.T) {
+	at := assert.New(t)
+	encoder := &amf.Encoder{}
+	obj := amf.Object{"app": "live", "objectEncoding": 3}
+
+	//AMF0 values switching to AMF3 for the object
+	b := bytes.NewBuffer([]byte{0})
+	encoder.EncodeAmf0(b, "connect")
+	encoder.EncodeAmf0(b, 1)
+	encoder.EncodeAmf0Amf3Marker(b)
+	encoder.EncodeAmf3(b, obj)
+	c := ChunkStream{TypeID: 17, Data: b.Bytes()}
+	vs, err := DecodeCommand(&c)
+	at.Nil(err)
+	at.Equal([]interface{}{"connect", float64(1), amf.Object{"app": "live", "objectEncoding": float64(3)}}, vs)
+
+	//AMF3 values only
+	b = bytes.NewBuffer([]byte{0})
+	encoder.EncodeAmf3(b, "connect")
+	encoder.EncodeAmf3(b, 1)
+	encoder.EncodeAmf3(b, obj)
+	c = ChunkStream{TypeID: 17, Data: b.Bytes()}
+	vs, err = DecodeCommand(&c)
+	at.Nil(err)
+	at.Equal([]interface{}{"connect", float64(1), amf.Object{"app": "live", "objectEncoding": float64(3)}}, vs)
+
+	c = ChunkStream{TypeID: 20}
+	_, err = DecodeCommand(&c)
+	at.NotNil(err)
+}
+
+func TestConnServerConnectAMF3(t *testing.T) {
+	at := assert.New(t)
+	encoder := &amf.Encoder{}
+	b := bytes.NewBuffer([]byte{0})
+	encoder.EncodeAmf0(b, "connect")
+	encoder.EncodeAmf0(b, 1)
+	encoder.EncodeAmf0Amf3Marker(b)
+	encoder.EncodeAmf3(b, amf.Object{"app": "live", "tcUrl": "rtmp://localhost/live", "objectEncoding": 3})
+
+	wr := bytes.NewBuffer(nil)
+	connServer := NewConnServer(newTestConn(bytes.NewBuffer(nil), wr), nil)
+	c := ChunkStream{CSID: 3, TypeID: 17, Data: b.Bytes()}
+	ns, err := connServer.handleCmdMsg(&c)
+	at.Nil(err)
+	at.Nil(ns)
+	at.Equal("live", connServer.ConnInfo.App)
+	at.Equal(3, connServer.ConnInfo.ObjectEncoding)
+
+	conn := newTestConn(wr, ioutil.Discard)
+	var r ChunkStream
+	for r.TypeID != 17 {
+		at.Nil(conn.Read(&r))
+	}
+	vs, err := DecodeCommand(&r)
+	at.Nil(err)
+	at.Equal("_result", vs[0])
+	at.Equal(float64(1), vs[1])
+	event := vs[3].(amf.Object)
+	at.Equal("NetConnection.Connect.Success", event["code"])
+	at.Equal(float64(3), event["objectEncoding"])
+}
+
+func soRequest(typeID uint32, name string, events ...soEvent) *ChunkStream {
+	data := soMessage{Name: name, Events: events}.encode()
+	if typeID == idSharedObjectAMF3 {
+		data = append([]byte{0}, data...)
+	}
+	return &ChunkStream{CSID: 3, TypeID: typeID, Length: uint32(len(data)), Data: data}
+}
+
+// readSOEvents reads the shared object messages written to wr
+func readSOEvents(t *testing.T, wr *bytes.Buffer) []soEvent {
+	conn := newTestConn(bytes.NewBuffer(wr.Bytes()), ioutil.Discard)
+	wr.Reset()
+	var events []soEvent
+	for {
+		var c ChunkStream
+		if err := conn.Read(&c); err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data := c.Data
+		if c.TypeID == idSharedObjectAMF3 {
+			data = data[1:]
+		}
+		msg, err := parseSharedObject(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, msg.Events...)
+	}
+}
+
+func TestSharedObject(t *testing.T) {
+	at := assert.New(t)
+	objects := NewSharedObjects()
+	wr1 := bytes.NewBuffer(nil)
+	wr2 := bytes.NewBuffer(nil)
+	c1 := NewConnServer(newTestConn(bytes.NewBuffer(nil), wr1), objects)
+	c1.ConnInfo.App = "live"
+	c2 := NewConnServer(newTestConn(bytes.NewBuffer(nil), wr2), objects)
+	c2.ConnInfo.App = "live"
+
+	//shared objects are refused before connect
+	at.NotNil(c1.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soUse})))
+	_, ok := objects.Get("live", "chat", "topic")
+	at.False(ok)
+	c1.connected = true
+	c2.connected = true
+
+	at.Nil(c1.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soUse})))
+	events := readSOEvents(t, wr1)
+	at.Equal(2, len(events))
+	at.Equal(uint8(soUseSuccess), events[0].Type)
+	at.Equal(uint8(soClear), events[1].Type)
+
+	b := bytes.NewBuffer(nil)
+	writeSOKey(b, "topic")
+	encodeSOValue(b, idSharedObjectAMF0, "hello")
+	at.Nil(c1.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+	events = readSOEvents(t, wr1)
+	at.Equal(1, len(events))
+	at.Equal(uint8(soSuccess), events[0].Type)
+	v, ok := objects.Get("live", "chat", "topic")
+	at.True(ok)
+	at.Equal("hello", v)
+
+	//a new subscriber gets the data in AMF3
+	at.Nil(c2.handleSharedObject(soRequest(idSharedObjectAMF3, "chat", soEvent{Type: soUse})))
+	events = readSOEvents(t, wr2)
+	at.Equal(3, len(events))
+	at.Equal(uint8(soChange), events[2].Type)
+	key, data, err := readSOKey(events[2].Data)
+	at.Nil(err)
+	at.Equal("topic", key)
+	v, err = amf.NewDecoder().DecodeAmf0(bytes.NewReader(data))
+	at.Nil(err)
+	at.Equal("hello", v)
+
+	//changes are sent to the other subscribers
+	b = bytes.NewBuffer(nil)
+	writeSOKey(b, "topic")
+	encodeSOValue(b, idSharedObjectAMF3, "bye")
+	at.Nil(c2.handleSharedObject(soRequest(idSharedObjectAMF3, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+	events = readSOEvents(t, wr1)
+	at.Equal(1, len(events))
+	at.Equal(uint8(soChange), events[0].Type)
+	events = readSOEvents(t, wr2)
+	at.Equal(uint8(soSuccess), events[0].Type)
+
+	//shared objects are scoped by application
+	_, ok = objects.Get("other", "chat", "topic")
+	at.False(ok)
+
+	//non persistent objects are removed with the last subscriber
+	objects.release(c1)
+	objects.release(c2)
+	_, ok = objects.Get("live", "chat", "topic")
+	at.False(ok)
+}
+
+func TestSharedObjectAMF3(t *testing.T) {
+	at := assert.New(t)
+	objects := NewSharedObjects()
+	c := NewConnServer(newTestConn(bytes.NewBuffer(nil), ioutil.Discard), objects)
+	c.ConnInfo.App = "live"
+	c.connected = true
+	at.Nil(c.handleSharedObject(soRequest(idSharedObjectAMF3, "chat", soEvent{Type: soUse})))
+
+	//AMF3 values are decoded with or without the marker switching to AMF3
+	b := bytes.NewBuffer(nil)
+	writeSOKey(b, "user")
+	encodeSOValue(b, idSharedObjectAMF3, amf.Object{"name": "bob"})
+	at.Nil(c.handleSharedObject(soRequest(idSharedObjectAMF3, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+	v, ok := objects.Get("live", "chat", "user")
+	at.True(ok)
+	at.Equal("bob", v.(amf.Object)["name"])
+
+	b = bytes.NewBuffer(nil)
+	writeSOKey(b, "count")
+	(&amf.Encoder{}).EncodeAmf3(b, 42)
+	at.Nil(c.handleSharedObject(soRequest(idSharedObjectAMF3, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+	v, ok = objects.Get("live", "chat", "count")
+	at.True(ok)
+	at.EqualValues(42, v)
+}
+
+func TestSharedObjectLimits(t *testing.T) {
+	at := assert.New(t)
+	objects := NewSharedObjects()
+	c := NewConnServer(newTestConn(bytes.NewBuffer(nil), ioutil.Discard), objects)
+	c.ConnInfo.App = "live"
+	c.connected = true
+
+	//events of objects which are not used are ignored
+	b := bytes.NewBuffer(nil)
+	writeSOKey(b, "topic")
+	encodeSOValue(b, idSharedObjectAMF0, "hello")
+	at.Nil(c.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+	_, ok := objects.Get("live", "chat", "topic")
+	at.False(ok)
+
+	at.Nil(c.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soUse})))
+	b = bytes.NewBuffer(nil)
+	writeSOKey(b, "topic")
+	encodeSOValue(b, idSharedObjectAMF0, string(make([]byte, maxSOValueSize)))
+	at.NotNil(c.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+
+	for i := 0; i < maxSOProperties; i++ {
+		b = bytes.NewBuffer(nil)
+		writeSOKey(b, fmt.Sprint("key", i))
+		encodeSOValue(b, idSharedObjectAMF0, i)
+		at.Nil(c.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+	}
+	b = bytes.NewBuffer(nil)
+	writeSOKey(b, "topic")
+	encodeSOValue(b, idSharedObjectAMF0, "hello")
+	at.NotNil(c.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+
+	for i := 1; i < maxSharedObjects; i++ {
+		at.Nil(c.handleSharedObject(soRequest(idSharedObjectAMF0, fmt.Sprint("chat", i), soEvent{Type: soUse})))
+	}
+	at.NotNil(c.handleSharedObject(soRequest(idSharedObjectAMF0, "more", soEvent{Type: soUse})))
+}
+
+func TestSharedObjectRelease(t *testing.T) {
+	at := assert.New(t)
+	objects := NewSharedObjects()
+	c1 := NewConnServer(newTestConn(bytes.NewBuffer(nil), ioutil.Discard), objects)
+	c1.ConnInfo.App = "live"
+	c1.connected = true
+	c2 := NewConnServer(newTestConn(bytes.NewBuffer(nil), ioutil.Discard), objects)
+	c2.ConnInfo.App = "live"
+	c2.connected = true
+
+	//a subscriber using an object released concurrently keeps it
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		at.Nil(c1.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soUse})))
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			objects.release(c1)
+		}()
+		go func() {
+			defer wg.Done()
+			at.Nil(c2.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soUse})))
+		}()
+		wg.Wait()
+		at.NotNil(objects.subscribed(c2, "chat"))
+		at.Nil(c2.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soRelease})))
+		at.Nil(objects.subscribed(c2, "chat"))
+	}
+
+	//persistent objects are kept until their application is removed
+	at.Nil(c1.handleSharedObject(&ChunkStream{TypeID: idSharedObjectAMF0, Data: soMessage{
+		Name: "chat", Flags: soPersistent, Events: []soEvent{{Type: soUse}},
+	}.encode()}))
+	b := bytes.NewBuffer(nil)
+	writeSOKey(b, "topic")
+	encodeSOValue(b, idSharedObjectAMF0, "hello")
+	at.Nil(c1.handleSharedObject(soRequest(idSharedObjectAMF0, "chat", soEvent{Type: soRequestChange, Data: b.Bytes()})))
+	objects.release(c1)
+	_, ok := objects.Get("live", "chat", "topic")
+	at.True(ok)
+	objects.RemoveApps(func(app string) bool { return app != "live" })
+	_, ok = objects.Get("live", "chat", "topic")
+	at.False(ok)
+}
+
+// readStatus reads the codes of the onStatus replies written to wr
+func readStatus(t *testing.T, wr *bytes.Buffer) []string {
+	conn := newTestConn(bytes.NewBuffer(wr.Bytes()), ioutil.Discard)
+	wr.Reset()
+	var codes []string
+	for {
+		var c ChunkStream
+		if err := conn.Read(&c); err == io.EOF {
+			return codes
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if c.TypeID != 20 {
+			continue
+		}
+		vs, err := DecodeCommand(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, vs[3].(amf.Object)["code"].(string))
+	}
+}
+
+func TestConnServerHandleCommand(t *testing.T) {
+	at := assert.New(t)
+	wr := bytes.NewBuffer(nil)
+	connServer := NewConnServer(newTestConn(bytes.NewBuffer(nil), wr), nil)
+
+	command := func(args ...interface{}) *ChunkStream {
+		b := bytes.NewBuffer(nil)
+		(&amf.Encoder{}).EncodeBatch(b, amf.AMF0, args...)
+		return &ChunkStream{CSID: 8, TypeID: 20, StreamID: 1, Data: b.Bytes()}
+	}
+
+	cmd, err := connServer.HandleCommand(command(CmdPause, 0, nil, true, 1000))
+	at.Nil(err)
+	at.Equal(StreamCommand{Name: CmdPause, Flag: true}, cmd)
+	at.Equal([]string{"NetStream.Pause.Notify"}, readStatus(t, wr))
+
+	cmd, err = connServer.HandleCommand(command(CmdPause, 0, nil, false, 1000))
+	at.Nil(err)
+	at.Equal(StreamCommand{Name: CmdPause}, cmd)
+	at.Equal([]string{"NetStream.Unpause.Notify"}, readStatus(t, wr))
+
+	cmd, err = connServer.HandleCommand(command(CmdReceiveVideo, 0, nil, false))
+	at.Nil(err)
+	at.Equal(StreamCommand{Name: CmdReceiveVideo}, cmd)
+	at.Equal(0, len(readStatus(t, wr)))
+
+	cmd, err = connServer.HandleCommand(command(CmdReceiveVideo, 0, nil, true))
+	at.Nil(err)
+	at.Equal(StreamCommand{Name: CmdReceiveVideo, Flag: true}, cmd)
+	at.Equal([]string{"NetStream.Seek.Notify", "NetStream.Play.Start"}, readStatus(t, wr))
+
+	cmd, err = connServer.HandleCommand(command(CmdSeek, 0, nil, 5000))
+	at.Nil(err)
+	at.Equal(CmdSeek, cmd.Name)
+	at.Equal([]string{"NetStream.Seek.Notify", "NetStream.Play.Start"}, readStatus(t, wr))
+
+	cmd, err = connServer.HandleCommand(command(CmdFCUnpublish, 0, nil, "stream"))
+	at.Nil(err)
+	at.Equal(CmdFCUnpublish, cmd.Name)
+	at.Equal([]string{"NetStream.Unpublish.Success"}, readStatus(t, wr))
+
+	cmd, err = connServer.HandleCommand(command(CmdDeleteStream, 0, nil, 1))
+	at.Nil(err)
+	at.Equal(CmdDeleteStream, cmd.Name)
+
+	cmd, err = connServer.HandleCommand(command("unknown", 0, nil))
+	at.Nil(err)
+	at.Equal("", cmd.Name)
+}
+
+func TestConnServerStreams(t *testing.T) {
+	at := assert.New(t)
+	rd := bytes.NewBuffer(nil)
+	client := newTestConn(nil, rd)
+	command := func(streamID uint32, args ...interface{}) {
+		b := bytes.NewBuffer(nil)
+		(&amf.Encoder{}).EncodeBatch(b, amf.AMF0, args...)
+		client.Write(&ChunkStream{CSID: 3, TypeID: 20, StreamID: streamID, Length: uint32(b.Len()), Data: b.Bytes()})
+	}
+	command(0, "connect", 1, amf.Object{"app": "live", "tcUrl": "rtmp://localhost/live"})
+	command(0, "createStream", 2, nil)
+	command(0, "createStream", 3, nil)
+	command(1, "publish", 0, nil, "first", "live")
+	command(2, "play", 0, nil, "second")
+	video := []byte{0x17, 0x01}
+	client.Write(&ChunkStream{CSID: 6, TypeID: 9, StreamID: 1, Length: uint32(len(video)), Data: video})
+	client.Write(&ChunkStream{CSID: 6, TypeID: 9, StreamID: 2, Length: uint32(len(video)), Data: video})
+	command(2, CmdPause, 0, nil, true, 0)
+	command(0, CmdDeleteStream, 0, nil, 1)
+	client.Flush()
+
+	wr := bytes.NewBuffer(nil)
+	connServer := NewConnServer(newTestConn(rd, wr), nil)
+	publisher, err := connServer.Accept()
+	at.Nil(err)
+	at.Equal(uint32(1), publisher.ID())
+	at.True(publisher.IsPublisher())
+	app, name, url := publisher.GetInfo()
+	at.Equal("live", app)
+	at.Equal("first", name)
+	at.Equal("rtmp://localhost/live/first", url)
+
+	player, err := connServer.Accept()
+	at.Nil(err)
+	at.Equal(uint32(2), player.ID())
+	at.False(player.IsPublisher())
+
+	_, err = connServer.Accept()
+	at.Equal(io.EOF, err)
+
+	//media is passed to the publisher only
+	var c ChunkStream
+	at.Nil(publisher.Read(&c))
+	at.Equal(uint32(9), c.TypeID)
+	at.Equal(video, c.Data)
+	at.Nil(publisher.Read(&c))
+	cmd, err := publisher.HandleCommand(&c)
+	at.Nil(err)
+	at.Equal(CmdDeleteStream, cmd.Name)
+	at.Equal(io.EOF, publisher.Read(&c))
+
+	at.Nil(player.Read(&c))
+	cmd, err = player.HandleCommand(&c)
+	at.Nil(err)
+	at.Equal(StreamCommand{Name: CmdPause, Flag: true}, cmd)
+	at.Equal(io.EOF, player.Read(&c))
+
+	//the client ended the publisher, so the connection stays open
+	publisher.Close(fmt.Errorf("deleted"))
+	at.Nil(connServer.stream(1, false))
+	at.NotNil(connServer.stream(2, false))
+
+	//writes use the stream id of the player
+	wr.Reset()
+	at.Nil(player.Write(ChunkStream{CSID: 6, TypeID: 9, Length: uint32(len(video)), Data: video}))
+	at.Nil(player.Flush())
+	at.Nil(newTestConn(wr, ioutil.Discard).Read(&c))
+	at.Equal(uint32(2), c.StreamID)
+}
+
+func TestConnServerReject(t *testing.T) {
+	at := assert.New(t)
+	wr := bytes.NewBuffer(nil)
+	connServer := NewConnServer(newTestConn(bytes.NewBuffer(nil), wr), nil)
+	connServer.CheckConnect = func(info ConnectInfo) error {
+		return fmt.Errorf("application name=%s is not configured", info.App)
+	}
+
+	b := bytes.NewBuffer(nil)
+	(&amf.Encoder{}).EncodeBatch(b, amf.AMF0, "connect", 1, amf.Object{"app": "other"})
+	_, err := connServer.handleCmdMsg(&ChunkStream{CSID: 3, TypeID: 20, Data: b.Bytes()})
+	at.NotNil(err)
+	at.Equal([]string{StatusConnectRejected}, readStatus(t, wr))
+
+	//streams reply once they are accepted or rejected
+	ns := newNetStream(connServer, 1)
+	ns.csid = 5
+	ns.isPublisher = true
+	at.Nil(ns.Start())
+	at.Equal([]string{"NetStream.Publish.Start"}, readStatus(t, wr))
+	at.Nil(ns.SendStatus("error", StatusPublishBadName, "invalid key"))
+	at.Equal([]string{StatusPublishBadName}, readStatus(t, wr))
+}
+
+func TestConnServerConcurrentStatus(t *testing.T) {
+	at := assert.New(t)
+	wr := bytes.NewBuffer(nil)
+	connServer := NewConnServer(newTestConn(bytes.NewBuffer(nil), wr), nil)
+
+	//the streams of a connection send their replies from their own goroutines
+	var wg sync.WaitGroup
+	for i := uint32(1); i <= 4; i++ {
+		ns := newNetStream(connServer, i)
+		ns.csid = 5
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				at.Nil(ns.SendStatus("status", "NetStream.Play.Start", fmt.Sprintf("stream %d", ns.id)))
+			}
+		}()
+	}
+	wg.Wait()
+	at.Equal(80, len(readStatus(t, wr)))
+}
+
+func TestNetStreamQueueFull(t *testing.T) {
+	at := assert.New(t)
+	connServer := NewConnServer(newTestConn(bytes.NewBuffer(nil), ioutil.Discard), nil)
+	ns := newNetStream(connServer, 1)
+
+	//a stream which does not read its messages never blocks the connection
+	for i := 0; i < msgQueueSize+10; i++ {
+		ns.push(ChunkStream{TypeID: 9, Timestamp: uint32(i)})
+	}
+	var c ChunkStream
+	for i := 0; i < msgQueueSize; i++ {
+		at.Nil(ns.Read(&c))
+		at.Equal(uint32(i), c.Timestamp)
+	}
+	err := ns.Read(&c)
+	at.NotNil(err)
+	at.Contains(err.Error(), "message queue of stream 1 is full")
+}
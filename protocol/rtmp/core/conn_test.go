@@ -3,10 +3,12 @@ package core
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"testing"
 
 	"github.com/gwuhaolin/livego/utils/pool"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -250,3 +252,208 @@ func TestConnWrite(t *testing.T) {
 	conn.Flush()
 	at.Equal(wr.Bytes(), []byte{0x4, 0x0, 0x0, 0xa0, 0x0, 0x0, 0x4, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3, 0x4})
 }
+
+type testPipe struct {
+	io.Reader
+	io.Writer
+}
+
+func newTestConn(r io.Reader, w io.Writer) *Conn {
+	return &Conn{
+		pool:                pool.NewPool(),
+		rw:                  NewReadWriter(testPipe{r, w}, 1024),
+		chunkSize:           128,
+		remoteChunkSize:     128,
+		windowAckSize:       2500000,
+		remoteWindowAckSize: 2500000,
+		chunks:              make(map[uint32]ChunkStream),
+		log:                 log.StandardLogger(),
+	}
+}
+
+func TestConnReadMultiByteCSID(t *testing.T) {
+	at := assert.New(t)
+	data := make([]byte, 128)
+	//csid 74 in 2 bytes
+	buf := []byte{0x00, 0x0a, 0x00, 0x00, 0x28, 0x00, 0x00, 0xc8, 0x14, 0x01, 0x00, 0x00, 0x00}
+	buf = append(buf, data...)
+	//csid 364 in 3 bytes
+	buf = append(buf, 0x01, 0x2c, 0x01, 0x00, 0x00, 0x50, 0x00, 0x00, 0x04, 0x12, 0x01, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04)
+	//continuation of csid 74
+	buf = append(buf, 0xc0, 0x0a)
+	buf = append(buf, data[:72]...)
+
+	conn := newTestConn(bytes.NewBuffer(buf), ioutil.Discard)
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.CSID), 364)
+	at.Equal(int(c.TypeID), 18)
+	at.Equal(int(c.Timestamp), 80)
+	at.Equal(c.Data, []byte{0x01, 0x02, 0x03, 0x04})
+
+	err = conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.CSID), 74)
+	at.Equal(int(c.TypeID), 20)
+	at.Equal(int(c.Timestamp), 40)
+	at.Equal(len(c.Data), 200)
+
+	err = conn.Read(&c)
+	at.Equal(err, io.EOF)
+}
+
+func TestConnWriteMultiByteCSID(t *testing.T) {
+	at := assert.New(t)
+	for _, csid := range []uint32{63, 64, 319, 320, 65599} {
+		wr := bytes.NewBuffer(nil)
+		conn := newTestConn(wr, wr)
+		c := ChunkStream{
+			Length:    200,
+			TypeID:    20,
+			CSID:      csid,
+			Timestamp: 40,
+			StreamID:  1,
+			Data:      make([]byte, 200),
+		}
+		at.Equal(conn.Write(&c), nil)
+		conn.Flush()
+
+		var r ChunkStream
+		at.Equal(conn.Read(&r), nil)
+		at.Equal(r.CSID, csid)
+		at.Equal(int(r.Length), 200)
+	}
+
+	conn := newTestConn(bytes.NewBuffer(nil), ioutil.Discard)
+	c := ChunkStream{Length: 1, TypeID: 20, CSID: 65600, Data: []byte{0}}
+	at.NotNil(conn.Write(&c))
+}
+
+func TestConnAbort(t *testing.T) {
+	at := assert.New(t)
+	data := make([]byte, 128)
+	buf := []byte{0x06, 0x00, 0x00, 0x28, 0x00, 0x00, 0xc8, 0x09, 0x01, 0x00, 0x00, 0x00}
+	buf = append(buf, data...)
+	//abort csid 6
+	buf = append(buf, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06)
+	//a new message with the header of the aborted one
+	data[0] = 0x17
+	buf = append(buf, 0xc6)
+	buf = append(buf, data...)
+	buf = append(buf, 0xc6)
+	buf = append(buf, data[:72]...)
+
+	conn := newTestConn(bytes.NewBuffer(buf), ioutil.Discard)
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.TypeID), idAbortMessages)
+
+	err = conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.TypeID), 9)
+	at.Equal(int(c.Timestamp), 40)
+	at.Equal(len(c.Data), 200)
+	at.Equal(c.Data[0], byte(0x17))
+}
+
+func TestConnReadMaxChunkSize(t *testing.T) {
+	at := assert.New(t)
+	//the reserved highest bit is ignored
+	buf := []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff}
+	buf = append(buf, 0x06, 0x00, 0x00, 0x00, 0x00, 0x13, 0x88, 0x09, 0x01, 0x00, 0x00, 0x00)
+	buf = append(buf, make([]byte, 5000)...)
+	//chunk size 0 is invalid and ignored
+	buf = append(buf, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+
+	conn := newTestConn(bytes.NewBuffer(buf), ioutil.Discard)
+	var c ChunkStream
+	at.Equal(conn.Read(&c), nil)
+	at.Equal(conn.remoteChunkSize, uint32(0x7fffffff))
+
+	at.Equal(conn.Read(&c), nil)
+	at.Equal(len(c.Data), 5000)
+
+	at.Equal(conn.Read(&c), nil)
+	at.Equal(conn.remoteChunkSize, uint32(0x7fffffff))
+}
+
+func TestConnAck(t *testing.T) {
+	at := assert.New(t)
+	//window ack size 200
+	buf := []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc8}
+	msg := []byte{0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64, 0x09, 0x01, 0x00, 0x00, 0x00}
+	msg = append(msg, make([]byte, 100)...)
+	for i := 0; i < 4; i++ {
+		buf = append(buf, msg...)
+	}
+
+	wr := bytes.NewBuffer(nil)
+	conn := newTestConn(bytes.NewBuffer(buf), wr)
+	var c ChunkStream
+	at.Equal(conn.Read(&c), nil)
+	at.Equal(conn.Read(&c), nil)
+	at.Equal(wr.Len(), 0)
+
+	//16 + 2*112 bytes received
+	at.Equal(conn.Read(&c), nil)
+	at.Equal(wr.Bytes(), []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0})
+
+	wr.Reset()
+	at.Equal(conn.Read(&c), nil)
+	at.Equal(wr.Len(), 0)
+}
+
+func TestConnExtendedTimestamp(t *testing.T) {
+	at := assert.New(t)
+	data := make([]byte, 128)
+	//type 0 with extended timestamp repeated in the continuation chunk
+	buf := []byte{0x06, 0xff, 0xff, 0xff, 0x00, 0x00, 0xc8, 0x09, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	buf = append(buf, data...)
+	buf = append(buf, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	buf = append(buf, data[:72]...)
+	//type 2 with extended delta, the continuation chunk repeats the delta
+	buf = append(buf, 0x86, 0xff, 0xff, 0xff, 0x01, 0x00, 0x00, 0x00)
+	buf = append(buf, data...)
+	buf = append(buf, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	buf = append(buf, data[:72]...)
+	//type 3 starting a new message repeats the extended delta,
+	//the continuation chunk leaves it out
+	buf = append(buf, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	buf = append(buf, data...)
+	buf = append(buf, 0xc6)
+	buf = append(buf, data[:72]...)
+
+	conn := newTestConn(bytes.NewBuffer(buf), ioutil.Discard)
+	var c ChunkStream
+	for _, ts := range []uint32{0x1000000, 0x2000000, 0x3000000} {
+		at.Equal(conn.Read(&c), nil)
+		at.Equal(c.Timestamp, ts)
+		at.Equal(len(c.Data), 200)
+	}
+	at.Equal(conn.Read(&c), io.EOF)
+}
+
+func TestConnWriteExtendedTimestamp(t *testing.T) {
+	at := assert.New(t)
+	wr := bytes.NewBuffer(nil)
+	conn := newTestConn(wr, wr)
+	c := ChunkStream{
+		Length:    300,
+		TypeID:    9,
+		Timestamp: 0x1234567,
+		StreamID:  1,
+		Data:      make([]byte, 300),
+	}
+	c.Data[128] = 0x01
+	c.Data[256] = 0x23
+	at.Equal(conn.Write(&c), nil)
+	conn.Flush()
+	at.Equal(wr.Len(), 16+128+5+128+5+44)
+
+	var r ChunkStream
+	at.Equal(conn.Read(&r), nil)
+	at.Equal(r.Timestamp, uint32(0x1234567))
+	at.Equal(r.Data, c.Data)
+}
@@ -141,8 +141,61 @@ func (conn *Conn) HandshakeClient() (err error) {
 	return
 }
 
-// HandshakeServer does handshaking to server
-func (conn *Conn) HandshakeServer() (err error) {
+// Kinds of server handshakes
+const (
+	HandshakeSimple  = "simple"  // C1 and S1 are echoed
+	HandshakeComplex = "complex" // C1 and S1 carry HMAC digests
+	// HandshakeFallback is a simple handshake answering a C1 with a
+	// version but no valid digest, as sent by some legacy clients
+	HandshakeFallback = "fallback"
+)
+
+// Reasons of failed handshakes
+const (
+	HandshakeReasonRead    = "read"    // C0C1 or C2 could not be read
+	HandshakeReasonWrite   = "write"   // S0S1S2 could not be written
+	HandshakeReasonVersion = "version" // C0 is not RTMP version 3
+	HandshakeReasonDigest  = "digest"  // strict only, C1 has no valid digest
+	HandshakeReasonC2      = "c2"      // strict only, C2 does not answer S1
+)
+
+// HandshakeError is a failed server handshake, Reason is one of the
+// HandshakeReason constants
+type HandshakeError struct {
+	Reason string
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("rtmp: handshake %s: %v", e.Reason, e.Err)
+}
+
+// hsValidC2 returns if C2 answers S1. The complex answer is signed with
+// the digest of S1, the simple one echoes S1, which is accepted for both.
+func hsValidC2(C2 []byte, S1 []byte, kind string) bool {
+	if bytes.Equal(C2[8:], S1[8:]) {
+		return true
+	}
+	if kind != HandshakeComplex {
+		return false
+	}
+	gap := hsCalcDigestPos(S1, 8)
+	key := hsMakeDigest(hsClientFullKey, S1[gap:gap+32], -1)
+	digest := hsMakeDigest(key, C2, len(C2)-32)
+	return bytes.Equal(C2[len(C2)-32:], digest)
+}
+
+// HandshakeServer does handshaking to server, clients sending a C1 without
+// valid digest get a simple handshake
+func (conn *Conn) HandshakeServer() error {
+	_, err := conn.ServerHandshake(false)
+	return err
+}
+
+// ServerHandshake does handshaking to server and returns its kind. When
+// strict, a C1 with a version but no valid digest and a C2 not answering
+// S1 fail the handshake. Errors are *HandshakeError.
+func (conn *Conn) ServerHandshake(strict bool) (kind string, err error) {
 	var random [(1 + 1536*2) * 2]byte
 
 	C0C1C2 := random[:1536*2+1]
@@ -160,12 +213,11 @@ func (conn *Conn) HandshakeServer() (err error) {
 	// < C0C1
 	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if _, err = io.ReadFull(conn.rw, C0C1); err != nil {
-		return
+		return "", &HandshakeError{HandshakeReasonRead, err}
 	}
 	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if C0[0] != 3 {
-		err = fmt.Errorf("rtmp: handshake version=%d invalid", C0[0])
-		return
+		return "", &HandshakeError{HandshakeReasonVersion, fmt.Errorf("version=%d invalid", C0[0])}
 	}
 
 	S0[0] = 3
@@ -175,35 +227,43 @@ func (conn *Conn) HandshakeServer() (err error) {
 	srvver := uint32(0x0d0e0a0d)
 	cliver := pio.U32BE(C1[4:8])
 
+	kind = HandshakeSimple
 	if cliver != 0 {
-		var ok bool
-		var digest []byte
-		if ok, digest = hsParse1(C1, hsClientPartialKey, hsServerFullKey); !ok {
-			err = fmt.Errorf("rtmp: handshake server: C1 invalid")
-			return
+		if ok, digest := hsParse1(C1, hsClientPartialKey, hsServerFullKey); ok {
+			kind = HandshakeComplex
+			hsCreate01(S0S1, srvtime, srvver, hsServerPartialKey)
+			hsCreate2(S2, digest)
+		} else if strict {
+			return "", &HandshakeError{HandshakeReasonDigest, fmt.Errorf("C1 version=%#x without valid digest", cliver)}
+		} else {
+			kind = HandshakeFallback
 		}
-		hsCreate01(S0S1, srvtime, srvver, hsServerPartialKey)
-		hsCreate2(S2, digest)
-	} else {
-		copy(S1, C2)
+	}
+	if kind != HandshakeComplex {
+		// time, zero and random bytes, C1 is echoed
+		pio.PutU32BE(S1[0:4], srvtime)
+		rand.Read(S1[8:])
 		copy(S2, C1)
 	}
 
 	// > S0S1S2
 	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if _, err = conn.rw.Write(S0S1S2); err != nil {
-		return
+		return "", &HandshakeError{HandshakeReasonWrite, err}
 	}
 	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if err = conn.rw.Flush(); err != nil {
-		return
+		return "", &HandshakeError{HandshakeReasonWrite, err}
 	}
 
 	// < C2
 	conn.Conn.SetDeadline(time.Now().Add(timeout))
 	if _, err = io.ReadFull(conn.rw, C2); err != nil {
-		return
+		return "", &HandshakeError{HandshakeReasonRead, err}
 	}
 	conn.Conn.SetDeadline(time.Time{})
-	return
+	if strict && !hsValidC2(C2, S1, kind) {
+		return "", &HandshakeError{HandshakeReasonC2, fmt.Errorf("C2 does not answer S1 of %s handshake", kind)}
+	}
+	return kind, nil
 }
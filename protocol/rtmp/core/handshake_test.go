@@ -0,0 +1,188 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hsVectorC1 returns a C1 of version 128.0.7.2 with the random bytes
+// i*7+3 and the digest at pos
+func hsVectorC1(pos int, digest string) []byte {
+	C1 := make([]byte, 1536)
+	copy(C1[4:8], []byte{0x80, 0, 7, 2})
+	for i := 8; i < len(C1); i++ {
+		C1[i] = byte(i*7 + 3)
+	}
+	d, _ := hex.DecodeString(digest)
+	copy(C1[pos:], d)
+	return C1
+}
+
+// hsVectors are C1 with digests in both schemes, with the key signing S2
+var hsVectors = []struct {
+	base   int
+	pos    int
+	digest string
+	s2Key  string
+}{
+	{8, 290, "0b441119ef46c4660e578ac88d3bf4c2d8901ff9a39c94bb92cb345f63928860", "c9b4bfa8650743a87fbcce8ea87abcef69670756c531d6476d141e04ce15331f"},
+	{772, 942, "8e211aefe949d44221d8905aa6154973bcab5ecb43dc582f65b1de1c2f94e4d5", "be47901e0f17614f341c5874d282e921437abf14d7abc7583e1256bcde1e410c"},
+}
+
+// hsServe runs a server handshake with a client sending C0C1, then C2
+// made from S0S1S2. It returns the kind, S0S1S2 and the error.
+func hsServe(strict bool, C0C1 []byte, makeC2 func(S0S1S2 []byte) []byte) (string, []byte, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	S0S1S2 := make([]byte, 1+1536*2)
+	go func() {
+		if _, err := b.Write(C0C1); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(b, S0S1S2); err != nil {
+			return
+		}
+		b.Write(makeC2(S0S1S2))
+	}()
+	kind, err := NewConn(a, 1024).ServerHandshake(strict)
+	return kind, S0S1S2, err
+}
+
+// echoS1 returns a C2 echoing S1
+func echoS1(S0S1S2 []byte) []byte {
+	return append([]byte(nil), S0S1S2[1:1537]...)
+}
+
+func TestHandshakeDigestVectors(t *testing.T) {
+	at := assert.New(t)
+	for _, v := range hsVectors {
+		C1 := hsVectorC1(v.pos, v.digest)
+		at.Equal(v.pos, hsCalcDigestPos(C1, v.base))
+		at.Equal(v.pos, hsFindDigest(C1, hsClientPartialKey, v.base))
+		ok, key := hsParse1(C1, hsClientPartialKey, hsServerFullKey)
+		at.True(ok)
+		at.Equal(v.s2Key, hex.EncodeToString(key))
+
+		// a modified C1 has no valid digest
+		C1[v.pos+40] ^= 0xff
+		ok, _ = hsParse1(C1, hsClientPartialKey, hsServerFullKey)
+		at.False(ok)
+	}
+}
+
+func TestHandshakeComplex(t *testing.T) {
+	at := assert.New(t)
+	for _, v := range hsVectors {
+		C0C1 := append([]byte{3}, hsVectorC1(v.pos, v.digest)...)
+		kind, S0S1S2, err := hsServe(true, C0C1, echoS1)
+		at.Nil(err)
+		at.Equal(HandshakeComplex, kind)
+
+		at.Equal(byte(3), S0S1S2[0])
+		S1 := S0S1S2[1:1537]
+		S2 := S0S1S2[1537:]
+		at.NotEqual(-1, hsFindDigest(S1, hsServerPartialKey, 8))
+		key, _ := hex.DecodeString(v.s2Key)
+		at.Equal(hsMakeDigest(key, S2, 1504), S2[1504:])
+	}
+}
+
+func TestHandshakeComplexSignedC2(t *testing.T) {
+	at := assert.New(t)
+	v := hsVectors[0]
+	C0C1 := append([]byte{3}, hsVectorC1(v.pos, v.digest)...)
+	signed := func(S0S1S2 []byte) []byte {
+		S1 := S0S1S2[1:1537]
+		gap := hsCalcDigestPos(S1, 8)
+		C2 := make([]byte, 1536)
+		hsCreate2(C2, hsMakeDigest(hsClientFullKey, S1[gap:gap+32], -1))
+		return C2
+	}
+	kind, _, err := hsServe(true, C0C1, signed)
+	at.Nil(err)
+	at.Equal(HandshakeComplex, kind)
+
+	// a random C2 fails only when strict
+	random := func([]byte) []byte {
+		return bytes.Repeat([]byte{0x5a}, 1536)
+	}
+	_, _, err = hsServe(true, C0C1, random)
+	if at.IsType(&HandshakeError{}, err) {
+		at.Equal(HandshakeReasonC2, err.(*HandshakeError).Reason)
+	}
+	_, _, err = hsServe(false, C0C1, random)
+	at.Nil(err)
+}
+
+func TestHandshakeSimple(t *testing.T) {
+	at := assert.New(t)
+	C0C1 := make([]byte, 1537)
+	C0C1[0] = 3
+	copy(C0C1[1:5], []byte{0, 0, 1, 0})
+	for i := 9; i < len(C0C1); i++ {
+		C0C1[i] = byte(i)
+	}
+
+	kind, S0S1S2, err := hsServe(true, C0C1, echoS1)
+	at.Nil(err)
+	at.Equal(HandshakeSimple, kind)
+	at.Equal(byte(3), S0S1S2[0])
+	// S1 has the time of C1 and a zero version, S2 echoes C1
+	at.Equal([]byte{0, 0, 1, 0, 0, 0, 0, 0}, S0S1S2[1:9])
+	at.Equal(C0C1[1:], S0S1S2[1537:])
+}
+
+func TestHandshakeFallback(t *testing.T) {
+	at := assert.New(t)
+	v := hsVectors[0]
+	C0C1 := append([]byte{3}, hsVectorC1(v.pos, v.digest)...)
+	C0C1[1+v.pos] ^= 0xff
+
+	kind, S0S1S2, err := hsServe(false, C0C1, echoS1)
+	at.Nil(err)
+	at.Equal(HandshakeFallback, kind)
+	at.Equal(C0C1[1:], S0S1S2[1537:])
+
+	_, _, err = hsServe(true, C0C1, echoS1)
+	if at.IsType(&HandshakeError{}, err) {
+		at.Equal(HandshakeReasonDigest, err.(*HandshakeError).Reason)
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	at := assert.New(t)
+	C0C1 := make([]byte, 1537)
+	C0C1[0] = 6
+	_, _, err := hsServe(false, C0C1, echoS1)
+	if at.IsType(&HandshakeError{}, err) {
+		at.Equal(HandshakeReasonVersion, err.(*HandshakeError).Reason)
+	}
+}
+
+func TestHandshakeClientServer(t *testing.T) {
+	at := assert.New(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	client := NewConn(b, 1024)
+	done := make(chan error, 1)
+	go func() {
+		err := client.HandshakeClient()
+		if err == nil {
+			err = client.Flush()
+		}
+		done <- err
+	}()
+	kind, err := NewConn(a, 1024).ServerHandshake(true)
+	at.Nil(err)
+	at.Equal(HandshakeSimple, kind)
+	at.Nil(<-done)
+}
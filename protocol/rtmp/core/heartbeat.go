@@ -0,0 +1,108 @@
+package core
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+// Heartbeat is the liveness of a connection, measured by the ping requests
+// sent to the peer and the messages received from it
+type Heartbeat struct {
+	RTT       time.Duration // round trip time of the last answered ping
+	LastRead  time.Time     // time of the last message of the peer
+	LastAck   time.Time     // time of the last acknowledgement of the peer
+	AckedSize uint32        // sequence number of the last acknowledgement
+	PingsSent uint32
+	Pongs     uint32 // ping responses received
+}
+
+// heartbeat is the Heartbeat of a Conn with the ping waiting for its
+// response
+type heartbeat struct {
+	lock     sync.Mutex
+	stats    Heartbeat
+	pingTime uint32 // timestamp of the pending ping
+	pingSent time.Time
+}
+
+// read records a message received from the peer
+func (hb *heartbeat) read(c *ChunkStream) {
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	now := time.Now()
+	hb.stats.LastRead = now
+	if c.TypeID == idAck && len(c.Data) >= 4 {
+		hb.stats.LastAck = now
+		hb.stats.AckedSize = binary.BigEndian.Uint32(c.Data)
+	}
+}
+
+// handleUserControl answers the ping requests of the peer and measures the
+// round trip time with its ping responses
+func (conn *Conn) handleUserControl(c *ChunkStream) error {
+	if c.TypeID != idUserControlMessages || len(c.Data) < 6 {
+		return nil
+	}
+	eventType := uint32(binary.BigEndian.Uint16(c.Data))
+	timestamp := binary.BigEndian.Uint32(c.Data[2:])
+	switch eventType {
+	case pingRequest:
+		ret := conn.userControlMsg(pingResponse, 4)
+		pio.PutU32BE(ret.Data[2:], timestamp)
+		return conn.writeControl(&ret)
+	case pingResponse:
+		hb := &conn.heartbeat
+		hb.lock.Lock()
+		if !hb.pingSent.IsZero() && timestamp == hb.pingTime {
+			hb.stats.RTT = time.Since(hb.pingSent)
+			hb.stats.Pongs++
+			hb.pingSent = time.Time{}
+		}
+		hb.lock.Unlock()
+	}
+	return nil
+}
+
+// Ping sends a ping request, the round trip time is measured when the peer
+// answers it
+func (conn *Conn) Ping() error {
+	hb := &conn.heartbeat
+	hb.lock.Lock()
+	hb.pingSent = time.Now()
+	hb.pingTime = uint32(hb.pingSent.Sub(conn.created) / time.Millisecond)
+	hb.stats.PingsSent++
+	timestamp := hb.pingTime
+	hb.lock.Unlock()
+
+	ret := conn.userControlMsg(pingRequest, 4)
+	pio.PutU32BE(ret.Data[2:], timestamp)
+	return conn.writeControl(&ret)
+}
+
+// Heartbeat returns the heartbeat statistics of the connection
+func (conn *Conn) Heartbeat() Heartbeat {
+	conn.heartbeat.lock.Lock()
+	defer conn.heartbeat.lock.Unlock()
+	return conn.heartbeat.stats
+}
+
+// Idle returns how long the peer has not sent any message, acknowledgements
+// and ping responses included
+func (conn *Conn) Idle() time.Duration {
+	conn.heartbeat.lock.Lock()
+	defer conn.heartbeat.lock.Unlock()
+	return time.Since(conn.heartbeat.stats.LastRead)
+}
+
+// writeControl writes and flushes a protocol control message
+func (conn *Conn) writeControl(c *ChunkStream) error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+	if err := c.writeChunk(conn.rw, int(conn.chunkSize)); err != nil {
+		return err
+	}
+	return conn.rw.Flush()
+}
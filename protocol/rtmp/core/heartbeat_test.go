@@ -0,0 +1,71 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnPing(t *testing.T) {
+	at := assert.New(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server := NewConn(a, 1024)
+	client := NewConn(b, 1024)
+
+	// the client answers pings while reading
+	go func() {
+		var c ChunkStream
+		for client.Read(&c) == nil {
+		}
+	}()
+	read := make(chan ChunkStream, 1)
+	go func() {
+		var c ChunkStream
+		if server.Read(&c) == nil {
+			read <- c
+		}
+	}()
+
+	at.Nil(server.Ping())
+	select {
+	case c := <-read:
+		at.Equal(uint32(idUserControlMessages), c.TypeID)
+		at.Equal([]byte{0, byte(pingResponse)}, c.Data[:2])
+	case <-time.After(time.Second):
+		t.Fatal("no ping response")
+	}
+
+	hb := server.Heartbeat()
+	at.Equal(uint32(1), hb.PingsSent)
+	at.Equal(uint32(1), hb.Pongs)
+	at.True(hb.RTT > 0)
+	at.True(server.Idle() < time.Second)
+	at.Equal(uint32(0), client.Heartbeat().PingsSent)
+}
+
+func TestConnAckHeartbeat(t *testing.T) {
+	at := assert.New(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server := NewConn(a, 1024)
+	client := NewConn(b, 1024)
+
+	done := make(chan error, 1)
+	go func() {
+		var c ChunkStream
+		done <- server.Read(&c)
+	}()
+	ack := client.NewAck(5000)
+	at.Nil(client.writeControl(&ack))
+	at.Nil(<-done)
+
+	hb := server.Heartbeat()
+	at.Equal(uint32(5000), hb.AckedSize)
+	at.False(hb.LastAck.IsZero())
+	at.Equal(hb.LastAck, hb.LastRead)
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// msgQueueSize is the number of messages queued for a stream, a stream
+// which does not read them in time is ended
+const msgQueueSize = 512
+
+// NetStream is a stream created on a server connection. The streams of a
+// connection publish or play independently, their messages are told apart
+// by the message stream id.
+type NetStream struct {
+	PublishInfo PublishInfo
+
+	id          uint32
+	csid        uint32 // chunk stream id of publish or play
+	started     bool
+	isPublisher bool
+	byPeer      bool // the client ended the stream
+	startTime   time.Time
+	hasMedia    bool // a publisher sent media
+	connServer  *ConnServer
+	msgs        chan ChunkStream
+	done        chan struct{}
+	once        sync.Once
+	err         error
+}
+
+func newNetStream(connServer *ConnServer, id uint32) *NetStream {
+	return &NetStream{
+		id:         id,
+		connServer: connServer,
+		msgs:       make(chan ChunkStream, msgQueueSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// ID returns the message stream id
+func (ns *NetStream) ID() uint32 {
+	return ns.id
+}
+
+// IsPublisher returns if the stream is published by the client
+func (ns *NetStream) IsPublisher() bool {
+	ns.connServer.lock.Lock()
+	defer ns.connServer.lock.Unlock()
+	return ns.isPublisher
+}
+
+// Heartbeat returns the heartbeat statistics of the connection of the stream
+func (ns *NetStream) Heartbeat() Heartbeat {
+	return ns.connServer.conn.Heartbeat()
+}
+
+// RemoteAddr returns the address of the client
+func (ns *NetStream) RemoteAddr() net.Addr {
+	return ns.connServer.conn.RemoteAddr()
+}
+
+// GetInfo gets information
+func (ns *NetStream) GetInfo() (app string, name string, url string) {
+	app = ns.connServer.ConnInfo.App
+	name = ns.PublishInfo.Name
+	url = ns.connServer.ConnInfo.TcURL + "/" + ns.PublishInfo.Name
+	return
+}
+
+// Start sends the replies to publish or play, once the stream is accepted
+func (ns *NetStream) Start() error {
+	cur := &ChunkStream{CSID: ns.csid, StreamID: ns.id}
+	if ns.IsPublisher() {
+		return ns.connServer.publishResp(cur)
+	}
+	return ns.connServer.playResp(cur)
+}
+
+// SendStatus sends an onStatus event of the stream, such as an error
+// status before closing a rejected stream
+func (ns *NetStream) SendStatus(level, code, description string) error {
+	return ns.connServer.onStatus(&ChunkStream{CSID: ns.csid, StreamID: ns.id}, level, code, description)
+}
+
+// push queues a message read by the connection, it is dropped once the
+// stream ended. A stream whose queue is full is ended rather than blocking
+// the connection, which reads the messages of all its streams.
+func (ns *NetStream) push(c ChunkStream) {
+	select {
+	case <-ns.done:
+		return
+	default:
+	}
+	select {
+	case ns.msgs <- c:
+	default:
+		ns.connServer.conn.log.Warningf("stream id=%d does not read its messages, ended", ns.id)
+		ns.end(fmt.Errorf("message queue of stream %d is full", ns.id))
+	}
+}
+
+// end ends the stream, Read returns err from now on
+func (ns *NetStream) end(err error) {
+	ns.once.Do(func() {
+		ns.err = err
+		close(ns.done)
+	})
+}
+
+// Read reads the next media or command message of the stream, the queued
+// messages are read before the end of the stream
+func (ns *NetStream) Read(c *ChunkStream) error {
+	select {
+	case *c = <-ns.msgs:
+		return nil
+	default:
+	}
+	select {
+	case *c = <-ns.msgs:
+		return nil
+	case <-ns.done:
+		return ns.err
+	}
+}
+
+func (ns *NetStream) Write(c ChunkStream) error {
+	if c.TypeID == av.TagScriptDataAMF0 ||
+		c.TypeID == av.TagScriptDataAMF3 {
+		// AMF3 data holds AMF0 values after a zero byte
+		var format []byte
+		if c.TypeID == av.TagScriptDataAMF3 && len(c.Data) > 0 {
+			format, c.Data = c.Data[:1], c.Data[1:]
+		}
+		data, err := amf.MetaDataReform(c.Data, amf.DEL)
+		if err != nil {
+			return err
+		}
+		c.Data = append(append([]byte(nil), format...), data...)
+		c.Length = uint32(len(c.Data))
+	}
+	c.StreamID = ns.id
+	return ns.connServer.conn.Write(&c)
+}
+
+// Flush does flushing
+func (ns *NetStream) Flush() error {
+	return ns.connServer.conn.Flush()
+}
+
+// HandleCommand handles a command message of the stream
+func (ns *NetStream) HandleCommand(c *ChunkStream) (StreamCommand, error) {
+	return ns.connServer.HandleCommand(c)
+}
+
+// Close ends the stream. The connection is closed with its last stream,
+// unless the client ended the stream itself.
+func (ns *NetStream) Close(err error) {
+	ns.end(err)
+	if ns.connServer.removeStream(ns) {
+		ns.connServer.Close(err)
+	}
+}
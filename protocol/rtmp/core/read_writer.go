@@ -8,17 +8,38 @@ import (
 // ReadWriter is a wrapper of bufio.ReadReadWriter
 type ReadWriter struct {
 	*bufio.ReadWriter
+	counter    *countReader
 	readError  error
 	writeError error
 }
 
+// countReader counts the bytes read from r
+type countReader struct {
+	r io.Reader
+	n uint32
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint32(n)
+	return n, err
+}
+
 // NewReadWriter wrapps a ReadWriter to return a ReadWriter
 func NewReadWriter(rw io.ReadWriter, bufSize int) *ReadWriter {
+	counter := &countReader{r: rw}
 	return &ReadWriter{
-		ReadWriter: bufio.NewReadWriter(bufio.NewReaderSize(rw, bufSize), bufio.NewWriterSize(rw, bufSize)),
+		ReadWriter: bufio.NewReadWriter(bufio.NewReaderSize(counter, bufSize), bufio.NewWriterSize(rw, bufSize)),
+		counter:    counter,
 	}
 }
 
+// Received returns the number of bytes consumed from the reader,
+// it wraps around after 4GB like the sequence number of acknowledgements
+func (rw *ReadWriter) Received() uint32 {
+	return rw.counter.n - uint32(rw.ReadWriter.Reader.Buffered())
+}
+
 // Read reads from reader to a byte array
 func (rw *ReadWriter) Read(p []byte) (int, error) {
 	if rw.readError != nil {
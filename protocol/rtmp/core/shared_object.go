@@ -0,0 +1,456 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// types of shared object messages
+const (
+	idSharedObjectAMF3 = 16
+	idSharedObjectAMF0 = 19
+)
+
+// events of shared object messages
+const (
+	soUse           = 1
+	soRelease       = 2
+	soRequestChange = 3
+	soChange        = 4
+	soSuccess       = 5
+	soSendMessage   = 6
+	soStatus        = 7
+	soClear         = 8
+	soRemove        = 9
+	soRequestRemove = 10
+	soUseSuccess    = 11
+)
+
+const soPersistent = 2
+
+// limits of the shared objects of a server, a client exceeding them is
+// disconnected
+const (
+	maxSharedObjects = 1024
+	maxSOProperties  = 1024
+	maxSOValueSize   = 64 * 1024
+)
+
+// soMessage is a shared object message:
+// name length (2 bytes), name, version (4 bytes), flags (4 bytes),
+// reserved (4 bytes), then events of type (1 byte), data length (4 bytes)
+// and data
+type soMessage struct {
+	Name    string
+	Version uint32
+	Flags   uint32
+	Events  []soEvent
+}
+
+type soEvent struct {
+	Type uint8
+	Data []byte
+}
+
+func parseSharedObject(data []byte) (soMessage, error) {
+	var msg soMessage
+	if len(data) < 2 {
+		return msg, fmt.Errorf("shared object message too short")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < n+12 {
+		return msg, fmt.Errorf("shared object message too short")
+	}
+	msg.Name = string(data[:n])
+	msg.Version = binary.BigEndian.Uint32(data[n:])
+	msg.Flags = binary.BigEndian.Uint32(data[n+4:])
+	data = data[n+12:]
+
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return msg, fmt.Errorf("shared object event too short")
+		}
+		size := binary.BigEndian.Uint32(data[1:])
+		if uint32(len(data)-5) < size {
+			return msg, fmt.Errorf("shared object event size=%d, %d bytes left", size, len(data)-5)
+		}
+		msg.Events = append(msg.Events, soEvent{Type: data[0], Data: data[5 : 5+size]})
+		data = data[5+size:]
+	}
+	return msg, nil
+}
+
+func (msg soMessage) encode() []byte {
+	b := bytes.NewBuffer(nil)
+	binary.Write(b, binary.BigEndian, uint16(len(msg.Name)))
+	b.WriteString(msg.Name)
+	binary.Write(b, binary.BigEndian, msg.Version)
+	binary.Write(b, binary.BigEndian, msg.Flags)
+	binary.Write(b, binary.BigEndian, uint32(0))
+	for _, event := range msg.Events {
+		b.WriteByte(event.Type)
+		binary.Write(b, binary.BigEndian, uint32(len(event.Data)))
+		b.Write(event.Data)
+	}
+	return b.Bytes()
+}
+
+// readSOKey reads the property name at the start of an event
+func readSOKey(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, fmt.Errorf("shared object key too short")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < n+2 {
+		return "", nil, fmt.Errorf("shared object key too short")
+	}
+	return string(data[2 : n+2]), data[n+2:], nil
+}
+
+func writeSOKey(b *bytes.Buffer, key string) {
+	binary.Write(b, binary.BigEndian, uint16(len(key)))
+	b.WriteString(key)
+}
+
+// encodeSOValue encodes v in AMF0, switching to AMF3 for clients using
+// AMF3 shared objects
+func encodeSOValue(b *bytes.Buffer, typeID uint32, v interface{}) error {
+	encoder := &amf.Encoder{}
+	if typeID == idSharedObjectAMF3 {
+		if err := encoder.EncodeAmf0Amf3Marker(b); err != nil {
+			return err
+		}
+		_, err := encoder.EncodeAmf3(b, v)
+		return err
+	}
+	_, err := encoder.EncodeAmf0(b, v)
+	return err
+}
+
+// decodeSOValue decodes a value encoded by encodeSOValue, AMF3 values may
+// come without the AMF0 marker switching to AMF3
+func decodeSOValue(typeID uint32, data []byte) (interface{}, error) {
+	if len(data) > maxSOValueSize {
+		return nil, fmt.Errorf("shared object value of %d bytes, max %d", len(data), maxSOValueSize)
+	}
+	decoder := amf.NewDecoder()
+	if typeID == idSharedObjectAMF3 {
+		if len(data) > 0 && data[0] == amf.AMF0AcmplusObjectMarker {
+			data = data[1:]
+		}
+		return decoder.DecodeAmf3(bytes.NewReader(data))
+	}
+	return decoder.DecodeAmf0(bytes.NewReader(data))
+}
+
+// SharedObject is a remote shared object of an application. Its data is
+// kept in memory, for persistent ones until the server stops or the
+// application is removed.
+type SharedObject struct {
+	lock        sync.Mutex
+	app         string
+	name        string
+	persistent  bool
+	version     uint32
+	data        map[string]interface{}
+	subscribers map[*ConnServer]uint32 // message type used by the subscriber
+}
+
+// SharedObjects holds the remote shared objects of one server
+type SharedObjects struct {
+	lock    sync.Mutex
+	objects map[string]*SharedObject
+}
+
+// NewSharedObjects returns an empty SharedObjects
+func NewSharedObjects() *SharedObjects {
+	return &SharedObjects{
+		objects: make(map[string]*SharedObject),
+	}
+}
+
+// use subscribes connServer to the shared object name of its application,
+// which is created if needed. Both are done under the lock so that a
+// concurrent release does not remove the object of a new subscriber.
+// The events sending the data of the object to connServer are returned.
+func (sos *SharedObjects) use(connServer *ConnServer, typeID uint32, name string, persistent bool) (*SharedObject, uint32, []soEvent, error) {
+	app := connServer.ConnInfo.App
+	key := app + "/" + name
+
+	sos.lock.Lock()
+	defer sos.lock.Unlock()
+
+	so, ok := sos.objects[key]
+	if !ok {
+		if len(sos.objects) >= maxSharedObjects {
+			return nil, 0, nil, fmt.Errorf("shared object %s refused, %d objects", key, len(sos.objects))
+		}
+		so = &SharedObject{
+			app:         app,
+			name:        name,
+			persistent:  persistent,
+			data:        make(map[string]interface{}),
+			subscribers: make(map[*ConnServer]uint32),
+		}
+		sos.objects[key] = so
+	}
+	version, events, err := so.subscribe(connServer, typeID)
+	return so, version, events, err
+}
+
+// subscribed returns the shared object name of the application of
+// connServer if connServer uses it
+func (sos *SharedObjects) subscribed(connServer *ConnServer, name string) *SharedObject {
+	sos.lock.Lock()
+	defer sos.lock.Unlock()
+
+	so, ok := sos.objects[connServer.ConnInfo.App+"/"+name]
+	if !ok {
+		return nil
+	}
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	if _, ok := so.subscribers[connServer]; !ok {
+		return nil
+	}
+	return so
+}
+
+// unsubscribe unsubscribes connServer from the object of key, the object is
+// removed without subscribers unless it is persistent. The lock is held.
+func (sos *SharedObjects) unsubscribe(connServer *ConnServer, key string, so *SharedObject) {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	delete(so.subscribers, connServer)
+	if len(so.subscribers) == 0 && !so.persistent {
+		delete(sos.objects, key)
+	}
+}
+
+// release unsubscribes connServer from all shared objects
+func (sos *SharedObjects) release(connServer *ConnServer) {
+	sos.lock.Lock()
+	defer sos.lock.Unlock()
+
+	for key, so := range sos.objects {
+		sos.unsubscribe(connServer, key, so)
+	}
+}
+
+// RemoveApps removes the shared objects, persistent ones included, of the
+// applications live does not report
+func (sos *SharedObjects) RemoveApps(live func(app string) bool) {
+	sos.lock.Lock()
+	defer sos.lock.Unlock()
+
+	for key, so := range sos.objects {
+		if !live(so.app) {
+			delete(sos.objects, key)
+		}
+	}
+}
+
+// handle handles the events of a shared object message of connServer. The
+// objects are used with a use event before their other events are handled.
+func (sos *SharedObjects) handle(connServer *ConnServer, typeID uint32, msg soMessage) error {
+	for _, event := range msg.Events {
+		switch event.Type {
+		case soUse:
+			so, version, events, err := sos.use(connServer, typeID, msg.Name, msg.Flags&soPersistent != 0)
+			if err != nil {
+				return err
+			}
+			if err := so.send(connServer, typeID, version, events); err != nil {
+				return err
+			}
+		case soRelease:
+			key := connServer.ConnInfo.App + "/" + msg.Name
+			sos.lock.Lock()
+			if so, ok := sos.objects[key]; ok {
+				sos.unsubscribe(connServer, key, so)
+			}
+			sos.lock.Unlock()
+		default:
+			so := sos.subscribed(connServer, msg.Name)
+			if so == nil {
+				connServer.conn.log.Debugf("shared object %s is not used, event type=%d ignored", msg.Name, event.Type)
+				continue
+			}
+			if err := so.handle(connServer, typeID, event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns the value of a property of a shared object of app
+func (sos *SharedObjects) Get(app, name, key string) (interface{}, bool) {
+	sos.lock.Lock()
+	so, ok := sos.objects[app+"/"+name]
+	sos.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	v, ok := so.data[key]
+	return v, ok
+}
+
+func (so *SharedObject) flags() uint32 {
+	if so.persistent {
+		return soPersistent
+	}
+	return 0
+}
+
+// send sends events to connServer, events are built for its message type
+func (so *SharedObject) send(connServer *ConnServer, typeID uint32, version uint32, events []soEvent) error {
+	msg := soMessage{
+		Name:    so.name,
+		Version: version,
+		Flags:   so.flags(),
+		Events:  events,
+	}
+	data := msg.encode()
+	if typeID == idSharedObjectAMF3 {
+		data = append([]byte{0}, data...)
+	}
+	return connServer.writeChunk(&ChunkStream{
+		CSID:   3,
+		TypeID: typeID,
+		Length: uint32(len(data)),
+		Data:   data,
+	})
+}
+
+func changeEvent(typeID uint32, key string, v interface{}) (soEvent, error) {
+	b := bytes.NewBuffer(nil)
+	writeSOKey(b, key)
+	if err := encodeSOValue(b, typeID, v); err != nil {
+		return soEvent{}, err
+	}
+	return soEvent{Type: soChange, Data: b.Bytes()}, nil
+}
+
+func keyEvent(eventType uint8, key string) soEvent {
+	b := bytes.NewBuffer(nil)
+	writeSOKey(b, key)
+	return soEvent{Type: eventType, Data: b.Bytes()}
+}
+
+type soTarget struct {
+	connServer *ConnServer
+	typeID     uint32
+}
+
+// others returns the subscribers except connServer
+func (so *SharedObject) others(connServer *ConnServer) []soTarget {
+	var targets []soTarget
+	for sub, typeID := range so.subscribers {
+		if sub != connServer {
+			targets = append(targets, soTarget{sub, typeID})
+		}
+	}
+	return targets
+}
+
+// subscribe adds connServer to the subscribers and returns the events
+// sending it the data of the object
+func (so *SharedObject) subscribe(connServer *ConnServer, typeID uint32) (uint32, []soEvent, error) {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+
+	so.subscribers[connServer] = typeID
+	events := []soEvent{{Type: soUseSuccess}, {Type: soClear}}
+	for key, v := range so.data {
+		ev, err := changeEvent(typeID, key, v)
+		if err != nil {
+			return 0, nil, err
+		}
+		events = append(events, ev)
+	}
+	return so.version, events, nil
+}
+
+// handle handles an event sent by a subscriber in a message of typeID
+func (so *SharedObject) handle(connServer *ConnServer, typeID uint32, event soEvent) error {
+	switch event.Type {
+	case soRequestChange:
+		key, data, err := readSOKey(event.Data)
+		if err != nil {
+			return err
+		}
+		v, err := decodeSOValue(typeID, data)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		so.lock.Lock()
+		if _, ok := so.data[key]; !ok && len(so.data) >= maxSOProperties {
+			so.lock.Unlock()
+			return fmt.Errorf("shared object %s has %d properties, %s refused", so.name, len(so.data), key)
+		}
+		so.data[key] = v
+		so.version++
+		version := so.version
+		targets := so.others(connServer)
+		so.lock.Unlock()
+
+		if err := so.send(connServer, typeID, version, []soEvent{keyEvent(soSuccess, key)}); err != nil {
+			return err
+		}
+		for _, target := range targets {
+			ev, err := changeEvent(target.typeID, key, v)
+			if err != nil {
+				return err
+			}
+			if err := so.send(target.connServer, target.typeID, version, []soEvent{ev}); err != nil {
+				connServer.conn.log.Debugf("shared object %s change: %v", so.name, err)
+			}
+		}
+		return nil
+
+	case soRequestRemove:
+		key, _, err := readSOKey(event.Data)
+		if err != nil {
+			return err
+		}
+		so.lock.Lock()
+		delete(so.data, key)
+		so.version++
+		version := so.version
+		targets := append(so.others(connServer), soTarget{connServer, typeID})
+		so.lock.Unlock()
+
+		for _, target := range targets {
+			if err := so.send(target.connServer, target.typeID, version, []soEvent{keyEvent(soRemove, key)}); err != nil {
+				connServer.conn.log.Debugf("shared object %s remove: %v", so.name, err)
+			}
+		}
+		return nil
+
+	case soSendMessage:
+		so.lock.Lock()
+		version := so.version
+		targets := append(so.others(connServer), soTarget{connServer, typeID})
+		so.lock.Unlock()
+
+		for _, target := range targets {
+			if err := so.send(target.connServer, target.typeID, version, []soEvent{event}); err != nil {
+				connServer.conn.log.Debugf("shared object %s send message: %v", so.name, err)
+			}
+		}
+		return nil
+	}
+
+	connServer.conn.log.Debugf("shared object %s: unsupported event type=%d", so.name, event.Type)
+	return nil
+}
@@ -0,0 +1,60 @@
+package rtmp
+
+import (
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+)
+
+// connEvent returns the data of an event about the publisher or player c
+func (s *Stream) connEvent(c av.Closer) map[string]interface{} {
+	stats := s.connStats(c)
+	return map[string]interface{}{
+		"id":          stats.ID,
+		"url":         stats.URL,
+		"protocol":    stats.Protocol,
+		"remote_addr": stats.RemoteAddr,
+	}
+}
+
+// publishStart publishes that r started publishing the stream
+func (s *Stream) publishStart(r av.ReadCloser) {
+	s.conf.Events().Publish(configure.EventPublishStart, r.Info().Key, s.connEvent(r))
+}
+
+// publishStop publishes that r stopped publishing the stream
+func (s *Stream) publishStop(r av.ReadCloser) {
+	s.conf.Events().Publish(configure.EventPublishStop, r.Info().Key, s.connEvent(r))
+}
+
+// playerJoin publishes that the player w joined the stream, other writers
+// such as the recorder are not players
+func (s *Stream) playerJoin(w av.WriteCloser) {
+	if _, ok := w.(av.Viewer); !ok {
+		return
+	}
+	s.conf.Events().Publish(configure.EventPlayerJoin, w.Info().Key, s.connEvent(w))
+}
+
+// removeWriter removes the writer key of the stream, a player leaving for
+// err is published
+func (s *Stream) removeWriter(key string, pw *PackWriterCloser, err error) {
+	removed := s.ws.RemoveCb(key, func(_ string, v interface{}, exists bool) bool {
+		return exists && v == pw
+	})
+	if _, ok := pw.w.(av.Viewer); !ok || !removed {
+		return
+	}
+	data := s.connEvent(pw.w)
+	if err != nil {
+		data["reason"] = err.Error()
+	}
+	s.conf.Events().Publish(configure.EventPlayerLeave, pw.w.Info().Key, data)
+}
+
+// publishCodecs publishes the new video and audio codecs of the stream
+func (s *Stream) publishCodecs(c codecs) {
+	s.conf.Events().Publish(configure.EventCodecChange, s.info.Key, map[string]interface{}{
+		"video_codec": c.video,
+		"audio_codec": c.audio,
+	})
+}
@@ -0,0 +1,30 @@
+package rtmp
+
+import (
+	"github.com/gwuhaolin/livego/av"
+)
+
+// Hooks are called by the servers before a session starts,
+// a returned error rejects the session
+type Hooks struct {
+	// OnPublish is called before a publisher starts
+	OnPublish func(info av.Info) error
+	// OnPlay is called before a RTMP or HTTP-FLV player starts
+	OnPlay func(info av.Info) error
+}
+
+// Publish calls OnPublish if it is set
+func (h Hooks) Publish(info av.Info) error {
+	if h.OnPublish == nil {
+		return nil
+	}
+	return h.OnPublish(info)
+}
+
+// Play calls OnPlay if it is set
+func (h Hooks) Play(info av.Info) error {
+	if h.OnPlay == nil {
+		return nil
+	}
+	return h.OnPlay(info)
+}
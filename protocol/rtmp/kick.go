@@ -0,0 +1,47 @@
+package rtmp
+
+import (
+	"fmt"
+)
+
+// KickPublisher disconnects the publisher of the stream key and its
+// backups, which ends the stream and closes its players. It returns the
+// address of the publisher.
+func (rs *Streams) KickPublisher(key string) (string, error) {
+	v, ok := rs.streams.Get(key)
+	if !ok {
+		return "", fmt.Errorf("stream %s not found", key)
+	}
+	s := v.(*Stream)
+	r, started := s.publisher()
+	if r == nil || !started {
+		return "", fmt.Errorf("stream %s has no publisher", key)
+	}
+	err := fmt.Errorf("kicked")
+	s.closeBackups(err)
+	addr := s.connStats(r).RemoteAddr
+	r.Close(err)
+	s.log.Infof("[%v] publisher kicked", r.Info())
+	return addr, nil
+}
+
+// KickPlayer disconnects the RTMP or HTTP-FLV player uid, it returns the
+// address of the player
+func (rs *Streams) KickPlayer(uid string) (string, error) {
+	for item := range rs.streams.IterBuffered() {
+		s := item.Val.(*Stream)
+		for w := range s.ws.IterBuffered() {
+			pw := w.Val.(*PackWriterCloser)
+			if !isViewer(pw.w) || pw.w.Info().UID != uid {
+				continue
+			}
+			addr := s.connStats(pw.w).RemoteAddr
+			err := fmt.Errorf("kicked")
+			s.removeWriter(w.Key, pw, err)
+			pw.w.Close(err)
+			s.log.Infof("[%v] player kicked", pw.w.Info())
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("player %s not found", uid)
+}
@@ -0,0 +1,75 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKick(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, nil, Hooks{})
+	defer s.close()
+	access := s.conf.Access()
+
+	c, err := s.publish("room")
+	if !at.Nil(err) {
+		return
+	}
+	defer c.Close(nil)
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+	p, err := s.play("room")
+	if !at.Nil(err) {
+		return
+	}
+	defer p.Close(nil)
+	id, _ := s.waitEvent(t, configure.EventPlayerJoin, "live/room").Data["id"].(string)
+
+	// the player is kicked and its address banned
+	addr, err := s.streams.KickPlayer(id)
+	at.Nil(err)
+	at.Contains(addr, "127.0.0.1:")
+	ev := s.waitEvent(t, configure.EventPlayerLeave, "live/room")
+	at.Equal(id, ev.Data["id"])
+	at.Equal("kicked", ev.Data["reason"])
+	_, err = readVideo(p, 1)
+	at.NotNil(err)
+	_, err = s.streams.KickPlayer(id)
+	at.NotNil(err)
+
+	access.Ban(configure.BanIP, "127.0.0.1", time.Minute)
+	_, err = s.play("room")
+	at.NotNil(err)
+	at.Equal(uint64(1), access.Stats().Denied[configure.DenyBanned])
+	at.True(access.Unban(configure.BanIP, "127.0.0.1"))
+
+	// the publisher is kicked and its stream key banned
+	_, err = s.streams.KickPublisher("live/other")
+	at.NotNil(err)
+	addr, err = s.streams.KickPublisher("live/room")
+	at.Nil(err)
+	at.Contains(addr, "127.0.0.1:")
+	s.waitEvent(t, configure.EventPublishStop, "live/room")
+	at.False(s.streams.HasPublisher("live/room"))
+	_, err = s.streams.KickPublisher("live/room")
+	at.NotNil(err)
+
+	access.Ban(configure.BanKey, "live/room", time.Minute)
+	key, _ := s.keys.GetKey("room")
+	c2, err := s.publish("room")
+	if err == nil {
+		c2.Close(nil)
+	}
+	ev = s.waitEvent(t, configure.EventError, "live/"+key)
+	at.Equal(true, ev.Data["publisher"])
+	at.Equal(uint64(2), access.Stats().Denied[configure.DenyBanned])
+	at.True(access.Unban(configure.BanKey, "live/room"))
+	c2, err = s.publish("room")
+	if at.Nil(err) {
+		defer c2.Close(nil)
+	}
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+}
@@ -1,11 +1,14 @@
 package rtmp
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gwuhaolin/livego/utils/uid"
@@ -21,40 +24,40 @@ import (
 const (
 	maxQueueNum         = 1024
 	saveStaticsInterval = 5000
-)
-
-var (
-	readTimeout  = configure.Config.GetInt("read_timeout")
-	writeTimeout = configure.Config.GetInt("write_timeout")
+	maxAggregateSize    = 64 * 1024
+	keepaliveInterval   = time.Second
 )
 
 // Client is the rtmp client
 type Client struct {
 	handler av.Handler
 	getter  av.GetWriter
+	conf    *configure.Store
 }
 
 // NewClient return a Client
-func NewClient(h av.Handler, getter av.GetWriter) *Client {
+func NewClient(h av.Handler, getter av.GetWriter, conf *configure.Store) *Client {
 	return &Client{
 		handler: h,
 		getter:  getter,
+		conf:    conf,
 	}
 }
 
 // Dial dials url with specific method
 func (c *Client) Dial(url string, method string) error {
 	connClient := core.NewConnClient()
+	connClient.SetLogger(c.conf.Logger())
 	if err := connClient.Start(url, method); err != nil {
 		return err
 	}
 	if method == av.PUBLISH {
-		writer := NewVirWriter(connClient)
-		log.Debugf("client Dial call NewVirWriter url=%s, method=%s", url, method)
+		writer := NewVirWriter(connClient, c.writeTimeout(), false, c.conf.Logger())
+		c.conf.Logger().Debugf("client Dial call NewVirWriter url=%s, method=%s", url, method)
 		c.handler.HandleWriter(writer)
 	} else if method == av.PLAY {
-		reader := NewVirReader(connClient)
-		log.Debugf("client Dial call NewVirReader url=%s, method=%s", url, method)
+		reader := NewVirReader(connClient, c.readTimeout(), c.conf.Logger())
+		c.conf.Logger().Debugf("client Dial call NewVirReader url=%s, method=%s", url, method)
 		c.handler.HandleReader(reader)
 		if c.getter != nil {
 			writer := c.getter.Writer(reader.Info())
@@ -69,98 +72,478 @@ func (c *Client) Handler() av.Handler {
 	return c.handler
 }
 
+func (c *Client) readTimeout() time.Duration {
+	return time.Second * time.Duration(c.conf.Current().ReadTimeout)
+}
+
+func (c *Client) writeTimeout() time.Duration {
+	return time.Second * time.Duration(c.conf.Current().WriteTimeout)
+}
+
 // Server is a rtmp server
 type Server struct {
 	handler av.Handler
 	getter  av.GetWriter
+	dvr     *flv.Dvr
+	conf    *configure.Store
+	keys    configure.KeyStore
+	hooks   Hooks
+	log     *log.Logger
+	objects *core.SharedObjects
+
+	lock       sync.Mutex
+	listener   net.Listener
+	closed     bool
+	handshakes HandshakeStats
 }
 
-// NewServer returns a Server
-func NewServer(h av.Handler, getter av.GetWriter) *Server {
-	return &Server{
+// HandshakeStats counts the handshakes of a server by kind, the failed
+// ones by reason
+type HandshakeStats struct {
+	Simple   uint64            `json:"simple"`
+	Complex  uint64            `json:"complex"`
+	Fallback uint64            `json:"fallback"`
+	Failed   map[string]uint64 `json:"failed"`
+}
+
+// NewServer returns a Server, publishers are authenticated by keys
+func NewServer(h av.Handler, getter av.GetWriter, conf *configure.Store,
+	keys configure.KeyStore, hooks Hooks) *Server {
+	s := &Server{
 		handler: h,
 		getter:  getter,
+		dvr:     flv.NewDvr(conf),
+		conf:    conf,
+		keys:    keys,
+		hooks:   hooks,
+		log:     conf.Logger(),
+		objects: core.NewSharedObjects(),
+		handshakes: HandshakeStats{
+			Failed: make(map[string]uint64),
+		},
 	}
+	// the shared objects of removed applications are dropped on reload
+	conf.OnReload(func(*configure.ServerCfg) {
+		s.objects.RemoveApps(conf.CheckAppName)
+	})
+	return s
 }
 
 // Serve serves http requests
 func (s *Server) Serve(listener net.Listener) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Error("rtmp serve panic: ", r)
+			s.log.Error("rtmp serve panic: ", r)
 		}
 	}()
 
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.lock.Unlock()
+
 	for {
 		var netconn net.Conn
 		netconn, err = listener.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
 			return
 		}
+		ip, err := s.admit(netconn)
+		if err != nil {
+			continue
+		}
 		conn := core.NewConn(netconn, 4*1024)
-		log.Debug("new client, connect remote: ", conn.RemoteAddr().String(),
+		conn.SetLogger(s.log)
+		s.log.Debug("new client, connect remote: ", conn.RemoteAddr().String(),
 			"local:", conn.LocalAddr().String())
-		go s.handleConn(conn)
+		go func() {
+			defer s.conf.Access().Close(ip)
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// admit takes a connection of the client of c from the connection limits,
+// c is closed if they are reached
+func (s *Server) admit(c net.Conn) (string, error) {
+	ip := clientIP(c.RemoteAddr())
+	if err := s.conf.Access().Open(ip); err != nil {
+		s.log.Warningf("refuse connection of %s: %v", c.RemoteAddr(), err)
+		c.Close()
+		return ip, err
+	}
+	return ip, nil
+}
+
+// Handshakes returns the handshake counters of the server
+func (s *Server) Handshakes() HandshakeStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.handshakes
+	stats.Failed = make(map[string]uint64, len(s.handshakes.Failed))
+	for reason, n := range s.handshakes.Failed {
+		stats.Failed[reason] = n
 	}
+	return stats
+}
+
+// handshake does the server handshake of conn and counts it
+func (s *Server) handshake(conn *core.Conn) error {
+	kind, err := conn.ServerHandshake(s.conf.Current().HandshakeStrict)
+
+	s.lock.Lock()
+	switch kind {
+	case core.HandshakeSimple:
+		s.handshakes.Simple++
+	case core.HandshakeComplex:
+		s.handshakes.Complex++
+	case core.HandshakeFallback:
+		s.handshakes.Fallback++
+	}
+	if hsErr, ok := err.(*core.HandshakeError); ok {
+		s.handshakes.Failed[hsErr.Reason]++
+	}
+	s.lock.Unlock()
+
+	if kind == core.HandshakeFallback {
+		s.log.Infof("handshake of %s: C1 without valid digest, simple handshake used", conn.RemoteAddr())
+	}
+	return err
+}
+
+// ServeConn serves the RTMP session of c until it is closed, for
+// connections not accepted by Serve such as tunneled ones
+func (s *Server) ServeConn(c net.Conn) error {
+	if s.isClosed() {
+		c.Close()
+		return fmt.Errorf("server is shutting down")
+	}
+	ip, err := s.admit(c)
+	if err != nil {
+		return err
+	}
+	defer s.conf.Access().Close(ip)
+	conn := core.NewConn(c, 4*1024)
+	conn.SetLogger(s.log)
+	s.log.Debug("new client, connect remote: ", conn.RemoteAddr().String(),
+		"local:", conn.LocalAddr().String())
+	return s.handleConn(conn)
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// Close stops accepting new connections.
+// Sessions which have not started publishing or playing yet are rejected.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections, then ends all publishers and
+// gives players until ctx is done to drain. DVR files still open afterwards
+// are finalized.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+	if streams, ok := s.handler.(*Streams); ok {
+		if e := streams.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := s.dvr.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
 
 func (s *Server) handleConn(conn *core.Conn) error {
-	if err := conn.HandshakeServer(); err != nil {
+	if err := s.handshake(conn); err != nil {
 		conn.Close()
-		log.Error("handleConn HandshakeServer err: ", err)
+		s.log.Errorf("handleConn handshake of %s err: %v", conn.RemoteAddr(), err)
 		return err
 	}
-	connServer := core.NewConnServer(conn)
+	connServer := core.NewConnServer(conn, s.objects)
+	connServer.CheckConnect = func(info core.ConnectInfo) error {
+		if s.isClosed() {
+			return fmt.Errorf("server is shutting down")
+		}
+		if !s.conf.CheckAppName(info.App) {
+			return fmt.Errorf("application name=%s is not configured", info.App)
+		}
+		return nil
+	}
 
-	if err := connServer.ReadMsg(); err != nil {
-		conn.Close()
-		log.Error("handleConn read msg err: ", err)
+	done := make(chan struct{})
+	defer close(done)
+	go s.keepalive(conn, connServer, done)
+
+	// the streams of the connection are served until it is closed
+	accepted := false
+	for {
+		ns, err := connServer.Accept()
+		if err != nil {
+			conn.Close()
+			if accepted {
+				s.log.Debug("handleConn read msg err: ", err)
+			} else {
+				s.log.Error("handleConn read msg err: ", err)
+			}
+			return err
+		}
+		accepted = true
+		s.handleStream(ns)
+	}
+}
+
+// keepalive pings the peer every ping_interval and closes the connection
+// once the peer sent nothing for idle_timeout, acknowledgements and ping
+// responses included. Publishers which send no media for publish_timeout
+// are closed.
+func (s *Server) keepalive(conn *core.Conn, connServer *core.ConnServer, done <-chan struct{}) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		cfg := s.conf.Current()
+		if cfg.IdleTimeout > 0 && conn.Idle() >= time.Duration(cfg.IdleTimeout)*time.Second {
+			s.log.Infof("close idle connection %s after %v", conn.RemoteAddr(), conn.Idle())
+			conn.Close()
+			return
+		}
+		if cfg.PublishTimeout > 0 {
+			timeout := time.Duration(cfg.PublishTimeout) * time.Second
+			for _, ns := range connServer.WaitingPublishers(timeout) {
+				_, name, _ := ns.GetInfo()
+				err := fmt.Errorf("no media received in %v", timeout)
+				s.log.Infof("close publisher %s: %v", name, err)
+				ns.Close(err)
+			}
+		}
+		if cfg.PingInterval > 0 && time.Since(lastPing) >= time.Duration(cfg.PingInterval)*time.Second {
+			lastPing = time.Now()
+			if err := conn.Ping(); err != nil {
+				s.log.Debug("ping error: ", err)
+			}
+		}
+	}
+}
+
+// handleStream starts publishing or playing a stream of a connection, the
+// stream is closed if it is rejected
+func (s *Server) handleStream(ns *core.NetStream) error {
+	if s.isClosed() {
+		err := fmt.Errorf("server is shutting down")
+		ns.Close(err)
+		s.log.Warning("handleConn: ", err)
 		return err
 	}
 
-	appname, name, _ := connServer.GetInfo()
+	appname, name, _ := ns.GetInfo()
 
-	if ret := configure.CheckAppName(appname); !ret {
+	// publish or play without connect
+	if ret := s.conf.CheckAppName(appname); !ret {
 		err := fmt.Errorf("application name=%s is not configured", appname)
-		conn.Close()
-		log.Error("CheckAppName err: ", err)
+		s.reject(ns, err)
+		ns.Close(err)
+		s.log.Error("CheckAppName err: ", err)
 		return err
 	}
 
-	log.Debugf("handleConn: IsPublisher=%v", connServer.IsPublisher())
-	if connServer.IsPublisher() {
-		channel, err := configure.RoomKeys.GetChannel(name)
-		if err != nil {
-			err := fmt.Errorf("invalid key")
-			conn.Close()
-			log.Error("CheckKey err: ", err)
+	cfg := s.conf.Current()
+	s.log.Debugf("handleConn: IsPublisher=%v, stream id=%d", ns.IsPublisher(), ns.ID())
+	var query string
+	if i := strings.Index(name, "?"); i >= 0 {
+		name, query = name[:i], name[i:]
+	}
+	values, _ := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	ip := clientIP(ns.RemoteAddr())
+	if ns.IsPublisher() {
+		// publishers authenticated by token publish with the channel name,
+		// the others with its key
+		channel := name
+		if err := s.conf.Access().CheckPublish(appname, ip); err != nil {
+			s.reject(ns, err)
+			ns.Close(err)
+			s.log.Warning("publish: ", err)
 			return err
 		}
-		connServer.PublishInfo.Name = channel
-		if pushlist, ret := configure.GetStaticPushURLList(appname); ret && (pushlist != nil) {
-			log.Debugf("GetStaticPushUrlList: %v", pushlist)
+		if err := cfg.Token.Check(configure.TokenPublish, appname, name, values, ip); err != nil {
+			s.reject(ns, err)
+			ns.Close(err)
+			s.log.Warningf("publish token of %s: %v", ip, err)
+			return err
+		}
+		if !cfg.Token.Publish {
+			var err error
+			if channel, err = s.keys.GetChannel(name); err != nil {
+				err := fmt.Errorf("invalid key")
+				s.reject(ns, err)
+				ns.Close(err)
+				s.log.Error("CheckKey err: ", err)
+				return err
+			}
+		}
+		if err := s.conf.Access().CheckBan(configure.BanKey, appname+"/"+channel); err != nil {
+			s.reject(ns, err)
+			ns.Close(err)
+			s.log.Warning("publish: ", err)
+			return err
+		}
+		// the query, such as role=backup, is kept in the url
+		ns.PublishInfo.Name = channel + query
+		if pushlist, ret := s.conf.GetStaticPushURLList(appname); ret && (pushlist != nil) {
+			s.log.Debugf("GetStaticPushUrlList: %v", pushlist)
+		}
+		reader := NewVirReader(ns, time.Second*time.Duration(cfg.ReadTimeout), s.log)
+		reader.LimitBitrate(func() (int, string) {
+			return s.conf.GetMaxBitrate(appname, channel)
+		})
+		failover := false
+		if streams, ok := s.handler.(*Streams); ok {
+			failover = streams.IsFailover(reader.Info())
+			if err := streams.CheckPublisher(reader.Info()); err != nil {
+				s.reject(ns, err)
+				reader.Close(err)
+				s.log.Warning("handleConn: ", err)
+				return err
+			}
+		}
+		if err := s.hooks.Publish(reader.Info()); err != nil {
+			s.reject(ns, err)
+			reader.Close(err)
+			s.log.Error("OnPublish err: ", err)
+			return err
+		}
+		if err := ns.Start(); err != nil {
+			reader.Close(err)
+			return err
 		}
-		reader := NewVirReader(connServer)
 		s.handler.HandleReader(reader)
-		log.Debugf("new publisher: %+v", reader.Info())
+		s.log.Debugf("new publisher: %+v", reader.Info())
 
+		// the outputs of the stream continue with a backup publisher
+		if failover {
+			return nil
+		}
 		if s.getter != nil {
 			writeType := reflect.TypeOf(s.getter)
-			log.Debugf("handleConn:writeType=%v", writeType)
+			s.log.Debugf("handleConn:writeType=%v", writeType)
 			writer := s.getter.Writer(reader.Info())
 			s.handler.HandleWriter(writer)
 		}
-		flvWriter := new(flv.Dvr)
-		s.handler.HandleWriter(flvWriter.Writer(reader.Info()))
+		if flvWriter := s.dvr.Writer(reader.Info()); flvWriter != nil {
+			s.handler.HandleWriter(flvWriter)
+		}
 	} else {
-		writer := NewVirWriter(connServer)
-		log.Debugf("new player: %+v", writer.Info())
-		s.handler.HandleWriter(writer)
+		if err := s.conf.Access().CheckPlay(appname, ip); err != nil {
+			s.reject(ns, err)
+			ns.Close(err)
+			s.log.Warning("play: ", err)
+			return err
+		}
+		if err := cfg.Token.Check(configure.TokenPlay, appname, name, values, ip); err != nil {
+			s.reject(ns, err)
+			ns.Close(err)
+			s.log.Warningf("play token of %s: %v", ip, err)
+			return err
+		}
+		// the admitted player is counted until it is added to the stream
+		admitted := func() {}
+		if streams, ok := s.handler.(*Streams); ok {
+			err := streams.CheckEgress()
+			if err == nil {
+				admitted, err = streams.AdmitViewer(appname + "/" + name)
+			}
+			if err != nil {
+				s.reject(ns, err)
+				ns.Close(err)
+				s.log.Warning("play: ", err)
+				return err
+			}
+		}
+		defer admitted()
+		writer := NewVirWriter(ns, time.Second*time.Duration(cfg.WriteTimeout), cfg.RTMPAggregate, s.log)
+		if app, _ := s.conf.GetApplication(appname); app.PlayBeforePublish == configure.PlayReject {
+			key := writer.Info().Key
+			if streams, ok := s.handler.(*Streams); ok && !streams.HasPublisher(key) {
+				err := fmt.Errorf("stream %s not found", key)
+				ns.SendStatus("error", core.StatusPlayStreamNotFound, err.Error())
+				writer.Close(err)
+				s.log.Debug("handleConn: ", err)
+				return err
+			}
+		}
+		if err := s.hooks.Play(writer.Info()); err != nil {
+			s.reject(ns, err)
+			writer.Close(err)
+			s.log.Error("OnPlay err: ", err)
+			return err
+		}
+		if err := ns.Start(); err != nil {
+			writer.Close(err)
+			return err
+		}
+		s.log.Debugf("new player: %+v", writer.Info())
+		if streams, ok := s.handler.(*Streams); ok {
+			streams.HandleViewer(writer, admitted)
+		} else {
+			s.handler.HandleWriter(writer)
+		}
 	}
 
 	return nil
 }
 
+// clientIP returns the host of addr
+func clientIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// reject sends the error status of a rejected publisher or player
+func (s *Server) reject(ns *core.NetStream, err error) {
+	code := core.StatusPlayFailed
+	if ns.IsPublisher() {
+		code = core.StatusPublishBadName
+	}
+	if e := ns.SendStatus("error", code, err.Error()); e != nil {
+		s.log.Debug("send error status: ", e)
+	}
+	app, name, _ := ns.GetInfo()
+	s.conf.Events().Publish(configure.EventError, app+"/"+name, map[string]interface{}{
+		"protocol":    "rtmp",
+		"publisher":   ns.IsPublisher(),
+		"remote_addr": remoteAddr(ns),
+		"error":       err.Error(),
+	})
+}
+
 // GetInfo returns a struct that can return a info
 type GetInfo interface {
 	GetInfo() (string, string, string)
@@ -174,6 +557,18 @@ type StreamReadWriteCloser interface {
 	Read(*core.ChunkStream) error
 }
 
+// commandHandler is implemented by connections which handle the NetStream
+// commands of publishers and players
+type commandHandler interface {
+	HandleCommand(*core.ChunkStream) (core.StreamCommand, error)
+}
+
+// heartbeater is implemented by connections which measure the liveness of
+// their peer
+type heartbeater interface {
+	Heartbeat() core.Heartbeat
+}
+
 // StaticsBW is static bw
 type StaticsBW struct {
 	StreamID               uint32
@@ -193,28 +588,46 @@ type VirWriter struct {
 	av.RWBaser
 
 	uid         string
+	closeLock   sync.Mutex // guards closed, packetQueue is sent to and closed under it
 	closed      bool
+	aggregate   bool
 	conn        StreamReadWriteCloser
 	packetQueue chan *av.Packet
+	pending     int32      // packets queued or being sent
+	bwLock      sync.Mutex // guards WriteBWInfo
 	WriteBWInfo StaticsBW
+	connected   time.Time
+	dropped     uint64 // packets dropped from the queue
+	log         *log.Logger
+
+	// set by the commands of the player
+	lock    sync.Mutex
+	paused  bool
+	noAudio bool
+	noVideo bool
+	waitKey bool
 }
 
-// NewVirWriter return a VirWriter
-func NewVirWriter(conn StreamReadWriteCloser) *VirWriter {
+// NewVirWriter return a VirWriter logging to logger, with aggregate the
+// queued audio and video packets are sent in aggregate messages
+func NewVirWriter(conn StreamReadWriteCloser, timeout time.Duration, aggregate bool, logger *log.Logger) *VirWriter {
 	ret := &VirWriter{
-		RWBaser: av.NewRWBase(time.Second * time.Duration(writeTimeout)),
+		RWBaser: av.NewRWBase(timeout),
 
 		uid:         uid.NewID(),
+		aggregate:   aggregate,
 		conn:        conn,
 		packetQueue: make(chan *av.Packet, maxQueueNum),
 		WriteBWInfo: StaticsBW{0, 0, 0, 0, 0, 0, 0, 0},
+		connected:   time.Now(),
+		log:         logger,
 	}
 
 	go ret.Check()
 	go func() {
 		err := ret.SendPacket()
 		if err != nil {
-			log.Warning(err)
+			ret.log.Warning(err)
 		}
 	}()
 	return ret
@@ -224,6 +637,9 @@ func NewVirWriter(conn StreamReadWriteCloser) *VirWriter {
 func (v *VirWriter) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
 	nowInMS := int64(time.Now().UnixNano() / 1e6)
 
+	v.bwLock.Lock()
+	defer v.bwLock.Unlock()
+
 	v.WriteBWInfo.StreamID = streamid
 	if isVideoFlag {
 		v.WriteBWInfo.VideoDatainBytes = v.WriteBWInfo.VideoDatainBytes + length
@@ -245,7 +661,7 @@ func (v *VirWriter) SaveStatics(streamid uint32, length uint64, isVideoFlag bool
 	}
 }
 
-// Check check
+// Check reads the commands of the player until the connection is closed
 func (v *VirWriter) Check() {
 	var c core.ChunkStream
 	for {
@@ -253,20 +669,91 @@ func (v *VirWriter) Check() {
 			v.Close(err)
 			return
 		}
+		if c.TypeID != 20 && c.TypeID != 17 {
+			continue
+		}
+		h, ok := v.conn.(commandHandler)
+		if !ok {
+			continue
+		}
+		cmd, err := h.HandleCommand(&c)
+		if err != nil {
+			v.Close(err)
+			return
+		}
+		v.lock.Lock()
+		switch cmd.Name {
+		case core.CmdPause:
+			v.paused = cmd.Flag
+		case core.CmdReceiveAudio:
+			v.noAudio = !cmd.Flag
+		case core.CmdReceiveVideo:
+			v.noVideo = !cmd.Flag
+		}
+		v.lock.Unlock()
+		if cmd.Name == core.CmdCloseStream || cmd.Name == core.CmdDeleteStream {
+			v.Close(fmt.Errorf("player sent %s", cmd.Name))
+			return
+		}
 	}
 }
 
+// accept returns if p is sent to the player. Sequence headers are always
+// sent, video resumes at a key frame.
+func (v *VirWriter) accept(p *av.Packet) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	switch {
+	case p.IsVideo:
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if ok && vh.IsSeq() {
+			return true
+		}
+		if v.paused || v.noVideo {
+			v.waitKey = true
+			return false
+		}
+		if v.waitKey {
+			if !ok || !vh.IsKeyFrame() {
+				return false
+			}
+			v.waitKey = false
+		}
+	case p.IsAudio:
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		if ok && ah.SoundFormat() == av.SoundAAC && ah.AACPacketType() == av.AACSeqHeader {
+			return true
+		}
+		return !v.paused && !v.noAudio
+	}
+	return true
+}
+
 // DropPacket drops packet due to queue max
 func (v *VirWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Warningf("[%v] packet queue max!!!", info)
+	v.log.Warningf("[%v] packet queue max!!!", info)
+	var dropped uint64
 	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
+		// the queue may be drained by the sender meanwhile
+		var tmpPkt *av.Packet
+		var ok bool
+		select {
+		case tmpPkt, ok = <-pktQue:
+		default:
+		}
 		// try to don't drop audio
+		if ok {
+			atomic.AddInt32(&v.pending, -1)
+		}
 		if ok && tmpPkt.IsAudio {
 			if len(pktQue) > maxQueueNum-2 {
-				log.Debug("drop audio pkt")
+				v.log.Debug("drop audio pkt")
 				<-pktQue
+				atomic.AddInt32(&v.pending, -1)
+				dropped += 2
 			} else {
+				atomic.AddInt32(&v.pending, 1)
 				pktQue <- tmpPkt
 			}
 
@@ -276,26 +763,40 @@ func (v *VirWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
 			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
 			// dont't drop sps config and dont't drop key frame
 			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
+				atomic.AddInt32(&v.pending, 1)
 				pktQue <- tmpPkt
+			} else {
+				dropped++
 			}
 			if len(pktQue) > maxQueueNum-10 {
-				log.Debug("drop video pkt")
+				v.log.Debug("drop video pkt")
 				<-pktQue
+				atomic.AddInt32(&v.pending, -1)
+				dropped++
 			}
 		}
 
+		if ok && tmpPkt.IsMetadata {
+			dropped++
+		}
 	}
-	log.Debug("packet queue len: ", len(pktQue))
+	atomic.AddUint64(&v.dropped, dropped)
+	v.log.Debug("packet queue len: ", len(pktQue))
 }
 
 // Write writes packet
 func (v *VirWriter) Write(p *av.Packet) (err error) {
 	err = nil
 
+	v.closeLock.Lock()
+	defer v.closeLock.Unlock()
 	if v.closed {
 		err = fmt.Errorf("VirWriter closed")
 		return
 	}
+	if !v.accept(p) {
+		return
+	}
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("VirWriter has already been closed:%v", e)
@@ -304,50 +805,105 @@ func (v *VirWriter) Write(p *av.Packet) (err error) {
 	if len(v.packetQueue) >= maxQueueNum-24 {
 		v.DropPacket(v.packetQueue, v.Info())
 	} else {
+		atomic.AddInt32(&v.pending, 1)
 		v.packetQueue <- p
 	}
 
 	return
 }
 
+// IsViewer returns if the player is connected, every writer serves one
+func (v *VirWriter) IsViewer() bool {
+	v.closeLock.Lock()
+	defer v.closeLock.Unlock()
+	return !v.closed
+}
+
+// QueueLen returns the number of packets waiting to be sent, including
+// the ones being sent
+func (v *VirWriter) QueueLen() int {
+	return int(atomic.LoadInt32(&v.pending))
+}
+
+// chunkStream converts a packet to a message and counts it
+func (v *VirWriter) chunkStream(p *av.Packet) core.ChunkStream {
+	var cs core.ChunkStream
+	cs.Data = p.Data
+	cs.Length = uint32(len(p.Data))
+	cs.StreamID = p.StreamID
+	cs.Timestamp = p.TimeStamp
+	cs.Timestamp += v.BaseTimestamp()
+
+	if p.IsVideo {
+		cs.TypeID = av.TagVideo
+	} else {
+		if p.IsMetadata {
+			cs.TypeID = av.TagScriptDataAMF0
+		} else {
+			cs.TypeID = av.TagAudio
+		}
+	}
+
+	v.SaveStatics(p.StreamID, uint64(cs.Length), p.IsVideo)
+	v.SetPreTime()
+	v.RecTimestamp(cs.Timestamp, cs.TypeID)
+	return cs
+}
+
 // SendPacket sends packet
 func (v *VirWriter) SendPacket() error {
 	Flush := reflect.ValueOf(v.conn).MethodByName("Flush")
-	var cs core.ChunkStream
+	var next *av.Packet
 	for {
-		p, ok := <-v.packetQueue
-		if ok {
-			cs.Data = p.Data
-			cs.Length = uint32(len(p.Data))
-			cs.StreamID = p.StreamID
-			cs.Timestamp = p.TimeStamp
-			cs.Timestamp += v.BaseTimestamp()
-
-			if p.IsVideo {
-				cs.TypeID = av.TagVideo
-			} else {
-				if p.IsMetadata {
-					cs.TypeID = av.TagScriptDataAMF0
-				} else {
-					cs.TypeID = av.TagAudio
-				}
+		p := next
+		next = nil
+		if p == nil {
+			var ok bool
+			if p, ok = <-v.packetQueue; !ok {
+				return fmt.Errorf("closed")
 			}
+		}
 
-			v.SaveStatics(p.StreamID, uint64(cs.Length), p.IsVideo)
-			v.SetPreTime()
-			v.RecTimestamp(cs.Timestamp, cs.TypeID)
-			err := v.conn.Write(cs)
-			if err != nil {
-				v.closed = true
-				return err
+		cs := v.chunkStream(p)
+		sent := int32(1)
+		if v.aggregate && !p.IsMetadata {
+			// the packets already queued are sent together, metadata
+			// is sent on its own as players expect it unwrapped
+			msgs := []core.ChunkStream{cs}
+			size := len(cs.Data)
+		collect:
+			for size < maxAggregateSize {
+				select {
+				case q, ok := <-v.packetQueue:
+					if !ok {
+						break collect
+					}
+					if q.IsMetadata || q.StreamID != p.StreamID {
+						next = q
+						break collect
+					}
+					msg := v.chunkStream(q)
+					msgs = append(msgs, msg)
+					sent++
+					size += len(msg.Data)
+				default:
+					break collect
+				}
+			}
+			if len(msgs) > 1 {
+				cs = core.NewAggregate(msgs)
 			}
-			Flush.Call(nil)
-		} else {
-			return fmt.Errorf("closed")
 		}
 
+		if err := v.conn.Write(cs); err != nil {
+			v.closeLock.Lock()
+			v.closed = true
+			v.closeLock.Unlock()
+			return err
+		}
+		Flush.Call(nil)
+		atomic.AddInt32(&v.pending, -sent)
 	}
-
 }
 
 // Info returns info
@@ -357,20 +913,30 @@ func (v *VirWriter) Info() (ret av.Info) {
 	ret.URL = URL
 	_url, err := url.Parse(URL)
 	if err != nil {
-		log.Warning(err)
+		v.log.Warning(err)
 	}
 	ret.Key = strings.TrimLeft(_url.Path, "/")
 	ret.Inter = true
 	return
 }
 
+// Heartbeat returns the heartbeat statistics of the connection of the player
+func (v *VirWriter) Heartbeat() core.Heartbeat {
+	if h, ok := v.conn.(heartbeater); ok {
+		return h.Heartbeat()
+	}
+	return core.Heartbeat{}
+}
+
 // Close closes this VirWriter
 func (v *VirWriter) Close(err error) {
-	log.Warning("player ", v.Info(), "closed: "+err.Error())
+	v.log.Warning("player ", v.Info(), "closed: "+err.Error())
+	v.closeLock.Lock()
 	if !v.closed {
 		close(v.packetQueue)
 	}
 	v.closed = true
+	v.closeLock.Unlock()
 	v.conn.Close(err)
 }
 
@@ -381,13 +947,23 @@ type VirReader struct {
 	uid        string
 	demuxer    flv.Demuxer
 	conn       StreamReadWriteCloser
+	bwLock     sync.Mutex // guards ReadBWInfo
 	ReadBWInfo StaticsBW
+	connected  time.Time
+	dropped    uint64 // video packets dropped over the bitrate limit
+	log        *log.Logger
+
+	// the bitrate limit, only accessed by the reading goroutine
+	limit    func() (int, string)
+	checked  int64 // LastTimestamp of ReadBWInfo when checked
+	dropping bool
+	waitKey  bool
 }
 
-// NewVirReader returns a virReader
-func NewVirReader(conn StreamReadWriteCloser) *VirReader {
+// NewVirReader returns a virReader logging to logger
+func NewVirReader(conn StreamReadWriteCloser, timeout time.Duration, logger *log.Logger) *VirReader {
 	return &VirReader{
-		RWBaser: av.NewRWBase(time.Second * time.Duration(writeTimeout)),
+		RWBaser: av.NewRWBase(timeout),
 
 		uid:     uid.NewID(),
 		conn:    conn,
@@ -402,6 +978,8 @@ func NewVirReader(conn StreamReadWriteCloser) *VirReader {
 			AudioSpeedInBytesperMS: 0,
 			LastTimestamp:          0,
 		},
+		connected: time.Now(),
+		log:       logger,
 	}
 }
 
@@ -409,6 +987,9 @@ func NewVirReader(conn StreamReadWriteCloser) *VirReader {
 func (v *VirReader) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
 	nowInMS := int64(time.Now().UnixNano() / 1e6)
 
+	v.bwLock.Lock()
+	defer v.bwLock.Unlock()
+
 	v.ReadBWInfo.StreamID = streamid
 	if isVideoFlag {
 		v.ReadBWInfo.VideoDatainBytes = v.ReadBWInfo.VideoDatainBytes + length
@@ -431,11 +1012,27 @@ func (v *VirReader) SaveStatics(streamid uint32, length uint64, isVideoFlag bool
 	}
 }
 
-// Read read to packet
-func (v *VirReader) Read(p *av.Packet) (err error) {
+// Read reads a packet, the video dropped because of the bitrate limit is
+// skipped
+func (v *VirReader) Read(p *av.Packet) error {
+	for {
+		if err := v.read(p); err != nil {
+			return err
+		}
+		if err := v.checkBitrate(); err != nil {
+			return err
+		}
+		if !v.drop(p) {
+			return nil
+		}
+	}
+}
+
+// read read to packet
+func (v *VirReader) read(p *av.Packet) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Warning("rtmp read packet panic: ", r)
+			v.log.Warning("rtmp read packet panic: ", r)
 		}
 	}()
 
@@ -446,6 +1043,12 @@ func (v *VirReader) Read(p *av.Packet) (err error) {
 		if err != nil {
 			return err
 		}
+		if cs.TypeID == 20 || cs.TypeID == 17 {
+			if err = v.handleCommand(&cs); err != nil {
+				return err
+			}
+			continue
+		}
 		if cs.TypeID == av.TagAudio ||
 			cs.TypeID == av.TagVideo ||
 			cs.TypeID == av.TagScriptDataAMF0 ||
@@ -466,6 +1069,24 @@ func (v *VirReader) Read(p *av.Packet) (err error) {
 	return err
 }
 
+// handleCommand handles a command of the publisher, the stream ends when
+// it stops publishing
+func (v *VirReader) handleCommand(cs *core.ChunkStream) error {
+	h, ok := v.conn.(commandHandler)
+	if !ok {
+		return nil
+	}
+	cmd, err := h.HandleCommand(cs)
+	if err != nil {
+		return err
+	}
+	switch cmd.Name {
+	case core.CmdFCUnpublish, core.CmdCloseStream, core.CmdDeleteStream:
+		return fmt.Errorf("publisher sent %s", cmd.Name)
+	}
+	return nil
+}
+
 // Info returns info
 func (v *VirReader) Info() (ret av.Info) {
 	ret.UID = v.uid
@@ -473,14 +1094,23 @@ func (v *VirReader) Info() (ret av.Info) {
 	ret.URL = URL
 	_url, err := url.Parse(URL)
 	if err != nil {
-		log.Warning(err)
+		v.log.Warning(err)
 	}
 	ret.Key = strings.TrimLeft(_url.Path, "/")
 	return
 }
 
+// Heartbeat returns the heartbeat statistics of the connection of the
+// publisher
+func (v *VirReader) Heartbeat() core.Heartbeat {
+	if h, ok := v.conn.(heartbeater); ok {
+		return h.Heartbeat()
+	}
+	return core.Heartbeat{}
+}
+
 // Close close this reader
 func (v *VirReader) Close(err error) {
-	log.Debug("publisher ", v.Info(), "closed: "+err.Error())
+	v.log.Debug("publisher ", v.Info(), "closed: "+err.Error())
 	v.conn.Close(err)
 }
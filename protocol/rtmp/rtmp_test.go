@@ -0,0 +1,499 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testServer is a Server on a local port with its streams and keys, the
+// events of its store are received on events
+type testServer struct {
+	*Server
+	conf    *configure.Store
+	streams *Streams
+	keys    *configure.RoomKeysType
+	addr    net.Addr
+	events  <-chan configure.Event
+}
+
+// newTestServer starts a server of the default configuration changed by
+// config
+func newTestServer(t *testing.T, config func(*configure.ServerCfg), hooks Hooks) *testServer {
+	dir, err := ioutil.TempDir("", "livego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := configure.DefaultConfig()
+	cfg.FLVDir = dir
+	if config != nil {
+		config(&cfg)
+	}
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	conf, err := configure.NewStore(&cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		conf: conf,
+		keys: configure.NewRoomKeys(),
+		addr: l.Addr(),
+	}
+	s.events, _ = conf.Events().Subscribe(1024)
+	s.streams = NewStreams(conf)
+	s.Server = NewServer(s.streams, nil, conf, s.keys, hooks)
+	go s.Serve(l)
+	return s
+}
+
+func (s *testServer) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	os.RemoveAll(s.conf.Current().FLVDir)
+}
+
+// update changes the configuration of s by config
+func (s *testServer) update(config func(*configure.ServerCfg)) error {
+	cfg := *s.conf.Current()
+	cfg.Server = append(configure.Applications(nil), cfg.Server...)
+	config(&cfg)
+	return s.conf.Update(&cfg)
+}
+
+func (s *testServer) url(name string) string {
+	return fmt.Sprintf("rtmp://%s/live/%s", s.addr, name)
+}
+
+// publish publishes the channel name with its key
+func (s *testServer) publish(name string) (*core.ConnClient, error) {
+	key, err := s.keys.GetKey(name)
+	if err != nil {
+		return nil, err
+	}
+	c := core.NewConnClient()
+	return c, c.Start(s.url(key), av.PUBLISH)
+}
+
+func (s *testServer) play(name string) (*core.ConnClient, error) {
+	c := core.NewConnClient()
+	return c, c.Start(s.url(name), av.PLAY)
+}
+
+// waitEvent returns the next event of type typ about the stream key
+func (s *testServer) waitEvent(t *testing.T, typ, key string) configure.Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-s.events:
+			if ev.Type == typ && ev.Key == key {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no event %s of %s", typ, key)
+		}
+	}
+}
+
+// sendVideo sends a video frame every 10ms from timestamp start with a key
+// frame every 5 frames, until done is closed
+func sendVideo(c *core.ConnClient, start uint32, done chan struct{}) {
+	key := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x01}
+	inter := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x02}
+	for i := uint32(0); ; i++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		data := inter
+		if i%5 == 0 {
+			data = key
+		}
+		c.Write(core.ChunkStream{CSID: 6, TypeID: av.TagVideo, StreamID: c.StreamID(), Timestamp: start + 40*i, Length: uint32(len(data)), Data: data})
+		c.Flush()
+	}
+}
+
+// readVideo returns the timestamps of the next n video messages
+func readVideo(c *core.ConnClient, n int) ([]uint32, error) {
+	var ts []uint32
+	for len(ts) < n {
+		var cs core.ChunkStream
+		if err := c.Read(&cs); err != nil {
+			return ts, err
+		}
+		if cs.TypeID == av.TagVideo {
+			ts = append(ts, cs.Timestamp)
+		}
+	}
+	return ts, nil
+}
+
+func TestRejectUnknownApp(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, nil, Hooks{})
+	defer s.close()
+
+	c := core.NewConnClient()
+	err := c.Start(fmt.Sprintf("rtmp://%s/other/room", s.addr), av.PUBLISH)
+	if err == nil {
+		c.Close(nil)
+	}
+	at.NotNil(err)
+}
+
+func TestRejectInvalidKey(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, nil, Hooks{})
+	defer s.close()
+
+	c := core.NewConnClient()
+	err := c.Start(s.url("wrong"), av.PUBLISH)
+	if at.NotNil(err) {
+		at.Equal(core.ErrResponse, err)
+	} else {
+		c.Close(nil)
+	}
+	ev := s.waitEvent(t, configure.EventError, "live/wrong")
+	at.Equal("invalid key", ev.Data["error"])
+	at.False(s.streams.HasPublisher("live/wrong"))
+}
+
+func TestPlayBeforePublish(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, nil, Hooks{})
+	defer s.close()
+
+	at.NotNil(s.update(func(cfg *configure.ServerCfg) {
+		cfg.Server[0].PlayBeforePublish = "unknown"
+	}))
+	at.Nil(s.update(func(cfg *configure.ServerCfg) {
+		cfg.Server[0].PlayBeforePublish = configure.PlayReject
+	}))
+
+	c, err := s.play("room")
+	if at.NotNil(err) {
+		at.Contains(err.Error(), core.StatusPlayStreamNotFound)
+	} else {
+		c.Close(nil)
+	}
+
+	c, err = s.publish("room")
+	at.Nil(err)
+	defer c.Close(nil)
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+	at.True(s.streams.HasPublisher("live/room"))
+
+	p, err := s.play("room")
+	at.Nil(err)
+	if err == nil {
+		p.Close(nil)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, func(cfg *configure.ServerCfg) {
+		cfg.PingInterval = 1
+		cfg.PublishTimeout = 1
+	}, Hooks{})
+	defer s.close()
+
+	// a publisher without media is closed
+	silent, err := s.publish("silent")
+	if !at.Nil(err) {
+		return
+	}
+	defer silent.Close(nil)
+	go func() {
+		var cs core.ChunkStream
+		for silent.Read(&cs) == nil {
+		}
+	}()
+	s.waitEvent(t, configure.EventPublishStart, "live/silent")
+
+	c, err := s.publish("room")
+	if !at.Nil(err) {
+		return
+	}
+	defer c.Close(nil)
+	done := make(chan struct{})
+	defer close(done)
+	go sendVideo(c, 0, done)
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+
+	// the player answers the pings it reads
+	p, err := s.play("room")
+	if !at.Nil(err) {
+		return
+	}
+	defer p.Close(nil)
+	pinged := make(chan struct{})
+	go func() {
+		var cs core.ChunkStream
+		for p.Read(&cs) == nil {
+			// a ping request user control message
+			if cs.TypeID == 4 && len(cs.Data) >= 2 && cs.Data[1] == 6 {
+				close(pinged)
+				break
+			}
+		}
+		for p.Read(&cs) == nil {
+		}
+	}()
+	s.waitEvent(t, configure.EventPublishStop, "live/silent")
+	at.True(s.streams.HasPublisher("live/room"))
+
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("player not pinged")
+	}
+	var pings []uint32
+	if v, ok := s.streams.GetStreams().Get("live/room"); ok {
+		for item := range v.(*Stream).Ws().IterBuffered() {
+			if w, ok := item.Val.(*PackWriterCloser).Writer().(*VirWriter); ok {
+				pings = append(pings, w.Heartbeat().PingsSent)
+			}
+		}
+	}
+	if at.Len(pings, 1) {
+		at.NotZero(pings[0])
+	}
+}
+
+func TestToken(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, func(cfg *configure.ServerCfg) {
+		cfg.Token = configure.Token{Secret: "secret", Publish: true, Play: true}
+	}, Hooks{})
+	defer s.close()
+
+	tokenURL := func(action string, expire int64) string {
+		token := configure.SignToken("secret", action, "live", "room", expire, "")
+		return "room?" + configure.TokenQuery(token, expire).Encode()
+	}
+	expire := time.Now().Add(time.Minute).Unix()
+
+	for _, name := range []string{
+		"room",
+		tokenURL(configure.TokenPlay, expire),
+		tokenURL(configure.TokenPublish, time.Now().Add(-time.Minute).Unix()),
+	} {
+		c := core.NewConnClient()
+		if err := c.Start(s.url(name), av.PUBLISH); err == nil {
+			c.Close(nil)
+		}
+		ev := s.waitEvent(t, configure.EventError, "live/"+name)
+		at.Equal(true, ev.Data["publisher"], name)
+	}
+	at.False(s.streams.HasPublisher("live/room"))
+
+	//publishers with a token publish with the channel name
+	c := core.NewConnClient()
+	at.Nil(c.Start(s.url(tokenURL(configure.TokenPublish, expire)), av.PUBLISH))
+	defer c.Close(nil)
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+
+	p, err := s.play("room")
+	if at.NotNil(err) {
+		at.Contains(err.Error(), core.StatusPlayFailed)
+	} else {
+		p.Close(nil)
+	}
+	p, err = s.play(tokenURL(configure.TokenPlay, expire))
+	at.Nil(err)
+	if err == nil {
+		p.Close(nil)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, func(cfg *configure.ServerCfg) {
+		cfg.MaxConnsPerIP = 1
+	}, Hooks{})
+	defer s.close()
+	access := s.conf.Access()
+
+	c, err := s.publish("room")
+	if !at.Nil(err) {
+		return
+	}
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+	at.Equal(1, access.Stats().Conns)
+	p, err := s.play("room")
+	if at.NotNil(err) {
+		at.Equal(uint64(1), access.Stats().Denied[configure.DenyMaxConnsPerIP])
+	} else {
+		p.Close(nil)
+	}
+	c.Close(nil)
+	s.waitEvent(t, configure.EventPublishStop, "live/room")
+
+	at.NotNil(s.update(func(cfg *configure.ServerCfg) {
+		cfg.Server[0].PublishACL.Deny = []string{"127.0.0.1/33"}
+	}))
+	at.Nil(s.update(func(cfg *configure.ServerCfg) {
+		cfg.MaxConnsPerIP = 0
+		cfg.Server[0].PublishACL = configure.ACL{Allow: []string{"10.0.0.0/8"}}
+		cfg.Server[0].PlayACL = configure.ACL{Deny: []string{"127.0.0.1"}}
+	}))
+
+	key, _ := s.keys.GetKey("other")
+	c, err = s.publish("other")
+	if err == nil {
+		c.Close(nil)
+	}
+	s.waitEvent(t, configure.EventError, "live/"+key)
+	at.False(s.streams.HasPublisher("live/other"))
+	at.Equal(uint64(1), access.Stats().Denied[configure.DenyPublish])
+	p, err = s.play("other")
+	if err == nil {
+		p.Close(nil)
+	}
+	s.waitEvent(t, configure.EventError, "live/other")
+	at.Equal(uint64(1), access.Stats().Denied[configure.DenyPlay])
+}
+
+// commandConn is a player connection sending the commands received on cmds
+// and the messages written to it on written
+type commandConn struct {
+	cmds    chan *core.StreamCommand
+	cmd     core.StreamCommand
+	written chan core.ChunkStream
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newCommandConn() *commandConn {
+	return &commandConn{
+		cmds:    make(chan *core.StreamCommand),
+		written: make(chan core.ChunkStream),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *commandConn) GetInfo() (string, string, string) {
+	return "live", "room", "rtmp://localhost/live/room"
+}
+
+func (c *commandConn) Close(error) {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func (c *commandConn) Flush() error { return nil }
+
+func (c *commandConn) Read(cs *core.ChunkStream) error {
+	select {
+	case cmd := <-c.cmds:
+		cs.TypeID = 0
+		if cmd != nil {
+			c.cmd = *cmd
+			cs.TypeID = 20
+		}
+		return nil
+	case <-c.closed:
+		return fmt.Errorf("closed")
+	}
+}
+
+func (c *commandConn) HandleCommand(*core.ChunkStream) (core.StreamCommand, error) {
+	return c.cmd, nil
+}
+
+func (c *commandConn) Write(cs core.ChunkStream) error {
+	select {
+	case c.written <- cs:
+		return nil
+	case <-c.closed:
+		return fmt.Errorf("closed")
+	}
+}
+
+// command sends a command and returns once the writer has applied it
+func (c *commandConn) command(name string, flag bool) {
+	c.cmds <- &core.StreamCommand{Name: name, Flag: flag}
+	c.cmds <- nil
+}
+
+func TestVirWriterCommands(t *testing.T) {
+	at := assert.New(t)
+	conn := newCommandConn()
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	w := NewVirWriter(conn, 10*time.Second, false, logger)
+	defer w.Close(fmt.Errorf("done"))
+
+	packet := func(video bool, data ...byte) *av.Packet {
+		p := &av.Packet{IsVideo: video, IsAudio: !video, Data: data}
+		flv.NewDemuxer().DemuxH(p)
+		return p
+	}
+	var (
+		videoSeq = packet(true, 0x17, 0x00, 0x00, 0x00, 0x00, 0x01)
+		key      = packet(true, 0x17, 0x01, 0x00, 0x00, 0x00, 0x01)
+		inter    = packet(true, 0x27, 0x01, 0x00, 0x00, 0x00, 0x02)
+		audioSeq = packet(false, 0xaf, 0x00, 0x12, 0x10)
+		audio    = packet(false, 0xaf, 0x01, 0x21)
+	)
+	//write writes the packets with timestamps from 1 and returns the
+	//timestamps of the ones sent, up to the metadata written after them
+	write := func(packets ...*av.Packet) []uint32 {
+		for i, p := range packets {
+			q := *p
+			q.TimeStamp = uint32(i + 1)
+			at.Nil(w.Write(&q))
+		}
+		at.Nil(w.Write(&av.Packet{IsMetadata: true, Data: []byte{0x02}}))
+		var sent []uint32
+		for cs := range conn.written {
+			if cs.TypeID == av.TagScriptDataAMF0 {
+				return sent
+			}
+			sent = append(sent, cs.Timestamp)
+		}
+		return sent
+	}
+
+	at.Equal([]uint32{1, 2, 3}, write(key, audio, inter))
+
+	//without video only the sequence headers and audio are sent
+	conn.command(core.CmdReceiveVideo, false)
+	at.Equal([]uint32{3, 4}, write(inter, key, audio, videoSeq))
+	//video resumes at the next key frame
+	conn.command(core.CmdReceiveVideo, true)
+	at.Equal([]uint32{2, 3, 4}, write(inter, audio, key, inter))
+
+	//paused, only the sequence headers are sent
+	conn.command(core.CmdPause, true)
+	at.Equal([]uint32{3, 4}, write(audio, key, audioSeq, videoSeq))
+	conn.command(core.CmdPause, false)
+	at.Equal([]uint32{2, 3, 4}, write(inter, audio, key, inter))
+
+	//without audio the AAC sequence header is still sent
+	conn.command(core.CmdReceiveAudio, false)
+	at.Equal([]uint32{2, 3}, write(audio, audioSeq, inter))
+	conn.command(core.CmdReceiveAudio, true)
+	at.Equal([]uint32{1, 2}, write(audio, inter))
+}
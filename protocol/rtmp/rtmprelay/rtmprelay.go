@@ -1,130 +1,464 @@
 package rtmprelay
 
 import (
-	"bytes"
 	"fmt"
-	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
 	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
 	"github.com/gwuhaolin/livego/protocol/rtmp/core"
 
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	stopCtrl = "RTMPRELAY_STOP"
+// States of static pushes and relays
+const (
+	// StateConnecting means connections are being made
+	StateConnecting = "connecting"
+	// StateLive means packets are relayed
+	StateLive = "live"
+	// StateRetrying means waiting to reconnect after an error
+	StateRetrying = "retrying"
+	// StateFailed means reconnecting was given up
+	StateFailed = "failed"
 )
 
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+	maxRetries = 10
+)
+
+// dial starts a rtmp client logging to logger, the connection is closed if
+// starting fails
+func dial(url string, method string, logger *log.Logger) (*core.ConnClient, error) {
+	connectClient := core.NewConnClient()
+	connectClient.SetLogger(logger)
+	if err := connectClient.Start(url, method); err != nil {
+		connectClient.Close(nil)
+		return nil, err
+	}
+	return connectClient, nil
+}
+
+// writePacket sends a packet on the stream of connectClient
+func writePacket(connectClient *core.ConnClient, p *av.Packet) error {
+	var cs core.ChunkStream
+
+	cs.Data = p.Data
+	cs.Length = uint32(len(p.Data))
+	cs.StreamID = connectClient.StreamID()
+	cs.Timestamp = p.TimeStamp
+
+	if p.IsVideo {
+		cs.TypeID = av.TagVideo
+	} else {
+		if p.IsMetadata {
+			cs.TypeID = av.TagScriptDataAMF0
+		} else {
+			cs.TypeID = av.TagAudio
+		}
+	}
+
+	if err := connectClient.Write(cs); err != nil {
+		return err
+	}
+	return connectClient.Flush()
+}
+
 // RtmpRelay is a relay for rtmp stream
 type RtmpRelay struct {
-	PlayURL              string
-	PublishURL           string
-	csChan               chan core.ChunkStream
-	sndctrlChan          chan string
+	bytes      uint64 // first for 64-bit alignment of atomic access
+	PlayURL    string
+	PublishURL string
+	done       chan struct{}
+	demuxer    flv.Demuxer
+	cache      *cache.Cache
+
+	lock                 sync.Mutex
 	connectPlayClient    *core.ConnClient
 	connectPublishClient *core.ConnClient
 	startflag            bool
+	state                string
+	retries              int
+	lastErr              error
+	startTime            time.Time
+	events               *configure.Events
+	log                  *log.Logger
+
+	// timestamps of a new play connection are shifted to continue
+	// after the last packet sent, only accessed by the relay goroutine
+	lastTimestamp uint32
+	offset        uint32
+	rebase        bool
+}
+
+// RtmpRelayStatus is the state of a relay
+type RtmpRelayStatus struct {
+	PlayURL    string `json:"play_url"`
+	PublishURL string `json:"publish_url"`
+	State      string `json:"state"`
+	Retries    int    `json:"retries"`
+	Bytes      uint64 `json:"bytes"`
+	Uptime     int64  `json:"uptime"`
+	Error      string `json:"error,omitempty"`
 }
 
 // NewRtmpRelay returns a RtmpRelay
 func NewRtmpRelay(playURL *string, publishURL *string) *RtmpRelay {
 	return &RtmpRelay{
-		PlayURL:              *playURL,
-		PublishURL:           *publishURL,
-		csChan:               make(chan core.ChunkStream, 500),
-		sndctrlChan:          make(chan string),
-		connectPlayClient:    nil,
-		connectPublishClient: nil,
-		startflag:            false,
+		PlayURL:    *playURL,
+		PublishURL: *publishURL,
+		done:       make(chan struct{}),
+		demuxer:    flv.NewDemuxer(),
+		cache:      cache.NewCache(1),
+		log:        log.StandardLogger(),
+	}
+}
+
+// connect connects the sides which are not connected yet. A new publish
+// connection gets the cached metadata, sequence headers and GOP first.
+func (relay *RtmpRelay) connect() error {
+	relay.lock.Lock()
+	playClient, publishClient := relay.connectPlayClient, relay.connectPublishClient
+	relay.lock.Unlock()
+
+	if playClient == nil || publishClient == nil {
+		relay.setState(StateConnecting, nil)
+	}
+
+	if playClient == nil {
+		relay.log.Debugf("play server addr:%v starting....", relay.PlayURL)
+		c, err := dial(relay.PlayURL, av.PLAY, relay.log)
+		if err != nil {
+			return err
+		}
+		if !relay.setClients(c, nil) {
+			return fmt.Errorf("rtmprelay stopped")
+		}
+		relay.rebase = relay.lastTimestamp != 0
+	}
+
+	if publishClient == nil {
+		relay.log.Debugf("publish server addr:%v starting....", relay.PublishURL)
+		c, err := dial(relay.PublishURL, av.PUBLISH, relay.log)
+		if err != nil {
+			return err
+		}
+		if err := relay.cache.Send(publishConn{c}); err != nil {
+			c.Close(nil)
+			return err
+		}
+		if !relay.setClients(nil, c) {
+			return fmt.Errorf("rtmprelay stopped")
+		}
+	}
+
+	relay.lock.Lock()
+	relay.state = StateLive
+	relay.retries = 0
+	relay.lastErr = nil
+	relay.lock.Unlock()
+	relay.publishState()
+	return nil
+}
+
+// publishConn sends packets to a publish connection
+type publishConn struct {
+	client *core.ConnClient
+}
+
+// Write sends a packet
+func (c publishConn) Write(p *av.Packet) error {
+	return writePacket(c.client, p)
+}
+
+// setClients stores the new connections, they are closed instead if the
+// relay has been stopped
+func (relay *RtmpRelay) setClients(playClient, publishClient *core.ConnClient) bool {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
+	if !relay.startflag {
+		if playClient != nil {
+			playClient.Close(nil)
+		}
+		if publishClient != nil {
+			publishClient.Close(nil)
+		}
+		return false
+	}
+	if playClient != nil {
+		relay.connectPlayClient = playClient
+	}
+	if publishClient != nil {
+		relay.connectPublishClient = publishClient
+	}
+	return true
+}
+
+// closePlay closes the play connection so it is made again
+func (relay *RtmpRelay) closePlay() {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	if relay.connectPlayClient != nil {
+		relay.connectPlayClient.Close(nil)
+		relay.connectPlayClient = nil
+	}
+}
+
+// closePublish closes the publish connection so it is made again
+func (relay *RtmpRelay) closePublish() {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	if relay.connectPublishClient != nil {
+		relay.connectPublishClient.Close(nil)
+		relay.connectPublishClient = nil
+	}
+}
+
+// packet converts a received media message to a packet
+func (relay *RtmpRelay) packet(rc *core.ChunkStream) *av.Packet {
+	if relay.rebase {
+		relay.offset = relay.lastTimestamp + 1 - rc.Timestamp
+		relay.rebase = false
+	}
+
+	p := &av.Packet{
+		IsAudio:    rc.TypeID == av.TagAudio,
+		IsVideo:    rc.TypeID == av.TagVideo,
+		IsMetadata: rc.TypeID == av.TagScriptDataAMF0,
+		TimeStamp:  rc.Timestamp + relay.offset,
+		Data:       rc.Data,
+	}
+	if !p.IsMetadata {
+		relay.lastTimestamp = p.TimeStamp
+	}
+	relay.demuxer.DemuxH(p)
+	return p
+}
+
+// playStopped returns an error if the command is a status ending the play,
+// the play connection is then made again
+func playStopped(vs []interface{}) error {
+	if len(vs) < 4 || vs[0] != "onStatus" {
+		return nil
+	}
+	info, ok := vs[3].(amf.Object)
+	if !ok {
+		return nil
 	}
+	switch code := info["code"]; {
+	case info["level"] == "error", code == "NetStream.Play.Stop", code == "NetStream.Play.UnpublishNotify":
+		return fmt.Errorf("%v", code)
+	}
+	return nil
 }
 
-// rcvPlayChunkStream received play chunk stream
-func (relay *RtmpRelay) rcvPlayChunkStream() {
-	log.Debug("rcvPlayRtmpMediaPacket connectClient.Read...")
+// forward relays the media and metadata of the play connection to the
+// publish connection until either fails, the failed one is closed
+func (relay *RtmpRelay) forward() error {
+	relay.lock.Lock()
+	playClient, publishClient := relay.connectPlayClient, relay.connectPublishClient
+	relay.lock.Unlock()
+	if playClient == nil || publishClient == nil {
+		return fmt.Errorf("rtmprelay not connected")
+	}
+
+	relay.log.Debug("rcvPlayRtmpMediaPacket connectClient.Read...")
 	for {
 		var rc core.ChunkStream
-
-		if relay.startflag == false {
-			relay.connectPlayClient.Close(nil)
-			log.Debugf("rcvPlayChunkStream close: playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
-			break
+		if err := playClient.Read(&rc); err != nil {
+			relay.closePlay()
+			return fmt.Errorf("play %s: %v", relay.PlayURL, err)
 		}
-		err := relay.connectPlayClient.Read(&rc)
 
-		if err != nil && err == io.EOF {
-			break
+		if rc.TypeID == av.TagScriptDataAMF3 && len(rc.Data) > 1 && rc.Data[1] == amf.AMF0StringMarker {
+			// AMF3 data messages hold AMF0 values after a zero byte, the
+			// ones in AMF3 encoding are dropped
+			rc.Data = rc.Data[1:]
+			rc.Length--
+			rc.TypeID = av.TagScriptDataAMF0
 		}
-		//log.Debugf("connectPlayClient.Read return rc.TypeID=%v length=%d, err=%v", rc.TypeID, len(rc.Data), err)
 		switch rc.TypeID {
 		case 20, 17:
-			r := bytes.NewReader(rc.Data)
-			vs, err := relay.connectPlayClient.DecodeBatch(r, amf.AMF0)
-
-			log.Debugf("rcvPlayRtmpMediaPacket: vs=%v, err=%v", vs, err)
-		case 18:
-			log.Debug("rcvPlayRtmpMediaPacket: metadata....")
-		case 8, 9:
-			relay.csChan <- rc
+			// the other commands answer the play connection itself, such as
+			// _result, onBWDone or |RtmpSampleAccess, and are not forwarded:
+			// the publish connection makes its own
+			vs, err := core.DecodeCommand(&rc)
+			relay.log.Debugf("rcvPlayRtmpMediaPacket: vs=%v, err=%v", vs, err)
+			if err := playStopped(vs); err != nil {
+				relay.closePlay()
+				return fmt.Errorf("play %s: %v", relay.PlayURL, err)
+			}
+		case av.TagScriptDataAMF0, av.TagAudio, av.TagVideo:
+			p := relay.packet(&rc)
+			relay.cache.Write(*p)
+			if err := writePacket(publishClient, p); err != nil {
+				relay.closePublish()
+				return fmt.Errorf("publish %s: %v", relay.PublishURL, err)
+			}
+			atomic.AddUint64(&relay.bytes, uint64(len(rc.Data)))
 		}
 	}
 }
 
-// sendPublishChunkStream sends publish chunk stream
-func (relay *RtmpRelay) sendPublishChunkStream() {
+// run relays until the relay is stopped, reconnecting the failed side with
+// exponential backoff
+func (relay *RtmpRelay) run() {
+	backoff := minBackoff
 	for {
+		err := relay.connect()
+		if err == nil {
+			backoff = minBackoff
+			err = relay.forward()
+		}
+
 		select {
-		case rc := <-relay.csChan:
-			//log.Debugf("sendPublishChunkStream: rc.TypeID=%v length=%d", rc.TypeID, len(rc.Data))
-			relay.connectPublishClient.Write(rc)
-		case ctrlcmd := <-relay.sndctrlChan:
-			if ctrlcmd == stopCtrl {
-				relay.connectPublishClient.Close(nil)
-				log.Debugf("sendPublishChunkStream close: playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
-				break
-			}
+		case <-relay.done:
+			relay.log.Debugf("rtmprelay close: playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
+			return
+		default:
 		}
+
+		relay.lock.Lock()
+		relay.retries++
+		retries := relay.retries
+		relay.lock.Unlock()
+		if retries > maxRetries {
+			relay.log.Errorf("rtmprelay %s -> %s failed after %d retries: %v", relay.PlayURL, relay.PublishURL, maxRetries, err)
+			relay.setState(StateFailed, err)
+			relay.closePlay()
+			relay.closePublish()
+			return
+		}
+		relay.log.Warningf("rtmprelay %s -> %s error: %v, retry %d in %v", relay.PlayURL, relay.PublishURL, err, retries, backoff)
+		relay.setState(StateRetrying, err)
+
+		select {
+		case <-relay.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (relay *RtmpRelay) setState(state string, err error) {
+	relay.lock.Lock()
+	relay.state = state
+	relay.lastErr = err
+	relay.lock.Unlock()
+	relay.publishState()
+}
+
+// SetEvents sets the event bus the state changes of the relay are
+// published to
+func (relay *RtmpRelay) SetEvents(events *configure.Events) {
+	relay.lock.Lock()
+	relay.events = events
+	relay.lock.Unlock()
+}
+
+// SetLogger makes the relay log to l instead of the standard logger, it
+// is called before Start
+func (relay *RtmpRelay) SetLogger(l *log.Logger) {
+	relay.log = l
+}
+
+// publishState publishes the state of the relay
+func (relay *RtmpRelay) publishState() {
+	status := relay.Status()
+	relay.lock.Lock()
+	events := relay.events
+	relay.lock.Unlock()
+
+	data := map[string]interface{}{
+		"relay":       "relay",
+		"play_url":    status.PlayURL,
+		"publish_url": status.PublishURL,
+		"state":       status.State,
+		"retries":     status.Retries,
 	}
+	if status.Error != "" {
+		data["error"] = status.Error
+	}
+	events.Publish(configure.EventRelayState, "", data)
 }
 
-// Start start the relay
+// Start start the relay, an error is returned if the first connections fail.
+// Later failures are retried in the background.
 func (relay *RtmpRelay) Start() error {
+	relay.lock.Lock()
 	if relay.startflag {
+		relay.lock.Unlock()
 		return fmt.Errorf("The rtmprelay already started, playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
 	}
-
-	relay.connectPlayClient = core.NewConnClient()
-	relay.connectPublishClient = core.NewConnClient()
-
-	log.Debugf("play server addr:%v starting....", relay.PlayURL)
-	err := relay.connectPlayClient.Start(relay.PlayURL, "play")
-	if err != nil {
-		log.Debugf("connectPlayClient.Start url=%v error", relay.PlayURL)
-		return err
+	select {
+	case <-relay.done:
+		relay.lock.Unlock()
+		return fmt.Errorf("The rtmprelay already stoped, playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
+	default:
 	}
+	relay.startflag = true
+	relay.startTime = time.Now()
+	relay.lock.Unlock()
 
-	log.Debugf("publish server addr:%v starting....", relay.PublishURL)
-	err = relay.connectPublishClient.Start(relay.PublishURL, "publish")
-	if err != nil {
-		log.Debugf("connectPublishClient.Start url=%v error", relay.PublishURL)
-		relay.connectPlayClient.Close(nil)
+	if err := relay.connect(); err != nil {
+		relay.Stop()
 		return err
 	}
 
-	relay.startflag = true
-	go relay.rcvPlayChunkStream()
-	go relay.sendPublishChunkStream()
-
+	go relay.run()
 	return nil
 }
 
-// Stop stops the relay
+// Stop stops the relay and closes its connections
 func (relay *RtmpRelay) Stop() {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
 	if !relay.startflag {
-		log.Debugf("The rtmprelay already stoped, playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
+		relay.log.Debugf("The rtmprelay already stoped, playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
 		return
 	}
 
 	relay.startflag = false
-	relay.sndctrlChan <- stopCtrl
+	close(relay.done)
+	if relay.connectPlayClient != nil {
+		relay.connectPlayClient.Close(nil)
+		relay.connectPlayClient = nil
+	}
+	if relay.connectPublishClient != nil {
+		relay.connectPublishClient.Close(nil)
+		relay.connectPublishClient = nil
+	}
+}
+
+// Status returns the state of this relay
+func (relay *RtmpRelay) Status() RtmpRelayStatus {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
+	status := RtmpRelayStatus{
+		PlayURL:    relay.PlayURL,
+		PublishURL: relay.PublishURL,
+		State:      relay.state,
+		Retries:    relay.retries,
+		Bytes:      atomic.LoadUint64(&relay.bytes),
+	}
+	if !relay.startTime.IsZero() {
+		status.Uptime = int64(time.Since(relay.startTime) / time.Second)
+	}
+	if relay.lastErr != nil {
+		status.Error = relay.lastErr.Error()
+	}
+	return status
 }
@@ -0,0 +1,125 @@
+package rtmprelay
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeMedia sends a media message to the player ns
+func writeMedia(ns *core.NetStream, typeID, ts uint32, data []byte) error {
+	if err := ns.Write(core.ChunkStream{CSID: 6, TypeID: typeID, StreamID: ns.ID(), Timestamp: ts, Length: uint32(len(data)), Data: data}); err != nil {
+		return err
+	}
+	return ns.Flush()
+}
+
+// readMessage returns the next media message of ns
+func readMessage(ns *core.NetStream) (core.ChunkStream, error) {
+	for {
+		var c core.ChunkStream
+		if err := ns.Read(&c); err != nil {
+			return c, err
+		}
+		switch c.TypeID {
+		case av.TagAudio, av.TagVideo, av.TagScriptDataAMF0:
+			return c, nil
+		}
+	}
+}
+
+func TestRtmpRelay(t *testing.T) {
+	at := assert.New(t)
+	in := newTestIngest(t)
+	defer in.l.Close()
+	events, states := newTestEvents(t)
+
+	playURL, publishURL := in.url("source"), in.url("target")
+	relay := NewRtmpRelay(&playURL, &publishURL)
+	relay.SetEvents(events)
+	if !at.Nil(relay.Start()) {
+		return
+	}
+	defer relay.Stop()
+	at.NotNil(relay.Start())
+	ev := waitState(t, states, StateLive)
+	at.Equal("relay", ev.Data["relay"])
+	player, publisher := in.stream(t), in.stream(t)
+	at.False(player.IsPublisher())
+	at.True(publisher.IsPublisher())
+
+	//metadata and media are forwarded, the metadata as @setDataFrame
+	meta := bytes.NewBuffer(nil)
+	(&amf.Encoder{}).EncodeBatch(meta, amf.AMF0, "onMetaData", amf.Object{"width": 1280})
+	at.Nil(writeMedia(player, av.TagScriptDataAMF0, 0, meta.Bytes()))
+	at.Nil(writeMedia(player, av.TagVideo, 0, testPacket(0, true).Data))
+	at.Nil(writeMedia(player, av.TagVideo, 40, testPacket(40, false).Data))
+	c, err := readMessage(publisher)
+	at.Nil(err)
+	at.Equal(uint32(av.TagScriptDataAMF0), c.TypeID)
+	data, _ := amf.MetaDataReform(meta.Bytes(), amf.ADD)
+	at.Equal(data, c.Data)
+	for _, ts := range []uint32{0, 40} {
+		c, err = readMessage(publisher)
+		at.Nil(err)
+		at.Equal(uint32(av.TagVideo), c.TypeID)
+		at.Equal(ts, c.Timestamp)
+	}
+	at.Equal(StateLive, relay.Status().State)
+	at.True(relay.Status().Bytes > 0)
+
+	//AMF3 data is forwarded as metadata, commands are not
+	cmd := bytes.NewBuffer(nil)
+	(&amf.Encoder{}).EncodeBatch(cmd, amf.AMF0, "onStatus", float64(0), nil, amf.Object{"level": "status", "code": "NetStream.Play.Start"})
+	at.Nil(writeMedia(player, 17, 80, append([]byte{0}, cmd.Bytes()...)))
+	at.Nil(writeMedia(player, av.TagScriptDataAMF3, 80, append([]byte{0}, meta.Bytes()...)))
+	c, err = readMessage(publisher)
+	at.Nil(err)
+	at.Equal(uint32(av.TagScriptDataAMF0), c.TypeID)
+	at.Equal(data, c.Data)
+
+	//a new play connection continues the timestamps of the publish one
+	player.Close(fmt.Errorf("dropped"))
+	ev = waitState(t, states, StateRetrying)
+	at.Contains(ev.Data["error"], "play")
+	waitState(t, states, StateLive)
+	player = in.stream(t)
+	at.False(player.IsPublisher())
+	at.Nil(writeMedia(player, av.TagVideo, 5000, testPacket(0, false).Data))
+	c, err = readMessage(publisher)
+	at.Nil(err)
+	at.Equal(uint32(41), c.Timestamp)
+	at.Equal(0, relay.Status().Retries)
+
+	//an AMF3 status ending the play makes the play connection again
+	cmd.Reset()
+	(&amf.Encoder{}).EncodeBatch(cmd, amf.AMF0, "onStatus", float64(0), nil, amf.Object{"level": "status", "code": "NetStream.Play.UnpublishNotify"})
+	at.Nil(writeMedia(player, 17, 0, append([]byte{0}, cmd.Bytes()...)))
+	ev = waitState(t, states, StateRetrying)
+	at.Contains(ev.Data["error"], "NetStream.Play.UnpublishNotify")
+	waitState(t, states, StateLive)
+	player = in.stream(t)
+	at.False(player.IsPublisher())
+
+	relay.Stop()
+	_, err = readMessage(publisher)
+	at.NotNil(err)
+	at.NotNil(relay.Start())
+}
+
+func TestRtmpRelayStartError(t *testing.T) {
+	at := assert.New(t)
+	in := newTestIngest(t)
+	in.l.Close()
+
+	playURL, publishURL := in.url("source"), in.url("target")
+	relay := NewRtmpRelay(&playURL, &publishURL)
+	at.NotNil(relay.Start())
+	at.Equal(StateConnecting, relay.Status().State)
+}
@@ -3,9 +3,11 @@ package rtmprelay
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
 	"github.com/gwuhaolin/livego/protocol/rtmp/core"
 
 	log "github.com/sirupsen/logrus"
@@ -13,181 +15,310 @@ import (
 
 // StaticPush is a static push
 type StaticPush struct {
-	RtmpURL       string
-	packetChan    chan *av.Packet
-	sndctrlChan   chan string
-	connectClient *core.ConnClient
-	startflag     bool
+	RtmpURL    string
+	packetChan chan *av.Packet
+	done       chan struct{}
+
+	lock      sync.Mutex
+	cache     *cache.Cache
+	startflag bool
+	state     string
+	retries   int
+	lastErr   error
+	events    *configure.Events
+	log       *log.Logger
+}
+
+// StaticPushStatus is the state of a static push
+type StaticPushStatus struct {
+	URL     string `json:"url"`
+	State   string `json:"state"`
+	Retries int    `json:"retries"`
+	Error   string `json:"error,omitempty"`
 }
 
 // NewStaticPush returns a StaticPush
 func NewStaticPush(rtmpurl string) *StaticPush {
 	return &StaticPush{
-		RtmpURL:       rtmpurl,
-		packetChan:    make(chan *av.Packet, 500),
-		sndctrlChan:   make(chan string),
-		connectClient: nil,
-		startflag:     false,
+		RtmpURL:    rtmpurl,
+		packetChan: make(chan *av.Packet, 500),
+		done:       make(chan struct{}),
+		cache:      cache.NewCache(1),
+		log:        log.StandardLogger(),
 	}
 }
 
-var staticPushMap = make(map[string](*StaticPush))
-var mapLock = new(sync.RWMutex)
-
-var (
-	staticRelayStopCtrl = "STATIC_RTMPRELAY_STOP"
-)
-
-// GetStaticPushList get the static push list of an application
-func GetStaticPushList(appname string) ([]string, error) {
-	pushurlList, ok := configure.GetStaticPushURLList(appname)
+// StaticPushes holds the static pushes of one server by rtmp url
+type StaticPushes struct {
+	lock   sync.RWMutex
+	pushes map[string]*StaticPush
+	events *configure.Events
+	log    *log.Logger
+}
 
-	if !ok {
-		return nil, fmt.Errorf("no static push url")
+// NewStaticPushes returns an empty StaticPushes, the state changes of its
+// pushes are published to events and they log to logger
+func NewStaticPushes(events *configure.Events, logger *log.Logger) *StaticPushes {
+	return &StaticPushes{
+		pushes: make(map[string]*StaticPush),
+		events: events,
+		log:    logger,
 	}
-
-	return pushurlList, nil
 }
 
-// GetAndCreateStaticPushObject get the staticpush of given rtmpurl, or create one
-func GetAndCreateStaticPushObject(rtmpurl string) *StaticPush {
-	mapLock.RLock()
-	staticpush, ok := staticPushMap[rtmpurl]
-	log.Debugf("GetAndCreateStaticPushObject: %s, return %v", rtmpurl, ok)
-	if !ok {
-		mapLock.RUnlock()
-		newStaticpush := NewStaticPush(rtmpurl)
-
-		mapLock.Lock()
-		staticPushMap[rtmpurl] = newStaticpush
-		mapLock.Unlock()
+// GetAndCreate get the staticpush of given rtmpurl, or create one
+func (m *StaticPushes) GetAndCreate(rtmpurl string) *StaticPush {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-		return newStaticpush
+	staticpush, ok := m.pushes[rtmpurl]
+	m.log.Debugf("GetAndCreateStaticPushObject: %s, return %v", rtmpurl, ok)
+	if !ok {
+		staticpush = NewStaticPush(rtmpurl)
+		staticpush.events = m.events
+		staticpush.log = m.log
+		m.pushes[rtmpurl] = staticpush
 	}
-	mapLock.RUnlock()
-
 	return staticpush
 }
 
-// GetStaticPushObject gets static push object
-func GetStaticPushObject(rtmpurl string) (*StaticPush, error) {
-	mapLock.RLock()
-	if staticpush, ok := staticPushMap[rtmpurl]; ok {
-		mapLock.RUnlock()
+// Get gets static push object
+func (m *StaticPushes) Get(rtmpurl string) (*StaticPush, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if staticpush, ok := m.pushes[rtmpurl]; ok {
 		return staticpush, nil
 	}
-	mapLock.RUnlock()
-
 	return nil, fmt.Errorf("staticPushMap[%s] not exist", rtmpurl)
 }
 
-// ReleaseStaticPushObject release one static_push object
-func ReleaseStaticPushObject(rtmpurl string) {
-	mapLock.RLock()
-	if _, ok := staticPushMap[rtmpurl]; ok {
-		mapLock.RUnlock()
+// Release release one static_push object
+func (m *StaticPushes) Release(rtmpurl string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-		log.Debugf("ReleaseStaticPushObject %s ok", rtmpurl)
-		mapLock.Lock()
-		delete(staticPushMap, rtmpurl)
-		mapLock.Unlock()
+	if _, ok := m.pushes[rtmpurl]; ok {
+		m.log.Debugf("ReleaseStaticPushObject %s ok", rtmpurl)
+		delete(m.pushes, rtmpurl)
 	} else {
-		mapLock.RUnlock()
-		log.Debugf("ReleaseStaticPushObject: not find %s", rtmpurl)
+		m.log.Debugf("ReleaseStaticPushObject: not find %s", rtmpurl)
+	}
+}
+
+// List returns the status of all static pushes
+func (m *StaticPushes) List() []StaticPushStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	list := make([]StaticPushStatus, 0, len(m.pushes))
+	for _, staticpush := range m.pushes {
+		list = append(list, staticpush.Status())
 	}
+	return list
 }
 
-// Start starts publishing
+// Start starts publishing, the connection is made in the background and
+// made again with exponential backoff whenever sending fails
 func (sp *StaticPush) Start() error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
 	if sp.startflag {
 		return fmt.Errorf("StaticPush already start %s", sp.RtmpURL)
 	}
-
-	sp.connectClient = core.NewConnClient()
-
-	log.Debugf("static publish server addr:%v starting....", sp.RtmpURL)
-	err := sp.connectClient.Start(sp.RtmpURL, "publish")
-	if err != nil {
-		log.Debugf("connectClient.Start url=%v error", sp.RtmpURL)
-		return err
+	select {
+	case <-sp.done:
+		return fmt.Errorf("StaticPush already stopped %s", sp.RtmpURL)
+	default:
 	}
-	log.Debugf("static publish server addr:%v started, streamid=%d", sp.RtmpURL, sp.connectClient.StreamID())
-	go sp.Handle()
 
 	sp.startflag = true
+	sp.state = StateConnecting
+	go sp.Handle()
 	return nil
 }
 
-// Stop stops the stop
+// Stop stops the push and closes its connection
 func (sp *StaticPush) Stop() {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
 	if !sp.startflag {
 		return
 	}
 
-	log.Debugf("StaticPush Stop: %s", sp.RtmpURL)
-	sp.sndctrlChan <- staticRelayStopCtrl
+	sp.log.Debugf("StaticPush Stop: %s", sp.RtmpURL)
+	close(sp.done)
 	sp.startflag = false
 }
 
-// Write writes a packet
-func (sp *StaticPush) Write(packet *av.Packet) {
+// Write caches a packet for reconnecting and queues it while the push is
+// live. Packets are dropped if the remote server can not keep up.
+func (sp *StaticPush) Write(packet *av.Packet) error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
 	if !sp.startflag {
-		return
+		return fmt.Errorf("StaticPush not started %s", sp.RtmpURL)
 	}
 
-	sp.packetChan <- packet
+	sp.cache.Write(*packet)
+	if sp.state != StateLive {
+		return nil
+	}
+	select {
+	case sp.packetChan <- packet:
+	default:
+		sp.log.Debugf("StaticPush %s queue full, drop packet", sp.RtmpURL)
+	}
+	return nil
 }
 
 // Send send packet
-func (sp *StaticPush) Send(p *av.Packet) {
-	if !sp.startflag {
-		return
-	}
-	var cs core.ChunkStream
+func (sp *StaticPush) Send(connectClient *core.ConnClient, p *av.Packet) error {
+	return writePacket(connectClient, p)
+}
 
-	cs.Data = p.Data
-	cs.Length = uint32(len(p.Data))
-	cs.StreamID = sp.connectClient.StreamID()
-	cs.Timestamp = p.TimeStamp
-	//cs.Timestamp += v.BaseTimeStamp()
+// pushConn sends packets directly to the connection of a static push
+type pushConn struct {
+	sp     *StaticPush
+	client *core.ConnClient
+}
 
-	//log.Printf("Static sendPacket: rtmpurl=%s, length=%d, streamid=%d",
-	//	self.RtmpUrl, len(p.Data), cs.StreamID)
-	if p.IsVideo {
-		cs.TypeID = av.TagVideo
-	} else {
-		if p.IsMetadata {
-			cs.TypeID = av.TagScriptDataAMF0
-		} else {
-			cs.TypeID = av.TagAudio
-		}
+// Write sends a packet
+func (c pushConn) Write(p *av.Packet) error {
+	return c.sp.Send(c.client, p)
+}
+
+// connect connects to the remote server and sends the metadata,
+// sequence headers and GOP cached so far, then the push is live
+func (sp *StaticPush) connect() (*core.ConnClient, error) {
+	sp.setState(StateConnecting, nil)
+
+	sp.log.Debugf("static publish server addr:%v starting....", sp.RtmpURL)
+	connectClient, err := dial(sp.RtmpURL, av.PUBLISH, sp.log)
+	if err != nil {
+		return nil, err
 	}
+	sp.log.Debugf("static publish server addr:%v started, streamid=%d", sp.RtmpURL, connectClient.StreamID())
 
-	sp.connectClient.Write(cs)
-}
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
 
-// Handle handles packet
-func (sp *StaticPush) Handle() {
-	if !sp.IsStart() {
-		log.Debugf("static push %s not started", sp.RtmpURL)
-		return
+	// packets queued before the failure are covered by the cache
+	for len(sp.packetChan) > 0 {
+		<-sp.packetChan
+	}
+	if err := sp.cache.Send(pushConn{sp, connectClient}); err != nil {
+		connectClient.Close(nil)
+		return nil, err
 	}
+	sp.state = StateLive
+	sp.retries = 0
+	sp.lastErr = nil
+	sp.publishState(sp.status())
+	return connectClient, nil
+}
 
+// send sends the queued packets until the push is stopped or sending fails
+func (sp *StaticPush) send(connectClient *core.ConnClient) error {
 	for {
 		select {
+		case <-sp.done:
+			return nil
 		case packet := <-sp.packetChan:
-			sp.Send(packet)
-		case ctrlcmd := <-sp.sndctrlChan:
-			if ctrlcmd == staticRelayStopCtrl {
-				sp.connectClient.Close(nil)
-				log.Debugf("Static HandleAvPacket close: publishurl=%s", sp.RtmpURL)
-				break
+			if err := sp.Send(connectClient, packet); err != nil {
+				return err
 			}
 		}
 	}
 }
 
+// Handle connects and sends packets until the push is stopped,
+// reconnecting with exponential backoff after errors
+func (sp *StaticPush) Handle() {
+	backoff := minBackoff
+	for {
+		connectClient, err := sp.connect()
+		if err == nil {
+			backoff = minBackoff
+			err = sp.send(connectClient)
+			connectClient.Close(nil)
+			if err == nil {
+				sp.log.Debugf("Static HandleAvPacket close: publishurl=%s", sp.RtmpURL)
+				return
+			}
+		}
+
+		sp.lock.Lock()
+		sp.retries++
+		retries := sp.retries
+		sp.lock.Unlock()
+		if retries > maxRetries {
+			sp.log.Errorf("StaticPush %s failed after %d retries: %v", sp.RtmpURL, maxRetries, err)
+			sp.setState(StateFailed, err)
+			return
+		}
+		sp.log.Warningf("StaticPush %s error: %v, retry %d in %v", sp.RtmpURL, err, retries, backoff)
+		sp.setState(StateRetrying, err)
+
+		select {
+		case <-sp.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (sp *StaticPush) setState(state string, err error) {
+	sp.lock.Lock()
+	sp.state = state
+	sp.lastErr = err
+	status := sp.status()
+	sp.lock.Unlock()
+	sp.publishState(status)
+}
+
+// publishState publishes the state of the push
+func (sp *StaticPush) publishState(status StaticPushStatus) {
+	data := map[string]interface{}{
+		"relay":   "static_push",
+		"url":     status.URL,
+		"state":   status.State,
+		"retries": status.Retries,
+	}
+	if status.Error != "" {
+		data["error"] = status.Error
+	}
+	sp.events.Publish(configure.EventRelayState, "", data)
+}
+
+// Status returns the state of this push
+func (sp *StaticPush) Status() StaticPushStatus {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	return sp.status()
+}
+
+func (sp *StaticPush) status() StaticPushStatus {
+	status := StaticPushStatus{
+		URL:     sp.RtmpURL,
+		State:   sp.state,
+		Retries: sp.retries,
+	}
+	if sp.lastErr != nil {
+		status.Error = sp.lastErr.Error()
+	}
+	return status
+}
+
 // IsStart returns if this is started
 func (sp *StaticPush) IsStart() bool {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
 	return sp.startflag
 }
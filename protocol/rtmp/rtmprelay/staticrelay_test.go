@@ -0,0 +1,209 @@
+package rtmprelay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testIngest is an RTMP server passing the streams of its clients to a
+// channel
+type testIngest struct {
+	l       net.Listener
+	streams chan *core.NetStream
+}
+
+func newTestIngest(t *testing.T) *testIngest {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := &testIngest{l: l, streams: make(chan *core.NetStream, 4)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go in.serve(core.NewConn(c, 4*1024))
+		}
+	}()
+	return in
+}
+
+func (in *testIngest) serve(conn *core.Conn) {
+	if _, err := conn.ServerHandshake(false); err != nil {
+		conn.Close()
+		return
+	}
+	connServer := core.NewConnServer(conn, nil)
+	for {
+		ns, err := connServer.Accept()
+		if err != nil {
+			return
+		}
+		if err := ns.Start(); err != nil {
+			return
+		}
+		in.streams <- ns
+	}
+}
+
+func (in *testIngest) url(name string) string {
+	return fmt.Sprintf("rtmp://%s/live/%s", in.l.Addr(), name)
+}
+
+// stream returns the next stream started on the ingest
+func (in *testIngest) stream(t *testing.T) *core.NetStream {
+	select {
+	case ns := <-in.streams:
+		return ns
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream started")
+		return nil
+	}
+}
+
+// readMedia returns the type ids of the next n media messages of ns
+func readMedia(ns *core.NetStream, n int) ([]uint32, error) {
+	var types []uint32
+	for len(types) < n {
+		var c core.ChunkStream
+		if err := ns.Read(&c); err != nil {
+			return types, err
+		}
+		switch c.TypeID {
+		case av.TagAudio, av.TagVideo, av.TagScriptDataAMF0:
+			types = append(types, c.TypeID)
+		}
+	}
+	return types, nil
+}
+
+// newTestEvents returns an event bus with a subscription
+func newTestEvents(t *testing.T) (*configure.Events, <-chan configure.Event) {
+	cfg := configure.DefaultConfig()
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	conf, err := configure.NewStore(&cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := conf.Events().Subscribe(64)
+	return conf.Events(), events
+}
+
+// waitState returns the next relay_state event of state
+func waitState(t *testing.T, events <-chan configure.Event, state string) configure.Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == configure.EventRelayState && ev.Data["state"] == state {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no relay state %s", state)
+		}
+	}
+}
+
+// testPacket returns a demuxed H.264 video packet, a sequence header or a
+// key frame
+func testPacket(ts uint32, seq bool) *av.Packet {
+	data := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x01}
+	if seq {
+		data = []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0xc0, 0x1e, 0xff}
+	}
+	p := &av.Packet{IsVideo: true, TimeStamp: ts, Data: data}
+	flv.NewDemuxer().DemuxH(p)
+	return p
+}
+
+func TestStaticPushReconnect(t *testing.T) {
+	at := assert.New(t)
+	in := newTestIngest(t)
+	defer in.l.Close()
+	events, states := newTestEvents(t)
+
+	pushes := NewStaticPushes(events, log.StandardLogger())
+	sp := pushes.GetAndCreate(in.url("room"))
+	at.NotNil(sp.Write(testPacket(0, true)))
+	at.Nil(sp.Start())
+	at.NotNil(sp.Start())
+	defer sp.Stop()
+
+	ev := waitState(t, states, StateLive)
+	at.Equal("static_push", ev.Data["relay"])
+	at.Equal(in.url("room"), ev.Data["url"])
+	ns := in.stream(t)
+	at.Nil(sp.Write(testPacket(0, true)))
+	at.Nil(sp.Write(testPacket(40, false)))
+	types, err := readMedia(ns, 2)
+	at.Nil(err)
+	at.Equal([]uint32{av.TagVideo, av.TagVideo}, types)
+
+	//the push reconnects when the ingest drops it and resends the cache
+	ns.Close(fmt.Errorf("dropped"))
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for ts := uint32(80); ; ts += 40 {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			sp.Write(testPacket(ts, false))
+		}
+	}()
+	ev = waitState(t, states, StateRetrying)
+	at.Equal(1, ev.Data["retries"])
+	at.NotEmpty(ev.Data["error"])
+	waitState(t, states, StateLive)
+	ns = in.stream(t)
+	types, err = readMedia(ns, 2)
+	at.Nil(err)
+	at.Equal([]uint32{av.TagVideo, av.TagVideo}, types)
+	at.Equal(StaticPushStatus{URL: in.url("room"), State: StateLive}, sp.Status())
+	at.Equal([]StaticPushStatus{sp.Status()}, pushes.List())
+
+	sp.Stop()
+	at.False(sp.IsStart())
+	at.NotNil(sp.Start())
+	pushes.Release(in.url("room"))
+	_, err = pushes.Get(in.url("room"))
+	at.NotNil(err)
+}
+
+func TestStaticPushRetry(t *testing.T) {
+	at := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("rtmp://%s/live/room", l.Addr())
+	l.Close()
+	events, states := newTestEvents(t)
+
+	//a push which can not connect retries in the background
+	sp := NewStaticPushes(events, log.StandardLogger()).GetAndCreate(url)
+	at.Nil(sp.Start())
+	ev := waitState(t, states, StateRetrying)
+	at.Equal(1, ev.Data["retries"])
+	status := sp.Status()
+	at.Equal(StateRetrying, status.State)
+	at.Equal(1, status.Retries)
+	at.NotEmpty(status.Error)
+	sp.Stop()
+}
@@ -0,0 +1,139 @@
+package rtmp
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// queueWriter is a writer whose queue is emptied when released is closed
+type queueWriter struct {
+	*testWriter
+	released chan struct{}
+}
+
+func (w *queueWriter) Write(*av.Packet) error { return nil }
+
+func (w *queueWriter) QueueLen() int {
+	select {
+	case <-w.released:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, nil, Hooks{})
+	defer s.close()
+
+	c, err := s.publish("room")
+	if !at.Nil(err) {
+		return
+	}
+	defer c.Close(nil)
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+	p, err := s.play("room")
+	if !at.Nil(err) {
+		return
+	}
+	defer p.Close(nil)
+	s.waitEvent(t, configure.EventPlayerJoin, "live/room")
+	var w *VirWriter
+	if v, ok := s.streams.GetStreams().Get("live/room"); ok {
+		for item := range v.(*Stream).Ws().IterBuffered() {
+			if v, ok := item.Val.(*PackWriterCloser).Writer().(*VirWriter); ok {
+				w = v
+			}
+		}
+	}
+	if !at.NotNil(w) {
+		return
+	}
+
+	//the frames are queued while the player does not read, the audio
+	//frame changing the codec follows them. They are below the window ack
+	//size, the player sends nothing the server could leave unread.
+	frame := make([]byte, 32*1024)
+	frame[0], frame[1] = 0x17, 0x01
+	for i := uint32(0); i < 60; i++ {
+		c.Write(core.ChunkStream{CSID: 6, TypeID: av.TagVideo, StreamID: c.StreamID(), Timestamp: 40 * i, Length: uint32(len(frame)), Data: frame})
+	}
+	audio := []byte{0xaf, 0x01, 0x21}
+	c.Write(core.ChunkStream{CSID: 4, TypeID: av.TagAudio, StreamID: c.StreamID(), Timestamp: 2400, Length: uint32(len(audio)), Data: audio})
+	c.Flush()
+	for {
+		ev := s.waitEvent(t, configure.EventCodecChange, "live/room")
+		if ev.Data["audio_codec"] == "AAC" {
+			break
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	//every frame sent to the player is read before the end of the stream
+	var bytes uint64
+	for {
+		var cs core.ChunkStream
+		if err = p.Read(&cs); err != nil {
+			break
+		}
+		if cs.TypeID == av.TagVideo {
+			bytes += uint64(cs.Length)
+		}
+	}
+	at.Equal(io.EOF, err)
+	at.Nil(<-done)
+	at.NotZero(bytes)
+	w.bwLock.Lock()
+	at.Equal(w.WriteBWInfo.VideoDatainBytes, bytes)
+	w.bwLock.Unlock()
+	ev := s.waitEvent(t, configure.EventPlayerLeave, "live/room")
+	at.Equal("server is shutting down", ev.Data["reason"])
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	at := assert.New(t)
+	rs := newTestStreams(t, nil)
+	r := newTestReader("publisher", "rtmp://localhost/live/show")
+	rs.HandleReader(r)
+	w := &queueWriter{newTestWriter(), make(chan struct{})}
+	rs.HandleWriter(w)
+
+	//the drain is cut short by the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	at.Equal(context.DeadlineExceeded, rs.Shutdown(ctx))
+	<-w.closed
+	<-r.closed
+	at.False(rs.HasPublisher("live/show"))
+
+	//streams are closed once drained
+	rs = newTestStreams(t, nil)
+	w = &queueWriter{newTestWriter(), make(chan struct{})}
+	rs.HandleWriter(w)
+	done := make(chan error, 1)
+	go func() {
+		done <- rs.Shutdown(context.Background())
+	}()
+	select {
+	case <-w.closed:
+		t.Fatal("closed before drained")
+	default:
+	}
+	close(w.released)
+	at.Nil(<-done)
+	<-w.closed
+}
@@ -0,0 +1,237 @@
+package rtmp
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
+)
+
+// failoverGap is the gap in milliseconds between the last packet of a
+// publisher and the first packet of the publisher replacing it
+const failoverGap = 40
+
+// isBackup returns if the publisher of info publishes with role=backup
+func isBackup(info av.Info) bool {
+	u, err := url.Parse(info.URL)
+	return err == nil && u.Query().Get("role") == "backup"
+}
+
+func isKeyFrame(p *av.Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
+
+// rebaser keeps the timestamps of a stream continuous across changes of
+// publisher, only accessed by the TransStart goroutine
+type rebaser struct {
+	waitKey   bool // drop packets until a key frame of the new publisher
+	offset    uint32
+	lastVideo uint32
+	lastAudio uint32
+}
+
+// start returns the timestamp of the first packet after a change
+func (rb *rebaser) start() uint32 {
+	last := rb.lastVideo
+	if int32(rb.lastAudio-last) > 0 {
+		last = rb.lastAudio
+	}
+	return last + failoverGap
+}
+
+// rebase shifts the timestamp of p, audio and video never go backwards
+// after a change of publisher
+func (rb *rebaser) rebase(p *av.Packet) {
+	if rb.offset == 0 {
+		if p.IsVideo {
+			rb.lastVideo = p.TimeStamp
+		} else if p.IsAudio {
+			rb.lastAudio = p.TimeStamp
+		}
+		return
+	}
+
+	p.TimeStamp += rb.offset
+	switch {
+	case p.IsVideo:
+		if int32(p.TimeStamp-rb.lastVideo) < 0 {
+			p.TimeStamp = rb.lastVideo
+		}
+		rb.lastVideo = p.TimeStamp
+	case p.IsAudio:
+		if int32(p.TimeStamp-rb.lastAudio) < 0 {
+			p.TimeStamp = rb.lastAudio
+		}
+		rb.lastAudio = p.TimeStamp
+	default:
+		p.TimeStamp = rb.lastVideo
+	}
+}
+
+// backup is a hot-standby publisher of a stream. Its packets are read into
+// its own cache until it is promoted, so players get its sequence headers
+// at once.
+type backup struct {
+	r     av.ReadCloser
+	cache *cache.Cache
+	stop  chan struct{}
+	done  chan error // the read error, nil once stopped for promotion
+}
+
+// AddBackup holds r as a backup publisher, promoted when the publisher
+// stops
+func (s *Stream) AddBackup(r av.ReadCloser) {
+	s.addBackup(r, cache.NewCache(s.conf.Current().GopNum))
+}
+
+func (s *Stream) addBackup(r av.ReadCloser, c *cache.Cache) {
+	b := &backup{
+		r:     r,
+		cache: c,
+		stop:  make(chan struct{}),
+		done:  make(chan error, 1),
+	}
+	s.lock.Lock()
+	s.backups = append(s.backups, b)
+	s.lock.Unlock()
+	s.log.Debugf("[%v] backup publisher added", r.Info())
+	go s.readBackup(b)
+}
+
+// Backups returns the number of backup publishers
+func (s *Stream) Backups() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.backups)
+}
+
+// servedByBackup returns if the stream is published by a backup publisher
+func (s *Stream) servedByBackup() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rBackup
+}
+
+// Restore makes r the publisher of a stream served by a backup publisher,
+// which is held as backup again
+func (s *Stream) Restore(r av.ReadCloser) {
+	select {
+	case s.restore <- r:
+	default:
+		r.Close(fmt.Errorf("stream %s is being restored", s.info.Key))
+	}
+}
+
+func (s *Stream) readBackup(b *backup) {
+	var p av.Packet
+	for {
+		if err := b.r.Read(&p); err != nil {
+			s.removeBackup(b)
+			b.r.Close(err)
+			b.done <- err
+			return
+		}
+		b.cache.Write(p)
+
+		select {
+		case <-b.stop:
+			b.done <- nil
+			return
+		default:
+		}
+	}
+}
+
+func (s *Stream) removeBackup(b *backup) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, v := range s.backups {
+		if v == b {
+			s.backups = append(s.backups[:i], s.backups[i+1:]...)
+			return
+		}
+	}
+}
+
+// promote replaces the stopped publisher by the first live backup
+func (s *Stream) promote() bool {
+	for {
+		s.lock.Lock()
+		if s.closing || len(s.backups) == 0 {
+			s.lock.Unlock()
+			return false
+		}
+		b := s.backups[0]
+		s.backups = s.backups[1:]
+		s.lock.Unlock()
+
+		// wait until the backup stops reading
+		close(b.stop)
+		if err := <-b.done; err != nil {
+			continue
+		}
+
+		if r := s.Reader(); r != nil {
+			r.Close(fmt.Errorf("replaced by backup"))
+		}
+		s.switchTo(b.r, b.cache)
+		s.log.Infof("[%v] backup publisher promoted", b.r.Info())
+		return true
+	}
+}
+
+// demote makes r the publisher and holds the current publisher as backup
+// with its cache, which keeps its sequence headers
+func (s *Stream) demote(r av.ReadCloser) {
+	s.addBackup(s.Reader(), s.cache)
+	s.switchTo(r, cache.NewCache(s.conf.Current().GopNum))
+	s.log.Infof("[%v] publisher restored", r.Info())
+}
+
+func (s *Stream) switchTo(r av.ReadCloser, c *cache.Cache) {
+	s.lock.Lock()
+	s.r = r
+	s.rBackup = isBackup(r.Info())
+	s.lock.Unlock()
+	s.cache = c
+	s.rebaser.waitKey = true
+}
+
+// resume continues the stream with the key frame at timestamp of the new
+// publisher. The writers get its metadata and sequence headers first.
+func (s *Stream) resume(timestamp uint32) {
+	start := s.rebaser.start()
+	s.rebaser.waitKey = false
+	s.rebaser.offset = start - timestamp
+	s.cache.Rebase(start)
+
+	for item := range s.ws.IterBuffered() {
+		v := item.Val.(*PackWriterCloser)
+		if !v.init {
+			continue
+		}
+		if d, ok := v.w.(av.Discontinuer); ok {
+			d.Discontinuity()
+		}
+		if err := s.cache.SendHeaders(v.w); err != nil {
+			s.log.Debugf("[%s] send headers error: %v, remove", v.w.Info(), err)
+			s.removeWriter(item.Key, v, err)
+		}
+	}
+}
+
+// closeBackups closes all backup publishers
+func (s *Stream) closeBackups(err error) {
+	s.lock.Lock()
+	backups := s.backups
+	s.backups = nil
+	s.lock.Unlock()
+	for _, b := range backups {
+		b.r.Close(err)
+	}
+}
@@ -0,0 +1,224 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testReader is a publisher reading the packets sent on its channel
+type testReader struct {
+	info    av.Info
+	packets chan *av.Packet
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newTestReader(uid, url string) *testReader {
+	return &testReader{
+		info:    av.Info{Key: "live/show", URL: url, UID: uid},
+		packets: make(chan *av.Packet),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (r *testReader) Info() av.Info { return r.info }
+func (r *testReader) Alive() bool   { return true }
+
+func (r *testReader) Close(error) {
+	r.once.Do(func() { close(r.closed) })
+}
+
+func (r *testReader) Read(p *av.Packet) error {
+	select {
+	case v := <-r.packets:
+		*p = *v
+		return nil
+	case <-r.closed:
+		return fmt.Errorf("closed")
+	}
+}
+
+// feed publishes video frames on r from timestamp start with a key frame
+// every 5 frames, the last byte of their data is id. It returns when done
+// or r is closed.
+func (r *testReader) feed(id byte, start uint32, done chan struct{}) {
+	for i := uint32(0); ; i++ {
+		p := videoPacket(i%5 == 0)
+		p.Data = append(append([]byte(nil), p.Data[:len(p.Data)-1]...), id)
+		p.TimeStamp = start + 40*i
+		select {
+		case r.packets <- p:
+		case <-r.closed:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// testFrame is a video frame received by a testWriter
+type testFrame struct {
+	id        byte
+	timestamp uint32
+}
+
+// testWriter is a player sending the video frames it gets on its channel
+type testWriter struct {
+	frames chan testFrame
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTestWriter() *testWriter {
+	return &testWriter{
+		frames: make(chan testFrame),
+		closed: make(chan struct{}),
+	}
+}
+
+func (w *testWriter) Info() av.Info {
+	return av.Info{Key: "live/show", UID: "player", Inter: true}
+}
+func (w *testWriter) Alive() bool        { return true }
+func (w *testWriter) CalcBaseTimestamp() {}
+
+func (w *testWriter) Close(error) {
+	w.once.Do(func() { close(w.closed) })
+}
+
+func (w *testWriter) Write(p *av.Packet) error {
+	if !p.IsVideo {
+		return nil
+	}
+	select {
+	case w.frames <- testFrame{p.Data[len(p.Data)-1], p.TimeStamp}:
+		return nil
+	case <-w.closed:
+		return fmt.Errorf("closed")
+	}
+}
+
+// until returns the frames received until the first one published by id,
+// which is included
+func (w *testWriter) until(t *testing.T, id byte) []testFrame {
+	var frames []testFrame
+	for {
+		f := <-w.frames
+		frames = append(frames, f)
+		if f.id == id {
+			return frames
+		}
+		if len(frames) > 1000 {
+			t.Fatalf("no frame of publisher %d", id)
+		}
+	}
+}
+
+// continuous returns if the timestamps of frames increase by 40ms
+func continuous(frames []testFrame) bool {
+	for i := 1; i < len(frames); i++ {
+		if frames[i].timestamp-frames[i-1].timestamp != 40 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDuplicatePublisher(t *testing.T) {
+	at := assert.New(t)
+	rs := newTestStreams(t, func(cfg *configure.ServerCfg) {
+		cfg.Server[0].DuplicatePublisher = configure.PublishReject
+	})
+	defer rs.Shutdown(context.Background())
+
+	primary := newTestReader("primary", "rtmp://localhost/live/show")
+	defer primary.Close(nil)
+	rs.HandleReader(primary)
+	at.True(rs.HasPublisher("live/show"))
+
+	duplicate := newTestReader("duplicate", "rtmp://localhost/live/show")
+	at.NotNil(rs.CheckPublisher(duplicate.Info()))
+	rs.HandleReader(duplicate)
+	<-duplicate.closed
+
+	//a standby publisher takes over when the primary stops
+	at.Nil(rs.conf.Update(func() *configure.ServerCfg {
+		cfg := *rs.conf.Current()
+		cfg.Server = configure.Applications{{Appname: "live", Live: true, DuplicatePublisher: configure.PublishStandby}}
+		return &cfg
+	}()))
+	standby := newTestReader("standby", "rtmp://localhost/live/show")
+	defer standby.Close(nil)
+	at.Nil(rs.CheckPublisher(standby.Info()))
+	at.True(rs.IsFailover(standby.Info()))
+	rs.HandleReader(standby)
+	item, _ := rs.GetStreams().Get("live/show")
+	stream := item.(*Stream)
+	at.Equal(1, stream.Backups())
+
+	w := newTestWriter()
+	defer w.Close(nil)
+	rs.HandleWriter(w)
+	done := make(chan struct{})
+	defer close(done)
+	go standby.feed(2, 0, done)
+	primary.Close(nil)
+	w.until(t, 2)
+	at.Equal(0, stream.Backups())
+	at.True(rs.HasPublisher("live/show"))
+}
+
+func TestFailover(t *testing.T) {
+	at := assert.New(t)
+	rs := newTestStreams(t, nil)
+	defer rs.Shutdown(context.Background())
+
+	primary := newTestReader("primary", "rtmp://localhost/live/show")
+	rs.HandleReader(primary)
+	backup := newTestReader("backup", "rtmp://localhost/live/show?role=backup")
+	defer backup.Close(nil)
+	rs.HandleReader(backup)
+	item, _ := rs.GetStreams().Get("live/show")
+	stream := item.(*Stream)
+	at.Equal(1, stream.Backups())
+
+	w := newTestWriter()
+	defer w.Close(nil)
+	rs.HandleWriter(w)
+	primaryDone := make(chan struct{})
+	go primary.feed(1, 1000, primaryDone)
+	backupDone := make(chan struct{})
+	defer close(backupDone)
+	go backup.feed(2, 90000, backupDone)
+	before := w.until(t, 1)
+	for i := 0; i < 4; i++ {
+		before = append(before, <-w.frames)
+	}
+
+	//the backup continues the stream where the primary stopped
+	close(primaryDone)
+	primary.Close(nil)
+	after := w.until(t, 2)
+	at.True(continuous(append(before, after...)), "%v %v", before, after)
+	at.Equal(0, stream.Backups())
+
+	//the primary takes over again when it returns
+	primary = newTestReader("restored", "rtmp://localhost/live/show")
+	defer primary.Close(nil)
+	at.True(rs.IsFailover(primary.Info()))
+	rs.HandleReader(primary)
+	primaryDone = make(chan struct{})
+	defer close(primaryDone)
+	go primary.feed(3, 0, primaryDone)
+	restored := w.until(t, 3)
+	at.True(continuous(append(after, restored...)), "%v %v", after, restored)
+	at.Equal(1, stream.Backups())
+	at.False(stream.servedByBackup())
+}
@@ -0,0 +1,230 @@
+package rtmp
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+var videoCodecs = map[uint8]string{
+	2:  "H263",
+	3:  "Screen",
+	4:  "VP6",
+	5:  "VP6A",
+	6:  "Screen2",
+	7:  "H264",
+	12: "H265",
+}
+
+var audioCodecs = map[uint8]string{
+	0:  "PCM",
+	1:  "ADPCM",
+	2:  "MP3",
+	3:  "PCM",
+	4:  "Nellymoser",
+	5:  "Nellymoser",
+	6:  "Nellymoser",
+	7:  "G711A",
+	8:  "G711U",
+	10: "AAC",
+	11: "Speex",
+	14: "MP3",
+}
+
+func codecName(names map[uint8]string, id uint8) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return strconv.Itoa(int(id))
+}
+
+// codecs are the codecs of the packets of a stream
+type codecs struct {
+	video string
+	audio string
+}
+
+// updateCodecs records the codec of p if it changed
+func (s *Stream) updateCodecs(p *av.Packet) {
+	c, _ := s.codecs.Load().(codecs)
+	switch {
+	case p.IsVideo:
+		h, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return
+		}
+		name := codecName(videoCodecs, h.CodecID())
+		if name == c.video {
+			return
+		}
+		c.video = name
+	case p.IsAudio:
+		h, ok := p.Header.(av.AudioPacketHeader)
+		if !ok {
+			return
+		}
+		name := codecName(audioCodecs, h.SoundFormat())
+		if name == c.audio {
+			return
+		}
+		c.audio = name
+	default:
+		return
+	}
+	s.codecs.Store(c)
+	s.publishCodecs(c)
+}
+
+// Codecs returns the video and audio codecs of the stream, empty until
+// their first packet
+func (s *Stream) Codecs() (video, audio string) {
+	c, _ := s.codecs.Load().(codecs)
+	return c.video, c.audio
+}
+
+// remoteAddrer is implemented by connections which know the address of
+// their peer
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
+func remoteAddr(conn interface{}) string {
+	if c, ok := conn.(remoteAddrer); ok {
+		if addr := c.RemoteAddr(); addr != nil {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// WriteBW returns a snapshot of the statistics of the packets sent
+func (v *VirWriter) WriteBW() StaticsBW {
+	v.bwLock.Lock()
+	defer v.bwLock.Unlock()
+	return v.WriteBWInfo
+}
+
+// ReadBW returns a snapshot of the statistics of the packets received
+func (v *VirReader) ReadBW() StaticsBW {
+	v.bwLock.Lock()
+	defer v.bwLock.Unlock()
+	return v.ReadBWInfo
+}
+
+// Stats returns the statistics of the player
+func (v *VirWriter) Stats() av.Stats {
+	bw := v.WriteBW()
+	return av.Stats{
+		Protocol:   "rtmp",
+		RemoteAddr: remoteAddr(v.conn),
+		Connected:  v.connected,
+		Bytes:      bw.VideoDatainBytes + bw.AudioDatainBytes,
+		Kbps:       int(bw.VideoSpeedInBytesperMS + bw.AudioSpeedInBytesperMS),
+		Queue:      len(v.packetQueue),
+		Dropped:    atomic.LoadUint64(&v.dropped),
+	}
+}
+
+// Stats returns the statistics of the publisher
+func (v *VirReader) Stats() av.Stats {
+	bw := v.ReadBW()
+	return av.Stats{
+		Protocol:   "rtmp",
+		RemoteAddr: remoteAddr(v.conn),
+		Connected:  v.connected,
+		Bytes:      bw.VideoDatainBytes + bw.AudioDatainBytes,
+		Kbps:       int(bw.VideoSpeedInBytesperMS + bw.AudioSpeedInBytesperMS),
+		Dropped:    atomic.LoadUint64(&v.dropped),
+	}
+}
+
+// ConnStats are the statistics of a publisher, a player or an output of a
+// stream
+type ConnStats struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	av.Stats
+	RTT   int64  `json:"rtt"` // round trip time of the last ping in milliseconds, RTMP only
+	Video string `json:"video_codec"`
+	Audio string `json:"audio_codec"`
+}
+
+// StreamStats are the statistics of a stream: its publisher, its players
+// and its outputs, such as the HLS segmenter and the recorder
+type StreamStats struct {
+	Key       string      `json:"key"`
+	App       string      `json:"app"`
+	Name      string      `json:"name"`
+	Publisher *ConnStats  `json:"publisher"`
+	Players   []ConnStats `json:"players"`
+	Outputs   []ConnStats `json:"outputs"`
+}
+
+func (s *Stream) connStats(c av.Closer) ConnStats {
+	info := c.Info()
+	stats := ConnStats{ID: info.UID, URL: info.URL}
+	if st, ok := c.(av.Stater); ok {
+		stats.Stats = st.Stats()
+	}
+	if h, ok := c.(heartbeater); ok {
+		stats.RTT = int64(h.Heartbeat().RTT / time.Millisecond)
+	}
+	stats.Video, stats.Audio = s.Codecs()
+	return stats
+}
+
+// Stats returns the statistics of the stream key
+func (s *Stream) Stats(key string) StreamStats {
+	stats := StreamStats{
+		Key:     key,
+		App:     key,
+		Players: []ConnStats{},
+		Outputs: []ConnStats{},
+	}
+	if i := strings.Index(key, "/"); i >= 0 {
+		stats.App, stats.Name = key[:i], key[i+1:]
+	}
+	if r := s.Reader(); r != nil {
+		pub := s.connStats(r)
+		stats.Publisher = &pub
+	}
+	for item := range s.ws.IterBuffered() {
+		pw := item.Val.(*PackWriterCloser)
+		ws := s.connStats(pw.w)
+		ws.Dropped += atomic.LoadUint64(&pw.dropped)
+		if _, ok := pw.w.(av.Viewer); !ok {
+			stats.Outputs = append(stats.Outputs, ws)
+		} else if isViewer(pw.w) {
+			stats.Players = append(stats.Players, ws)
+		}
+	}
+	sort.Slice(stats.Players, func(i, j int) bool {
+		return stats.Players[i].Connected.Before(stats.Players[j].Connected)
+	})
+	sort.Slice(stats.Outputs, func(i, j int) bool {
+		return stats.Outputs[i].Protocol < stats.Outputs[j].Protocol
+	})
+	return stats
+}
+
+// Stats returns the statistics of the streams sorted by key, filtered by
+// app and name if they are not empty
+func (rs *Streams) Stats(app, name string) []StreamStats {
+	ret := []StreamStats{}
+	for item := range rs.streams.IterBuffered() {
+		stats := item.Val.(*Stream).Stats(item.Key)
+		if (app != "" && stats.App != app) || (name != "" && stats.Name != name) {
+			continue
+		}
+		ret = append(ret, stats)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
@@ -0,0 +1,69 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecName(t *testing.T) {
+	at := assert.New(t)
+	at.Equal("H264", codecName(videoCodecs, 7))
+	at.Equal("AAC", codecName(audioCodecs, 10))
+	at.Equal("99", codecName(videoCodecs, 99))
+}
+
+func TestStreamStats(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, nil, Hooks{})
+	defer s.close()
+
+	c, err := s.publish("room")
+	at.Nil(err)
+	defer c.Close(nil)
+	done := make(chan struct{})
+	defer close(done)
+	go sendVideo(c, 0, done)
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+
+	p, err := s.play("room")
+	if !at.Nil(err) {
+		return
+	}
+	defer p.Close(nil)
+	join := s.waitEvent(t, configure.EventPlayerJoin, "live/room")
+	// the statistics of packets are saved before they are sent
+	_, err = readVideo(p, 2)
+	at.Nil(err)
+
+	stats := s.streams.Stats("live", "")
+	if at.Len(stats, 1) {
+		stream := stats[0]
+		at.Equal("live/room", stream.Key)
+		at.Equal("live", stream.App)
+		at.Equal("room", stream.Name)
+		if at.NotNil(stream.Publisher) {
+			at.Equal("rtmp", stream.Publisher.Protocol)
+			at.Contains(stream.Publisher.RemoteAddr, "127.0.0.1:")
+			at.Equal("H264", stream.Publisher.Video)
+			at.True(stream.Publisher.Bytes > 0)
+		}
+		if at.Len(stream.Players, 1) {
+			player := stream.Players[0]
+			at.Equal(join.Data["id"], player.ID)
+			at.Equal("rtmp", player.Protocol)
+			at.Contains(player.RemoteAddr, "127.0.0.1:")
+			at.Equal("H264", player.Video)
+			at.True(player.Bytes > 0)
+			at.False(player.Connected.IsZero())
+		}
+		// the recorder of the application
+		if at.Len(stream.Outputs, 1) {
+			at.Equal("flv", stream.Outputs[0].Protocol)
+		}
+	}
+	at.Len(s.streams.Stats("live", "other"), 0)
+	at.Len(s.streams.Stats("other", ""), 0)
+}
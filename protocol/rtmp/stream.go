@@ -1,11 +1,15 @@
 package rtmp
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
 	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
 	"github.com/gwuhaolin/livego/protocol/rtmp/rtmprelay"
 
@@ -19,60 +23,214 @@ var (
 
 // Streams is the streams of rtmp
 type Streams struct {
-	streams cmap.ConcurrentMap //key
+	streams   cmap.ConcurrentMap //key
+	conf      *configure.Store
+	pushes    *rtmprelay.StaticPushes
+	egress    *egress
+	log       *log.Logger
+	done      chan struct{}
+	closeOnce sync.Once
+
+	limits   cmap.ConcurrentMap // viewer limits set at runtime by key
+	admit    sync.Mutex         // serializes the viewer limit checks
+	lock     sync.Mutex
+	counters []func() map[string]int
+	reserved map[string]int // admitted viewers not added yet by key
 }
 
 // NewStreams returns RtmpStream
-func NewStreams() *Streams {
+func NewStreams(conf *configure.Store) *Streams {
 	ret := &Streams{
-		streams: cmap.New(),
+		streams:  cmap.New(),
+		conf:     conf,
+		pushes:   rtmprelay.NewStaticPushes(conf.Events(), conf.Logger()),
+		egress:   &egress{},
+		log:      conf.Logger(),
+		done:     make(chan struct{}),
+		limits:   cmap.New(),
+		reserved: make(map[string]int),
 	}
 	go ret.CheckAlive()
 	return ret
 }
 
+// newStream returns a Stream using the configuration of rs
+func (rs *Streams) newStream() *Stream {
+	return &Stream{
+		cache:   cache.NewCache(rs.conf.Current().GopNum),
+		ws:      cmap.New(),
+		conf:    rs.conf,
+		pushes:  rs.pushes,
+		egress:  rs.egress,
+		log:     rs.log,
+		restore: make(chan av.ReadCloser, 1),
+	}
+}
+
+// closed returns if Shutdown has been called
+func (rs *Streams) closed() bool {
+	select {
+	case <-rs.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops accepting publishers and players, then closes every stream.
+// Players are given until ctx is done to send out their queued packets.
+func (rs *Streams) Shutdown(ctx context.Context) error {
+	rs.closeOnce.Do(func() {
+		close(rs.done)
+	})
+
+	var wg sync.WaitGroup
+	for item := range rs.streams.IterBuffered() {
+		wg.Add(1)
+		go func(key string, s *Stream) {
+			defer wg.Done()
+			s.Close(ctx)
+			rs.streams.Remove(key)
+		}(item.Key, item.Val.(*Stream))
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
 // HandleReader handles reader
 func (rs *Streams) HandleReader(r av.ReadCloser) {
 	info := r.Info()
-	log.Debugf("HandleReader: info[%v]", info)
+	rs.log.Debugf("HandleReader: info[%v]", info)
+
+	if rs.closed() {
+		r.Close(fmt.Errorf("server is shutting down"))
+		return
+	}
 
 	var stream *Stream
 	i, ok := rs.streams.Get(info.Key)
 	if stream, ok = i.(*Stream); ok {
+		if pub, started := stream.publisher(); started && pub != nil {
+			if isBackup(info) {
+				stream.AddBackup(r)
+				return
+			}
+			if stream.servedByBackup() {
+				stream.Restore(r)
+				return
+			}
+			switch rs.duplicatePublisher(info.Key) {
+			case configure.PublishReject:
+				r.Close(fmt.Errorf("stream %s is already published", info.Key))
+				return
+			case configure.PublishStandby:
+				stream.AddBackup(r)
+				return
+			}
+		}
 		stream.TransStop()
+		stream.closeBackups(fmt.Errorf("stop old"))
 		id := stream.ID()
 		if id != emptyID && id != info.UID {
-			ns := NewStream()
+			ns := rs.newStream()
 			stream.Copy(ns)
 			stream = ns
+			stream.info = info
 			rs.streams.Set(info.Key, ns)
 		}
 	} else {
-		stream = NewStream()
+		stream = rs.newStream()
 		rs.streams.Set(info.Key, stream)
 		stream.info = info
 	}
 
 	stream.AddReader(r)
+	stream.publishStart(r)
 }
 
 // HandleWriter handles writer
 func (rs *Streams) HandleWriter(w av.WriteCloser) {
+	rs.HandleViewer(w, nil)
+}
+
+// HandleViewer handles the writer of a viewer admitted by AdmitViewer,
+// admitted is called once the viewer is counted by its stream, before its
+// joining is published
+func (rs *Streams) HandleViewer(w av.WriteCloser, admitted func()) {
 	info := w.Info()
-	log.Debugf("HandleWriter: info[%v]", info)
+	rs.log.Debugf("HandleWriter: info[%v]", info)
 
-	var s *Stream
-	ok := rs.streams.Has(info.Key)
-	if !ok {
-		s = NewStream()
-		rs.streams.Set(info.Key, s)
-		s.info = info
-	} else {
+	if rs.closed() {
+		w.Close(fmt.Errorf("server is shutting down"))
+		return
+	}
+
+	// players of a stream which is not published yet wait for the publisher
+	s := rs.newStream()
+	s.info = info
+	if !rs.streams.SetIfAbsent(info.Key, s) {
 		item, ok := rs.streams.Get(info.Key)
-		if ok {
-			s = item.(*Stream)
-			s.AddWriter(w)
+		if !ok {
+			w.Close(fmt.Errorf("stream %s removed", info.Key))
+			return
 		}
+		s = item.(*Stream)
+	}
+	s.AddWriter(w)
+	if admitted != nil {
+		admitted()
+	}
+	s.playerJoin(w)
+}
+
+// duplicatePublisher returns the duplicate publisher policy of the
+// application of key
+func (rs *Streams) duplicatePublisher(key string) string {
+	app, _ := rs.conf.GetApplication(strings.SplitN(key, "/", 2)[0])
+	return app.DuplicatePublisher
+}
+
+// CheckPublisher returns an error if a publisher is rejected because the
+// stream is already published. Backup publishers are never rejected.
+func (rs *Streams) CheckPublisher(info av.Info) error {
+	if isBackup(info) {
+		return nil
+	}
+	if rs.duplicatePublisher(info.Key) == configure.PublishReject && rs.HasPublisher(info.Key) {
+		return fmt.Errorf("stream %s is already published", info.Key)
+	}
+	return nil
+}
+
+// IsFailover returns if a publisher joins the stream as a backup or takes
+// it over from a backup, then the outputs of the stream are kept
+func (rs *Streams) IsFailover(info av.Info) bool {
+	item, ok := rs.streams.Get(info.Key)
+	if !ok {
+		return false
+	}
+	s := item.(*Stream)
+	if r, started := s.publisher(); r == nil || !started {
+		return false
+	}
+	return isBackup(info) || s.servedByBackup() ||
+		rs.duplicatePublisher(info.Key) == configure.PublishStandby
+}
+
+// HasPublisher returns if the stream of key is being published
+func (rs *Streams) HasPublisher(key string) bool {
+	item, ok := rs.streams.Get(key)
+	if !ok {
+		return false
+	}
+	r, started := item.(*Stream).publisher()
+	return r != nil && started
+}
+
+// ReloadStaticPush applies the static push configuration to all live streams
+func (rs *Streams) ReloadStaticPush() {
+	for item := range rs.streams.IterBuffered() {
+		item.Val.(*Stream).ReloadStaticPush()
 	}
 }
 
@@ -81,10 +239,19 @@ func (rs *Streams) GetStreams() cmap.ConcurrentMap {
 	return rs.streams
 }
 
+// StaticPushes returns the static pushes of all streams
+func (rs *Streams) StaticPushes() *rtmprelay.StaticPushes {
+	return rs.pushes
+}
+
 // CheckAlive check if this stream is alive
 func (rs *Streams) CheckAlive() {
 	for {
-		<-time.After(5 * time.Second)
+		select {
+		case <-rs.done:
+			return
+		case <-time.After(5 * time.Second):
+		}
 		for item := range rs.streams.IterBuffered() {
 			v := item.Val.(*Stream)
 			if v.CheckAlive() == 0 {
@@ -96,17 +263,38 @@ func (rs *Streams) CheckAlive() {
 
 // Stream is one rtmp stream
 type Stream struct {
-	isStart bool
-	cache   *cache.Cache
+	cache  *cache.Cache
+	ws     cmap.ConcurrentMap
+	info   av.Info
+	conf   *configure.Store
+	pushes *rtmprelay.StaticPushes
+	egress *egress
+	codecs atomic.Value
+	log    *log.Logger
+
+	// pushURLs are the static pushes started for this stream,
+	// only accessed by the TransStart goroutine
+	pushURLs   []string
+	pushReload int32
+
+	// the publisher and the state of the stream are guarded by lock
+	lock    sync.Mutex
 	r       av.ReadCloser
-	ws      cmap.ConcurrentMap
-	info    av.Info
+	isStart bool
+	closing bool
+	backups []*backup
+	rBackup bool // r publishes with role=backup
+	restore chan av.ReadCloser
+	rebaser rebaser
 }
 
 // PackWriterCloser is a WriteCloser for packet
 type PackWriterCloser struct {
-	init bool
-	w    av.WriteCloser
+	init    bool
+	player  bool   // counted in the egress, unlike recorders
+	waitKey bool   // video resumes at a key frame after dropping
+	dropped uint64 // video packets skipped over max_egress
+	w       av.WriteCloser
 }
 
 // Writer gets WriteCloser
@@ -114,27 +302,48 @@ func (p *PackWriterCloser) Writer() av.WriteCloser {
 	return p.w
 }
 
-// NewStream returns a Stream
-func NewStream() *Stream {
-	return &Stream{
-		cache: cache.NewCache(),
-		ws:    cmap.New(),
-	}
-}
-
 // ID returns ID
 func (s *Stream) ID() string {
-	if s.r != nil {
-		return s.r.Info().UID
+	if r := s.Reader(); r != nil {
+		return r.Info().UID
 	}
 	return emptyID
 }
 
 // Reader returns a ReadCloser
 func (s *Stream) Reader() av.ReadCloser {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.r
 }
 
+// publisher returns the publisher and if the stream is started
+func (s *Stream) publisher() (av.ReadCloser, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.r, s.isStart
+}
+
+// started returns if the stream is started
+func (s *Stream) started() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.isStart
+}
+
+func (s *Stream) setStarted(started bool) {
+	s.lock.Lock()
+	s.isStart = started
+	s.lock.Unlock()
+}
+
+// isClosing returns if the stream is being closed by Close
+func (s *Stream) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
 // Ws returns a ws
 func (s *Stream) Ws() cmap.ConcurrentMap {
 	return s.ws
@@ -152,222 +361,235 @@ func (s *Stream) Copy(dst *Stream) {
 
 // AddReader add a reader
 func (s *Stream) AddReader(r av.ReadCloser) {
+	s.lock.Lock()
 	s.r = r
+	s.rBackup = isBackup(r.Info())
+	s.isStart = true
+	s.lock.Unlock()
 	go s.TransStart()
 }
 
 // AddWriter add a writer
 func (s *Stream) AddWriter(w av.WriteCloser) {
 	info := w.Info()
-	pw := &PackWriterCloser{w: w}
+	pw := &PackWriterCloser{w: w, player: info.Inter}
 	s.ws.Set(info.UID, pw)
 }
 
-// StartStaticPush starts push if static_push is set
-/*检测本application下是否配置static_push,
-如果配置, 启动push远端的连接*/
-func (s *Stream) StartStaticPush() {
+// staticPushURLs returns the static push urls of this stream from config
+func (s *Stream) staticPushURLs() []string {
 	key := s.info.Key
 
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
-		return
-	}
-
 	index := strings.Index(key, "/")
 	if index < 0 {
-		return
+		return nil
 	}
 
 	streamname := key[index+1:]
-	appname := dscr[0]
+	appname := key[:index]
 
-	log.Debugf("StartStaticPush: current streamname=%s， appname=%s", streamname, appname)
-	pushurllist, err := rtmprelay.GetStaticPushList(appname)
-	if err != nil || len(pushurllist) < 1 {
-		log.Debugf("StartStaticPush: GetStaticPushList error=%v", err)
-		return
+	pushurllist, ok := s.conf.GetStaticPushURLList(appname)
+	if !ok || len(pushurllist) < 1 {
+		s.log.Debugf("staticPushURLs: no static push url for %s", appname)
+		return nil
 	}
 
+	urls := make([]string, 0, len(pushurllist))
 	for _, pushurl := range pushurllist {
-		pushurl := pushurl + "/" + streamname
-		log.Debugf("StartStaticPush: static pushurl=%s", pushurl)
-
-		staticpushObj := rtmprelay.GetAndCreateStaticPushObject(pushurl)
-		if staticpushObj != nil {
-			if err := staticpushObj.Start(); err != nil {
-				log.Debugf("StartStaticPush: staticpushObj.Start %s error=%v", pushurl, err)
-			} else {
-				log.Debugf("StartStaticPush: staticpushObj.Start %s ok", pushurl)
-			}
-		} else {
-			log.Debugf("StartStaticPush GetStaticPushObject %s error", pushurl)
-		}
+		urls = append(urls, pushurl+"/"+streamname)
 	}
+	return urls
 }
 
-// StopStaticPush stops the static push
-func (s *Stream) StopStaticPush() {
-	key := s.info.Key
+// startStaticPush starts the static push of pushurl
+func (s *Stream) startStaticPush(pushurl string) {
+	s.log.Debugf("StartStaticPush: static pushurl=%s", pushurl)
 
-	log.Debugf("StopStaticPush......%s", key)
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
+	staticpushObj := s.pushes.GetAndCreate(pushurl)
+	if staticpushObj == nil {
+		s.log.Debugf("StartStaticPush GetStaticPushObject %s error", pushurl)
 		return
 	}
-
-	index := strings.Index(key, "/")
-	if index < 0 {
-		return
+	s.pushURLs = append(s.pushURLs, pushurl)
+	if err := staticpushObj.Start(); err != nil {
+		s.log.Debugf("StartStaticPush: staticpushObj.Start %s error=%v", pushurl, err)
+	} else {
+		s.log.Debugf("StartStaticPush: staticpushObj.Start %s ok", pushurl)
 	}
+}
 
-	streamname := key[index+1:]
-	appname := dscr[0]
+// stopStaticPush stops and releases the static push of pushurl
+func (s *Stream) stopStaticPush(pushurl string) {
+	s.log.Debugf("StopStaticPush: static pushurl=%s", pushurl)
 
-	log.Debugf("StopStaticPush: current streamname=%s， appname=%s", streamname, appname)
-	pushurllist, err := rtmprelay.GetStaticPushList(appname)
-	if err != nil || len(pushurllist) < 1 {
-		log.Debugf("StopStaticPush: GetStaticPushList error=%v", err)
-		return
+	staticpushObj, err := s.pushes.Get(pushurl)
+	if (staticpushObj != nil) && (err == nil) {
+		staticpushObj.Stop()
+		s.pushes.Release(pushurl)
+		s.log.Debugf("StopStaticPush: staticpushObj.Stop %s ", pushurl)
+	} else {
+		s.log.Debugf("StopStaticPush GetStaticPushObject %s error", pushurl)
 	}
+}
 
-	for _, pushurl := range pushurllist {
-		pushurl := pushurl + "/" + streamname
-		log.Debugf("StopStaticPush: static pushurl=%s", pushurl)
-
-		staticpushObj, err := rtmprelay.GetStaticPushObject(pushurl)
-		if (staticpushObj != nil) && (err == nil) {
-			staticpushObj.Stop()
-			rtmprelay.ReleaseStaticPushObject(pushurl)
-			log.Debugf("StopStaticPush: staticpushObj.Stop %s ", pushurl)
-		} else {
-			log.Debugf("StopStaticPush GetStaticPushObject %s error", pushurl)
-		}
+// StartStaticPush starts push if static_push is set
+/*检测本application下是否配置static_push,
+如果配置, 启动push远端的连接*/
+func (s *Stream) StartStaticPush() {
+	s.log.Debugf("StartStaticPush......%s", s.info.Key)
+	for _, pushurl := range s.staticPushURLs() {
+		s.startStaticPush(pushurl)
 	}
 }
 
-// IsSendStaticPush returns if static push is sent
-func (s *Stream) IsSendStaticPush() bool {
-	key := s.info.Key
-
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
-		return false
+// StopStaticPush stops the static push
+func (s *Stream) StopStaticPush() {
+	s.log.Debugf("StopStaticPush......%s", s.info.Key)
+	for _, pushurl := range s.pushURLs {
+		s.stopStaticPush(pushurl)
 	}
+	s.pushURLs = nil
+}
 
-	appname := dscr[0]
+// ReloadStaticPush makes the stream apply the static push configuration
+// again before sending the next packet
+func (s *Stream) ReloadStaticPush() {
+	atomic.StoreInt32(&s.pushReload, 1)
+}
 
-	//log.Debugf("SendStaticPush: current streamname=%s， appname=%s", streamname, appname)
-	pushurllist, err := rtmprelay.GetStaticPushList(appname)
-	if err != nil || len(pushurllist) < 1 {
-		//log.Debugf("SendStaticPush: GetStaticPushList error=%v", err)
-		return false
+// updateStaticPush stops the static pushes removed from the configuration
+// and starts the added ones, which get the cached packets first
+func (s *Stream) updateStaticPush() {
+	wanted := make(map[string]bool)
+	for _, pushurl := range s.staticPushURLs() {
+		wanted[pushurl] = true
 	}
 
-	index := strings.Index(key, "/")
-	if index < 0 {
-		return false
+	started := make(map[string]bool)
+	kept := s.pushURLs[:0]
+	for _, pushurl := range s.pushURLs {
+		if wanted[pushurl] {
+			started[pushurl] = true
+			kept = append(kept, pushurl)
+		} else {
+			s.stopStaticPush(pushurl)
+		}
 	}
+	s.pushURLs = kept
 
-	streamname := key[index+1:]
-
-	for _, pushurl := range pushurllist {
-		pushurl := pushurl + "/" + streamname
-		//log.Debugf("SendStaticPush: static pushurl=%s", pushurl)
+	for pushurl := range wanted {
+		if started[pushurl] {
+			continue
+		}
+		s.startStaticPush(pushurl)
+		if staticpushObj, err := s.pushes.Get(pushurl); err == nil {
+			if err := s.cache.Send(staticpushObj); err != nil {
+				s.log.Debugf("updateStaticPush: send cache to %s error=%v", pushurl, err)
+			}
+		}
+	}
+}
 
-		staticpushObj, err := rtmprelay.GetStaticPushObject(pushurl)
+// IsSendStaticPush returns if static push is sent
+func (s *Stream) IsSendStaticPush() bool {
+	for _, pushurl := range s.pushURLs {
+		staticpushObj, err := s.pushes.Get(pushurl)
 		if (staticpushObj != nil) && (err == nil) {
 			return true
-			//staticpushObj.WriteAvPacket(&packet)
-			//log.Debugf("SendStaticPush: WriteAvPacket %s ", pushurl)
 		}
-		log.Debugf("SendStaticPush GetStaticPushObject %s error", pushurl)
+		s.log.Debugf("SendStaticPush GetStaticPushObject %s error", pushurl)
 	}
 	return false
 }
 
 // SendStaticPush sends static push
 func (s *Stream) SendStaticPush(packet av.Packet) {
-	key := s.info.Key
-
-	dscr := strings.Split(key, "/")
-	if len(dscr) < 1 {
-		return
-	}
-
-	index := strings.Index(key, "/")
-	if index < 0 {
-		return
-	}
-
-	streamname := key[index+1:]
-	appname := dscr[0]
-
-	//log.Debugf("SendStaticPush: current streamname=%s， appname=%s", streamname, appname)
-	pushurllist, err := rtmprelay.GetStaticPushList(appname)
-	if err != nil || len(pushurllist) < 1 {
-		//log.Debugf("SendStaticPush: GetStaticPushList error=%v", err)
-		return
-	}
-
-	for _, pushurl := range pushurllist {
-		pushurl := pushurl + "/" + streamname
-		//log.Debugf("SendStaticPush: static pushurl=%s", pushurl)
-
-		staticpushObj, err := rtmprelay.GetStaticPushObject(pushurl)
+	for _, pushurl := range s.pushURLs {
+		staticpushObj, err := s.pushes.Get(pushurl)
 		if (staticpushObj != nil) && (err == nil) {
 			staticpushObj.Write(&packet)
-			//log.Debugf("SendStaticPush: WriteAvPacket %s ", pushurl)
 		} else {
-			log.Debugf("SendStaticPush GetStaticPushObject %s error", pushurl)
+			s.log.Debugf("SendStaticPush GetStaticPushObject %s error", pushurl)
 		}
 	}
 }
 
 // TransStart start the transport
 func (s *Stream) TransStart() {
-	s.isStart = true
+	s.setStarted(true)
 	var p av.Packet
 
-	log.Debugf("TransStart: %v", s.info)
+	s.log.Debugf("TransStart: %v", s.info)
 
 	s.StartStaticPush()
 
 	for {
-		if !s.isStart {
+		if !s.started() {
 			s.closeInter()
 			return
 		}
-		err := s.r.Read(&p)
+		select {
+		case r := <-s.restore:
+			s.demote(r)
+		default:
+		}
+		err := s.Reader().Read(&p)
 		if err != nil {
+			if s.started() && s.promote() {
+				continue
+			}
+			// the stream is stopped before its end is published
+			s.setStarted(false)
 			s.closeInter()
-			s.isStart = false
 			return
 		}
 
+		s.updateCodecs(&p)
+
+		// after a change of publisher, the stream resumes at a key frame
+		if s.rebaser.waitKey {
+			if !isKeyFrame(&p) {
+				s.cache.Write(p)
+				continue
+			}
+			s.resume(p.TimeStamp)
+		}
+		s.rebaser.rebase(&p)
+
+		if atomic.CompareAndSwapInt32(&s.pushReload, 1, 0) {
+			s.updateStaticPush()
+		}
+
 		if s.IsSendStaticPush() {
 			s.SendStaticPush(p)
 		}
 
 		s.cache.Write(p)
 
+		over := s.egress.over(s.conf.Current())
 		for item := range s.ws.IterBuffered() {
 			v := item.Val.(*PackWriterCloser)
 			if !v.init {
-				//log.Debugf("cache.send: %v", v.w.Info())
+				//s.log.Debugf("cache.send: %v", v.w.Info())
 				if err = s.cache.Send(v.w); err != nil {
-					log.Debugf("[%s] send cache packet error: %v, remove", v.w.Info(), err)
-					s.ws.Remove(item.Key)
+					s.log.Debugf("[%s] send cache packet error: %v, remove", v.w.Info(), err)
+					s.removeWriter(item.Key, v, err)
 					continue
 				}
 				v.init = true
 			} else {
+				if s.egress.skip(v, &p, over) {
+					continue
+				}
+				if v.player {
+					s.egress.Add(len(p.Data))
+				}
 				newPacket := p
 				//writeType := reflect.TypeOf(v.w)
-				//log.Debugf("w.Write: type=%v, %v", writeType, v.w.Info())
+				//s.log.Debugf("w.Write: type=%v, %v", writeType, v.w.Info())
 				if err = v.w.Write(&newPacket); err != nil {
-					log.Debugf("[%s] write packet error: %v, remove", v.w.Info(), err)
-					s.ws.Remove(item.Key)
+					s.log.Debugf("[%s] write packet error: %v, remove", v.w.Info(), err)
+					s.removeWriter(item.Key, v, err)
 				}
 			}
 		}
@@ -376,30 +598,92 @@ func (s *Stream) TransStart() {
 
 // TransStop stops the transport
 func (s *Stream) TransStop() {
-	log.Debugf("TransStop: %s", s.info.Key)
+	s.log.Debugf("TransStop: %s", s.info.Key)
+
+	s.lock.Lock()
+	r, started := s.r, s.isStart
+	s.isStart = false
+	s.lock.Unlock()
 
-	if s.isStart && s.r != nil {
-		s.r.Close(fmt.Errorf("stop old"))
+	if started && r != nil {
+		r.Close(fmt.Errorf("stop old"))
 	}
+}
 
-	s.isStart = false
+// Close stops the publisher and closes all writers of this stream.
+// Writers are given until ctx is done to send out their queued packets.
+func (s *Stream) Close(ctx context.Context) {
+	s.lock.Lock()
+	s.closing = true
+	s.lock.Unlock()
+	s.TransStop()
+	s.closeBackups(fmt.Errorf("server is shutting down"))
+	s.drain(ctx)
+
+	for item := range s.ws.IterBuffered() {
+		v := item.Val.(*PackWriterCloser)
+		err := fmt.Errorf("server is shutting down")
+		s.removeWriter(item.Key, v, err)
+		if v.w != nil {
+			v.w.Close(err)
+			s.log.Debugf("[%v] writer closed on shutdown", v.w.Info())
+		}
+	}
+}
+
+// drain waits until no writer has queued packets or ctx is done
+func (s *Stream) drain(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		pending := 0
+		for item := range s.ws.IterBuffered() {
+			v := item.Val.(*PackWriterCloser)
+			if q, ok := v.w.(av.Queuer); ok {
+				pending += q.QueueLen()
+			}
+		}
+		if pending == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			s.log.Warningf("[%s] %d packets dropped on shutdown", s.info.Key, pending)
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 // CheckAlive checks if this stream is alive or not
 func (s *Stream) CheckAlive() (n int) {
-	if s.r != nil && s.isStart {
-		if s.r.Alive() {
+	r, started := s.publisher()
+	if r != nil && started {
+		if r.Alive() {
 			n++
 		} else {
-			s.r.Close(fmt.Errorf("read timeout"))
+			r.Close(fmt.Errorf("read timeout"))
+		}
+	}
+	s.lock.Lock()
+	backups := append([]*backup(nil), s.backups...)
+	s.lock.Unlock()
+	for _, b := range backups {
+		if b.r.Alive() {
+			n++
+		} else {
+			b.r.Close(fmt.Errorf("read timeout"))
 		}
 	}
 	for item := range s.ws.IterBuffered() {
 		v := item.Val.(*PackWriterCloser)
 		if v.w != nil {
-			if !v.w.Alive() && s.isStart {
-				s.ws.Remove(item.Key)
-				v.w.Close(fmt.Errorf("write timeout"))
+			if !v.w.Alive() && started {
+				err := fmt.Errorf("write timeout")
+				s.removeWriter(item.Key, v, err)
+				v.w.Close(err)
 				continue
 			}
 			n++
@@ -410,18 +694,25 @@ func (s *Stream) CheckAlive() (n int) {
 }
 
 func (s *Stream) closeInter() {
-	if s.r != nil {
+	if r := s.Reader(); r != nil {
 		s.StopStaticPush()
-		log.Debugf("[%v] publisher closed", s.r.Info())
+		s.log.Debugf("[%v] publisher closed", r.Info())
+		s.publishStop(r)
+	}
+
+	// writers are drained and closed by Close
+	if s.isClosing() {
+		return
 	}
 
 	for item := range s.ws.IterBuffered() {
 		v := item.Val.(*PackWriterCloser)
 		if v.w != nil {
 			if v.w.Info().IsInterval() {
-				v.w.Close(fmt.Errorf("closed"))
-				s.ws.Remove(item.Key)
-				log.Debugf("[%v] player closed and remove\n", v.w.Info())
+				err := fmt.Errorf("closed")
+				v.w.Close(err)
+				s.removeWriter(item.Key, v, err)
+				s.log.Debugf("[%v] player closed and remove\n", v.w.Info())
 			}
 		}
 	}
@@ -0,0 +1,145 @@
+package rtmp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+// ViewerLimit is the number of viewers of a stream or an application and
+// its limit, 0 for no limit
+type ViewerLimit struct {
+	Key     string `json:"key"`
+	Viewers int    `json:"viewers"`
+	Max     int    `json:"max"`
+	// Runtime is set if Max was set by SetViewerLimit instead of the
+	// configuration
+	Runtime bool `json:"runtime"`
+}
+
+// isViewer returns if w counts as a viewer
+func isViewer(w av.WriteCloser) bool {
+	v, ok := w.(av.Viewer)
+	return ok && v.IsViewer()
+}
+
+// AddViewerCounter adds a function returning the viewers by stream key
+// which are not writers of the streams, such as HLS sessions
+func (rs *Streams) AddViewerCounter(fn func() map[string]int) {
+	rs.lock.Lock()
+	rs.counters = append(rs.counters, fn)
+	rs.lock.Unlock()
+}
+
+// viewers returns the viewers by stream key
+func (rs *Streams) viewers() map[string]int {
+	viewers := make(map[string]int)
+	for item := range rs.streams.IterBuffered() {
+		for w := range item.Val.(*Stream).ws.IterBuffered() {
+			if isViewer(w.Val.(*PackWriterCloser).w) {
+				viewers[item.Key]++
+			}
+		}
+	}
+	rs.lock.Lock()
+	counters := rs.counters
+	for key, n := range rs.reserved {
+		viewers[key] += n
+	}
+	rs.lock.Unlock()
+	for _, counter := range counters {
+		for key, n := range counter() {
+			viewers[key] += n
+		}
+	}
+	return viewers
+}
+
+// SetViewerLimit sets the viewer limit of the stream app/name or of the
+// application app at runtime, until the server stops. A negative max
+// restores the limit of the configuration.
+func (rs *Streams) SetViewerLimit(key string, max int) {
+	if max < 0 {
+		rs.limits.Remove(key)
+		return
+	}
+	rs.limits.Set(key, max)
+}
+
+// ViewerLimit returns the viewers and the viewer limit of the stream
+// app/name or of the application app
+func (rs *Streams) ViewerLimit(key string) ViewerLimit {
+	return rs.viewerLimit(key, rs.viewers())
+}
+
+func (rs *Streams) viewerLimit(key string, viewers map[string]int) ViewerLimit {
+	limit := ViewerLimit{Key: key}
+	app := key
+	if i := strings.Index(key, "/"); i >= 0 {
+		app = key[:i]
+		limit.Viewers = viewers[key]
+	} else {
+		for k, n := range viewers {
+			if strings.HasPrefix(k, app+"/") {
+				limit.Viewers += n
+			}
+		}
+	}
+
+	if max, ok := rs.limits.Get(key); ok {
+		limit.Max = max.(int)
+		limit.Runtime = true
+	} else if conf, ok := rs.conf.GetApplication(app); ok {
+		if app == key {
+			limit.Max = conf.MaxAppViewers
+		} else {
+			limit.Max = conf.MaxViewers
+		}
+	}
+	return limit
+}
+
+// CheckViewers returns an error if a new viewer of the stream key is
+// beyond the viewer limit of the stream or of its application
+func (rs *Streams) CheckViewers(key string) error {
+	viewers := rs.viewers()
+	limits := []string{key}
+	if i := strings.Index(key, "/"); i >= 0 {
+		limits = append(limits, key[:i])
+	}
+	for _, k := range limits {
+		limit := rs.viewerLimit(k, viewers)
+		if limit.Max > 0 && limit.Viewers >= limit.Max {
+			return fmt.Errorf("%s has the maximum of %d viewers", k, limit.Max)
+		}
+	}
+	return nil
+}
+
+// AdmitViewer checks the viewer limits for a new viewer of the stream key
+// and counts it until the returned function is called, once the viewer
+// was added or refused. Concurrent viewers are admitted one by one, so
+// they cannot exceed the limits together.
+func (rs *Streams) AdmitViewer(key string) (func(), error) {
+	rs.admit.Lock()
+	defer rs.admit.Unlock()
+	if err := rs.CheckViewers(key); err != nil {
+		return nil, err
+	}
+
+	rs.lock.Lock()
+	rs.reserved[key]++
+	rs.lock.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rs.lock.Lock()
+			if rs.reserved[key]--; rs.reserved[key] <= 0 {
+				delete(rs.reserved, key)
+			}
+			rs.lock.Unlock()
+		})
+	}, nil
+}
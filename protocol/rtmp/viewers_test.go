@@ -0,0 +1,134 @@
+package rtmp
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStreams returns Streams of the default configuration changed by
+// config
+func newTestStreams(t *testing.T, config func(*configure.ServerCfg)) *Streams {
+	cfg := configure.DefaultConfig()
+	if config != nil {
+		config(&cfg)
+	}
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	conf, err := configure.NewStore(&cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStreams(conf)
+}
+
+func TestAdmitViewer(t *testing.T) {
+	at := assert.New(t)
+	rs := newTestStreams(t, func(cfg *configure.ServerCfg) {
+		cfg.Server[0].MaxViewers = 2
+	})
+	hls := make(map[string]int)
+	var lock sync.Mutex
+	rs.AddViewerCounter(func() map[string]int {
+		lock.Lock()
+		defer lock.Unlock()
+		return map[string]int{"live/movie": hls["live/movie"]}
+	})
+
+	//concurrent viewers are admitted up to the limit
+	var wg sync.WaitGroup
+	var admitted []func()
+	refused := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := rs.AdmitViewer("live/movie")
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				refused++
+				return
+			}
+			admitted = append(admitted, done)
+		}()
+	}
+	wg.Wait()
+	at.Equal(2, len(admitted))
+	at.Equal(18, refused)
+	at.Equal(2, rs.ViewerLimit("live/movie").Viewers)
+
+	//admitted viewers are counted by their counter once added
+	lock.Lock()
+	hls["live/movie"] = 2
+	lock.Unlock()
+	for _, done := range admitted {
+		done()
+		done()
+	}
+	at.Equal(2, rs.ViewerLimit("live/movie").Viewers)
+	_, err := rs.AdmitViewer("live/movie")
+	at.NotNil(err)
+
+	lock.Lock()
+	hls["live/movie"] = 1
+	lock.Unlock()
+	done, err := rs.AdmitViewer("live/movie")
+	at.Nil(err)
+	done()
+	_, err = rs.AdmitViewer("live/other")
+	at.Nil(err)
+}
+
+func TestMaxViewers(t *testing.T) {
+	at := assert.New(t)
+	s := newTestServer(t, func(cfg *configure.ServerCfg) {
+		cfg.Server[0].MaxViewers = 1
+	}, Hooks{})
+	defer s.close()
+
+	c, err := s.publish("room")
+	at.Nil(err)
+	defer c.Close(nil)
+	s.waitEvent(t, configure.EventPublishStart, "live/room")
+
+	p1, err := s.play("room")
+	at.Nil(err)
+	defer p1.Close(nil)
+	s.waitEvent(t, configure.EventPlayerJoin, "live/room")
+	at.Equal(ViewerLimit{Key: "live/room", Viewers: 1, Max: 1}, s.streams.ViewerLimit("live/room"))
+
+	p2, err := s.play("room")
+	if at.NotNil(err) {
+		at.Contains(err.Error(), core.StatusPlayFailed)
+	} else {
+		p2.Close(nil)
+	}
+
+	// the limits are changed at runtime
+	s.streams.SetViewerLimit("live/room", 2)
+	p2, err = s.play("room")
+	if at.Nil(err) {
+		defer p2.Close(nil)
+	}
+	s.waitEvent(t, configure.EventPlayerJoin, "live/room")
+	s.streams.SetViewerLimit("live/room", 3)
+	s.streams.SetViewerLimit("live", 2)
+	at.Equal(ViewerLimit{Key: "live", Viewers: 2, Max: 2, Runtime: true}, s.streams.ViewerLimit("live"))
+	p3, err := s.play("room")
+	if at.NotNil(err) {
+		at.Contains(err.Error(), core.StatusPlayFailed)
+	} else {
+		p3.Close(nil)
+	}
+
+	// a negative limit restores the configuration
+	s.streams.SetViewerLimit("live/room", -1)
+	at.Equal(ViewerLimit{Key: "live/room", Viewers: 2, Max: 1}, s.streams.ViewerLimit("live/room"))
+}
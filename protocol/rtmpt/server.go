@@ -0,0 +1,209 @@
+// Package rtmpt serves RTMP tunneled over HTTP. The client opens a session
+// and exchanges the RTMP bytes in the bodies of POST requests, the session
+// is served like a native RTMP connection.
+package rtmpt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxInterval is the longest polling interval asked to idle clients
+	maxInterval = 0x21
+	// maxBody is the largest body of a send request
+	maxBody = 4 << 20
+	// sessionTimeout closes the sessions of clients which stopped polling
+	sessionTimeout = 30 * time.Second
+	contentType    = "application/x-fcs"
+)
+
+// Server is the RTMPT server
+type Server struct {
+	serveConn  func(net.Conn) error
+	log        *log.Logger
+	httpServer *http.Server
+
+	lock     sync.Mutex
+	sessions map[string]*session
+	closed   bool
+	done     chan struct{}
+}
+
+// NewServer returns a Server, serveConn serves the RTMP connection of each
+// session until it is closed
+func NewServer(conf *configure.Store, serveConn func(net.Conn) error) *Server {
+	return &Server{
+		serveConn:  serveConn,
+		log:        conf.Logger(),
+		httpServer: &http.Server{},
+		sessions:   make(map[string]*session),
+		done:       make(chan struct{}),
+	}
+}
+
+// Serve serves http requests
+func (server *Server) Serve(l net.Listener) error {
+	go server.expire()
+	server.httpServer.Handler = http.HandlerFunc(server.handle)
+	if err := server.httpServer.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests and closes all sessions, the requests
+// in progress are given until ctx is done
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.lock.Lock()
+	if !server.closed {
+		server.closed = true
+		close(server.done)
+	}
+	sessions := server.sessions
+	server.sessions = make(map[string]*session)
+	server.lock.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+	return server.httpServer.Shutdown(ctx)
+}
+
+// expire closes the sessions whose client sent no request for
+// sessionTimeout
+func (server *Server) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.done:
+			return
+		case <-ticker.C:
+		}
+		server.lock.Lock()
+		for id, s := range server.sessions {
+			if s.idle() >= sessionTimeout {
+				delete(server.sessions, id)
+				s.Close()
+				server.log.Debugf("rtmpt session %s of %s expired", id, s.remote)
+			}
+		}
+		server.lock.Unlock()
+	}
+}
+
+// handle handles the requests of the form /open/1, /send/ID/SEQ,
+// /idle/ID/SEQ and /close/ID/SEQ
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.log.Error("rtmpt handle panic: ", r)
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	paths := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch paths[0] {
+	case "open":
+		server.open(w, r)
+		return
+	case "send", "idle", "close":
+	default:
+		// including /fcs/ident2, which clients try first
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(paths) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	server.lock.Lock()
+	s, ok := server.sessions[paths[1]]
+	server.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch paths[0] {
+	case "send":
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			server.remove(s)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.feed(data)
+	case "close":
+		server.remove(s)
+		reply(w, []byte{0})
+		return
+	}
+
+	// the data written before the session was closed is still sent
+	if s.isClosed() && !s.pending() {
+		server.remove(s)
+		http.NotFound(w, r)
+		return
+	}
+	reply(w, s.poll())
+}
+
+// open starts a session and replies with its id
+func (server *Server) open(w http.ResponseWriter, r *http.Request) {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		local = addr("")
+	}
+	s := newSession(uid.NewID(), local, addr(r.RemoteAddr))
+
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	server.sessions[s.id] = s
+	server.lock.Unlock()
+
+	server.log.Debugf("rtmpt session %s opened by %s", s.id, r.RemoteAddr)
+	go func() {
+		err := server.serveConn(s)
+		server.log.Debugf("rtmpt session %s closed: %v", s.id, err)
+		s.Close()
+	}()
+	reply(w, []byte(fmt.Sprintf("%s\n", s.id)))
+}
+
+// remove closes s and forgets it
+func (server *Server) remove(s *session) {
+	server.lock.Lock()
+	if server.sessions[s.id] == s {
+		delete(server.sessions, s.id)
+	}
+	server.lock.Unlock()
+	s.Close()
+}
+
+func reply(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Write(data)
+}
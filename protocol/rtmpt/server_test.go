@@ -0,0 +1,269 @@
+package rtmpt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T, serveConn func(net.Conn) error) *Server {
+	cfg := configure.DefaultConfig()
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	conf, err := configure.NewStore(&cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(conf, serveConn)
+}
+
+// request returns the status and body of the response of server to a
+// request of method to uri
+func request(server *Server, method, uri string, body []byte) (int, string) {
+	w := httptest.NewRecorder()
+	server.handle(w, httptest.NewRequest(method, uri, bytes.NewReader(body)))
+	return w.Code, w.Body.String()
+}
+
+// open opens a session and returns its id
+func open(t *testing.T, server *Server) string {
+	status, body := request(server, "POST", "/open/1", nil)
+	if status != http.StatusOK {
+		t.Fatalf("open: %d", status)
+	}
+	return strings.TrimSpace(body)
+}
+
+func TestServer(t *testing.T) {
+	at := assert.New(t)
+	conns := make(chan net.Conn, 1)
+	served := make(chan struct{}, 1)
+	server := newTestServer(t, func(c net.Conn) error {
+		conns <- c
+		<-c.(*session).closed
+		served <- struct{}{}
+		return nil
+	})
+
+	status, _ := request(server, "GET", "/open/1", nil)
+	at.Equal(http.StatusMethodNotAllowed, status)
+	status, _ = request(server, "POST", "/fcs/ident2", nil)
+	at.Equal(http.StatusNotFound, status)
+	status, _ = request(server, "POST", "/idle", nil)
+	at.Equal(http.StatusNotFound, status)
+	status, _ = request(server, "POST", "/idle/unknown/1", nil)
+	at.Equal(http.StatusNotFound, status)
+
+	//the session exchanges the data of send and idle requests
+	id := open(t, server)
+	c := <-conns
+	status, body := request(server, "POST", "/send/"+id+"/1", []byte("hello"))
+	at.Equal(http.StatusOK, status)
+	at.Equal("\x02", body)
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	at.Nil(err)
+	at.Equal("hello", string(b[:n]))
+	c.Write([]byte("world"))
+	_, body = request(server, "POST", "/idle/"+id+"/2", nil)
+	at.Equal("\x01world", body)
+
+	//the data written before the connection is closed is still polled
+	c.Write([]byte("bye"))
+	c.Close()
+	<-served
+	_, body = request(server, "POST", "/idle/"+id+"/3", nil)
+	at.Equal("\x01bye", body)
+	status, _ = request(server, "POST", "/idle/"+id+"/4", nil)
+	at.Equal(http.StatusNotFound, status)
+
+	//the client closes its session
+	id = open(t, server)
+	<-conns
+	_, body = request(server, "POST", "/close/"+id+"/1", nil)
+	at.Equal("\x00", body)
+	<-served
+	status, _ = request(server, "POST", "/idle/"+id+"/2", nil)
+	at.Equal(http.StatusNotFound, status)
+
+	//the sessions are closed on shutdown
+	open(t, server)
+	<-conns
+	at.Nil(server.Shutdown(context.Background()))
+	<-served
+	status, _ = request(server, "POST", "/open/1", nil)
+	at.Equal(http.StatusServiceUnavailable, status)
+}
+
+// tunnel is the client side of an RTMPT session
+type tunnel struct {
+	url string
+	id  string
+
+	lock sync.Mutex
+	seq  int
+	buf  bytes.Buffer // data received and not read yet
+}
+
+func dialTunnel(addr net.Addr) (*tunnel, error) {
+	c := &tunnel{url: fmt.Sprintf("http://%s", addr)}
+	resp, err := http.Post(c.url+"/open/1", contentType, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	id, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.id = string(bytes.TrimSpace(id))
+	return c, nil
+}
+
+// post sends a request of the session and keeps the data of the response
+func (c *tunnel) post(cmd string, body []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	url := fmt.Sprintf("%s/%s/%s/%d", c.url, cmd, c.id, c.seq)
+	resp, err := http.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", cmd, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if len(data) > 1 {
+		c.buf.Write(data[1:])
+	}
+	return nil
+}
+
+// Read polls the server until it has data
+func (c *tunnel) Read(p []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		if c.buf.Len() > 0 {
+			n, _ := c.buf.Read(p)
+			c.lock.Unlock()
+			return n, nil
+		}
+		c.lock.Unlock()
+		if err := c.post("idle", nil); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *tunnel) Write(p []byte) (int, error) {
+	if err := c.post("send", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *tunnel) Close() error                     { return c.post("close", nil) }
+func (c *tunnel) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *tunnel) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *tunnel) SetDeadline(time.Time) error      { return nil }
+func (c *tunnel) SetReadDeadline(time.Time) error  { return nil }
+func (c *tunnel) SetWriteDeadline(time.Time) error { return nil }
+
+// readVideo returns the timestamp of the next video message of read
+func readVideo(read func(*core.ChunkStream) error) (uint32, error) {
+	for {
+		var c core.ChunkStream
+		if err := read(&c); err != nil {
+			return 0, err
+		}
+		if c.TypeID == av.TagVideo {
+			return c.Timestamp, nil
+		}
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	at := assert.New(t)
+	streams := make(chan *core.NetStream, 1)
+	server := newTestServer(t, func(c net.Conn) error {
+		conn := core.NewConn(c, 4*1024)
+		if _, err := conn.ServerHandshake(false); err != nil {
+			return err
+		}
+		connServer := core.NewConnServer(conn, nil)
+		for {
+			ns, err := connServer.Accept()
+			if err != nil {
+				return err
+			}
+			if err := ns.Start(); err != nil {
+				return err
+			}
+			streams <- ns
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+	url := fmt.Sprintf("rtmp://%s/live/room", l.Addr())
+	video := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x01}
+
+	//a tunneled publisher
+	conn, err := dialTunnel(l.Addr())
+	if !at.Nil(err) {
+		return
+	}
+	c := core.NewConnClient()
+	if !at.Nil(c.StartConn(conn, url, av.PUBLISH)) {
+		return
+	}
+	defer c.Close(nil)
+	ns := <-streams
+	at.True(ns.IsPublisher())
+	at.Nil(c.Write(core.ChunkStream{CSID: 6, TypeID: av.TagVideo, StreamID: c.StreamID(), Timestamp: 40, Length: uint32(len(video)), Data: video}))
+	at.Nil(c.Flush())
+	ts, err := readVideo(ns.Read)
+	at.Nil(err)
+	at.Equal(uint32(40), ts)
+
+	//a tunneled player
+	conn, err = dialTunnel(l.Addr())
+	if !at.Nil(err) {
+		return
+	}
+	p := core.NewConnClient()
+	if !at.Nil(p.StartConn(conn, url, av.PLAY)) {
+		return
+	}
+	defer p.Close(nil)
+	ns = <-streams
+	at.False(ns.IsPublisher())
+	at.Nil(ns.Write(core.ChunkStream{CSID: 6, TypeID: av.TagVideo, StreamID: ns.ID(), Timestamp: 80, Length: uint32(len(video)), Data: video}))
+	at.Nil(ns.Flush())
+	ts, err = readVideo(p.Read)
+	at.Nil(err)
+	at.Equal(uint32(80), ts)
+}
@@ -0,0 +1,213 @@
+package rtmpt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPending is the number of bytes waiting for the client to poll them,
+// writes block beyond it like on a full TCP connection
+const maxPending = 1 << 20
+
+// addr is the address of an RTMPT session
+type addr string
+
+func (a addr) Network() string { return "rtmpt" }
+func (a addr) String() string  { return string(a) }
+
+// timeoutError is returned by reads and writes after their deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// session is the virtual connection of an RTMPT session. It reads the
+// bodies of the send requests of the client and its writes are returned by
+// the responses to the send and idle requests.
+type session struct {
+	id     string
+	local  net.Addr
+	remote net.Addr
+
+	lock          sync.Mutex
+	in            bytes.Buffer
+	out           bytes.Buffer
+	interval      byte // polling interval returned to the client
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lastRequest   time.Time
+
+	readable chan struct{}
+	writable chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newSession(id string, local, remote net.Addr) *session {
+	return &session{
+		id:          id,
+		local:       local,
+		remote:      remote,
+		interval:    1,
+		lastRequest: time.Now(),
+		readable:    make(chan struct{}, 1),
+		writable:    make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits until c is notified, the session is closed or deadline
+func (s *session) wait(c chan struct{}, deadline time.Time) error {
+	var timer <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case <-c:
+	case <-s.closed:
+	case <-timer:
+		return timeoutError{}
+	}
+	return nil
+}
+
+// Read reads the data sent by the client
+func (s *session) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.in.Len() > 0 {
+			n, _ := s.in.Read(p)
+			s.lock.Unlock()
+			return n, nil
+		}
+		deadline := s.readDeadline
+		s.lock.Unlock()
+		if s.isClosed() {
+			return 0, io.EOF
+		}
+		if err := s.wait(s.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues p for the client
+func (s *session) Write(p []byte) (int, error) {
+	for {
+		if s.isClosed() {
+			return 0, io.ErrClosedPipe
+		}
+		s.lock.Lock()
+		if s.out.Len() < maxPending {
+			s.out.Write(p)
+			s.lock.Unlock()
+			return len(p), nil
+		}
+		deadline := s.writeDeadline
+		s.lock.Unlock()
+		if err := s.wait(s.writable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// feed passes the body of a send request to Read
+func (s *session) feed(data []byte) {
+	s.lock.Lock()
+	s.in.Write(data)
+	s.lastRequest = time.Now()
+	s.lock.Unlock()
+	notify(s.readable)
+}
+
+// poll returns the interval byte followed by the data written since the
+// last request. The interval grows while there is nothing to send.
+func (s *session) poll() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastRequest = time.Now()
+	if s.out.Len() > 0 {
+		s.interval = 1
+	} else if s.interval < maxInterval {
+		s.interval++
+	}
+	data := make([]byte, 1+s.out.Len())
+	data[0] = s.interval
+	copy(data[1:], s.out.Bytes())
+	s.out.Reset()
+	notify(s.writable)
+	return data
+}
+
+// pending returns if data waits for the client
+func (s *session) pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.out.Len() > 0
+}
+
+// idle returns how long the client has not sent any request
+func (s *session) idle() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.lastRequest)
+}
+
+// Close closes the session, the data not read by the client is dropped
+func (s *session) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func (s *session) LocalAddr() net.Addr  { return s.local }
+func (s *session) RemoteAddr() net.Addr { return s.remote }
+
+func (s *session) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *session) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *session) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.lock.Unlock()
+	return nil
+}
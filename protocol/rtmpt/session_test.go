@@ -0,0 +1,76 @@
+package rtmpt
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	at := assert.New(t)
+	s := newSession("id", addr("local"), addr("remote"))
+	at.Equal("remote", s.RemoteAddr().String())
+	at.Equal("rtmpt", s.LocalAddr().Network())
+
+	//the data fed is read
+	s.feed([]byte("hello"))
+	b := make([]byte, 16)
+	n, err := s.Read(b)
+	at.Nil(err)
+	at.Equal("hello", string(b[:n]))
+
+	//reads wait for data until their deadline
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = s.Read(b)
+	if at.NotNil(err) {
+		at.True(err.(net.Error).Timeout())
+	}
+	s.SetReadDeadline(time.Time{})
+	read := make(chan string, 1)
+	go func() {
+		n, _ := s.Read(b)
+		read <- string(b[:n])
+	}()
+	s.feed([]byte("again"))
+	at.Equal("again", <-read)
+
+	//the polling interval grows while nothing is written
+	at.Equal([]byte{2}, s.poll())
+	at.Equal([]byte{3}, s.poll())
+	n, err = s.Write([]byte("data"))
+	at.Nil(err)
+	at.Equal(4, n)
+	at.True(s.pending())
+	at.Equal([]byte("\x01data"), s.poll())
+	at.False(s.pending())
+
+	//writes wait while maxPending bytes are not polled
+	_, err = s.Write(make([]byte, maxPending))
+	at.Nil(err)
+	s.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = s.Write([]byte("x"))
+	if at.NotNil(err) {
+		at.True(err.(net.Error).Timeout())
+	}
+	s.SetDeadline(time.Time{})
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write([]byte("x"))
+		written <- err
+	}()
+	at.Len(s.poll(), 1+maxPending)
+	at.Nil(<-written)
+	at.Equal([]byte("\x01x"), s.poll())
+
+	//the session is closed once
+	at.Nil(s.Close())
+	at.Nil(s.Close())
+	at.True(s.isClosed())
+	_, err = s.Read(b)
+	at.Equal(io.EOF, err)
+	_, err = s.Write([]byte("x"))
+	at.Equal(io.ErrClosedPipe, err)
+}